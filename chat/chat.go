@@ -0,0 +1,137 @@
+// Package chat holds the OpenAI-compatible chat completion types the agent
+// sends to and receives from model providers. They are shared with the
+// middleware package, so code outside the agent can read and rewrite
+// requests and replies.
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+type ChatCompletionRequest struct {
+	Model     string          `json:"model"`
+	Messages  []Message       `json:"messages"`
+	Tools     []Tool          `json:"tools,omitempty"`
+	ExtraBody json.RawMessage `json:"extra_body,omitempty"`
+
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+}
+
+type Message struct {
+	Role         string          `json:"role"`
+	Content      string          `json:"content"`
+	ToolCalls    []ToolCall      `json:"tool_calls,omitempty"`
+	ToolCallID   string          `json:"tool_call_id,omitempty"`
+	ExtraContent json.RawMessage `json:"extra_content,omitempty"`
+	Parts        []ContentPart   `json:"-"` // Attachments sent after Content
+}
+
+// ContentPart is one element of a multimodal message content array.
+type ContentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *ContentImage `json:"image_url,omitempty"`
+	File     *ContentFile  `json:"file,omitempty"`
+}
+
+type ContentImage struct {
+	URL string `json:"url"`
+}
+
+type ContentFile struct {
+	Filename string `json:"filename"`
+	FileData string `json:"file_data"`
+}
+
+// MarshalJSON sends messages with attachments as a content array and all
+// others as a plain string, which every provider accepts.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	parts := append([]ContentPart{{Type: "text", Text: m.Content}}, m.Parts...)
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), parts})
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.plain)
+	content := bytes.TrimSpace(raw.Content)
+	if len(content) == 0 || string(content) == "null" {
+		return nil
+	}
+	if content[0] != '[' {
+		return json.Unmarshal(content, &m.Content)
+	}
+	var parts []ContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return err
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" && len(texts) == 0 {
+			texts = append(texts, part.Text)
+		} else {
+			m.Parts = append(m.Parts, part)
+		}
+	}
+	m.Content = strings.Join(texts, "")
+	return nil
+}
+
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type ToolCall struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Function     ToolCallFunction `json:"function"`
+	ExtraContent json.RawMessage  `json:"extra_content,omitempty"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type ChatCompletionResponse struct {
+	Choices []Choice  `json:"choices"`
+	Error   *APIError `json:"error,omitempty"`
+	Usage   *Usage    `json:"usage,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type APIError struct {
+	Message string `json:"message"`
+	Code    any    `json:"code"`
+}
+
+type Choice struct {
+	Message Message `json:"message"`
+}
@@ -0,0 +1,30 @@
+package chat
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMessageJSON(t *testing.T) {
+	plain, err := json.Marshal(Message{Role: "user", Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(plain), `{"role":"user","content":"hi"}`; got != want {
+		t.Errorf("plain message = %s, want %s", got, want)
+	}
+
+	withImage := Message{Role: "user", Content: "What is this?", Parts: []ContentPart{{Type: "image_url", ImageURL: &ContentImage{URL: "data:image/png;base64,AA=="}}}}
+	data, err := json.Marshal(withImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back Message
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, withImage) {
+		t.Errorf("round trip = %+v, want %+v", back, withImage)
+	}
+}
@@ -0,0 +1,134 @@
+// Package commitpolicy lets an organization enforce its rules on the commits
+// the agent proposes: rewrite the message (ticket prefixes, sign-offs), choose
+// which files are committed, split a commit by path, or veto it. A build of
+// the agent registers Go policies from init, e.g.
+//
+//	func init() {
+//		commitpolicy.Use(commitpolicy.SignOff("Jane Doe <jane@example.com>"), commitpolicy.SplitByPath("docs/"))
+//	}
+package commitpolicy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Proposal is one commit about to be proposed to the user.
+type Proposal struct {
+	Message string   `json:"message"`
+	Paths   []string `json:"paths"`
+}
+
+// Policy turns a proposal into zero or more proposals; returning an error
+// vetoes the commit. Paths may only be narrowed, never added to.
+type Policy struct {
+	Name  string
+	Apply func(ctx context.Context, proposal Proposal) ([]Proposal, error)
+}
+
+var chain []Policy
+
+// Use appends policies to the chain. It is not safe to call once commits are
+// being made.
+func Use(p ...Policy) {
+	chain = append(chain, p...)
+}
+
+// Registered returns the policies added with Use, in order.
+func Registered() []Policy {
+	return chain[:len(chain):len(chain)]
+}
+
+// Run passes proposal through policies in order. Its paths are the files that
+// may be committed: a policy that adds one, or returns an empty message,
+// fails the run. Proposals left without paths are dropped.
+func Run(ctx context.Context, proposal Proposal, policies []Policy) ([]Proposal, error) {
+	allowed := make(map[string]bool)
+	for _, path := range proposal.Paths {
+		allowed[path] = true
+	}
+
+	proposals := []Proposal{proposal}
+	for _, policy := range policies {
+		var next []Proposal
+		for _, p := range proposals {
+			out, err := policy.Apply(ctx, p)
+			if err != nil {
+				return nil, fmt.Errorf("vetoed by commit policy %s: %v", policy.Name, err)
+			}
+			for _, o := range out {
+				if strings.TrimSpace(o.Message) == "" {
+					return nil, fmt.Errorf("commit policy %s returned an empty message", policy.Name)
+				}
+				for _, path := range o.Paths {
+					if !allowed[path] {
+						return nil, fmt.Errorf("commit policy %s added %s, which the agent didn't change", policy.Name, path)
+					}
+				}
+				if len(o.Paths) > 0 {
+					next = append(next, o)
+				}
+			}
+		}
+		proposals = next
+	}
+	return proposals, nil
+}
+
+// SignOff appends a Signed-off-by trailer for identity ("Name <email>").
+func SignOff(identity string) Policy {
+	return Policy{
+		Name: "sign-off",
+		Apply: func(ctx context.Context, p Proposal) ([]Proposal, error) {
+			trailer := "Signed-off-by: " + identity
+			if !strings.Contains(p.Message, trailer) {
+				p.Message = strings.TrimRight(p.Message, "\n") + "\n\n" + trailer
+			}
+			return []Proposal{p}, nil
+		},
+	}
+}
+
+// RequireMessage vetoes commits whose message doesn't match pattern.
+func RequireMessage(pattern string) Policy {
+	re := regexp.MustCompile(pattern)
+	return Policy{
+		Name: "require-message",
+		Apply: func(ctx context.Context, p Proposal) ([]Proposal, error) {
+			if !re.MatchString(p.Message) {
+				return nil, fmt.Errorf("commit message must match %s", pattern)
+			}
+			return []Proposal{p}, nil
+		},
+	}
+}
+
+// SplitByPath moves the files under each prefix into a commit of their own,
+// with the same message.
+func SplitByPath(prefixes ...string) Policy {
+	return Policy{
+		Name: "split-by-path",
+		Apply: func(ctx context.Context, p Proposal) ([]Proposal, error) {
+			groups := make([][]string, len(prefixes)+1)
+			for _, path := range p.Paths {
+				group := len(prefixes)
+				for i, prefix := range prefixes {
+					if strings.HasPrefix(path, prefix) {
+						group = i
+						break
+					}
+				}
+				groups[group] = append(groups[group], path)
+			}
+			var out []Proposal
+			for _, paths := range groups {
+				if len(paths) > 0 {
+					out = append(out, Proposal{Message: p.Message, Paths: paths})
+				}
+			}
+			return out, nil
+		},
+	}
+}
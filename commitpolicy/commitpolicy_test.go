@@ -0,0 +1,44 @@
+package commitpolicy
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	proposal := Proposal{Message: "Update docs and code", Paths: []string{"docs/a.md", "main.go"}}
+
+	got, err := Run(ctx, proposal, []Policy{SignOff("Jane Doe <jane@example.com>"), SplitByPath("docs/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := "Update docs and code\n\nSigned-off-by: Jane Doe <jane@example.com>"
+	want := []Proposal{{Message: message, Paths: []string{"docs/a.md"}}, {Message: message, Paths: []string{"main.go"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run = %+v, want %+v", got, want)
+	}
+
+	if _, err := Run(ctx, proposal, []Policy{RequireMessage(`^\[[A-Z]+-\d+\] `)}); err == nil || !strings.Contains(err.Error(), "vetoed by commit policy require-message") {
+		t.Errorf("RequireMessage error = %v", err)
+	}
+
+	sneaky := Policy{Name: "sneaky", Apply: func(ctx context.Context, p Proposal) ([]Proposal, error) {
+		p.Paths = append(p.Paths, ".env")
+		return []Proposal{p}, nil
+	}}
+	if _, err := Run(ctx, proposal, []Policy{sneaky}); err == nil || !strings.Contains(err.Error(), "added .env") {
+		t.Errorf("added path error = %v", err)
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	defer func() { chain = nil }()
+	Use(SignOff("a <a@example.com>"))
+	policies := append(Registered(), SplitByPath("docs/"))
+	if len(chain) != 1 || len(policies) != 2 {
+		t.Errorf("appending to Registered changed the chain: %d policies", len(chain))
+	}
+}
@@ -0,0 +1,323 @@
+// Package diffengine parses the unified diffs sent to apply_udiff and applies
+// them to file contents by matching each hunk's context, rather than trusting
+// its line numbers.
+package diffengine
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Hunk is one '@@' section of a diff. SearchLines are the context and removed
+// lines expected in the file, ReplaceLines the context and added lines that
+// replace them.
+type Hunk struct {
+	SearchLines  []string
+	ReplaceLines []string
+	OldStart     int // Line number from the hunk header, 0 if absent
+}
+
+var (
+	ErrNoHunks         = errors.New("no valid hunks found in diff")
+	ErrPureInsertion   = errors.New("pure insertion (no context lines) is not allowed in existing file")
+	ErrAmbiguous       = errors.New("ambiguous context")
+	ErrContextNotFound = errors.New("context not found")
+)
+
+// HunkError reports a hunk that could not be applied. It wraps one of the
+// Err* values above.
+type HunkError struct {
+	Hunk   int // 1-based
+	Err    error
+	Detail string
+}
+
+func (e *HunkError) Error() string {
+	return fmt.Sprintf("hunk %d failed to apply: %v%s", e.Hunk, e.Err, e.Detail)
+}
+
+func (e *HunkError) Unwrap() error { return e.Err }
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)`)
+
+// Parse returns the hunks of diff. File headers and lines outside hunks are
+// ignored.
+func Parse(diff string) []Hunk {
+	var hunks []Hunk
+	var current *Hunk
+
+	for _, line := range strings.Split(diff, "\n") {
+		line = strings.TrimRight(line, "\r") // Diffs written with Windows line endings
+
+		if strings.HasPrefix(line, "@@") {
+			if current != nil {
+				hunks = append(hunks, *current)
+			}
+			current = &Hunk{SearchLines: []string{}, ReplaceLines: []string{}}
+			if match := hunkHeaderRe.FindStringSubmatch(line); match != nil {
+				current.OldStart, _ = strconv.Atoi(match[1])
+			}
+			continue
+		}
+		// Skip ---/+++ headers before the first hunk
+		if current == nil {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, " "):
+			current.SearchLines = append(current.SearchLines, line[1:])
+			current.ReplaceLines = append(current.ReplaceLines, line[1:])
+		case strings.HasPrefix(line, "-"):
+			current.SearchLines = append(current.SearchLines, line[1:])
+		case strings.HasPrefix(line, "+"):
+			current.ReplaceLines = append(current.ReplaceLines, line[1:])
+		}
+		// Anything else (e.g. "\ No newline at end of file") is ignored
+	}
+
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+	return hunks
+}
+
+// FileOp holds the git extended headers of a diff that renames or deletes its
+// file rather than (only) changing its content.
+type FileOp struct {
+	RenameFrom string // From "rename from", empty if absent
+	RenameTo   string // From "rename to"; the diff renames its file when set
+	Deleted    bool   // "deleted file mode" or a "+++ /dev/null" target
+}
+
+// ParseFileOp reads the file headers before the first hunk.
+func ParseFileOp(diff string) FileOp {
+	var op FileOp
+	for _, line := range strings.Split(diff, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			return op
+		case strings.HasPrefix(line, "rename from "):
+			op.RenameFrom = strings.TrimSpace(strings.TrimPrefix(line, "rename from "))
+		case strings.HasPrefix(line, "rename to "):
+			op.RenameTo = strings.TrimSpace(strings.TrimPrefix(line, "rename to "))
+		case strings.HasPrefix(line, "deleted file mode"), strings.TrimSpace(line) == "+++ /dev/null":
+			op.Deleted = true
+		}
+	}
+	return op
+}
+
+// Split returns the raw text of each hunk, dropping file headers.
+func Split(diff string) []string {
+	var hunks []string
+	var current []string
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "@@") {
+			if current != nil {
+				hunks = append(hunks, strings.Join(current, "\n"))
+			}
+			current = []string{line}
+		} else if current != nil {
+			current = append(current, line)
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, strings.TrimRight(strings.Join(current, "\n"), "\n"))
+	}
+	return hunks
+}
+
+// Format is how a file encodes its text, so that an edit can write it back
+// the same way.
+type Format struct {
+	EOL          string // "\n" or "\r\n"
+	BOM          bool   // Starts with a UTF-8 byte order mark
+	FinalNewline bool   // The last line ends with EOL
+}
+
+const bom = "\ufeff"
+
+// DetectFormat returns the format of content. With mixed line endings the
+// more frequent one wins. An empty file gets "\n" and a final newline.
+func DetectFormat(content string) Format {
+	f := Format{EOL: "\n", BOM: strings.HasPrefix(content, bom), FinalNewline: true}
+	content = strings.TrimPrefix(content, bom)
+	if content == "" {
+		return f
+	}
+	if crlf := strings.Count(content, "\r\n"); crlf > strings.Count(content, "\n")-crlf {
+		f.EOL = "\r\n"
+	}
+	f.FinalNewline = strings.HasSuffix(content, "\n")
+	return f
+}
+
+// Normalize removes the byte order mark and converts line endings to "\n",
+// the form Apply works on.
+func Normalize(content string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(content, bom), "\r\n", "\n")
+}
+
+// Restore converts normalized content to the format f.
+func (f Format) Restore(content string) string {
+	if content != "" {
+		hasFinal := strings.HasSuffix(content, "\n")
+		if f.FinalNewline && !hasFinal {
+			content += "\n"
+		} else if !f.FinalNewline && hasFinal {
+			content = strings.TrimSuffix(content, "\n")
+		}
+	}
+	if f.EOL == "\r\n" {
+		content = strings.ReplaceAll(content, "\n", "\r\n")
+	}
+	if f.BOM {
+		content = bom + content
+	}
+	return content
+}
+
+// Apply applies hunks to content in order and returns the new content.
+// content is normalized first, so the result has '\n' line endings and no
+// byte order mark; see Format to write it back as it was. When a hunk's
+// context occurs more than once, the line number in its header picks the
+// nearest occurrence.
+func Apply(content string, hunks []Hunk) (string, error) {
+	if len(hunks) == 0 {
+		return "", ErrNoHunks
+	}
+	content = Normalize(content)
+
+	// lineDelta tracks how earlier hunks shifted the lines that later hunk
+	// headers refer to
+	newContent := content
+	lineDelta := 0
+	for i, hunk := range hunks {
+		searchBlock := strings.Join(hunk.SearchLines, "\n")
+		replaceBlock := strings.Join(hunk.ReplaceLines, "\n")
+
+		if len(hunk.SearchLines) == 0 {
+			if content != "" {
+				return "", &HunkError{Hunk: i + 1, Err: ErrPureInsertion, Detail: ".\nPlease provide at least 2 lines of context (' ') around the new code to uniquely locate the insertion point."}
+			}
+			// A new file; each hunk adds to it
+			if newContent != "" {
+				newContent += "\n"
+			}
+			newContent += replaceBlock
+			continue
+		}
+
+		switch matches := strings.Count(newContent, searchBlock); {
+		case matches > 1:
+			offset, ok := NearestMatch(newContent, searchBlock, hunk.OldStart+lineDelta)
+			if hunk.OldStart == 0 || !ok {
+				return "", &HunkError{Hunk: i + 1, Err: ErrAmbiguous, Detail: fmt.Sprintf(". The search block matches %d times in the file (lines %s).\nPlease provide more context lines, or the line number in the hunk header ('@@ -<line>,<count> ...'), to identify the code to replace.", matches, strings.Join(MatchLines(newContent, searchBlock), ", "))}
+			}
+			newContent = newContent[:offset] + replaceBlock + newContent[offset+len(searchBlock):]
+		case matches == 0:
+			return "", notFound(i+1, newContent, hunk.SearchLines)
+		default:
+			newContent = strings.Replace(newContent, searchBlock, replaceBlock, 1)
+		}
+		lineDelta += len(hunk.ReplaceLines) - len(hunk.SearchLines)
+	}
+	return newContent, nil
+}
+
+// notFound builds the error for a hunk whose context is missing, pointing at
+// the closest match when there is a plausible one.
+func notFound(hunk int, content string, searchLines []string) error {
+	fileLines := strings.Split(content, "\n")
+	bestIdx, score := FindBestMatch(fileLines, searchLines)
+	if bestIdx == -1 || score <= 0.5 {
+		return &HunkError{Hunk: hunk, Err: ErrContextNotFound, Detail: ".\nSearch Block:\n" + strings.Join(searchLines, "\n")}
+	}
+	start := bestIdx - 5
+	if start < 0 {
+		start = 0
+	}
+	end := bestIdx + len(searchLines) + 5
+	if end > len(fileLines) {
+		end = len(fileLines)
+	}
+	snippet := strings.Join(fileLines[start:end], "\n")
+	return &HunkError{Hunk: hunk, Err: ErrContextNotFound, Detail: fmt.Sprintf(".\nProbable match found at lines %d-%d (score %.2f):\n```\n%s\n```\nPlease verify the context lines and try again.", start+1, end, score, snippet)}
+}
+
+// MatchOffsets returns the byte offsets at which block occurs in content,
+// including overlapping occurrences.
+func MatchOffsets(content, block string) []int {
+	var offsets []int
+	for from := 0; ; {
+		i := strings.Index(content[from:], block)
+		if i == -1 {
+			return offsets
+		}
+		offsets = append(offsets, from+i)
+		from += i + 1
+	}
+}
+
+// MatchLines returns the 1-based start lines of the first ten occurrences of
+// block, followed by "..." if there are more.
+func MatchLines(content, block string) []string {
+	var lines []string
+	for _, offset := range MatchOffsets(content, block) {
+		if len(lines) == 10 {
+			return append(lines, "...")
+		}
+		lines = append(lines, strconv.Itoa(strings.Count(content[:offset], "\n")+1))
+	}
+	return lines
+}
+
+// NearestMatch picks the occurrence of block that starts closest to line. It
+// fails when two occurrences are equally close.
+func NearestMatch(content, block string, line int) (int, bool) {
+	best, bestDist, tie := -1, 0, false
+	for _, offset := range MatchOffsets(content, block) {
+		dist := strings.Count(content[:offset], "\n") + 1 - line
+		if dist < 0 {
+			dist = -dist
+		}
+		switch {
+		case best == -1 || dist < bestDist:
+			best, bestDist, tie = offset, dist, false
+		case dist == bestDist:
+			tie = true
+		}
+	}
+	return best, best != -1 && !tie
+}
+
+// FindBestMatch returns the index of the window of fileLines that shares the
+// most lines with searchLines, ignoring surrounding whitespace, and the
+// fraction of lines that matched. It returns -1 if nothing matched.
+func FindBestMatch(fileLines, searchLines []string) (int, float64) {
+	if len(searchLines) == 0 || len(fileLines) < len(searchLines) {
+		return -1, 0.0
+	}
+
+	bestScore := 0.0
+	bestIdx := -1
+	for i := 0; i <= len(fileLines)-len(searchLines); i++ {
+		matches := 0
+		for j := range searchLines {
+			if strings.TrimSpace(fileLines[i+j]) == strings.TrimSpace(searchLines[j]) {
+				matches++
+			}
+		}
+		score := float64(matches) / float64(len(searchLines))
+		if score > bestScore {
+			bestScore = score
+			bestIdx = i
+		}
+	}
+	return bestIdx, bestScore
+}
@@ -0,0 +1,375 @@
+package diffengine
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want []Hunk
+	}{
+		{
+			name: "empty",
+			diff: "",
+			want: nil,
+		},
+		{
+			name: "no hunk header",
+			diff: "--- a/x\n+++ b/x\n-old\n+new\n",
+			want: nil,
+		},
+		{
+			name: "file headers and line number",
+			diff: "--- a/x.go\n+++ b/x.go\n@@ -12,3 +12,3 @@ func f() {\n a\n-b\n+c\n d\n",
+			want: []Hunk{{SearchLines: []string{"a", "b", "d"}, ReplaceLines: []string{"a", "c", "d"}, OldStart: 12}},
+		},
+		{
+			name: "header without line numbers",
+			diff: "@@ ... @@\n-b\n+c\n",
+			want: []Hunk{{SearchLines: []string{"b"}, ReplaceLines: []string{"c"}}},
+		},
+		{
+			name: "CRLF diff",
+			diff: "@@ -1,2 +1,2 @@\r\n a\r\n-b\r\n+c\r\n",
+			want: []Hunk{{SearchLines: []string{"a", "b"}, ReplaceLines: []string{"a", "c"}, OldStart: 1}},
+		},
+		{
+			name: "multiple hunks",
+			diff: "@@ -1 +1 @@\n-a\n+b\n@@ -5 +5 @@\n-c\n+d\n",
+			want: []Hunk{
+				{SearchLines: []string{"a"}, ReplaceLines: []string{"b"}, OldStart: 1},
+				{SearchLines: []string{"c"}, ReplaceLines: []string{"d"}, OldStart: 5},
+			},
+		},
+		{
+			name: "blank context line and no-newline marker",
+			diff: "@@ -1,3 +1,3 @@\n a\n \n-b\n+c\n\\ No newline at end of file\n",
+			want: []Hunk{{SearchLines: []string{"a", "", "b"}, ReplaceLines: []string{"a", "", "c"}, OldStart: 1}},
+		},
+		{
+			name: "empty hunk",
+			diff: "@@ -1,0 +1,0 @@\n",
+			want: []Hunk{{SearchLines: []string{}, ReplaceLines: []string{}, OldStart: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.diff); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFileOp(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want FileOp
+	}{
+		{"content change", "--- a/x\n+++ b/x\n@@ -1 +1 @@\n-a\n+b\n", FileOp{}},
+		{"rename", "diff --git a/x b/y\nsimilarity index 100%\nrename from x\nrename to y\n", FileOp{RenameFrom: "x", RenameTo: "y"}},
+		{"rename with changes", "rename from a/old.go\r\nrename to b/new.go\r\n--- a/a/old.go\n+++ b/b/new.go\n@@ -1 +1 @@\n-a\n+b\n", FileOp{RenameFrom: "a/old.go", RenameTo: "b/new.go"}},
+		{"deleted file mode", "diff --git a/x b/x\ndeleted file mode 100644\n--- a/x\n+++ /dev/null\n@@ -1 +0,0 @@\n-a\n", FileOp{Deleted: true}},
+		{"dev null target", "--- a/x\n+++ /dev/null\n", FileOp{Deleted: true}},
+		{"headers after first hunk are content", "@@ -1 +1 @@\n rename to y\n", FileOp{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseFileOp(tt.diff); got != tt.want {
+				t.Errorf("ParseFileOp() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"headers only", "--- a/x\n+++ b/x\n", nil},
+		{"one hunk", "--- a/x\n+++ b/x\n@@ -1 +1 @@\n-a\n+b\n", []string{"@@ -1 +1 @@\n-a\n+b"}},
+		{"two hunks", "@@ -1 +1 @@\n-a\n+b\n@@ -3 +3 @@\n-c\n+d\n\n", []string{"@@ -1 +1 @@\n-a\n+b", "@@ -3 +3 @@\n-c\n+d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Split(tt.diff); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Split() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		diff    string
+		want    string
+		wantErr error
+		errHas  string
+	}{
+		{
+			name:    "replace line",
+			content: "a\nb\nc\n",
+			diff:    "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+			want:    "a\nB\nc\n",
+		},
+		{
+			name:    "keeps missing trailing newline",
+			content: "a\nb\nc",
+			diff:    "@@ -2,2 +2,2 @@\n b\n-c\n+C\n",
+			want:    "a\nb\nC",
+		},
+		{
+			name:    "keeps trailing newline",
+			content: "a\nb\n",
+			diff:    "@@ -1,2 +1,3 @@\n a\n b\n+c\n",
+			want:    "a\nb\nc\n",
+		},
+		{
+			name:    "delete lines",
+			content: "a\nb\nc\nd\n",
+			diff:    "@@ -1,4 +1,2 @@\n a\n-b\n-c\n d\n",
+			want:    "a\nd\n",
+		},
+		{
+			name:    "whitespace in context is exact",
+			content: "func f() {\n\treturn 1\n}\n",
+			diff:    "@@ -1,3 +1,3 @@\n func f() {\n-\treturn 1\n+\treturn 2\n }\n",
+			want:    "func f() {\n\treturn 2\n}\n",
+		},
+		{
+			name:    "CRLF content is normalized",
+			content: "a\r\nb\r\nc\r\n",
+			diff:    "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+			want:    "a\nB\nc\n",
+		},
+		{
+			name:    "CRLF diff against LF content",
+			content: "a\nb\nc\n",
+			diff:    "@@ -1,3 +1,3 @@\r\n a\r\n-b\r\n+B\r\n c\r\n",
+			want:    "a\nB\nc\n",
+		},
+		{
+			name:    "new file",
+			content: "",
+			diff:    "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,2 @@\n+hello\n+world\n",
+			want:    "hello\nworld",
+		},
+		{
+			name:    "new file from several hunks",
+			content: "",
+			diff:    "@@ -0,0 +1 @@\n+one\n@@ -0,0 +2 @@\n+two\n",
+			want:    "one\ntwo",
+		},
+		{
+			name:    "context missing in empty file",
+			content: "",
+			diff:    "@@ -1 +1 @@\n-a\n+b\n",
+			wantErr: ErrContextNotFound,
+			errHas:  "Search Block:\na",
+		},
+		{
+			name:    "pure insertion into existing file",
+			content: "a\n",
+			diff:    "@@ -1,0 +2 @@\n+b\n",
+			wantErr: ErrPureInsertion,
+			errHas:  "hunk 1 failed to apply",
+		},
+		{
+			name:    "ambiguous context without line number",
+			content: "x\nsame\ny\nsame\n",
+			diff:    "@@ ... @@\n-same\n+other\n",
+			wantErr: ErrAmbiguous,
+			errHas:  "matches 2 times in the file (lines 2, 4)",
+		},
+		{
+			name:    "ambiguous context resolved by line number",
+			content: "x\nsame\ny\nsame\n",
+			diff:    "@@ -4,1 +4,1 @@\n-same\n+other\n",
+			want:    "x\nsame\ny\nother\n",
+		},
+		{
+			name:    "ambiguous context with equidistant line number",
+			content: "same\nx\nsame\n",
+			diff:    "@@ -2,1 +2,1 @@\n-same\n+other\n",
+			wantErr: ErrAmbiguous,
+		},
+		{
+			name:    "line numbers shift after earlier hunks",
+			content: "a\ndup\nb\ndup\n",
+			diff:    "@@ -1,1 +1,3 @@\n-a\n+a1\n+a2\n+a3\n@@ -4,1 +6,1 @@\n-dup\n+last\n",
+			want:    "a1\na2\na3\ndup\nb\nlast\n",
+		},
+		{
+			name:    "context not found with suggestion",
+			content: "one\ntwo\nthree\nfour\n",
+			diff:    "@@ -1,3 +1,3 @@\n one\n-two\n+2\n tree\n",
+			wantErr: ErrContextNotFound,
+			errHas:  "Probable match found at lines 1-5 (score 0.67)",
+		},
+		{
+			name:    "second hunk fails",
+			content: "a\nb\n",
+			diff:    "@@ -1 +1 @@\n-a\n+A\n@@ -2 +2 @@\n-zzz\n+Z\n",
+			wantErr: ErrContextNotFound,
+			errHas:  "hunk 2 failed to apply",
+		},
+		{
+			name:    "later hunk sees earlier changes",
+			content: "a\nb\n",
+			diff:    "@@ -1 +1 @@\n-a\n+A\n@@ -1 +1 @@\n-A\n+AA\n",
+			want:    "AA\nb\n",
+		},
+		{
+			name:    "no hunks",
+			content: "a\n",
+			diff:    "just text",
+			wantErr: ErrNoHunks,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply(tt.content, Parse(tt.diff))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Apply() error = %v, want %v", err, tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.errHas) {
+					t.Errorf("Apply() error = %q, want it to contain %q", err, tt.errHas)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Apply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Format
+	}{
+		{"empty", "", Format{EOL: "\n", FinalNewline: true}},
+		{"LF", "a\nb\n", Format{EOL: "\n", FinalNewline: true}},
+		{"CRLF", "a\r\nb\r\n", Format{EOL: "\r\n", FinalNewline: true}},
+		{"no final newline", "a\r\nb", Format{EOL: "\r\n"}},
+		{"BOM", "\ufeffa\n", Format{EOL: "\n", BOM: true, FinalNewline: true}},
+		{"mixed, mostly LF", "a\r\nb\nc\n", Format{EOL: "\n", FinalNewline: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat(tt.content); got != tt.want {
+				t.Errorf("DetectFormat() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, content := range []string{"a\nb\n", "a\r\nb\r\n", "a\r\nb", "\ufeffa\r\nb\r\n", "\ufeffa"} {
+		if got := DetectFormat(content).Restore(Normalize(content)); got != content {
+			t.Errorf("round trip of %q = %q", content, got)
+		}
+	}
+	// An edit that drops or adds the final newline keeps the file's state
+	if got := (Format{EOL: "\r\n", FinalNewline: true}).Restore("a\nb"); got != "a\r\nb\r\n" {
+		t.Errorf("Restore() = %q", got)
+	}
+	if got := (Format{EOL: "\n"}).Restore("a\n"); got != "a" {
+		t.Errorf("Restore() = %q", got)
+	}
+}
+
+func TestMatchLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		block   string
+		want    []string
+	}{
+		{"none", "a\nb\n", "c", nil},
+		{"one", "a\nb\n", "b", []string{"2"}},
+		{"overlapping", "aaa", "aa", []string{"1", "1"}},
+		{"capped at ten", strings.Repeat("x\n", 12), "x", []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "..."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchLines(tt.content, tt.block); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MatchLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNearestMatch(t *testing.T) {
+	content := "dup\na\ndup\nb\nc\ndup\n" // dup on lines 1, 3 and 6
+	tests := []struct {
+		name   string
+		line   int
+		want   int // Line of the chosen occurrence
+		wantOK bool
+	}{
+		{"exact", 3, 3, true},
+		{"closest below", 5, 6, true},
+		{"before the first", 0, 1, true},
+		{"past the end", 100, 6, true},
+		{"tie", 2, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, ok := NearestMatch(content, "dup", tt.line)
+			if ok != tt.wantOK {
+				t.Fatalf("NearestMatch() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok {
+				if got := strings.Count(content[:offset], "\n") + 1; got != tt.want {
+					t.Errorf("NearestMatch() picked line %d, want %d", got, tt.want)
+				}
+			}
+		})
+	}
+	if _, ok := NearestMatch(content, "missing", 1); ok {
+		t.Error("NearestMatch() found a block that doesn't occur")
+	}
+}
+
+func TestFindBestMatch(t *testing.T) {
+	file := []string{"func f() {", "    x := 1", "    return x", "}"}
+	tests := []struct {
+		name      string
+		search    []string
+		wantIdx   int
+		wantScore float64
+	}{
+		{"exact", []string{"    x := 1", "    return x"}, 1, 1},
+		{"ignores indentation", []string{"x := 1", "return x"}, 1, 1},
+		{"partial", []string{"x := 2", "return x"}, 1, 0.5},
+		{"no match", []string{"nothing", "here"}, -1, 0},
+		{"empty search", nil, -1, 0},
+		{"longer than file", []string{"a", "b", "c", "d", "e"}, -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx, score := FindBestMatch(file, tt.search)
+			if idx != tt.wantIdx || score != tt.wantScore {
+				t.Errorf("FindBestMatch() = (%d, %.2f), want (%d, %.2f)", idx, score, tt.wantIdx, tt.wantScore)
+			}
+		})
+	}
+}
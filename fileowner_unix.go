@@ -0,0 +1,23 @@
+//go:build unix
+
+// File ownership is only meaningful on Unix; see fileowner_other.go.
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// preserveOwner gives path the owner and group of the file described by info.
+// Without the privilege to change the owner it still tries the group, and
+// failures are ignored: the edit itself matters more than who owns it.
+func preserveOwner(path string, info os.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if os.Chown(path, int(st.Uid), int(st.Gid)) != nil {
+		os.Chown(path, -1, int(st.Gid))
+	}
+}
@@ -76,6 +76,31 @@ else
     exit 1
 fi
 
+# Verify the checksum, when the release has one
+SUMS="${TMP_DIR}/checksums.txt"
+SUMS_URL="${GITHUB_URL}/releases/download/${VERSION}/checksums.txt"
+if command -v curl >/dev/null 2>&1; then
+    CODE=$(curl -sL -w "%{http_code}" -o "$SUMS" "$SUMS_URL")
+else
+    wget -qO "$SUMS" "$SUMS_URL" && CODE=200 || CODE=404
+fi
+if [ "$CODE" = "200" ]; then
+    EXPECTED=$(grep " \*\{0,1\}${BINARY_NAME}\$" "$SUMS" | cut -d' ' -f1)
+    if command -v sha256sum >/dev/null 2>&1; then
+        ACTUAL=$(sha256sum "$DEST" | cut -d' ' -f1)
+    else
+        ACTUAL=$(shasum -a 256 "$DEST" | cut -d' ' -f1)
+    fi
+    if [ -z "$EXPECTED" ] || [ "$EXPECTED" != "$ACTUAL" ]; then
+        echo "Error: Checksum verification failed for ${BINARY_NAME}"
+        rm -rf "$TMP_DIR"
+        exit 1
+    fi
+    echo "Checksum verified."
+else
+    echo "Warning: Release ${VERSION} has no checksums; skipping verification."
+fi
+
 # Install
 chmod +x "$DEST"
 
@@ -100,7 +125,17 @@ fi
 # Try to move
 if mv "$DEST" "$INSTALL_DEST"; then
     echo "Successfully installed to $INSTALL_DEST"
-    echo "Run 'simple-agent --help' to get started."
+    # `sa "task"` runs a one-line task: a symlink, so updates cover both.
+    # An existing sa that isn't ours is left alone.
+    ALIAS_DEST="$(dirname "$INSTALL_DEST")/sa"
+    if [ ! -e "$ALIAS_DEST" ] && [ ! -L "$ALIAS_DEST" ] || [ "$(basename "$(readlink "$ALIAS_DEST")")" = "$(basename "$INSTALL_DEST")" ]; then
+        if ln -sf "$(basename "$INSTALL_DEST")" "$ALIAS_DEST" 2>/dev/null; then
+            echo "Linked quick-task alias $ALIAS_DEST"
+        fi
+    else
+        echo "Skipping the sa alias: $ALIAS_DEST already exists"
+    fi
+    echo "Run 'simple-agent --help' to get started, or 'sa \"<task>\"' for a one-line task."
 else
     echo "Error: Could not move binary to $INSTALL_DEST"
     echo "Try running with sudo or check permissions."
@@ -0,0 +1,205 @@
+// Package llm fakes the chat completion API for tests. A Mock is an
+// http.RoundTripper that answers chat completion requests with canned
+// responses from a Script, in order, and records every request, so the
+// agent's tool loop, diff application and hooks can be exercised end to end
+// without calling a real provider.
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Script is the sequence of responses a Mock replays. Other fields in the
+// file are ignored, so a test case can keep its own settings next to them.
+type Script struct {
+	Responses []Response `json:"responses"`
+}
+
+// Response is one canned reply: an assistant message, or an HTTP error when
+// Status is set.
+type Response struct {
+	Content   string     `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Status    int        `json:"status,omitempty"` // Non-200 status, answered with Body
+	Body      string     `json:"body,omitempty"`
+}
+
+// ToolCall is a tool call of a canned reply. Arguments may be written as a
+// JSON object or as the string the API would send.
+type ToolCall struct {
+	ID        string          `json:"id,omitempty"` // Default call_<response>_<index>
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// Request is a request the Mock received.
+type Request struct {
+	Method string
+	Path   string
+	Body   []byte
+}
+
+// Mock replays a Script. It is safe for concurrent use; responses are handed
+// out in the order requests arrive.
+type Mock struct {
+	mu       sync.Mutex
+	script   Script
+	next     int
+	requests []Request
+}
+
+func NewMock(script Script) *Mock {
+	return &Mock{script: script}
+}
+
+// LoadMock reads a Script from a JSON file.
+func LoadMock(path string) (*Mock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var script Script
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("invalid mock script %s: %v", path, err)
+	}
+	return NewMock(script), nil
+}
+
+// Requests returns the requests received so far.
+func (m *Mock) Requests() []Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Request(nil), m.requests...)
+}
+
+// Remaining returns how many canned responses have not been used.
+func (m *Mock) Remaining() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.script.Responses) - m.next
+}
+
+// RoundTrip answers chat completion requests from the script. Anything else,
+// and requests after the script has run out, get an error response that the
+// agent does not retry.
+func (m *Mock) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	m.mu.Lock()
+	m.requests = append(m.requests, Request{Method: req.Method, Path: req.URL.Path, Body: body})
+	if !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		m.mu.Unlock()
+		return reply(req, http.StatusNotFound, errorBody(fmt.Sprintf("mock: no canned response for %s %s", req.Method, req.URL.Path))), nil
+	}
+	if m.next >= len(m.script.Responses) {
+		n := len(m.script.Responses)
+		m.mu.Unlock()
+		return reply(req, http.StatusBadRequest, errorBody(fmt.Sprintf("mock: script exhausted after %d responses", n))), nil
+	}
+	index := m.next
+	canned := m.script.Responses[index]
+	m.next++
+	m.mu.Unlock()
+
+	if canned.Status != 0 && canned.Status != http.StatusOK {
+		return reply(req, canned.Status, canned.Body), nil
+	}
+	var model struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &model)
+	data, err := completion(index, model.Model, canned, len(body))
+	if err != nil {
+		return nil, err
+	}
+	return reply(req, http.StatusOK, string(data)), nil
+}
+
+// completion renders a canned response as an OpenAI chat completion. Token
+// usage is estimated from the sizes, so it is deterministic.
+func completion(index int, model string, canned Response, requestSize int) ([]byte, error) {
+	type function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	}
+	type toolCall struct {
+		ID       string   `json:"id"`
+		Type     string   `json:"type"`
+		Function function `json:"function"`
+	}
+	var calls []toolCall
+	for i, tc := range canned.ToolCalls {
+		args := string(bytes.TrimSpace(tc.Arguments))
+		var s string
+		if json.Unmarshal(tc.Arguments, &s) == nil {
+			args = s
+		}
+		if args == "" {
+			args = "{}"
+		}
+		id := tc.ID
+		if id == "" {
+			id = fmt.Sprintf("call_%d_%d", index+1, i+1)
+		}
+		calls = append(calls, toolCall{ID: id, Type: "function", Function: function{Name: tc.Name, Arguments: args}})
+	}
+	finish := "stop"
+	if len(calls) > 0 {
+		finish = "tool_calls"
+	}
+	completionTokens := len(canned.Content) / 4
+	for _, c := range calls {
+		completionTokens += len(c.Function.Arguments) / 4
+	}
+	return json.Marshal(map[string]any{
+		"id":     fmt.Sprintf("mock-%d", index+1),
+		"object": "chat.completion",
+		"model":  model,
+		"choices": []map[string]any{{
+			"index": 0,
+			"message": map[string]any{
+				"role":       "assistant",
+				"content":    canned.Content,
+				"tool_calls": calls,
+			},
+			"finish_reason": finish,
+		}},
+		"usage": map[string]int{
+			"prompt_tokens":     requestSize / 4,
+			"completion_tokens": completionTokens,
+			"total_tokens":      requestSize/4 + completionTokens,
+		},
+	})
+}
+
+func errorBody(message string) string {
+	data, _ := json.Marshal(map[string]any{"error": map[string]any{"message": message}})
+	return string(data)
+}
+
+func reply(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
@@ -0,0 +1,104 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func post(t *testing.T, m *Mock, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("POST", "https://api.example.com"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: m}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestMockReplaysInOrder(t *testing.T) {
+	m := NewMock(Script{Responses: []Response{
+		{ToolCalls: []ToolCall{
+			{Name: "read_file", Arguments: json.RawMessage(`{"path": "a.go"}`)},
+			{ID: "mine", Name: "git_status", Arguments: json.RawMessage(`"{}"`)},
+		}},
+		{Status: 503, Body: `{"error": {"message": "overloaded"}}`},
+		{Content: "Done."},
+	}})
+
+	status, body := post(t, m, "/v1/chat/completions", `{"model": "test-model"}`)
+	if status != 200 {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	var resp struct {
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Content   string `json:"content"`
+				ToolCalls []struct {
+					ID       string `json:"id"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Model != "test-model" || resp.Choices[0].FinishReason != "tool_calls" {
+		t.Errorf("model %q, finish_reason %q", resp.Model, resp.Choices[0].FinishReason)
+	}
+	calls := resp.Choices[0].Message.ToolCalls
+	if len(calls) != 2 {
+		t.Fatalf("got %d tool calls, want 2", len(calls))
+	}
+	if calls[0].ID != "call_1_1" || calls[0].Function.Name != "read_file" || calls[0].Function.Arguments != `{"path": "a.go"}` {
+		t.Errorf("first call = %+v", calls[0])
+	}
+	if calls[1].ID != "mine" || calls[1].Function.Arguments != "{}" {
+		t.Errorf("second call = %+v", calls[1])
+	}
+
+	if status, body := post(t, m, "/v1/chat/completions", `{}`); status != 503 || !strings.Contains(body, "overloaded") {
+		t.Errorf("got %d %s, want the canned 503", status, body)
+	}
+	if status, body := post(t, m, "/v1/chat/completions", `{}`); status != 200 || !strings.Contains(body, `"content":"Done."`) {
+		t.Errorf("got %d %s, want the final answer", status, body)
+	}
+	if m.Remaining() != 0 {
+		t.Errorf("Remaining() = %d, want 0", m.Remaining())
+	}
+	if status, body := post(t, m, "/v1/chat/completions", `{}`); status != 400 || !strings.Contains(body, "exhausted after 3 responses") {
+		t.Errorf("got %d %s, want an exhausted error", status, body)
+	}
+}
+
+func TestMockRecordsRequests(t *testing.T) {
+	m := NewMock(Script{Responses: []Response{{Content: "hi"}}})
+	if status, _ := post(t, m, "/v1/embeddings", `{"input": "x"}`); status != 404 {
+		t.Errorf("embeddings status = %d, want 404", status)
+	}
+	post(t, m, "/v1/chat/completions", `{"messages": []}`)
+
+	reqs := m.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("recorded %d requests, want 2", len(reqs))
+	}
+	if reqs[0].Path != "/v1/embeddings" || reqs[1].Path != "/v1/chat/completions" || string(reqs[1].Body) != `{"messages": []}` {
+		t.Errorf("requests = %+v", reqs)
+	}
+	if m.Remaining() != 0 {
+		t.Errorf("the embeddings request used a canned response")
+	}
+}
@@ -1,34 +1,63 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"html"
 	"io"
 	"io/fs"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
+
+	"github.com/robert-at-pretension-io/simple-agent/chat"
+	"github.com/robert-at-pretension-io/simple-agent/commitpolicy"
+	"github.com/robert-at-pretension-io/simple-agent/diffengine"
+	"github.com/robert-at-pretension-io/simple-agent/llm"
+	"github.com/robert-at-pretension-io/simple-agent/middleware"
 )
 
 //go:embed skills
 var embeddedSkillsFS embed.FS
 
-//go:embed install.sh
-var installScript []byte
-
 var CoreSkillsDir string
 
 const Version = "v1.1.54"
@@ -37,73 +66,38 @@ var (
 	GeminiURL      = "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"
 	ModelName      = "gemini-3-pro-preview"
 	FlashModelName = "gemini-3-flash-preview"
+
+	EmbeddingURL       = "https://generativelanguage.googleapis.com/v1beta/openai/embeddings"
+	EmbeddingModelName = "gemini-embedding-001"
 )
 
 const (
 	OpenAIURL       = "https://api.openai.com/v1/chat/completions"
 	OpenAIModelName = "gpt-4o"
+
+	OpenAIEmbeddingURL       = "https://api.openai.com/v1/embeddings"
+	OpenAIEmbeddingModelName = "text-embedding-3-small"
 )
 
 // --- API Structures ---
 
-type ChatCompletionRequest struct {
-	Model     string          `json:"model"`
-	Messages  []Message       `json:"messages"`
-	Tools     []Tool          `json:"tools,omitempty"`
-	ExtraBody json.RawMessage `json:"extra_body,omitempty"`
-}
-
-type Message struct {
-	Role         string          `json:"role"`
-	Content      string          `json:"content"`
-	ToolCalls    []ToolCall      `json:"tool_calls,omitempty"`
-	ToolCallID   string          `json:"tool_call_id,omitempty"`
-	ExtraContent json.RawMessage `json:"extra_content,omitempty"`
-}
-
-type Tool struct {
-	Type     string             `json:"type"`
-	Function FunctionDefinition `json:"function"`
-}
-
-type FunctionDefinition struct {
-	Name        string          `json:"name"`
-	Description string          `json:"description"`
-	Parameters  json.RawMessage `json:"parameters"`
-}
-
-type ToolCall struct {
-	ID           string           `json:"id"`
-	Type         string           `json:"type"`
-	Function     ToolCallFunction `json:"function"`
-	ExtraContent json.RawMessage  `json:"extra_content,omitempty"`
-}
-
-type ToolCallFunction struct {
-	Name      string `json:"name"`
-	Arguments string `json:"arguments"`
-}
-
-type ChatCompletionResponse struct {
-	Choices []Choice  `json:"choices"`
-	Error   *APIError `json:"error,omitempty"`
-	Usage   *Usage    `json:"usage,omitempty"`
-}
-
-type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
-}
-
-type APIError struct {
-	Message string `json:"message"`
-	Code    any    `json:"code"`
-}
-
-type Choice struct {
-	Message Message `json:"message"`
-}
+// The request and response types live in package chat, so the middleware
+// package can use them.
+type (
+	ChatCompletionRequest  = chat.ChatCompletionRequest
+	ChatCompletionResponse = chat.ChatCompletionResponse
+	Message                = chat.Message
+	ContentPart            = chat.ContentPart
+	ContentImage           = chat.ContentImage
+	ContentFile            = chat.ContentFile
+	Tool                   = chat.Tool
+	FunctionDefinition     = chat.FunctionDefinition
+	ToolCall               = chat.ToolCall
+	ToolCallFunction       = chat.ToolCallFunction
+	Usage                  = chat.Usage
+	APIError               = chat.APIError
+	Choice                 = chat.Choice
+)
 
 // --- Tool Definitions ---
 
@@ -111,7 +105,7 @@ var udiffTool = Tool{
 	Type: "function",
 	Function: FunctionDefinition{
 		Name:        "apply_udiff",
-		Description: "Apply a unified diff to a file. The diff should be in standard unified format (diff -U0), including headers. IMPORTANT: Context lines are mandatory for insertions. You must include at least 2 lines of context around your changes. A hunk with only '+' lines is invalid (unless creating a new file). Ensure enough context is provided to uniquely locate the code.",
+		Description: "Apply a unified diff to a file. The diff should be in standard unified format (diff -U0), including headers. Git's 'rename from'/'rename to' and 'deleted file mode' headers rename or delete the file. IMPORTANT: Context lines are mandatory for insertions. You must include at least 2 lines of context around your changes. A hunk with only '+' lines is invalid (unless creating a new file). Ensure enough context is provided to uniquely locate the code.",
 		Parameters: json.RawMessage(`{
 			"type": "object",
 			"properties": {
@@ -122,6 +116,15 @@ var udiffTool = Tool{
 				"diff": {
 					"type": "string",
 					"description": "The unified diff content. Must include @@ ... @@ headers for hunks. Must include context lines."
+				},
+				"replace_hunks": {
+					"type": "array",
+					"items": {"type": "integer"},
+					"description": "Retry a failed patch without resending it: the 1-based numbers of the hunks in the last failed patch for this path that 'diff' replaces. 'diff' then contains only the corrected hunks, in the same order; all other hunks are reused."
+				},
+				"force": {
+					"type": "boolean",
+					"description": "Edit a file over the size limit for edits. Only set it after a 'file_too_large' error, when the edit is intended."
 				}
 			},
 			"required": ["path", "diff"]
@@ -133,7 +136,7 @@ var runScriptTool = Tool{
 	Type: "function",
 	Function: FunctionDefinition{
 		Name:        "run_script",
-		Description: "Execute a shell script (.sh) from a skill. This is the PRIMARY way to execute code and interact with the OS. You use this to run the 'yolo-runner' skill for arbitrary shell commands, or other specialized skill scripts.",
+		Description: "Execute a script from a skill's scripts/ folder (.sh, .py, .js or executable). Use 'run_command' for ad-hoc shell commands.",
 		Parameters: json.RawMessage(`{
 	"type": "object",
 	"properties": {
@@ -154,6 +157,32 @@ var runScriptTool = Tool{
 	},
 }
 
+var runCommandTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "run_command",
+		Description: "Run a shell command (bash -c) in the project, e.g. 'ls -R', 'grep -rn -C 5 foo src', 'go test ./...'. Pipes and '&&' work. Commands are checked against the user's allow/deny policy and may need approval. Secrets are removed from the environment. Each call starts in the project root or 'workdir'; 'cd' does not persist.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"command": {
+					"type": "string",
+					"description": "The command line to run"
+				},
+				"workdir": {
+					"type": "string",
+					"description": "Directory to run in, relative to the project root (default: the project root)"
+				},
+				"timeout_seconds": {
+					"type": "integer",
+					"description": "Kill the command after this many seconds (default and maximum: the configured timeout, 600 unless changed)"
+				}
+			},
+			"required": ["command"]
+		}`),
+	},
+}
+
 var shortenContextTool = Tool{
 	Type: "function",
 	Function: FunctionDefinition{
@@ -180,6 +209,80 @@ var shortenContextTool = Tool{
 	},
 }
 
+var spawnAgentTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "spawn_agent",
+		Description: "Delegate a self-contained task to a sub-agent with its own isolated context. Use this to decompose large tasks (e.g. 'update every call site of X', 'find out why test Y fails') without filling your own context with exploration. The sub-agent cannot ask the user questions, so the task description must contain everything it needs. Only its final report is returned to you.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"task": {
+					"type": "string",
+					"description": "Complete description of the task, including relevant files, constraints, and what the final report should contain."
+				},
+				"allowed_tools": {
+					"type": "array",
+					"items": {
+						"type": "string",
+						"enum": ["apply_udiff", "edit_many", "run_command", "run_script", "read_file", "run_tests", "build_project"]
+					},
+					"description": "Tools the sub-agent may use. Defaults to apply_udiff, run_command and run_script. Use ['read_file', 'run_command'] for investigation."
+				},
+				"max_turns": {
+					"type": "integer",
+					"description": "Maximum number of model requests the sub-agent may make (default 20, max 50)."
+				}
+			},
+			"required": ["task"]
+		}`),
+	},
+}
+
+var orchestrateAgentsTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "orchestrate_agents",
+		Description: "Run several sub-agents in parallel, each in its own git worktree created from the current working tree (including uncommitted changes). Use this to try alternative approaches side by side (e.g. 'try three approaches to this refactor') or to split independent work. The working tree is NOT modified: you receive each agent's report and diff for comparison, and each diff is saved as a patch file you can apply with 'git apply'.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"agents": {
+					"type": "array",
+					"items": {
+						"type": "object",
+						"properties": {
+							"label": {
+								"type": "string",
+								"description": "Short unique name for this agent (letters, digits, '.', '_', '-'), e.g. 'extract-interface'."
+							},
+							"task": {
+								"type": "string",
+								"description": "Complete, self-contained task description for this agent."
+							}
+						},
+						"required": ["label", "task"]
+					},
+					"description": "The sub-agents to run concurrently (1-5)."
+				},
+				"allowed_tools": {
+					"type": "array",
+					"items": {
+						"type": "string",
+						"enum": ["apply_udiff", "edit_many", "run_command", "run_script", "read_file", "run_tests", "build_project"]
+					},
+					"description": "Tools the sub-agents may use. Defaults to apply_udiff, run_command and run_script."
+				},
+				"max_turns": {
+					"type": "integer",
+					"description": "Maximum number of model requests per sub-agent (default 20, max 50)."
+				}
+			},
+			"required": ["agents"]
+		}`),
+	},
+}
+
 // --- Skills System ---
 
 type Skill struct {
@@ -187,13 +290,50 @@ type Skill struct {
 	Description    string
 	Version        string
 	Dependencies   []string
+	Permissions    []string // What the scripts need, e.g. network or writes outside the project
 	Path           string
 	DefinitionFile string
-	Hooks          map[string]string
+	Hooks          map[string]HookSpec
+	Commands       map[string]SkillCommand // Slash commands, by name without the '/'
 	Scripts        []string
 }
 
-// var supportedHooks = []string{"startup", "pre_edit", "post_edit", "pre_view", "post_view", "pre_run", "post_run", "pre_commit"}
+// SkillCommand is a slash command declared in a skill's frontmatter. It runs
+// a script or sends a prompt template to the model:
+//
+//	commands:
+//	  deploy: scripts/deploy.sh {args}
+//	  review:
+//	    prompt: Review {args} for security issues.
+//	    description: Security review of a file
+type SkillCommand struct {
+	Script      string // Script path (relative to the skill) and arguments
+	Prompt      string
+	Description string
+}
+
+// HookSpec describes a hook registered in a skill's frontmatter.
+// A hook is either a plain command (`post_edit: scripts/lint.sh`) or a block:
+//
+//	pre_edit:
+//	  command: scripts/lint.sh {path}
+//	  priority: 10
+//	  filter: "*.go, *.mod"
+//	  blocking: true
+type HookSpec struct {
+	Command  string
+	Priority int           // Higher priorities run first
+	Filter   []string      // Glob patterns matched against the {path} context variable
+	Blocking bool          // A failure aborts the operation and is reported to the model
+	Timeout  time.Duration // 0 means defaultHookTimeout
+}
+
+// defaultHookTimeout bounds a hook. Hooks are not stopped when the turn is
+// interrupted, so a linter isn't killed halfway through rewriting a file;
+// this is what stops one that hangs.
+const defaultHookTimeout = 60 * time.Second
+
+// var supportedHooks = []string{"startup", "pre_edit", "post_edit", "pre_view", "post_view", "pre_run", "post_run", "pre_commit", "pre_prompt", "post_response", "on_error", "session_end"}
 
 func getSkillsExplanation() string {
 	return `
@@ -219,10 +359,21 @@ A skill is a directory (e.g., ` + "`skills/my-skill/`" + `) containing:
       - ` + "`pre_edit` / `post_edit`" + `: Runs before/after ` + "`apply_udiff`" + `. **Great for running linters/tests automatically.**
       - ` + "`pre_run` / `post_run`" + `: Runs before/after ` + "`run_script`" + `.
       - ` + "`pre_commit`" + `: Runs before the agent proposes a git commit.
+      - ` + "`pre_prompt`" + `: Runs before every request to the model. Its output is injected as temporary system context for that request (e.g. current branch, failing tests). Receives ` + "`{input_file}`" + `.
+      - ` + "`post_response`" + `: Runs after every model response. Receives ` + "`{response_file}`" + `; its output is added to the conversation.
+      - ` + "`on_error`" + `: Runs when a tool call or API request fails. Receives ` + "`{source}`" + ` (tool/api), ` + "`{tool}`" + ` and ` + "`{error_file}`" + `. Great for crash diagnostics.
+      - ` + "`session_end`" + `: Runs once when the session exits (cleanup/reporting). Receives ` + "`{history}`" + `.
       **Example**:
       hooks:
         post_edit: scripts/lint.sh
         startup: scripts/check_deps.sh
+      **Advanced Options**: A hook can be written as a block with ` + "`command`" + `, ` + "`priority`" + ` (higher runs first), ` + "`filter`" + ` (globs matched against the edited/run path, e.g. ` + "`\"*.go\"`" + `) and ` + "`blocking`" + ` (a failing ` + "`pre_*`" + ` hook aborts the operation and reports the error to you).
+      hooks:
+        pre_edit:
+          command: scripts/lint.sh {path}
+          priority: 10
+          filter: "*.go"
+          blocking: true
 2.  **` + "`scripts/`" + `** (Optional): A subdirectory for utility scripts.
     - **Multiple Scripts**: You can include multiple scripts for different sub-tasks (e.g., ` + "`setup.sh`" + `, ` + "`validate.py`" + `).
     - **Descriptive Names**: Give scripts clear, action-oriented names (e.g., ` + "`install_dependencies.sh`" + ` is better than ` + "`run.sh`" + `).
@@ -230,7 +381,7 @@ A skill is a directory (e.g., ` + "`skills/my-skill/`" + `) containing:
 
 ## How to Invoke Skills
 1.  **Discover**: The system provides a list of available skills.
-2.  **Learn**: If a user request matches a skill, read its 'SKILL.md' (e.g. using 'yolo-runner').
+2.  **Learn**: If a user request matches a skill, read its 'SKILL.md' (e.g. using 'read_file').
 3.  **Execute**: Follow the instructions in 'SKILL.md'.
     - If the instructions refer to scripts, execute them using 'run_script'.
     - Scripts are typically located relative to the skill directory (e.g., ` + "`skills/my-skill/scripts/script.sh`" + `).
@@ -259,26 +410,139 @@ When faced with a new, complex task that might be repeated, consider creating a
 }
 
 func discoverSkills(root string) []Skill {
-	var skills []Skill
-	if _, err := os.Stat(root); os.IsNotExist(err) {
-		return skills
+	return newSkillScanner(root, 0).Scan()
+}
+
+// skillRescanInterval rate-limits the rescans of project skills during turns.
+const skillRescanInterval = 2 * time.Second
+
+// skillScanner discovers the skills under root and rescans incrementally:
+// it only walks the tree again when the mtime of a directory or SKILL.md seen
+// in the last walk changed, and only re-parses skills whose SKILL.md or
+// scripts changed. Scans within minInterval of the last one reuse its result.
+type skillScanner struct {
+	mu          sync.Mutex
+	root        string
+	minInterval time.Duration
+	scanned     time.Time
+	stamps      map[string]time.Time    // Directories and SKILL.md files -> mtime at the last walk
+	cache       map[string]scannedSkill // SKILL.md path -> parsed skill
+	skills      []Skill
+}
+
+type scannedSkill struct {
+	stamp string // SKILL.md size and mtime plus the mtimes of its scripts directories
+	skill Skill
+	err   error
+}
+
+func newSkillScanner(root string, minInterval time.Duration) *skillScanner {
+	return &skillScanner{root: root, minInterval: minInterval, cache: make(map[string]scannedSkill)}
+}
+
+// projectSkillScanner watches ./skills for skills created during a session.
+var projectSkillScanner = newSkillScanner("./skills", skillRescanInterval)
+
+// Scan returns the current skills.
+func (s *skillScanner) Scan() []Skill {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stamps != nil && time.Since(s.scanned) < s.minInterval {
+		return append([]Skill(nil), s.skills...)
+	}
+	s.scanned = time.Now()
+	if s.stamps == nil || !s.unchanged() {
+		s.walk()
+	}
+	return append([]Skill(nil), s.skills...)
+}
+
+// unchanged reports whether everything seen in the last walk is as it was.
+func (s *skillScanner) unchanged() bool {
+	for path, modTime := range s.stamps {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *skillScanner) walk() {
+	s.stamps = make(map[string]time.Time)
+	s.skills = nil
+	info, err := os.Stat(s.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Creating the root changes its parent
+			if parent, err := os.Stat(filepath.Dir(s.root)); err == nil {
+				s.stamps[filepath.Dir(s.root)] = parent.ModTime()
+			}
+		}
+		return
 	}
+	s.stamps[s.root] = info.ModTime()
 
-	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	skillFiles := make(map[string]fs.FileInfo)
+	filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
-		if !d.IsDir() && d.Name() == "SKILL.md" {
-			skill, err := parseSkill(path)
-			if err == nil {
-				skills = append(skills, skill)
-			} else {
-				fmt.Fprintf(os.Stderr, "Warning: Failed to load skill at %s: %v\n", path, err)
+		// Skill test fixtures may contain skills of their own
+		if d.IsDir() && d.Name() == "tests" {
+			if _, err := os.Stat(filepath.Join(filepath.Dir(path), "SKILL.md")); err == nil {
+				return fs.SkipDir
 			}
 		}
+		if !d.IsDir() && d.Name() != "SKILL.md" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		s.stamps[path] = info.ModTime()
+		if !d.IsDir() {
+			skillFiles[path] = info
+		}
 		return nil
 	})
-	return skills
+
+	var paths []string
+	for path := range skillFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		info := skillFiles[path]
+		// Scripts are listed from the scripts directory, so its changes count too
+		stamps := []string{fmt.Sprintf("%d@%s", info.Size(), info.ModTime())}
+		scriptsDir := filepath.Join(filepath.Dir(path), "scripts")
+		for dir, modTime := range s.stamps {
+			if dir == scriptsDir || strings.HasPrefix(dir, scriptsDir+string(os.PathSeparator)) {
+				stamps = append(stamps, fmt.Sprintf("%s@%s", dir, modTime))
+			}
+		}
+		sort.Strings(stamps[1:])
+		stamp := strings.Join(stamps, "|")
+		cached, ok := s.cache[path]
+		if !ok || cached.stamp != stamp {
+			skill, err := parseSkill(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to load skill at %s: %v\n", path, err)
+			}
+			cached = scannedSkill{stamp: stamp, skill: skill, err: err}
+			s.cache[path] = cached
+		}
+		if cached.err == nil {
+			s.skills = append(s.skills, cached.skill)
+		}
+	}
+	for path := range s.cache {
+		if skillFiles[path] == nil {
+			delete(s.cache, path)
+		}
+	}
 }
 
 func parseSkill(path string) (Skill, error) {
@@ -288,13 +552,36 @@ func parseSkill(path string) (Skill, error) {
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	var scripts []string
+	scriptsDir := filepath.Join(filepath.Dir(path), "scripts")
+	if _, err := os.Stat(scriptsDir); err == nil {
+		filepath.WalkDir(scriptsDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			scripts = append(scripts, p)
+			return nil
+		})
+	}
+	return parseSkillDefinition(f, path, scripts)
+}
+
+// parseSkillDefinition parses a SKILL.md read from r. path is where the file
+// is (or will be) on disk.
+func parseSkillDefinition(r io.Reader, path string, scripts []string) (Skill, error) {
+	scanner := bufio.NewScanner(r)
 	var name, description, version string
-	var dependencies []string
-	hooks := make(map[string]string)
+	var dependencies, permissions []string
+	hooks := make(map[string]HookSpec)
+	commands := make(map[string]SkillCommand)
 	inFrontmatter := false
 	inHooks := false
-	inDependencies := false
+	inCommands := false
+	currentCommand := ""
+	currentCommandIndent := 0
+	var inList *[]string // The dependencies or permissions block being read
+	currentHook := ""
+	currentHookIndent := 0
 	lineCount := 0
 
 	for scanner.Scan() {
@@ -315,50 +602,103 @@ func parseSkill(path string) (Skill, error) {
 		if inFrontmatter {
 			if trimmedLine == "hooks:" {
 				inHooks = true
-				inDependencies = false
+				inList, inCommands = nil, false
+				continue
+			}
+			if trimmedLine == "commands:" {
+				inCommands = true
+				inList, inHooks = nil, false
 				continue
 			}
-			if trimmedLine == "dependencies:" {
-				inDependencies = true
-				inHooks = false
+			if trimmedLine == "dependencies:" || trimmedLine == "permissions:" {
+				inList = &dependencies
+				if trimmedLine == "permissions:" {
+					inList = &permissions
+				}
+				inHooks, inCommands = false, false
 				continue
 			}
 
+			if inCommands {
+				if strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t") {
+					parts := strings.SplitN(trimmedLine, ":", 2)
+					if len(parts) == 2 {
+						key := strings.TrimSpace(parts[0])
+						val := unquote(strings.TrimSpace(parts[1]))
+						indent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+						if currentCommand != "" && indent > currentCommandIndent {
+							c := commands[currentCommand]
+							switch key {
+							case "script", "run", "command":
+								c.Script = val
+							case "prompt":
+								c.Prompt = val
+							case "description":
+								c.Description = val
+							}
+							commands[currentCommand] = c
+						} else {
+							currentCommand = strings.TrimPrefix(key, "/")
+							currentCommandIndent = indent
+							commands[currentCommand] = SkillCommand{Script: val}
+						}
+					}
+				} else if trimmedLine != "" {
+					inCommands = false
+					currentCommand = ""
+				}
+			}
+
 			if inHooks {
 				// Check if we are still in hooks (indented)
 				if strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t") {
 					parts := strings.SplitN(trimmedLine, ":", 2)
 					if len(parts) == 2 {
 						key := strings.TrimSpace(parts[0])
-						val := strings.TrimSpace(parts[1])
-						hooks[key] = val
+						val := unquote(strings.TrimSpace(parts[1]))
+						indent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+						if currentHook != "" && indent > currentHookIndent {
+							// Property of the enclosing hook block
+							spec := hooks[currentHook]
+							applyHookProperty(&spec, key, val)
+							hooks[currentHook] = spec
+						} else {
+							currentHook = key
+							currentHookIndent = indent
+							hooks[key] = HookSpec{Command: val}
+						}
 					}
 				} else if trimmedLine != "" {
 					// Not empty and not indented, so we left hooks
 					inHooks = false
+					currentHook = ""
 				}
 			}
 
-			if inDependencies {
+			if inList != nil {
 				if strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t") {
 					val := strings.TrimSpace(trimmedLine)
 					val = strings.TrimPrefix(val, "-")
 					val = strings.TrimSpace(val)
 					if val != "" {
-						dependencies = append(dependencies, val)
+						*inList = append(*inList, val)
 					}
 				} else if trimmedLine != "" {
-					inDependencies = false
+					inList = nil
 				}
 			}
 
-			if !inHooks && !inDependencies {
+			if !inHooks && !inCommands && inList == nil {
 				if strings.HasPrefix(line, "name:") {
 					name = strings.TrimSpace(strings.TrimPrefix(line, "name:"))
 				} else if strings.HasPrefix(line, "description:") {
 					description = strings.TrimSpace(strings.TrimPrefix(line, "description:"))
 				} else if strings.HasPrefix(line, "version:") {
 					version = strings.TrimSpace(strings.TrimPrefix(line, "version:"))
+				} else if strings.HasPrefix(line, "permissions:") {
+					permissions = parseListValue(strings.TrimSpace(strings.TrimPrefix(line, "permissions:")))
 				}
 			}
 		}
@@ -372,158 +712,627 @@ func parseSkill(path string) (Skill, error) {
 	absPath, _ := filepath.Abs(filepath.Dir(path))
 	defFile, _ := filepath.Abs(path)
 
-	var scripts []string
-	scriptsDir := filepath.Join(filepath.Dir(path), "scripts")
-	if _, err := os.Stat(scriptsDir); err == nil {
-		filepath.WalkDir(scriptsDir, func(p string, d fs.DirEntry, err error) error {
-			if err != nil || d.IsDir() {
-				return nil
-			}
-			scripts = append(scripts, p)
-			return nil
-		})
-	}
-
 	return Skill{
 		Name:           name,
 		Description:    description,
 		Version:        version,
 		Dependencies:   dependencies,
+		Permissions:    permissions,
 		Path:           absPath,
 		DefinitionFile: defFile,
 		Hooks:          hooks,
+		Commands:       commands,
 		Scripts:        scripts,
 	}, nil
 }
 
+// applyHookProperty sets a single property of a block-style hook definition.
+func applyHookProperty(spec *HookSpec, key, val string) {
+	switch key {
+	case "command", "run":
+		spec.Command = val
+	case "priority":
+		if p, err := strconv.Atoi(val); err == nil {
+			spec.Priority = p
+		}
+	case "filter":
+		spec.Filter = parseListValue(val)
+	case "blocking":
+		spec.Blocking = val == "true" || val == "yes"
+	case "timeout":
+		if d, err := time.ParseDuration(val); err == nil {
+			spec.Timeout = d
+		} else if secs, err := strconv.Atoi(val); err == nil {
+			spec.Timeout = time.Duration(secs) * time.Second
+		}
+	}
+}
+
+// parseListValue parses a frontmatter value such as `[*.go, *.mod]` or `"*.go,*.mod"`.
+func parseListValue(val string) []string {
+	val = strings.TrimSuffix(strings.TrimPrefix(val, "["), "]")
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		item = unquote(strings.TrimSpace(item))
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func unquote(val string) string {
+	if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+		return val[1 : len(val)-1]
+	}
+	return val
+}
+
 func generateSkillsPrompt(skills []Skill) string {
 	if len(skills) == 0 {
 		return ""
 	}
+	cwd, _ := os.Getwd()
 	var sb strings.Builder
 	sb.WriteString("\n# Available Skills\n")
 	sb.WriteString("You can perform complex tasks by using the following skills.\n")
-	sb.WriteString("To use one, read the definition file first (e.g. using 'yolo-runner').\n\n")
+	sb.WriteString("To use one, read the definition file first (e.g. using 'read_file').\n")
+	sb.WriteString("Paths starting with 'core:' refer to built-in core skills; use them as-is in tool arguments and shell commands.\n\n")
 
 	for _, s := range skills {
-		sb.WriteString(fmt.Sprintf("- **%s**", s.Name))
-		if s.Version != "" {
-			sb.WriteString(fmt.Sprintf(" (v%s)", s.Version))
-		}
-		sb.WriteString(fmt.Sprintf(": %s\n", s.Description))
-		if len(s.Dependencies) > 0 {
-			sb.WriteString(fmt.Sprintf("  Dependencies: %s\n", strings.Join(s.Dependencies, ", ")))
-		}
-		if len(s.Scripts) > 0 {
-			sb.WriteString("  Scripts:\n")
-			for _, script := range s.Scripts {
-				sb.WriteString(fmt.Sprintf("    - %s\n", script))
-			}
+		if entry, ok := cachedSkillPrompt(&s); ok {
+			sb.WriteString(entry)
+		} else {
+			sb.WriteString(skillPromptEntry(cwd, s))
 		}
-		sb.WriteString(fmt.Sprintf("  Definition: %s\n", s.DefinitionFile))
 
-		if s.Name == "yolo-runner" {
+		if s.Name == "yolo-runner" && disabledTools["run_command"] {
 			sb.WriteString("\n  **AUTONOMY MODE**: You have the 'yolo-runner' skill. Use it to run ANY shell command needed to complete your task. You are authorized to take initiative.\n")
 		}
 		if s.Name == "remember" {
-			sb.WriteString("\n  **PROJECT MEMORY**: Use the 'remember' skill to persist important facts, decisions, and context. Read 'remember.txt' at the start of tasks and update it as you learn.\n")
+			sb.WriteString("\n  **PROJECT MEMORY**: Use the 'remember' and 'recall' tools to persist and look up decisions, conventions, and gotchas across sessions.\n")
 		}
 	}
 	return sb.String()
 }
 
-func runSkillHooks(ctx context.Context, skills []Skill, event string, context map[string]string) string {
-	var output strings.Builder
-	for _, skill := range skills {
-		if cmdTemplate, ok := skill.Hooks[event]; ok {
-			// Special hook type: inject_skill_md
-			if cmdTemplate == "inject_skill_md" {
-				body, err := readSkillBody(skill.DefinitionFile)
-				if err != nil {
-					fmt.Printf("[Hook Error] Failed to read skill body for '%s': %v\n", skill.Name, err)
-					continue
-				}
-				output.WriteString(fmt.Sprintf("\n[Skill: %s Instructions]\n%s\n", skill.Name, body))
-				continue
-			}
-
-			// Prepare command
-			cmdStr := cmdTemplate
-			// Replace {skill_path}
-			cmdStr = strings.ReplaceAll(cmdStr, "{skill_path}", skill.Path)
-			// Replace context variables
-			for k, v := range context {
-				cmdStr = strings.ReplaceAll(cmdStr, "{"+k+"}", v)
-			}
+// skillPromptEntry lists one skill in the skills prompt.
+func skillPromptEntry(cwd string, s Skill) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("- **%s**", s.Name))
+	if s.Version != "" {
+		sb.WriteString(fmt.Sprintf(" (v%s)", s.Version))
+	}
+	sb.WriteString(fmt.Sprintf(": %s\n", s.Description))
+	if len(s.Dependencies) > 0 {
+		sb.WriteString(fmt.Sprintf("  Dependencies: %s\n", strings.Join(s.Dependencies, ", ")))
+	}
+	if len(s.Scripts) > 0 {
+		sb.WriteString("  Scripts:\n")
+		for _, script := range s.Scripts {
+			sb.WriteString(fmt.Sprintf("    - %s\n", displayPath(cwd, script)))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("  Definition: %s\n", displayPath(cwd, s.DefinitionFile)))
+	return sb.String()
+}
 
-			// Parse command string into script path and args
-			parts, err := parseArgs(cmdStr)
-			if err != nil {
-				fmt.Printf("[Hook Error] Failed to parse command '%s' for skill '%s': %v\n", cmdStr, skill.Name, err)
-				continue
-			}
-			if len(parts) == 0 {
-				continue
-			}
-			scriptPath := parts[0]
-			args := parts[1:]
+// HooksConfig is the "hooks" config: user overrides of the skills' hook
+// settings, keyed by "event/skill" (e.g. "post_edit/go-lint"). Disabled
+// entries may also name a whole skill or event.
+type HooksConfig struct {
+	Disabled []string       `json:"disabled,omitempty"`
+	Priority map[string]int `json:"priority,omitempty"`
+}
 
-			// Resolve relative paths to skill directory
-			if !filepath.IsAbs(scriptPath) {
-				scriptPath = filepath.Join(skill.Path, scriptPath)
-			}
+var hooksConfig HooksConfig
 
-			fmt.Printf("[Hook: %s] Running for skill '%s': %s %v\n", event, skill.Name, scriptPath, args)
+func hookKey(event, skill string) string {
+	return event + "/" + skill
+}
 
-			// Use runSafeScript to enforce security and execution logic
-			out, err := runSafeScript(ctx, scriptPath, args, "")
-			if err != nil {
-				fmt.Printf("[Hook Error] %v\n", err)
-				output.WriteString(fmt.Sprintf("Hook '%s' (skill: %s) failed: %v\n", event, skill.Name, err))
-			} else if out != "" {
-				output.WriteString(fmt.Sprintf("Hook '%s' (skill: %s) output:\n%s\n", event, skill.Name, out))
-			}
+// hookDisabled reports whether the config or /hooks turned a hook off.
+func hookDisabled(event, skill string) bool {
+	for _, d := range hooksConfig.Disabled {
+		if d == hookKey(event, skill) || d == skill || d == event {
+			return true
 		}
 	}
-	return output.String()
+	return false
 }
 
-func readSkillBody(path string) (string, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
+// hookStep is one hook in an event's pipeline.
+type hookStep struct {
+	skill    Skill
+	spec     HookSpec
+	disabled bool
+}
+
+// hookPipeline returns the hooks registered for event in the order they run:
+// highest priority first (a priority in the config overrides the skill's),
+// ties in skill-name order. Disabled hooks are included and marked.
+func hookPipeline(skills []Skill, event string) []hookStep {
+	var steps []hookStep
+	for _, skill := range skills {
+		spec, ok := skill.Hooks[event]
+		if !ok || spec.Command == "" {
+			continue
+		}
+		if p, ok := hooksConfig.Priority[hookKey(event, skill.Name)]; ok {
+			spec.Priority = p
+		}
+		steps = append(steps, hookStep{skill: skill, spec: spec, disabled: hookDisabled(event, skill.Name)})
 	}
-	s := string(data)
-	s = strings.ReplaceAll(s, "\r\n", "\n")
-	if strings.HasPrefix(s, "---") {
-		parts := strings.SplitN(s, "---", 3)
-		if len(parts) >= 3 {
-			return strings.TrimSpace(parts[2]), nil
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].spec.Priority != steps[j].spec.Priority {
+			return steps[i].spec.Priority > steps[j].spec.Priority
+		}
+		return steps[i].skill.Name < steps[j].skill.Name
+	})
+	return steps
+}
+
+// hookEvents lists the events any skill registers a hook for.
+func hookEvents(skills []Skill) []string {
+	seen := make(map[string]bool)
+	var events []string
+	for _, skill := range skills {
+		for event := range skill.Hooks {
+			if !seen[event] {
+				seen[event] = true
+				events = append(events, event)
+			}
 		}
 	}
-	return s, nil
+	sort.Strings(events)
+	return events
 }
 
-// restoreTerminal restores the terminal to canonical mode and echo.
-func restoreTerminal() {
-	cmd := exec.Command("stty", "icanon", "echo", "isig")
-	cmd.Stdin = os.Stdin
-	_ = cmd.Run()
+// hookTies lists, per event, the skills whose hooks share a priority with
+// another skill's, i.e. whose relative order nobody chose.
+func hookTies(skills []Skill) map[string][]string {
+	ties := make(map[string][]string)
+	for _, event := range hookEvents(skills) {
+		byPriority := make(map[int][]string)
+		for _, step := range hookPipeline(skills, event) {
+			if !step.disabled {
+				byPriority[step.spec.Priority] = append(byPriority[step.spec.Priority], step.skill.Name)
+			}
+		}
+		for _, names := range byPriority {
+			if len(names) > 1 {
+				ties[event] = append(ties[event], names...)
+			}
+		}
+	}
+	return ties
 }
 
-// readInteractiveInput reads input in raw mode to support arrow keys and multi-line editing.
-// It handles basic line wrapping and cursor movement.
-func readInteractiveInput(reader *bufio.Reader, history []string) (string, error) {
-	// Attempt to set raw mode
-	cmd := exec.Command("stty", "-icanon", "-echo", "-isig")
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		// Fallback for non-POSIX or error: use the provided reader
-		return reader.ReadString('\n')
+// warnHookTies points out events where several skills' hooks run in an
+// order decided only by their names.
+func warnHookTies(skills []Skill) {
+	ties := hookTies(skills)
+	for _, event := range hookEvents(skills) {
+		if names := ties[event]; len(names) > 0 {
+			fmt.Printf("\033[33m[Hooks] %s hooks of %s share a priority and run in name order. Use /hooks to review or reorder them.\033[0m\n", event, strings.Join(names, ", "))
+		}
 	}
-	defer restoreTerminal()
+}
 
-	var buf []rune
+// printHookPipelines shows the effective order of every event's hooks.
+func printHookPipelines(skills []Skill) {
+	events := hookEvents(skills)
+	if len(events) == 0 {
+		fmt.Println("No skill registers hooks.")
+		return
+	}
+	cwd, _ := os.Getwd()
+	for _, event := range events {
+		fmt.Printf("%s:\n", event)
+		for i, step := range hookPipeline(skills, event) {
+			line := fmt.Sprintf("  %d. %-20s %s", i+1, step.skill.Name, step.spec.Command)
+			var notes []string
+			notes = append(notes, fmt.Sprintf("priority %d", step.spec.Priority))
+			if len(step.spec.Filter) > 0 {
+				notes = append(notes, "filter "+strings.Join(step.spec.Filter, ", "))
+			}
+			if step.spec.Blocking {
+				notes = append(notes, "blocking")
+			}
+			if step.spec.Timeout > 0 {
+				notes = append(notes, "timeout "+step.spec.Timeout.String())
+			}
+			notes = append(notes, displayPath(cwd, step.skill.Path))
+			line += "  (" + strings.Join(notes, "; ") + ")"
+			if step.disabled {
+				line = "\033[90m" + line + "  [disabled]\033[0m"
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+// handleHooksCommand implements /hooks: show the pipelines, or change a
+// hook's priority or turn it on or off for the session.
+func handleHooksCommand(skills []Skill, arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		printHookPipelines(skills)
+		return
+	}
+	usage := "Usage: /hooks [enable|disable <event/skill>] [priority <event/skill> <n>]"
+	if len(fields) < 2 {
+		fmt.Println(usage)
+		return
+	}
+	key := fields[1]
+	event, skill, ok := strings.Cut(key, "/")
+	if !ok && fields[0] == "priority" {
+		fmt.Println("Give the hook as <event>/<skill>, e.g. post_edit/go-lint.")
+		return
+	}
+	known := false
+	for _, e := range hookEvents(skills) {
+		for _, step := range hookPipeline(skills, e) {
+			if (ok && e == event && step.skill.Name == skill) || (!ok && (e == key || step.skill.Name == key)) {
+				known = true
+			}
+		}
+	}
+	if !known {
+		fmt.Printf("No hook matches '%s'. /hooks lists them.\n", key)
+		return
+	}
+
+	switch fields[0] {
+	case "disable":
+		hooksConfig.Disabled = append(hooksConfig.Disabled, key)
+	case "enable":
+		var kept []string
+		for _, d := range hooksConfig.Disabled {
+			if d != key {
+				kept = append(kept, d)
+			}
+		}
+		hooksConfig.Disabled = kept
+		if ok && hookDisabled(event, skill) {
+			fmt.Printf("Note: '%s' is still disabled by an entry for the whole skill or event.\n", key)
+		}
+	case "priority":
+		if len(fields) != 3 {
+			fmt.Println(usage)
+			return
+		}
+		n, err := strconv.Atoi(fields[2])
+		if err != nil {
+			fmt.Println(usage)
+			return
+		}
+		if hooksConfig.Priority == nil {
+			hooksConfig.Priority = make(map[string]int)
+		}
+		hooksConfig.Priority[key] = n
+	default:
+		fmt.Println(usage)
+		return
+	}
+	printHookPipelines(skills)
+	fmt.Println("Changed for this session. To keep it, add it to \"hooks\" in the config.")
+}
+
+// runSkillHooks runs every enabled hook registered for event, in pipeline
+// order (see hookPipeline). Hooks whose filter does not match the {path}
+// context variable are skipped. If a blocking hook fails, the remaining hooks
+// are skipped and an error is returned alongside the output collected so far.
+func runSkillHooks(ctx context.Context, skills []Skill, event string, context map[string]string) (string, error) {
+	var output strings.Builder
+	for _, h := range hookPipeline(skills, event) {
+		if h.disabled || (len(h.spec.Filter) > 0 && !hookFilterMatches(h.spec.Filter, context["path"])) {
+			continue
+		}
+		skill, cmdTemplate := h.skill, h.spec.Command
+
+		// Special hook type: inject_skill_md
+		if cmdTemplate == "inject_skill_md" {
+			body, err := readSkillBody(skill.DefinitionFile)
+			if err != nil {
+				fmt.Printf("[Hook Error] Failed to read skill body for '%s': %v\n", skill.Name, err)
+				continue
+			}
+			output.WriteString(fmt.Sprintf("\n[Skill: %s Instructions]\n%s\n", skill.Name, body))
+			continue
+		}
+
+		// Hooks that haven't started when the turn is interrupted don't run
+		if ctx.Err() != nil {
+			fmt.Printf("[Hook: %s] Skipped for skill '%s': the turn was interrupted\n", event, skill.Name)
+			output.WriteString(fmt.Sprintf("Hook '%s' (skill: %s) did not run: the turn was interrupted\n", event, skill.Name))
+			if h.spec.Blocking {
+				return output.String(), fmt.Errorf("blocking hook '%s' (skill: %s) did not run: the turn was interrupted", event, skill.Name)
+			}
+			continue
+		}
+
+		if ok, _ := trustSkill(ctx, &skill); !ok {
+			fmt.Printf("[Hook: %s] Skipped for skill '%s': not allowed to run scripts\n", event, skill.Name)
+			output.WriteString(fmt.Sprintf("Hook '%s' (skill: %s) did not run: not allowed to run scripts\n", event, skill.Name))
+			continue
+		}
+		if isCoreSkill(&skill) {
+			ensureCoreSkills()
+		}
+
+		// Prepare command
+		cmdStr := cmdTemplate
+		// Replace {skill_path}
+		cmdStr = strings.ReplaceAll(cmdStr, "{skill_path}", skill.Path)
+		// Replace context variables
+		for k, v := range context {
+			cmdStr = strings.ReplaceAll(cmdStr, "{"+k+"}", v)
+		}
+
+		// Parse command string into script path and args
+		parts, err := parseArgs(cmdStr)
+		if err != nil {
+			fmt.Printf("[Hook Error] Failed to parse command '%s' for skill '%s': %v\n", cmdStr, skill.Name, err)
+			continue
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		scriptPath := parts[0]
+		args := parts[1:]
+
+		// Resolve relative paths to skill directory
+		if !filepath.IsAbs(scriptPath) {
+			scriptPath = filepath.Join(skill.Path, scriptPath)
+		}
+
+		fmt.Printf("[Hook: %s] Running for skill '%s': %s %v\n", event, skill.Name, scriptPath, args)
+
+		out, took, err := runHookScript(ctx, h.spec, fmt.Sprintf("%s/%s", event, skill.Name), scriptPath, args)
+		if err == nil {
+			fmt.Printf("[Hook: %s] Completed for skill '%s' in %s\n", event, skill.Name, took.Round(100*time.Millisecond))
+		}
+		if err != nil {
+			fmt.Printf("[Hook Error] %v\n", err)
+			output.WriteString(fmt.Sprintf("Hook '%s' (skill: %s) failed: %v\n", event, skill.Name, err))
+			if h.spec.Blocking {
+				return output.String(), fmt.Errorf("blocking hook '%s' (skill: %s) failed", event, skill.Name)
+			}
+		} else if out != "" {
+			output.WriteString(fmt.Sprintf("Hook '%s' (skill: %s) output:\n%s\n", event, skill.Name, out))
+		}
+	}
+	return output.String(), nil
+}
+
+// runHookScript runs a hook script with its own context: detached from the
+// turn's cancellation but bounded by the hook's timeout (and by ctx's
+// deadline, if it has one). It returns how long the hook ran.
+func runHookScript(ctx context.Context, spec HookSpec, label, scriptPath string, args []string) (string, time.Duration, error) {
+	timeout := spec.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = max(time.Until(deadline), 0)
+	}
+	hookCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		if hookCtx.Err() == nil {
+			fmt.Printf("[Hook: %s] Letting it finish (up to %s)...\n", label, timeout)
+		}
+	})
+	defer stop()
+
+	started := time.Now()
+	// runSafeScript enforces security and execution logic
+	out, err := runSafeScript(hookCtx, scriptPath, args, "")
+	if errors.Is(hookCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("hook %s timed out after %s and was stopped before it completed", label, timeout)
+	}
+	return out, time.Since(started), err
+}
+
+// hasHook reports whether any skill registers an enabled hook for event.
+func hasHook(skills []Skill, event string) bool {
+	for _, step := range hookPipeline(skills, event) {
+		if !step.disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHookPayload stores free-form hook context (user input, responses, error
+// text) in a temp file so scripts receive a path instead of an unquoted argument.
+// The returned cleanup function removes the file.
+func writeHookPayload(event, content string) (string, func()) {
+	f, err := os.CreateTemp("", "simple-agent-"+event+"-*.txt")
+	if err != nil {
+		return "", func() {}
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+// runErrorHooks runs on_error hooks for a failed tool call or API request.
+func runErrorHooks(ctx context.Context, skills []Skill, source, tool string, errMsg string) string {
+	if !hasHook(skills, "on_error") {
+		return ""
+	}
+	errorFile, cleanup := writeHookPayload("on_error", errMsg)
+	defer cleanup()
+	out, _ := runSkillHooks(ctx, skills, "on_error", map[string]string{"source": source, "tool": tool, "error_file": errorFile})
+	return out
+}
+
+var sessionEndOnce sync.Once
+
+// runSessionEndHooks runs session_end hooks exactly once, regardless of how the
+// session terminates. Hooks get a bounded timeout since the user is leaving.
+// Pending telemetry is exported afterwards.
+func runSessionEndHooks(skills []Skill) {
+	sessionEndOnce.Do(func() {
+		defer releaseSession()
+		defer shutdownTelemetry(10 * time.Second)
+		if !hasHook(skills, "session_end") {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		out, _ := runSkillHooks(ctx, skills, "session_end", map[string]string{"history": getHistoryPath()})
+		if out != "" {
+			fmt.Printf("[Session End Hook Output]\n%s\n", out)
+		}
+	})
+}
+
+// hookFilterMatches reports whether path matches any of the glob patterns,
+// either as a whole or by its base name (so "*.go" matches "pkg/main.go").
+func hookFilterMatches(patterns []string, path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func readSkillBody(path string) (string, error) {
+	if data, ok := embeddedSkillFile(path); ok {
+		return parseSkillBody(string(data)), nil
+	}
+	return skillBodies.get(path)
+}
+
+func parseSkillBody(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if strings.HasPrefix(s, "---") {
+		parts := strings.SplitN(s, "---", 3)
+		if len(parts) >= 3 {
+			return strings.TrimSpace(parts[2])
+		}
+	}
+	return s
+}
+
+// skillBodyCache is a read-through cache of SKILL.md bodies. A file is only
+// re-read when its size or mtime changes, and the body hash the model was
+// last told about is kept so changes made mid-session can be announced.
+type skillBodyCache struct {
+	mu      sync.Mutex
+	entries map[string]*skillBodyEntry
+}
+
+type skillBodyEntry struct {
+	modTime      time.Time
+	size         int64
+	body         string
+	hash         [sha256.Size]byte
+	notifiedHash [sha256.Size]byte
+}
+
+var skillBodies = &skillBodyCache{entries: make(map[string]*skillBodyEntry)}
+
+func (c *skillBodyCache) get(path string) (string, error) {
+	e, err := c.load(path)
+	if err != nil {
+		return "", err
+	}
+	return e.body, nil
+}
+
+// load returns the current entry for path, re-reading the file if it changed
+// on disk. The caller must not modify the entry.
+func (c *skillBodyCache) load(path string) (*skillBodyEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[path]
+	if e != nil && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	body := parseSkillBody(string(data))
+	updated := &skillBodyEntry{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		body:    body,
+		hash:    sha256.Sum256([]byte(body)),
+	}
+	// The first version read is the baseline the model knows about
+	updated.notifiedHash = updated.hash
+	if e != nil {
+		updated.notifiedHash = e.notifiedHash
+	}
+	c.entries[path] = updated
+	return updated, nil
+}
+
+// changedSkills returns the skills whose instructions changed since the model
+// was last told about them, and marks the changes as announced. Skills seen
+// for the first time become the baseline.
+func changedSkills(skills []Skill) []Skill {
+	var changed []Skill
+	for _, skill := range skills {
+		if isEmbeddedSkill(&skill) {
+			continue // Built into the binary, so they never change
+		}
+		e, err := skillBodies.load(skill.DefinitionFile)
+		if err != nil {
+			continue
+		}
+		skillBodies.mu.Lock()
+		if e.hash != e.notifiedHash {
+			e.notifiedHash = e.hash
+			changed = append(changed, skill)
+		}
+		skillBodies.mu.Unlock()
+	}
+	return changed
+}
+
+// restoreTerminal restores the terminal to canonical mode and echo.
+func restoreTerminal() {
+	cmd := exec.Command("stty", "icanon", "echo", "isig")
+	cmd.Stdin = os.Stdin
+	_ = cmd.Run()
+}
+
+// readInteractiveInput reads input in raw mode to support arrow keys and multi-line editing.
+// It handles basic line wrapping and cursor movement.
+func readInteractiveInput(reader *bufio.Reader, history []string) (string, error) {
+	// Attempt to set raw mode
+	cmd := exec.Command("stty", "-icanon", "-echo", "-isig")
+	cmd.Stdin = os.Stdin
+	if err := cmd.Run(); err != nil {
+		// Fallback for non-POSIX or error: use the provided reader
+		return reader.ReadString('\n')
+	}
+	defer restoreTerminal()
+
+	// Bracketed paste: the terminal wraps pasted text in markers so it can be
+	// inserted in one piece instead of being replayed as keystrokes.
+	fmt.Print(bracketedPasteOn)
+	defer fmt.Print(bracketedPasteOff)
+
+	var buf []rune
 	cursor := 0
 	currentVisualRow := 0 // Track cursor row relative to prompt start
 	historyIndex := len(history)
@@ -593,18 +1402,72 @@ func readInteractiveInput(reader *bufio.Reader, history []string) (string, error
 		currentVisualRow = targetRow
 
 		fmt.Print("\033[?25h") // Show cursor
+		tui.Draw()             // Clearing below the prompt also clears the TUI panel
+	}
+
+	// insertText inserts typed or pasted text at the cursor, normalizing line
+	// endings and dropping control characters.
+	insertText := func(text string) {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		text = strings.ReplaceAll(text, "\r", "\n")
+		var runes []rune
+		for _, r := range text {
+			if unicode.IsPrint(r) || r == '\n' || r == '\t' {
+				runes = append(runes, r)
+			}
+		}
+		buf = append(buf[:cursor], append(runes, buf[cursor:]...)...)
+		cursor += len(runes)
+		if historyIndex == len(history) {
+			currentInputDraft = buf
+		}
 	}
 
-	bufRead := make([]byte, 12)
+	bufRead := make([]byte, 4096)
+	var pending []byte
+	needMore := true
 
 	for {
-		n, err := os.Stdin.Read(bufRead)
-		if err != nil {
-			return "", err
+		if needMore || len(pending) == 0 {
+			n, err := os.Stdin.Read(bufRead)
+			if err != nil {
+				return "", err
+			}
+			pending = append(pending, bufRead[:n]...)
+			needMore = false
+		}
+
+		// A paste is inserted whole once its end marker has arrived
+		if bytes.HasPrefix(pending, []byte(pasteStartMarker)) {
+			end := bytes.Index(pending, []byte(pasteEndMarker))
+			if end == -1 {
+				needMore = true
+				continue
+			}
+			insertText(string(pending[len(pasteStartMarker):end]))
+			pending = pending[end+len(pasteEndMarker):]
+			redraw()
+			continue
+		}
+		if len(pending) >= 2 && len(pending) < len(pasteStartMarker) && strings.HasPrefix(pasteStartMarker, string(pending)) {
+			needMore = true
+			continue
 		}
 
-		// Parse input
-		s := string(bufRead[:n])
+		// Parse input up to the next paste, keeping split UTF-8 sequences
+		// for the next read
+		chunk := pending
+		if i := bytes.Index(chunk, []byte(pasteStartMarker)); i > 0 {
+			chunk = chunk[:i]
+		}
+		if cut := incompleteUTF8Suffix(chunk); cut > 0 && cut < len(chunk) {
+			chunk = chunk[:len(chunk)-cut]
+		} else if cut == len(chunk) {
+			needMore = true
+			continue
+		}
+		pending = pending[len(chunk):]
+		s := string(chunk)
 
 		if s == "\x03" { // Ctrl+C
 			if len(buf) > 0 {
@@ -800,22 +1663,80 @@ func readInteractiveInput(reader *bufio.Reader, history []string) (string, error
 				}
 			}
 		} else {
-			// Print chars
-			runes := []rune(s)
-			for _, r := range runes {
-				if unicode.IsPrint(r) {
-					buf = append(buf[:cursor], append([]rune{r}, buf[cursor:]...)...)
-					cursor++
-					if historyIndex == len(history) {
-						currentInputDraft = buf
-					}
-				}
-			}
+			// Typed characters, or a paste from a terminal without bracketed paste
+			insertText(s)
 		}
 		redraw()
 	}
 }
 
+const (
+	bracketedPasteOn  = "\033[?2004h"
+	bracketedPasteOff = "\033[?2004l"
+	pasteStartMarker  = "\x1b[200~"
+	pasteEndMarker    = "\x1b[201~"
+)
+
+// incompleteUTF8Suffix returns the length of a truncated UTF-8 sequence at
+// the end of b, which happens when a read splits a multi-byte character.
+func incompleteUTF8Suffix(b []byte) int {
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < 0x80 {
+			return 0
+		}
+		if utf8.RuneStart(c) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// defaultPasteTerminator ends a /paste block.
+const defaultPasteTerminator = "EOF"
+
+// readPastedBlock reads lines verbatim until the terminator line or EOF, for
+// terminals without bracketed paste. Canonical mode is turned off so long
+// lines aren't truncated by the terminal's line buffer.
+func readPastedBlock(reader *bufio.Reader, terminator string) (string, error) {
+	if terminator == "" {
+		terminator = defaultPasteTerminator
+	}
+	fmt.Printf("Paste your text, then type %s on its own line (or press Ctrl+D):\n", terminator)
+	cmd := exec.Command("stty", "-icanon")
+	cmd.Stdin = os.Stdin
+	if cmd.Run() == nil {
+		defer restoreTerminal()
+	}
+
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == terminator {
+			break
+		}
+		// Ctrl+D arrives as a literal byte when canonical mode is off
+		if i := strings.IndexByte(trimmed, 0x04); i != -1 {
+			lines = append(lines, trimmed[:i])
+			break
+		}
+		if line != "" {
+			lines = append(lines, trimmed)
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n"), nil
+}
+
 func getTermWidth() int {
 	cmd := exec.Command("tput", "cols")
 	cmd.Stdin = os.Stdin
@@ -849,125 +1770,554 @@ func getCursorVisualPos(buf []rune, pos int, width int, promptLen int) (int, int
 	return y, x
 }
 
-// --- Main ---
+// --- Skill Tests ---
 
-func main() {
-	versionFlag := flag.Bool("version", false, "Print version and exit")
-	noUpdate := flag.Bool("no-update", false, "Skip auto-update check at startup")
-	noAutoAccept := flag.Bool("no-auto-accept", false, "Disable automatic acceptance of diffs (require user confirmation)")
-	continueSession := flag.Bool("continue", false, "Continue from previous session history")
-	gitAutoCommit := flag.Bool("git-auto-commit", false, "Automatically propose commits for file changes after every turn")
-	gitForceCommit := flag.Bool("git-force-commit", false, "Automatically commit changes without confirmation (implies -git-auto-commit)")
-	modelFlag := flag.String("model", "gemini", "Select model: gemini (default) or openai")
-	flag.Parse()
+// SkillFixture is a skill integration test, read from <fixture>/fixture.json.
+// The fixture's workspace/ directory is copied to a temp dir, the steps run
+// against it, and the resulting files are compared with the expected/
+// snapshot.
+type SkillFixture struct {
+	Skill string             `json:"skill,omitempty"` // Skill directory or name; defaults to the enclosing skill
+	Steps []SkillFixtureStep `json:"steps"`
+}
 
-	// Print version on startup
-	fmt.Printf("Simple Agent %s\n", Version)
+type SkillFixtureStep struct {
+	Run            string            `json:"run,omitempty"` // Script path relative to the skill directory
+	Args           []string          `json:"args,omitempty"`
+	Hook           string            `json:"hook,omitempty"`    // Hook event to fire instead of a script
+	Context        map[string]string `json:"context,omitempty"` // Hook context variables, e.g. {"path": "main.go"}
+	ExpectFailure  bool              `json:"expect_failure,omitempty"`
+	OutputContains []string          `json:"output_contains,omitempty"`
+}
 
-	// Default behavior is to auto-accept unless explicitly disabled
-	shouldAutoApprove := !*noAutoAccept
-	autoApprove := &shouldAutoApprove
+const skillTestTimeout = 5 * time.Minute
+
+// runSkillTestCommand implements "simple-agent skill-test" and returns the
+// process exit code.
+func runSkillTestCommand(args []string) int {
+	flags := flag.NewFlagSet("skill-test", flag.ExitOnError)
+	fixtureFlag := flags.String("fixture", "", "Fixture directory (more can be given as arguments)")
+	skillFlag := flags.String("skill", "", "Skill directory or name to test (default: from fixture.json or the enclosing skill)")
+	updateFlag := flags.Bool("update", false, "Rewrite the expected/ snapshots from the results")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: simple-agent skill-test --fixture <dir> [--skill <dir|name>] [--update] [fixture...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
 
-	if *versionFlag {
-		os.Exit(0)
+	fixtures := flags.Args()
+	if *fixtureFlag != "" {
+		fixtures = append([]string{*fixtureFlag}, fixtures...)
+	}
+	if len(fixtures) == 0 {
+		flags.Usage()
+		return 2
 	}
 
-	if !*noUpdate && !*versionFlag {
-		autoUpdate()
+	failed := 0
+	for _, dir := range fixtures {
+		problems, err := runSkillFixture(dir, *skillFlag, *updateFlag)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if len(problems) == 0 {
+			fmt.Printf("\033[32mPASS\033[0m %s\n", dir)
+			continue
+		}
+		failed++
+		fmt.Printf("\033[31mFAIL\033[0m %s\n", dir)
+		for _, p := range problems {
+			fmt.Printf("  - %s\n", strings.ReplaceAll(strings.TrimSpace(p), "\n", "\n    "))
+		}
 	}
+	fmt.Printf("\n%d passed, %d failed\n", len(fixtures)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
 
-	var apiKey string
+// runSkillFixture runs one fixture and returns the failed expectations.
+func runSkillFixture(dir, skillRef string, update bool) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "fixture.json"))
+	if err != nil {
+		return nil, err
+	}
+	var fixture SkillFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("invalid fixture.json: %v", err)
+	}
+	if skillRef == "" {
+		skillRef = fixture.Skill
+	}
+	skillDir, err := resolveFixtureSkill(dir, skillRef)
+	if err != nil {
+		return nil, err
+	}
 
-	switch *modelFlag {
-	case "openai":
-		GeminiURL = OpenAIURL
-		ModelName = OpenAIModelName
-		FlashModelName = OpenAIModelName
-		apiKey = os.Getenv("OPENAI_API_KEY")
-		if apiKey == "" {
-			fmt.Println("Please set OPENAI_API_KEY environment variable.")
-			os.Exit(1)
+	workspace, err := os.MkdirTemp("", "simple-agent-skill-test-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workspace)
+	if _, err := os.Stat(filepath.Join(dir, "workspace")); err == nil {
+		if err := copyDir(filepath.Join(dir, "workspace"), workspace); err != nil {
+			return nil, fmt.Errorf("failed to copy workspace: %v", err)
 		}
-	case "gemini":
-		// Globals are already set to Gemini defaults
-		apiKey = os.Getenv("GEMINI_API_KEY")
-		if apiKey == "" {
-			fmt.Println("Please set GEMINI_API_KEY environment variable.")
-			os.Exit(1)
+	}
+
+	// The skill is installed as a local skill so scripts and hooks pass the
+	// same path checks as in a real session
+	installed := filepath.Join(workspace, "skills", filepath.Base(skillDir))
+	if err := copyDir(skillDir, installed); err != nil {
+		return nil, fmt.Errorf("failed to install skill: %v", err)
+	}
+	skill, err := parseSkill(filepath.Join(installed, "SKILL.md"))
+	if err != nil {
+		return nil, err
+	}
+	// Running the fixture is the decision to run the skill: don't ask
+	getScriptApprovals().AllowSkillForSession(skill.Name)
+
+	ctx, cancel := context.WithTimeout(withWorkDir(context.Background(), workspace), skillTestTimeout)
+	defer cancel()
+
+	var problems []string
+	for i, step := range fixture.Steps {
+		label := fmt.Sprintf("step %d", i+1)
+		var out string
+		var stepErr error
+		switch {
+		case step.Run != "":
+			label += " (" + step.Run + ")"
+			args := make([]string, len(step.Args))
+			for j, arg := range step.Args {
+				args[j] = strings.ReplaceAll(arg, "{workspace}", workspace)
+			}
+			out, stepErr = runSafeScript(ctx, filepath.Join(skill.Path, step.Run), args, "")
+		case step.Hook != "":
+			label += " (hook " + step.Hook + ")"
+			out, stepErr = runSkillHooks(ctx, []Skill{skill}, step.Hook, step.Context)
+			prefix := fmt.Sprintf("Hook '%s' (skill: %s) ", step.Hook, skill.Name)
+			if stepErr == nil && strings.Contains(out, prefix+"failed") {
+				stepErr = errors.New("hook failed")
+			} else if stepErr == nil && strings.Contains(out, prefix+"did not run") {
+				stepErr = errors.New("hook did not run")
+			}
+		default:
+			return problems, fmt.Errorf("%s has neither 'run' nor 'hook'", label)
+		}
+
+		if step.ExpectFailure && stepErr == nil {
+			problems = append(problems, label+": expected failure, but it succeeded")
+		} else if !step.ExpectFailure && stepErr != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", label, stepErr))
+		}
+		for _, want := range step.OutputContains {
+			if !strings.Contains(out, want) && (stepErr == nil || !strings.Contains(stepErr.Error(), want)) {
+				problems = append(problems, fmt.Sprintf("%s: output does not contain %q", label, want))
+			}
 		}
-	default:
-		fmt.Printf("Unknown model: %s. usage: -model gemini|openai\n", *modelFlag)
-		os.Exit(1)
 	}
 
-	// Setup Core Skills (Extract embedded)
+	// Only the files the skill produced belong in the snapshot
+	os.RemoveAll(installed)
+	os.Remove(filepath.Dir(installed))
+
+	expectedDir := filepath.Join(dir, "expected")
+	if update {
+		if err := os.RemoveAll(expectedDir); err != nil {
+			return problems, err
+		}
+		if err := copyDir(workspace, expectedDir); err != nil {
+			return problems, fmt.Errorf("failed to update snapshot: %v", err)
+		}
+		fmt.Printf("Updated %s\n", expectedDir)
+		return problems, nil
+	}
+	if _, err := os.Stat(expectedDir); err != nil {
+		return problems, fmt.Errorf("no expected/ snapshot; run with --update to create one")
+	}
+	diffs, err := compareTrees(expectedDir, workspace)
+	if err != nil {
+		return problems, err
+	}
+	return append(problems, diffs...), nil
+}
+
+// resolveFixtureSkill finds the skill under test: an explicit directory, a
+// skill name from ./skills or the core skills, or else the skill the fixture
+// directory is nested in.
+func resolveFixtureSkill(fixtureDir, ref string) (string, error) {
+	if ref != "" {
+		for _, candidate := range []string{filepath.Join(fixtureDir, ref), ref} {
+			if _, err := os.Stat(filepath.Join(candidate, "SKILL.md")); err == nil {
+				return filepath.Abs(candidate)
+			}
+		}
+		skills := discoverSkills("./skills")
+		if err := setupCoreSkills(); err == nil {
+			skills = append(skills, discoverCoreSkills()...)
+		}
+		for _, s := range skills {
+			if s.Name == ref {
+				if isCoreSkill(&s) {
+					ensureCoreSkills()
+				}
+				return s.Path, nil
+			}
+		}
+		return "", fmt.Errorf("skill not found: %s", ref)
+	}
+
+	dir, err := filepath.Abs(fixtureDir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "SKILL.md")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no skill given and %s is not inside a skill directory", fixtureDir)
+		}
+		dir = parent
+	}
+}
+
+// compareTrees lists the differences between the expected snapshot and the
+// actual workspace.
+func compareTrees(expectedDir, actualDir string) ([]string, error) {
+	expected, err := readTree(expectedDir)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := readTree(actualDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	for _, rel := range sortedKeys(expected) {
+		got, ok := actual[rel]
+		switch {
+		case !ok:
+			diffs = append(diffs, "missing: "+rel)
+		case got != expected[rel]:
+			diffs = append(diffs, fmt.Sprintf("modified: %s (first difference at line %d)", rel, firstDiffLine(expected[rel], got)))
+		}
+	}
+	for _, rel := range sortedKeys(actual) {
+		if _, ok := expected[rel]; !ok {
+			diffs = append(diffs, "unexpected: "+rel)
+		}
+	}
+	return diffs, nil
+}
+
+func readTree(root string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	return files, err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func firstDiffLine(a, b string) int {
+	linesA, linesB := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i := 0; i < len(linesA) && i < len(linesB); i++ {
+		if linesA[i] != linesB[i] {
+			return i + 1
+		}
+	}
+	if len(linesA) < len(linesB) {
+		return len(linesA) + 1
+	}
+	return len(linesB) + 1
+}
+
+// copyDir copies a directory tree, keeping file modes.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
+// --- Capabilities ---
+
+// Capabilities describes an installation for wrapper tooling and support
+// scripts: "simple-agent capabilities --json". Credentials are only reported
+// as present or not.
+type Capabilities struct {
+	Version     string            `json:"version"`
+	Provider    string            `json:"provider"`
+	Model       string            `json:"model"`
+	FlashModel  string            `json:"flash_model"`
+	Endpoint    string            `json:"endpoint"`
+	Credentials map[string]bool   `json:"credentials"`
+	Models      []ModelCapability `json:"models"`
+	Aliases     map[string]string `json:"aliases"`
+	Tools       []ToolCapability  `json:"tools"`
+	Skills      []SkillCapability `json:"skills"`
+	Policies    PolicyCapability  `json:"policies"`
+	Sandbox     SandboxCapability `json:"sandbox"`
+}
+
+type ModelCapability struct {
+	Name string `json:"name"`
+	ModelInfo
+}
+
+type ToolCapability struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+type SkillCapability struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version,omitempty"`
+	Description string   `json:"description"`
+	Source      string   `json:"source"` // org, core or project
+	Path        string   `json:"path"`
+	Hooks       []string `json:"hooks,omitempty"`
+	Scripts     []string `json:"scripts,omitempty"`
+}
+
+type PolicyCapability struct {
+	AutoAccept       bool             `json:"auto_accept"` // Default for diffs; -no-auto-accept turns it off
+	ApprovedScripts  int              `json:"approved_scripts"`
+	ApprovedSkills   int              `json:"approved_skills"`
+	Thinking         string           `json:"thinking,omitempty"`
+	ToolProtocol     string           `json:"tool_protocol,omitempty"`
+	CommitConvention CommitConvention `json:"commit_convention"`
+	Retry            RetryPolicy      `json:"retry"`
+	Webhooks         int              `json:"webhooks"`
+	Commands         CommandPolicy    `json:"commands"`
+}
+
+// SandboxCapability reports how the agent is confined. There is no OS-level
+// sandbox: file tools are limited to the workspace (and read-only core
+// skills), but run_command and run_script have shell access.
+type SandboxCapability struct {
+	Enabled         bool   `json:"enabled"`
+	Workspace       string `json:"workspace"`
+	PathConfinement bool   `json:"path_confinement"`
+	ShellAccess     bool   `json:"shell_access"`
+	CoreSkillsDir   string `json:"core_skills_dir"`
+}
+
+// runCapabilitiesCommand implements "simple-agent capabilities" and returns
+// the process exit code.
+func runCapabilitiesCommand(args []string) int {
+	flags := flag.NewFlagSet("capabilities", flag.ExitOnError)
+	jsonFlag := flags.Bool("json", false, "Print JSON")
+	modelFlag := flags.String("model", "gemini", "Provider or model to report on, as for -model")
+	disableToolsFlag := flags.String("disable-tools", "", "Comma-separated built-in tools to disable, as for -disable-tools")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: simple-agent capabilities [--json] [--model <provider|model>] [--disable-tools <tools>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg := loadConfig()
+	if err := applyConfig(cfg, *disableToolsFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	provider, err := useModel(*modelFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 	if err := setupCoreSkills(); err != nil {
-		fmt.Printf("Warning: Failed to extract core skills: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Warning: Failed to extract core skills: %v\n", err)
 	}
 
-	// Discover skills
-	// 1. Core Skills
-	coreSkills := discoverSkills(CoreSkillsDir)
-	// 2. Project Skills (Current Directory)
-	projectSkills := discoverSkills("./skills")
+	caps := collectCapabilities(provider, cfg)
+	if *jsonFlag {
+		data, _ := json.MarshalIndent(caps, "", "  ")
+		fmt.Println(string(data))
+		return 0
+	}
+	printCapabilities(caps)
+	return 0
+}
 
-	// Merge skills (Project overrides Core)
-	skillMap := make(map[string]Skill)
-	for _, s := range coreSkills {
-		skillMap[s.Name] = s
+// collectCapabilities describes the active configuration; useModel and
+// applyConfig must have run.
+func collectCapabilities(provider string, cfg Config) Capabilities {
+	caps := Capabilities{
+		Version:    Version,
+		Provider:   provider,
+		Model:      ModelName,
+		FlashModel: FlashModelName,
+		Endpoint:   GeminiURL,
+		Credentials: map[string]bool{
+			"GEMINI_API_KEY":  os.Getenv("GEMINI_API_KEY") != "",
+			"OPENAI_API_KEY":  os.Getenv("OPENAI_API_KEY") != "",
+			"OPENAI_BASE_URL": os.Getenv("OPENAI_BASE_URL") != "",
+			"github_token":    prConfig.GitHubToken != "" || os.Getenv("GITHUB_TOKEN") != "" || os.Getenv("GH_TOKEN") != "",
+			"gitlab_token":    prConfig.GitLabToken != "" || os.Getenv("GITLAB_TOKEN") != "",
+		},
+		Aliases: modelAliases,
 	}
-	for _, s := range projectSkills {
-		skillMap[s.Name] = s
+
+	for name, info := range knownModels {
+		caps.Models = append(caps.Models, ModelCapability{Name: name, ModelInfo: info})
 	}
+	sort.Slice(caps.Models, func(i, j int) bool { return caps.Models[i].Name < caps.Models[j].Name })
 
-	// Convert back to slice
-	var skills []Skill
-	for _, s := range skillMap {
-		skills = append(skills, s)
+	for _, tool := range allTools() {
+		caps.Tools = append(caps.Tools, ToolCapability{Name: tool.Function.Name, Enabled: !disabledTools[tool.Function.Name]})
 	}
 
-	skillsPrompt := generateSkillsPrompt(skills)
+	for _, s := range mergeSkills(discoverCoreSkills(), discoverSkills("./skills")) {
+		sc := SkillCapability{Name: s.Name, Version: s.Version, Description: s.Description, Source: "project", Path: s.Path, Scripts: s.Scripts}
+		if isOrgSkill(&s) {
+			sc.Source = "org"
+		} else if rel, err := filepath.Rel(CoreSkillsDir, s.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			sc.Source = "core"
+		}
+		for event := range s.Hooks {
+			sc.Hooks = append(sc.Hooks, event)
+		}
+		sort.Strings(sc.Hooks)
+		caps.Skills = append(caps.Skills, sc)
+	}
 
-	// Track known skills to detect additions
-	knownSkills := make(map[string]bool)
-	for _, s := range skills {
-		knownSkills[s.Name] = true
+	approvals := loadScriptApprovals()
+	caps.Policies = PolicyCapability{
+		AutoAccept:       true,
+		ApprovedScripts:  len(approvals.Scripts),
+		ApprovedSkills:   len(approvals.Skills),
+		Thinking:         thinkingLevel,
+		ToolProtocol:     toolProtocol,
+		CommitConvention: commitConvention,
+		Retry:            retryPolicy,
+		Webhooks:         len(cfg.Webhooks),
+		Commands:         commandPolicy,
 	}
 
-	// Setup signal handling for interruption
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	cwd, _ := os.Getwd()
+	caps.Sandbox = SandboxCapability{
+		Workspace:       cwd,
+		PathConfinement: true,
+		ShellAccess:     !disabledTools["run_command"] || !disabledTools["run_script"],
+		CoreSkillsDir:   CoreSkillsDir,
+	}
+	return caps
+}
 
-	var currentCancel context.CancelFunc
-	var mu sync.Mutex
+func printCapabilities(caps Capabilities) {
+	fmt.Printf("Simple Agent %s\n", caps.Version)
+	fmt.Printf("Provider: %s (%s)\n", caps.Provider, caps.Endpoint)
+	fmt.Printf("Model:    %s (flash: %s)\n", caps.Model, caps.FlashModel)
 
-	var lastSignalTime time.Time
+	var creds []string
+	for name, ok := range caps.Credentials {
+		if ok {
+			creds = append(creds, name)
+		}
+	}
+	sort.Strings(creds)
+	if len(creds) == 0 {
+		creds = []string{"none"}
+	}
+	fmt.Printf("Credentials: %s\n", strings.Join(creds, ", "))
 
-	go func() {
-		for range sigChan {
-			mu.Lock()
-			if currentCancel != nil {
-				fmt.Println("\n[Interrupted by user]")
-				currentCancel()
-				currentCancel = nil
-			} else {
-				if time.Since(lastSignalTime) < 1*time.Second {
-					restoreTerminal()
-					fmt.Println("\nExiting...")
-					os.Exit(0)
-				}
-				lastSignalTime = time.Now()
-				fmt.Println("\n(Press Ctrl+C again to exit)")
-			}
-			mu.Unlock()
+	var enabled, disabled []string
+	for _, tool := range caps.Tools {
+		if tool.Enabled {
+			enabled = append(enabled, tool.Name)
+		} else {
+			disabled = append(disabled, tool.Name)
 		}
-	}()
+	}
+	fmt.Printf("\nTools: %s\n", strings.Join(enabled, ", "))
+	if len(disabled) > 0 {
+		fmt.Printf("Disabled: %s\n", strings.Join(disabled, ", "))
+	}
 
-	// Run startup hooks (using background context as this is init)
-	startupOutput := runSkillHooks(context.Background(), skills, "startup", nil)
+	fmt.Printf("\nSkills (%d):\n", len(caps.Skills))
+	for _, s := range caps.Skills {
+		line := fmt.Sprintf("  %s [%s]", s.Name, s.Source)
+		if len(s.Hooks) > 0 {
+			line += " hooks: " + strings.Join(s.Hooks, ", ")
+		}
+		fmt.Println(line)
+	}
+
+	p := caps.Policies
+	fmt.Println("\nPolicies:")
+	fmt.Printf("  Auto-accept diffs: %v\n", p.AutoAccept)
+	fmt.Printf("  Approved scripts/skills: %d/%d\n", p.ApprovedScripts, p.ApprovedSkills)
+	if p.Thinking != "" {
+		fmt.Printf("  Thinking: %s\n", p.Thinking)
+	}
+	if p.ToolProtocol != "" {
+		fmt.Printf("  Tool protocol: %s\n", p.ToolProtocol)
+	}
+	if p.CommitConvention.Style != "" || p.CommitConvention.Template != "" {
+		fmt.Printf("  Commit convention: %s\n", p.CommitConvention.template())
+	}
+	fmt.Printf("  Webhooks: %d\n", p.Webhooks)
+
+	sb := caps.Sandbox
+	fmt.Println("\nSandbox:")
+	fmt.Printf("  OS sandbox: %v\n", sb.Enabled)
+	fmt.Printf("  File tools confined to: %s (and core skills, read-only)\n", sb.Workspace)
+	fmt.Printf("  Shell access (run_command, run_script): %v\n", sb.ShellAccess)
+}
 
-	baseSystemPrompt := `You have access to tools to edit files and execute scripts (providing full shell access).
-When using 'apply_udiff', provide a unified diff.
+// --- Tool Selection ---
+
+// Built-in tools can be disabled for specialized deployments (e.g. a
+// review-only bot that must not edit files) with -disable-tools, the
+// SIMPLE_AGENT_DISABLE_TOOLS environment variable, or "disabled_tools" in the
+// config. Disabled tools are neither sent to the model nor described in the
+// system prompt, and calls to them are rejected.
+
+var disabledTools = map[string]bool{}
+
+// toolPromptBlocks are the tool instructions of the system prompt, in order.
+// A block is left out when its tool is disabled.
+var toolPromptBlocks = []struct{ Tool, Text string }{
+	{"apply_udiff", `When using 'apply_udiff', provide a unified diff.
 - Start hunks with '@@ ... @@'
 - Use ' ' for context, '-' for removal, '+' for addition.
 - **ALWAYS** include at least 2 lines of context around your changes.
@@ -978,1482 +2328,18568 @@ When using 'apply_udiff', provide a unified diff.
   3.  **Prefix with Space**: Add a single space ' ' to the beginning of these context lines.
   4.  **Combine**: Surround your '-' (removal) and '+' (addition) lines with these ' ' (context) lines.
 - **COMMON ISSUE**: The most frequent cause of failure is insufficient or mismatched context. Provide ample, unique context lines (more than 2 if needed) to ensure the patch applies correctly.
-- Do not include line numbers in the hunk header.
+- Line numbers in the hunk header are optional. When editing a large file you read in ranges, include the original line number ('@@ -120,8 +120,9 @@'); it is used to pick the right location when the context lines appear more than once.
 - Ensure enough context is provided to uniquely locate the code.
 - Replace entire blocks/functions rather than small internal edits to ensure uniqueness.
 - If a file does not exist, treat it as empty for the 'before' state.
-- **CLI PREFERENCE**: You are encouraged to use the CLI for efficiency and exploration.
+- To move or delete a file, use git's headers instead of rewriting it: 'rename from <old>' and 'rename to <new>' lines (hunks after them edit the moved file), or a 'deleted file mode 100644' line to delete 'path'. The user confirms each rename and deletion.`},
+	{"edit_many", `- **BATCH EDITS**: For a mechanical change across many files (renaming a function, type or import path), use 'edit_many' with a regex and a glob instead of one 'apply_udiff' per file. Anchor the pattern (e.g. '\bOldName\b') so it doesn't touch unrelated code, and use 'dry_run' first when unsure what it matches.`},
+	{"run_command", `- **CLI PREFERENCE**: You are encouraged to use the CLI ('run_command') for efficiency and exploration.
 - Use 'ls -R', 'grep', or 'find' to explore the file structure and search for patterns.
 - **GATHER CONTEXT**: When using 'grep' to find code to edit, ALWAYS use context flags (e.g., 'grep -C 5'). You need ample unique context lines to ensure 'apply_udiff' can locate the target code unambiguously.
 - Use 'cat', 'head', or 'tail' to quickly inspect file contents.
-- Run standard tools (git, go, npm, etc.) directly when needed.
-- Prefer shell commands for operations that are concise and standard.
-- **CONTEXT MANAGEMENT**: Use 'shorten_context' to keep the session focused and save tokens.
+- Run standard tools (go, npm, etc.) directly when needed.`},
+	{"run_tests", `- **TESTS**: Run tests with 'run_tests' rather than 'run_command': it knows the project's test command and returns the counts and failing tests instead of the whole log. Narrow it with 'path' and 'test' while fixing a failure, then run all tests before you finish.`},
+	{"build_project", `- **BUILD**: After changing code, check it with 'build_project'. It runs the project's build or type-check command and returns each compiler error with file, line and message; fix them and build again until it succeeds.`},
+	{"manage_todos", `- **TODOS**: For a task with three or more steps, write a todo list with 'manage_todos' before you start. Keep exactly one item in_progress, mark items done as soon as they are finished (not in batches), and add items you discover along the way. The list survives context shortening, so rely on it to keep track of long tasks.`},
+	{"git_status", `- **GIT**: Use the 'git_*' tools (git_status, git_diff, git_log, git_branch, git_stash, git_commit, git_checkout, git_reset) instead of running git through the shell. They return structured JSON and changes to the repository go through the user's approval policy. Use 'create_pr' to open a pull request when asked; commit your changes first.`},
+	{"run_command", `- Prefer shell commands for operations that are concise and standard. Use 'run_script' only for the scripts that skills provide.`},
+	{"shorten_context", `- **CONTEXT MANAGEMENT**: Use 'shorten_context' to keep the session focused and save tokens.
 - **When to Reset**: 
     - ONLY after completing a distinct task or sub-task.
     - Before starting a new, unrelated activity.
     - **AVOID** resetting if the user is building context (e.g., exploring files, reading docs) for an upcoming task. Wait for a definitive stopping point.
-- **Goal**: Maintain a clean, concise state with only vital information for the next steps.
-- **PROJECT MEMORY**:
-    - **remember.txt**: This file is your long-term memory. It contains architectural decisions, current status, and lessons learned.
-    - **Read First**: Always read 'remember.txt' when starting a task to ground yourself in the project context.
-    - **Update Always**: Actively maintain this file. If you make a decision or learn something, add it to 'remember.txt' immediately.
-    - **Use the Skill**: Use the 'remember' skill tools (or standard file tools) to curate this file.
-`
-	datePrompt := fmt.Sprintf("\n# Current Context\nToday's date is %s.\nNOTE: This date is injected by the system and is correct. It may seem like the future compared to your training data. Trust this date.\n", time.Now().Format("Monday, January 2, 2006"))
-	systemPrompt := baseSystemPrompt + datePrompt + getSkillsExplanation() + skillsPrompt
+- **Goal**: Maintain a clean, concise state with only vital information for the next steps.`},
+	{"read_file", `- **NAVIGATE LARGE FILES**: Use 'read_file' to read files. For files too large to read at once it returns an outline with line ranges; then read only the ranges you need with 'start_line'/'end_line'. 'code_outline' lists a source file's symbols directly. The line-number prefix of 'read_file' output is not part of the file; never copy it into diffs.`},
+	{"semantic_search", `- **SEMANTIC SEARCH**: Use 'semantic_search' to find code by concept when you don't know the exact identifiers. Use 'grep' when you do.`},
+	{"spawn_agent", `- **DELEGATION**: Use 'spawn_agent' to hand off large, self-contained sub-tasks to a sub-agent with its own context. Give it a complete task description; you only receive its final report.`},
+	{"orchestrate_agents", `- **PARALLEL EXPLORATION**: Use 'orchestrate_agents' to try several approaches concurrently in isolated git worktrees, then compare the resulting diffs and apply the best patch.`},
+	{"remember", `- **PROJECT MEMORY**:
+    - **Long-Term Memory**: Facts saved in earlier sessions are listed under '# Project Memory' and persist across sessions.
+    - **Recall First**: Use 'recall' to search for relevant decisions, conventions, and gotchas when starting a complex task.
+    - **Remember Always**: When you make a decision, discover a convention, or fix a tricky bug, save it immediately with 'remember'. One self-contained fact per entry.`},
+}
 
-	messages := []Message{
-		{
-			Role:    "system",
-			Content: systemPrompt,
-		},
-	}
+// allTools returns every built-in tool offered to the main agent.
+func allTools() []Tool {
+	return append([]Tool{udiffTool, editManyTool, runCommandTool, runScriptTool, shortenContextTool, rememberTool, recallTool, semanticSearchTool, codeOutlineTool, readFileTool, runTestsTool, buildProjectTool, manageTodosTool, createPRTool, spawnAgentTool, orchestrateAgentsTool}, gitTools...)
+}
 
-	if startupOutput != "" {
-		messages = append(messages, Message{Role: "system", Content: "Startup Instructions:\n" + startupOutput})
+// disableTools validates and records tool names from comma-separated lists.
+func disableTools(lists ...string) error {
+	known := make(map[string]bool)
+	for _, tool := range allTools() {
+		known[tool.Function.Name] = true
 	}
-
-	// Load history
-	if *continueSession {
-		savedMessages := loadHistory()
-		if len(savedMessages) > 0 {
-			for _, m := range savedMessages {
-				if m.Role != "system" {
-					messages = append(messages, m)
-				}
+	for _, list := range lists {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
 			}
-			fmt.Printf("Loaded %d messages from history.\n", len(messages)-1)
+			if !known[name] {
+				return fmt.Errorf("unknown tool '%s'", name)
+			}
+			disabledTools[name] = true
 		}
 	}
+	return nil
+}
 
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Welcome to Simple Agent %s (Model: %s)\n", Version, ModelName)
-	if len(skills) > 0 {
-		fmt.Printf("Loaded %d skills from ./skills\n", len(skills))
+// enabledTools filters out the disabled tools.
+func enabledTools(tools []Tool) []Tool {
+	var enabled []Tool
+	for _, tool := range tools {
+		if !disabledTools[tool.Function.Name] {
+			enabled = append(enabled, tool)
+		}
 	}
-	fmt.Println("Type your message. Press Ctrl+D (or Ctrl+Z on Windows) on a new line to send. Type /help for commands (e.g. /clear). Ctrl+C to interrupt/exit.")
+	return enabled
+}
 
-	client := &http.Client{}
+// buildToolPrompt assembles the tool instructions for the enabled tools.
+func buildToolPrompt() string {
+	var capabilities []string
+	if !disabledTools["apply_udiff"] {
+		capabilities = append(capabilities, "edit files")
+	}
+	if !disabledTools["run_command"] {
+		capabilities = append(capabilities, "run shell commands")
+	}
+	if !disabledTools["run_script"] {
+		capabilities = append(capabilities, "execute skill scripts")
+	}
+	var sb strings.Builder
+	if len(capabilities) > 0 {
+		last := len(capabilities) - 1
+		if last > 0 {
+			capabilities[last-1] += " and " + capabilities[last]
+			capabilities = capabilities[:last]
+		}
+		sb.WriteString("You have access to tools to " + strings.Join(capabilities, ", ") + ".\n")
+	} else {
+		sb.WriteString("You cannot edit files or run commands in this deployment. Use the tools you have been given.\n")
+	}
+	for _, block := range toolPromptBlocks {
+		if !disabledTools[block.Tool] {
+			sb.WriteString(block.Text + "\n")
+		}
+	}
+	sb.WriteString(toolErrorPrompt + "\n")
+	return sb.String()
+}
 
-	var pendingInput string
-	var commandHistory []string
+// --- Configuration ---
 
-	for {
-		var input string
-		if pendingInput != "" {
-			fmt.Printf("> %s\n", pendingInput)
-			input = pendingInput
-			pendingInput = ""
-		} else {
-			fmt.Print("\033[1;32mUser 👤\033[0m > ")
-			var err error
-			input, err = readInteractiveInput(reader, commandHistory)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				if err.Error() == "interrupted" {
-					restoreTerminal()
-					fmt.Println("Exiting...")
-					os.Exit(0)
-				}
-				fmt.Printf("Error reading input: %v\n", err)
-				os.Exit(1)
-			}
-			if strings.TrimSpace(input) == "" {
-				continue
-			}
-			commandHistory = append(commandHistory, input)
-
-			if handleSlashCommand(input, &messages, skills, systemPrompt, apiKey) {
-				continue
-			}
-		}
+// Config holds persistent preferences. It is loaded from ~/.simple_agent/config.json
+// and then overlaid with ./.simple_agent.json from the project; command-line flags
+// take precedence over both.
+type Config struct {
+	Language  string `json:"language,omitempty"`  // Reply language, e.g. "German"
+	Verbosity string `json:"verbosity,omitempty"` // terse, normal or explanatory
+	Thinking  string `json:"thinking,omitempty"`  // off, low, medium or high
 
-		// Capture the start index of the current turn's messages
-		startHistoryIndex := len(messages)
+	ToolProtocol  string   `json:"tool_protocol,omitempty"`  // native or text, for all models
+	DisabledTools []string `json:"disabled_tools,omitempty"` // Built-in tools to remove, e.g. apply_udiff
 
-		messages = append(messages, Message{
-			Role:    "user",
-			Content: input,
-		})
+	StripPhrases   []string `json:"strip_phrases,omitempty"`   // Boilerplate removed from replies
+	ResponseNotice string   `json:"response_notice,omitempty"` // Appended to final replies
 
-		// Start of turn: Create context and register cancel function
-		ctx, cancel := context.WithCancel(context.Background())
-		mu.Lock()
-		currentCancel = cancel
-		mu.Unlock()
+	Retry RetryPolicy `json:"retry"`
 
-		var lastUsage int
+	Webhooks []WebhookConfig `json:"webhooks,omitempty"` // Event callbacks in headless modes
 
-		// Interaction loop (handle tool calls)
-		for {
-			if ctx.Err() != nil {
-				break
-			}
+	Models map[string]ModelInfo `json:"models,omitempty"` // Context windows and pricing, by model name
 
-			var extraBody json.RawMessage
-			if *modelFlag == "gemini" {
-				extraBody = json.RawMessage(`{"google": {"thinking_config": {"include_thoughts": true}}}`)
-			}
+	PR PRConfig `json:"pr"` // Pull request remote and tokens
 
-			reqBody := ChatCompletionRequest{
-				Model:     ModelName,
-				Messages:  messages,
-				Tools:     []Tool{udiffTool, runScriptTool, shortenContextTool},
-				ExtraBody: extraBody,
-			}
+	Commit CommitConvention `json:"commit"` // Commit message format
 
-			jsonData, err := json.Marshal(reqBody)
-			if err != nil {
-				fmt.Printf("Error marshaling request: %v\n", err)
-				break
-			}
+	Hooks HooksConfig `json:"hooks"` // Disable skill hooks or override their priority
 
-			var resp *http.Response
-			var body []byte
-			maxRetries := 7
-			retryDelay := 2 * time.Second
+	Spellcheck SpellcheckConfig `json:"spellcheck"` // Spelling pass over edited docs and strings
 
-			for attempt := 0; attempt <= maxRetries; attempt++ {
-				if attempt > 0 {
-					fmt.Printf("Retrying in %v... (Attempt %d/%d)\n", retryDelay, attempt, maxRetries)
-					select {
-					case <-ctx.Done():
-						break
-					case <-time.After(retryDelay):
-						retryDelay *= 2
-					}
-				}
+	SyntaxCheck SyntaxCheckConfig `json:"syntax_check"` // Parse files after apply_udiff; report or revert breakage
 
-				req, err := http.NewRequestWithContext(ctx, "POST", GeminiURL, bytes.NewBuffer(jsonData))
-				if err != nil {
-					fmt.Printf("Error creating request: %v\n", err)
-					break
-				}
+	FileWatcher   bool `json:"file_watcher"`   // Tell the model about files changed outside the agent
+	CoverageCheck bool `json:"coverage_check"` // Measure coverage after turns that change files; point out untested changes
 
-				req.Header.Set("Content-Type", "application/json")
-				req.Header.Set("Authorization", "Bearer "+apiKey)
+	Commands CommandPolicy `json:"commands"` // run_command allow/deny lists and environment
 
-				spinnerStop := make(chan struct{})
-				spinnerDone := make(chan struct{})
-				go startSpinner(spinnerStop, spinnerDone)
+	Telemetry TelemetryConfig `json:"telemetry"` // OTLP export of spans and metrics
 
-				resp, err = client.Do(req)
+	Notify NotifyConfig `json:"notify"` // Notifications when a prompt waits or a long turn ends
 
-				close(spinnerStop)
-				<-spinnerDone
+	EncryptHistory HistoryEncryption `json:"encrypt_history"` // Encrypt saved history at rest
+	RedactSecrets  bool              `json:"redact_secrets"`  // Strip credentials from tool output (default true)
 
-				if err != nil {
-					if ctx.Err() == context.Canceled {
-						fmt.Println("\nRequest canceled.")
-						break
-					}
-					fmt.Printf("Error sending request: %v\n", err)
-					continue
-				}
+	TestCommand  string `json:"test_command,omitempty"`  // For -fix-tests and the project profile; detected if empty
+	BuildCommand string `json:"build_command,omitempty"` // For build_project and the project profile; detected if empty
 
-				body, err = io.ReadAll(resp.Body)
-				resp.Body.Close()
-				if err != nil {
-					fmt.Printf("Error reading response: %v\n", err)
-					continue
-				}
+	InstructionFiles []string `json:"instruction_files,omitempty"` // Names of project instruction files (default AGENTS.md, CLAUDE.md, .cursorrules)
+	PromptPrelude    string   `json:"prompt_prelude,omitempty"`    // File placed at the top of the system prompt; may use {variables}
 
-				if resp.StatusCode == http.StatusOK {
-					break
-				}
+	LineEndings   string `json:"line_endings,omitempty"` // Line endings of edited files: auto (keep each file's), lf or crlf
+	DurableWrites bool   `json:"durable_writes"`         // fsync edits and the edit journal so they survive a power loss
 
-				if resp.StatusCode == 400 {
-					fmt.Printf("API Error (Status 400): %s\nLogging to errors.txt\n", string(body))
-					f, err := os.OpenFile("errors.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-					if err == nil {
-						timestamp := time.Now().Format(time.RFC3339)
-						f.WriteString(fmt.Sprintf("Timestamp: %s\nError: %s\n", timestamp, string(body)))
-						f.WriteString("Last Messages:\n")
-						start := 0
-						if len(messages) > 2 {
-							start = len(messages) - 2
-						}
-						for i := start; i < len(messages); i++ {
-							content, _ := json.Marshal(messages[i])
-							f.WriteString(fmt.Sprintf("%s\n", content))
-						}
-						f.WriteString("--------------------------------------------------\n")
-						f.Close()
-					}
-					break
-				}
+	MaxEditBytes int `json:"max_edit_bytes"` // Larger files need apply_udiff's force flag (default 1 MiB, 0 disables)
+	MaxReadBytes int `json:"max_read_bytes"` // read_file refuses larger files (default 10 MiB, 0 disables)
 
-				if resp.StatusCode == 429 || resp.StatusCode >= 500 {
-					fmt.Printf("API Error (Status %d): %s\n", resp.StatusCode, string(body))
-					continue
-				}
+	LargeMessageTokens int `json:"large_message_tokens"` // Confirm before sending a message or tool result this large (default 20000, 0 disables)
 
-				fmt.Printf("API Error (Status %d): %s\n", resp.StatusCode, string(body))
-				break
-			}
+	MaxTurnRequests  int `json:"max_turn_requests"`   // Ask before a turn makes more model requests than this (default 40, 0 disables)
+	MaxTurnToolCalls int `json:"max_turn_tool_calls"` // Ask before a turn makes more tool calls than this (default 200, 0 disables)
 
-			if resp == nil || resp.StatusCode != http.StatusOK {
-				break
-			}
+	OrgSkills OrgSkillsConfig `json:"org_skills"` // Skills and instructions synced from the organization (user config only)
 
-			var chatResp ChatCompletionResponse
-			if err := json.Unmarshal(body, &chatResp); err != nil {
-				fmt.Printf("Error parsing response: %v\n", err)
-				break
-			}
+	IdleRecapMinutes int `json:"idle_recap_minutes"` // Recap where the task stood after this long at the prompt (default 120, 0 disables)
 
-			if chatResp.Error != nil {
-				fmt.Printf("API Error: %s\n", chatResp.Error.Message)
-				break
-			}
+	Links string `json:"links,omitempty"` // URL scheme for path:line citations: vscode, cursor, idea, file, off or a template
+}
 
-			if len(chatResp.Choices) == 0 {
-				fmt.Println("No choices returned from API")
-				break
-			}
+// existingConfigPaths returns the absolute paths of the config files that
+// exist, in the order loadConfig reads them.
+func existingConfigPaths() []string {
+	var paths []string
+	for _, path := range getConfigPaths() {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
 
-			if chatResp.Usage != nil {
-				lastUsage = chatResp.Usage.TotalTokens
-			}
+func getConfigPaths() []string {
+	var paths []string
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".simple_agent", "config.json"))
+	}
+	return append(paths, ".simple_agent.json")
+}
 
-			msg := chatResp.Choices[0].Message
-			messages = append(messages, msg)
+func loadConfig() Config {
+	cfg := Config{Retry: defaultRetryPolicy, RedactSecrets: true, MaxEditBytes: maxEditBytes, MaxReadBytes: maxReadBytes, LargeMessageTokens: largeMessageTokens, MaxTurnRequests: maxTurnRequests, MaxTurnToolCalls: maxTurnToolCalls, IdleRecapMinutes: int(idleRecapAfter / time.Minute)}
+	for i, path := range getConfigPaths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if i > 0 {
+			data = dropUserOnlyKeys(path, data)
+		}
+		// Unmarshaling into the same struct overlays only the fields present
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to parse config %s: %v\n", path, err)
+		}
+	}
+	return cfg
+}
 
-			// Print thoughts if present
-			if len(msg.ToolCalls) > 0 {
-				extractAndPrintThoughts(msg.Content)
-			}
-			printThought(msg.ExtraContent)
+// userOnlyConfigKeys are honoured only in ~/.simple_agent/config.json: they
+// trust skills or commands, or send data off the machine, so a repository
+// must not be able to set them.
+var userOnlyConfigKeys = []string{"org_skills", "commands", "redact_secrets", "webhooks", "pr", "telemetry"}
+
+// dropUserOnlyKeys removes userOnlyConfigKeys from a project config, with a
+// warning for each one present.
+func dropUserOnlyKeys(path string, data []byte) []byte {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return data // Reported when parsed
+	}
+	var dropped []string
+	for _, key := range userOnlyConfigKeys {
+		if _, ok := fields[key]; ok {
+			delete(fields, key)
+			dropped = append(dropped, key)
+		}
+	}
+	if len(dropped) == 0 {
+		return data
+	}
+	fmt.Fprintf(os.Stderr, "Warning: Ignoring %s in %s; set them in ~/.simple_agent/config.json.\n", strings.Join(dropped, ", "), path)
+	out, _ := json.Marshal(fields)
+	return out
+}
 
-			contextReset := false
+// applyConfig validates cfg and makes it the active configuration. disable
+// holds extra tools to disable from the command line.
+func applyConfig(cfg Config, disable string) error {
+	if _, ok := verbosityInstructions[cfg.Verbosity]; cfg.Verbosity != "" && !ok {
+		return fmt.Errorf("Unknown verbosity: %s. usage: -verbosity terse|normal|explanatory", cfg.Verbosity)
+	}
+	if !validThinkingLevel(cfg.Thinking) {
+		return fmt.Errorf("Unknown thinking level: %s. usage: -thinking off|low|medium|high", cfg.Thinking)
+	}
+	thinkingLevel = cfg.Thinking
 
-			if len(msg.ToolCalls) > 0 {
-				for _, toolCall := range msg.ToolCalls {
-					if ctx.Err() != nil {
-						break
-					}
+	if cfg.ToolProtocol != "" && cfg.ToolProtocol != "native" && cfg.ToolProtocol != "text" {
+		return fmt.Errorf("Unknown tool protocol: %s. usage: -tool-protocol native|text", cfg.ToolProtocol)
+	}
+	toolProtocol = cfg.ToolProtocol
 
-					printThought(toolCall.ExtraContent)
+	if err := disableTools(strings.Join(cfg.DisabledTools, ","), os.Getenv("SIMPLE_AGENT_DISABLE_TOOLS"), disable); err != nil {
+		return fmt.Errorf("Cannot disable tools: %v", err)
+	}
 
-					var toolResult string
-					var toolErr error
+	retryPolicy = cfg.Retry
+	prConfig = cfg.PR
+	spellcheck = cfg.Spellcheck
+	if !validSyntaxCheckMode(cfg.SyntaxCheck.Mode) {
+		return fmt.Errorf("Unknown syntax check mode: %s. usage: -syntax-check off|report|strict", cfg.SyntaxCheck.Mode)
+	}
+	syntaxCheck = cfg.SyntaxCheck
+	commandPolicy = cfg.Commands
+	redactSecrets = cfg.RedactSecrets
+	largeMessageTokens = cfg.LargeMessageTokens
+	maxEditBytes, maxReadBytes = cfg.MaxEditBytes, cfg.MaxReadBytes
+	if cfg.LineEndings != "" && cfg.LineEndings != "auto" && cfg.LineEndings != "lf" && cfg.LineEndings != "crlf" {
+		return fmt.Errorf("Unknown line_endings: %s. Use auto, lf or crlf", cfg.LineEndings)
+	}
+	lineEndings = cfg.LineEndings
+	configuredTestCommand, configuredBuildCommand = cfg.TestCommand, cfg.BuildCommand
+	durableWrites = cfg.DurableWrites
+	maxTurnRequests, maxTurnToolCalls = cfg.MaxTurnRequests, cfg.MaxTurnToolCalls
+	idleRecapAfter = time.Duration(cfg.IdleRecapMinutes) * time.Minute
+	orgSkills = cfg.OrgSkills
+	if !validLinkScheme(cfg.Links) {
+		return fmt.Errorf("Unknown links scheme: %s. Use vscode, cursor, idea, file, off or a template with {path} and {line}", cfg.Links)
+	}
+	linkScheme = cfg.Links
+	if err := cfg.Notify.check(); err != nil {
+		return fmt.Errorf("Invalid notify config: %v", err)
+	}
+	notifyConfig = cfg.Notify
+	commitConvention = cfg.Commit
+	hooksConfig = cfg.Hooks
+	if err := commitConvention.check(); err != nil {
+		return fmt.Errorf("Invalid commit convention: %v", err)
+	}
+	for name, info := range cfg.Models {
+		knownModels[name] = info
+	}
+	return nil
+}
 
-					switch toolCall.Function.Name {
-					case "apply_udiff":
-						fmt.Printf("\n\033[1;35m🛠  Tool Call: apply_udiff\033[0m\n")
-						var args struct {
-							Path string `json:"path"`
-							Diff string `json:"diff"`
-						}
-						if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
-							toolErr = fmt.Errorf("error parsing arguments: %v", err)
-						} else {
-							// Dry run first to check validity and generate helpful errors
-							_, err := applyUDiff(ctx, args.Path, args.Diff, true)
-							if err != nil {
-								toolErr = err
-							} else {
-								// Show diff to user
-								fmt.Printf("Proposed changes to %s:\n", args.Path)
-								printColoredDiff(args.Diff)
-
-								var confirm string
-								if *autoApprove {
-									fmt.Println("Auto-approving changes...")
-									confirm = "y"
-								} else {
-									// Ask for confirmation
-									fmt.Print("Apply these changes? [y/N]: ")
-									confirm, _ = bufio.NewReader(os.Stdin).ReadString('\n')
-								}
+var verbosityInstructions = map[string]string{
+	"terse":       "Be terse. Answer in as few words as possible, skip pleasantries and recaps, and only explain when asked.",
+	"normal":      "",
+	"explanatory": "Be explanatory. Walk through your reasoning, explain trade-offs and why changes were made, and point out related concepts the user may want to learn.",
+}
 
-								if ctx.Err() != nil {
-									toolErr = fmt.Errorf("interrupted by user")
-								} else {
-									confirm = strings.TrimSpace(confirm)
-
-									if strings.ToLower(confirm) == "y" {
-										// Pre-edit hook
-										preHookOut := runSkillHooks(ctx, skills, "pre_edit", map[string]string{"path": args.Path})
-
-										toolResult, toolErr = applyUDiff(ctx, args.Path, args.Diff, false)
-										if preHookOut != "" {
-											toolResult = "[Pre-Edit Hook Output]\n" + preHookOut + "\n\n" + toolResult
-										}
-										if toolErr == nil {
-											fmt.Printf("Successfully applied diff to %s\n", args.Path)
-											toolResult = "Diff applied successfully."
-										}
-
-										// Post-edit hook
-										hookOut := runSkillHooks(ctx, skills, "post_edit", map[string]string{"path": args.Path})
-										if hookOut != "" {
-											toolResult += "\n\n[Hook Output]\n" + hookOut
-										}
-									} else {
-										fmt.Println("Changes rejected.")
-										toolResult = "User rejected the changes."
-									}
-								}
-							}
-						}
+// getResponseStylePrompt builds the system prompt section for reply language and verbosity.
+func getResponseStylePrompt(cfg Config) string {
+	var sb strings.Builder
+	if cfg.Language != "" {
+		sb.WriteString(fmt.Sprintf("- **Language**: Always reply to the user in %s. Keep code, identifiers, code comments, commit messages, and tool arguments in English unless the user asks otherwise.\n", cfg.Language))
+	}
+	if instr := verbosityInstructions[cfg.Verbosity]; instr != "" {
+		sb.WriteString(fmt.Sprintf("- **Verbosity**: %s\n", instr))
+	}
+	if cfg.Links != "off" {
+		sb.WriteString(citationPrompt)
+	}
+	if sb.Len() == 0 {
+		return ""
+	}
+	return "\n# Response Style\n" + sb.String()
+}
 
-					case "run_script":
-						fmt.Printf("\n\033[1;35m🛠  Tool Call: run_script\033[0m\n")
-						var args struct {
-							Path string   `json:"path"`
-							Args []string `json:"args"`
-						}
-						if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
-							toolErr = fmt.Errorf("error parsing arguments: %v", err)
-						} else {
-							// Pre-run hook
-							preHookOut := runSkillHooks(ctx, skills, "pre_run", map[string]string{"path": args.Path, "args": strings.Join(args.Args, " ")})
+// --- Mock Provider ---
 
-							fmt.Printf("Executing script: %s %v\n", args.Path, args.Args)
-							toolResult, toolErr = runSafeScript(ctx, args.Path, args.Args, skillsPrompt)
-							if preHookOut != "" {
-								toolResult = "[Pre-Run Hook Output]\n" + preHookOut + "\n\n" + toolResult
-							}
+// SIMPLE_AGENT_MOCK=<script.json> replaces the provider with an llm.Mock
+// that replays the script's canned responses (see the llm package), for
+// end-to-end tests and demos without an API key. Other HTTP requests, such
+// as the update check, fail instead of reaching the network.
 
-							// Post-run hook
-							hookOut := runSkillHooks(ctx, skills, "post_run", map[string]string{"path": args.Path, "args": strings.Join(args.Args, " ")})
-							if hookOut != "" {
-								toolResult += "\n\n[Hook Output]\n" + hookOut
-							}
-						}
+const mockEnv = "SIMPLE_AGENT_MOCK"
 
-					case "shorten_context":
-						fmt.Printf("\n\033[1;35m🛠  Tool Call: shorten_context\033[0m\n")
-						var args struct {
-							Task   string `json:"task_description"`
-							Future string `json:"future_plans"`
-							Vital  string `json:"vital_information"`
-						}
-						if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
-							toolErr = fmt.Errorf("error parsing arguments: %v", err)
-						} else {
-							fmt.Println("Summarizing context...")
-							summary, err := summarizeContext(apiKey, messages, args.Task, args.Future, args.Vital)
-							if err != nil {
-								toolErr = fmt.Errorf("failed to summarize: %v", err)
-							} else {
-								if strings.TrimSpace(summary) == "" {
-									summary = "(No summary provided by the model)"
-								}
-								// Reset context
-								sysMsg := messages[0]
-								messages = []Message{sysMsg}
-								messages = append(messages, Message{
-									Role:    "user",
-									Content: fmt.Sprintf("Context has been shortened. Summary of previous conversation:\n%s", summary),
-								})
+// installMockLLM routes all HTTP requests to the mock named by
+// SIMPLE_AGENT_MOCK. It returns nil when the variable is unset.
+func installMockLLM() (*llm.Mock, error) {
+	path := os.Getenv(mockEnv)
+	if path == "" {
+		return nil, nil
+	}
+	mock, err := llm.LoadMock(path)
+	if err != nil {
+		return nil, err
+	}
+	http.DefaultTransport = mock
+	return mock, nil
+}
 
-								fmt.Println("Context shortened.")
-								fmt.Println("Gemini (Summary):")
-								printMarkdown(summary)
+// --- Chaos Mode ---
 
-								contextReset = true
-							}
-						}
+// ChaosMonkey randomly injects API errors, slow responses, and tool failures so
+// retry, cancellation, and recovery paths can be exercised on purpose. It is
+// enabled with the hidden -chaos flag; a nil *ChaosMonkey injects nothing.
+type ChaosMonkey struct {
+	rate float64
+	seed int64
+	mu   sync.Mutex
+	rng  *rand.Rand
+}
 
-					default:
-						toolErr = fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
-					}
+var chaos *ChaosMonkey
 
-					// Append tool response
-					content := toolResult
-					if toolErr != nil {
-						fmt.Printf("Tool Error: %v\n", toolErr)
-						content = fmt.Sprintf("Error: %v", toolErr)
-					}
+func newChaosMonkey(rate float64, seed int64) *ChaosMonkey {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &ChaosMonkey{rate: rate, seed: seed, rng: rand.New(rand.NewSource(seed))}
+}
 
-					if !contextReset {
-						messages = append(messages, Message{
-							Role:       "tool",
-							Content:    content,
-							ToolCallID: toolCall.ID,
-						})
-					}
-				}
+// roll returns -1 if no failure should be injected, otherwise a value in [0, n).
+func (c *ChaosMonkey) roll(n int) int {
+	if c == nil {
+		return -1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rng.Float64() >= c.rate {
+		return -1
+	}
+	return c.rng.Intn(n)
+}
 
-				if contextReset {
-					break
-				}
+// Delay returns a random slow-response delay between 2 and 10 seconds.
+func (c *ChaosMonkey) Delay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(2+c.rng.Intn(9)) * time.Second
+}
 
-				// Check for new skills
-				// Re-discover only project skills for dynamic updates
-				currentProjectSkills := discoverSkills("./skills")
+// ToolFailure returns an injected error for a tool call, or nil.
+func (c *ChaosMonkey) ToolFailure(tool string) error {
+	if c.roll(1) < 0 {
+		return nil
+	}
+	fmt.Printf("\033[33m[Chaos] Injecting failure into tool '%s'\033[0m\n", tool)
+	return fmt.Errorf("chaos: injected failure in tool '%s'", tool)
+}
 
-				// Merge again
-				for _, s := range currentProjectSkills {
-					skillMap[s.Name] = s
-				}
+// chaosTransport wraps an http.RoundTripper and injects faults into requests.
+type chaosTransport struct {
+	base http.RoundTripper
+}
 
-				var newSkills []Skill
-				for _, s := range skillMap {
-					if !knownSkills[s.Name] {
-						newSkills = append(newSkills, s)
-						knownSkills[s.Name] = true
-					}
-				}
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fake := func(status int, header http.Header, body string) *http.Response {
+		fmt.Printf("\033[33m[Chaos] Injecting HTTP %d\033[0m\n", status)
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode: status,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}
+	}
 
-				if len(newSkills) > 0 {
-					// Rebuild main skills list
-					skills = []Skill{}
-					for _, s := range skillMap {
-						skills = append(skills, s)
-					}
-					skillsPrompt = generateSkillsPrompt(skills)
+	switch chaos.roll(5) {
+	case 0:
+		return fake(http.StatusTooManyRequests, http.Header{}, `{"error": {"message": "chaos: rate limited", "code": 429}}`), nil
+	case 1:
+		return fake(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"1"}}, `{"error": {"message": "chaos: rate limited", "code": 429}}`), nil
+	case 2:
+		return fake(http.StatusInternalServerError, http.Header{}, `{"error": {"message": "chaos: internal error", "code": 500}}`), nil
+	case 3:
+		fmt.Println("\033[33m[Chaos] Injecting network error\033[0m")
+		return nil, fmt.Errorf("chaos: connection reset by peer")
+	case 4:
+		delay := chaos.Delay()
+		fmt.Printf("\033[33m[Chaos] Delaying request by %v\033[0m\n", delay)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.base.RoundTrip(req)
+}
 
-					var sb strings.Builder
-					sb.WriteString("SYSTEM NOTICE: New skills discovered:\n")
-					for _, s := range newSkills {
-						sb.WriteString(fmt.Sprintf("- %s: %s\n", s.Name, s.Description))
-					}
+// printUsage is flag.Usage without flags that have no usage text (hidden flags).
+func printUsage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Usage == "" {
+			return
+		}
+		line := "  -" + f.Name
+		name, usage := flag.UnquoteUsage(f)
+		if name != "" {
+			line += " " + name
+		}
+		line += "\n    \t" + usage
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s" {
+			line += fmt.Sprintf(" (default %q)", f.DefValue)
+		}
+		fmt.Fprintln(flag.CommandLine.Output(), line)
+	})
+}
 
-					messages = append(messages, Message{
-						Role:    "system",
-						Content: sb.String(),
-					})
-					fmt.Println(sb.String()) // Also print to console for user visibility
-				}
+// --- Main ---
 
-				// Loop back to send tool outputs to model
-				continue
-			}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "skill-test" {
+		os.Exit(runSkillTestCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "capabilities" {
+		os.Exit(runCapabilitiesCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-history" {
+		os.Exit(runMigrateHistoryCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplayCommand(os.Args[2:]))
+	}
+	// `simple-agent serve` takes the usual flags plus -host, -port and -token
+	serve := len(os.Args) > 1 && os.Args[1] == "serve"
+	if serve {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	// `simple-agent watch` takes the usual flags plus -prompt, -every,
+	// -on-change, -report and -issues
+	watch := len(os.Args) > 1 && os.Args[1] == "watch"
+	if watch {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	// `simple-agent acp` takes the usual flags; stdin and stdout carry the
+	// protocol from here on
+	acp := len(os.Args) > 1 && os.Args[1] == "acp"
+	acpIn, acpOut := os.Stdin, os.Stdout
+	if acp {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		os.Stdout = os.Stderr
+		if devNull, err := os.Open(os.DevNull); err == nil {
+			os.Stdin = devNull
+		}
+	}
 
-			if contextReset {
-				break
-			}
+	versionFlag := flag.Bool("version", false, "Print version and exit")
+	noUpdate := flag.Bool("no-update", false, "Skip auto-update check at startup")
+	allowUnsignedFlag := flag.Bool("allow-unsigned", false, "Let the auto-update install releases without checksums or signature")
+	noAutoAccept := flag.Bool("no-auto-accept", false, "Disable automatic acceptance of diffs (require user confirmation)")
+	continueSession := flag.Bool("continue", false, "Continue from previous session history")
+	gitAutoCommit := flag.Bool("git-auto-commit", false, "Automatically propose commits for file changes after every turn")
+	gitForceCommit := flag.Bool("git-force-commit", false, "Automatically commit changes without confirmation (implies -git-auto-commit)")
+	autoBranch := flag.Bool("auto-branch", false, "Work on a new branch per task; /merge squashes it back")
+	modelFlag := flag.String("model", "gemini", "Select provider (gemini, openai) or a specific model, e.g. flash or gpt-4.1")
+	chaosFlag := flag.Float64("chaos", 0, "")        // Hidden: failure-injection rate (0-1) for resilience testing
+	chaosSeedFlag := flag.Int64("chaos-seed", 0, "") // Hidden: seed for reproducible chaos runs
+	languageFlag := flag.String("language", "", "Language for replies, e.g. German (code stays English)")
+	verbosityFlag := flag.String("verbosity", "", "Reply verbosity: terse, normal or explanatory")
+	thinkingFlag := flag.String("thinking", "", "Thinking budget: off, low, medium or high (default: provider default)")
+	preludeFlag := flag.String("prelude", "", "File to place at the top of the system prompt; may use {cwd}, {git_branch}, {date} and other variables")
+	coverageCheckFlag := flag.Bool("coverage-check", false, "Measure test coverage after each turn that changes files, print the per-file change and point the model at changed lines no test runs")
+	durableWritesFlag := flag.Bool("durable-writes", false, "fsync every edit before reporting it done, so it survives a crash or power loss (slower)")
+	watchFilesFlag := flag.Bool("watch-files", false, "Tell the model which files changed outside the agent (e.g. in your editor) before each request")
+	syntaxCheckFlag := flag.String("syntax-check", "", "Parse files after each edit: report errors to the model, or strict to also revert edits that break parsing (default: off)")
+	disableToolsFlag := flag.String("disable-tools", "", "Comma-separated built-in tools to disable, e.g. apply_udiff,run_script")
+	toolProtocolFlag := flag.String("tool-protocol", "", "Tool calling: native, or text for models without tool support (default: per model)")
+	archiveFlag := flag.String("archive", "", "Run -task headless against a .zip/.tar/.tar.gz instead of the current directory")
+	taskFlag := flag.String("task", "", "Task for -archive mode")
+	outFlag := flag.String("out", "", "Output of -archive mode: a .patch/.diff, or a re-packed .zip/.tar/.tar.gz (default: <archive>.patch)")
+	fixTestsFlag := flag.Bool("fix-tests", false, "Run the tests and work on the failures until they pass")
+	testCmdFlag := flag.String("test-cmd", "", "Test command for -fix-tests (default: test_command from the config, or detected)")
+	fixRoundsFlag := flag.Int("fix-rounds", 5, "Turns -fix-tests may spend before giving up")
+	notifyFlag := flag.String("notify", "", "Comma-separated notification methods: bell, osc9, osc777, desktop")
+	tuiFlag := flag.Bool("tui", false, "Full-screen mode with a pending-changes panel and a token/cost status bar")
+	quickFlag := flag.Bool("quick", false, "Run the arguments as a one-line task in the current directory and exit (what the sa alias does)")
+	hostFlag := flag.String("host", "127.0.0.1", "Address serve mode listens on (0.0.0.0 to allow other machines)")
+	portFlag := flag.Int("port", 8080, "Port serve mode listens on")
+	tokenFlag := flag.String("token", "", "API token for serve mode (default: $SIMPLE_AGENT_SERVE_TOKEN, or a random one)")
+	noUIFlag := flag.Bool("no-ui", false, "Serve mode without the web UI, only the API")
+	watchPromptFlag := flag.String("prompt", "", "Task watch mode runs, e.g. \"triage new TODOs\"")
+	everyFlag := flag.Duration("every", 0, "How often watch mode runs, e.g. 30m or 1h")
+	onChangeFlag := flag.Bool("on-change", false, "Watch mode also runs when files in the project change")
+	reportFlag := flag.String("report", "", "Markdown file watch mode appends its reports to (default: .simple_agent/watch-report.md)")
+	issuesFlag := flag.Bool("issues", false, "Watch mode opens a GitHub/GitLab issue for every report with findings")
+	approvalPolicyFlag := flag.String("approval-policy", "", "JSON file that answers approval prompts per tool call, for headless runs with -no-auto-accept")
+	approvalSocketFlag := flag.String("approval-socket", "", "Unix socket where another process answers approval prompts")
+	debugLLMFlag := flag.Bool("debug-llm", false, "Write every model API request and response to ~/.simple_agent/debug (API key redacted)")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	// `sa "task"` and `simple-agent -quick "task"` run one task and exit
+	quick := *quickFlag || isQuickAlias(os.Args[0])
+	quickTask := strings.TrimSpace(strings.Join(flag.Args(), " "))
+	if quick && quickTask == "" {
+		fmt.Printf("Usage: %s [flags] \"<task>\"\n", filepath.Base(os.Args[0]))
+		os.Exit(2)
+	}
+
+	debugLLM = *debugLLMFlag
+	if *approvalPolicyFlag != "" || *approvalSocketFlag != "" {
+		var policy *ApprovalPolicy
+		if *approvalPolicyFlag != "" {
+			var err error
+			if policy, err = loadApprovalPolicy(*approvalPolicyFlag); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		approvalPrompter = newApprovalPrompter(policy, *approvalSocketFlag)
+	}
+	mock, err := installMockLLM()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if mock != nil {
+		fmt.Printf("⚠️  Mock mode: replaying canned responses from %s\n", os.Getenv(mockEnv))
+	}
+	if *chaosFlag > 0 {
+		chaos = newChaosMonkey(*chaosFlag, *chaosSeedFlag)
+		http.DefaultTransport = &chaosTransport{base: http.DefaultTransport}
+		fmt.Printf("⚠️  Chaos mode: injecting API and tool failures at rate %.2f (seed %d)\n", chaos.rate, chaos.seed)
+	}
+
+	cfg := loadConfig()
+	if *languageFlag != "" {
+		cfg.Language = *languageFlag
+	}
+	if *verbosityFlag != "" {
+		cfg.Verbosity = *verbosityFlag
+	}
+	if *thinkingFlag != "" {
+		cfg.Thinking = *thinkingFlag
+	}
+	if *toolProtocolFlag != "" {
+		cfg.ToolProtocol = *toolProtocolFlag
+	}
+	if *syntaxCheckFlag != "" {
+		cfg.SyntaxCheck.Mode = *syntaxCheckFlag
+	}
+	if *watchFilesFlag {
+		cfg.FileWatcher = true
+	}
+	if *durableWritesFlag {
+		cfg.DurableWrites = true
+	}
+	if *coverageCheckFlag {
+		cfg.CoverageCheck = true
+	}
+	if *preludeFlag != "" {
+		cfg.PromptPrelude = *preludeFlag
+	}
+	if *notifyFlag != "" {
+		cfg.Notify.Methods = strings.Split(*notifyFlag, ",")
+	}
+	if err := applyConfig(cfg, *disableToolsFlag); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	enableTelemetry(cfg.Telemetry)
+
+	if len(cfg.StripPhrases) > 0 {
+		middleware.Use(middleware.StripPhrases(cfg.StripPhrases...))
+	}
+	if cfg.ResponseNotice != "" {
+		middleware.Use(middleware.AppendNotice(cfg.ResponseNotice))
+	}
+
+	// Print version on startup
+	fmt.Printf("Simple Agent %s\n", Version)
+
+	// Default behavior is to auto-accept unless explicitly disabled
+	shouldAutoApprove := !*noAutoAccept
+	autoApprove := &shouldAutoApprove
+
+	if *versionFlag {
+		os.Exit(0)
+	}
+
+	if !*noUpdate && !*versionFlag && *archiveFlag == "" && !quick && !serve && !acp && !watch && mock == nil {
+		autoUpdate(*allowUnsignedFlag)
+	}
+
+	var apiKey string
+
+	provider, err := useModel(*modelFlag)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	switch {
+	case mock != nil:
+		apiKey = "mock"
+	case provider == "openai":
+		apiKey = os.Getenv("OPENAI_API_KEY")
+		// Any OpenAI-compatible server, e.g. a local model; those often need no key
+		if apiKey == "" && os.Getenv("OPENAI_BASE_URL") == "" {
+			fmt.Println("Please set OPENAI_API_KEY environment variable.")
+			os.Exit(1)
+		}
+	case provider == "gemini":
+		apiKey = os.Getenv("GEMINI_API_KEY")
+		if apiKey == "" {
+			fmt.Println("Please set GEMINI_API_KEY environment variable.")
+			os.Exit(1)
+		}
+	}
+
+	if err := initHistoryEncryption(cfg.EncryptHistory); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var archive *archiveJob
+	if *archiveFlag != "" {
+		if strings.TrimSpace(*taskFlag) == "" {
+			fmt.Println("-archive requires -task \"<what to do>\"")
+			os.Exit(1)
+		}
+		archive, err = prepareArchiveWorkspace(*archiveFlag, *outFlag)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer archive.Cleanup()
+		// The archive is untrusted: the config was read where the agent was
+		// started, and no saved approvals apply to it
+		configs := existingConfigPaths()
+		useEmptyApprovals()
+		// Everything below (skills, memory, tools) then works on the archive
+		if err := os.Chdir(archive.Root); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Unpacked %s into %s\n", *archiveFlag, archive.Root)
+		if len(configs) == 0 {
+			configs = []string{"defaults"}
+		}
+		fmt.Printf("Config: %s (the archive's own .simple_agent.json is not read; no saved approvals apply)\n", strings.Join(configs, ", "))
+	}
+
+	// Setup Core Skills (Extract embedded)
+	if err := setupCoreSkills(); err != nil {
+		fmt.Printf("Warning: Failed to extract core skills: %v\n", err)
+	}
+
+	if err := syncOrgSkills(); err != nil {
+		fmt.Printf("Warning: Org skills unavailable: %v\n", err)
+	}
+
+	// Discover skills
+	// 1. Core Skills (and the org skills they don't override)
+	coreSkills := discoverCoreSkills()
+	// 2. Project Skills (Current Directory)
+	projectSkills := projectSkillScanner.Scan()
+
+	// Merge skills (Project overrides Core)
+	skillMap := make(map[string]Skill)
+	for _, s := range coreSkills {
+		skillMap[s.Name] = s
+	}
+	for _, s := range projectSkills {
+		skillMap[s.Name] = s
+	}
+
+	// Convert back to slice
+	var skills []Skill
+	for _, s := range skillMap {
+		skills = append(skills, s)
+	}
+
+	skillsPrompt := generateSkillsPrompt(skills)
+	changedSkills(skills) // Cache the instructions the session starts with
+
+	// Track known skills to detect additions
+	knownSkills := make(map[string]bool)
+	for _, s := range skills {
+		knownSkills[s.Name] = true
+	}
+
+	// Setup signal handling for interruption
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+
+	var currentCancel context.CancelFunc
+	var mu sync.Mutex
+
+	var lastSignalTime time.Time
+	// During a turn, the first Ctrl+C pauses at the next safe point and a
+	// second one aborts the turn
+	var pauseRequested int32
+
+	go func() {
+		for range sigChan {
+			mu.Lock()
+			if currentCancel != nil {
+				if atomic.CompareAndSwapInt32(&pauseRequested, 0, 1) {
+					fmt.Println("\n[Pause requested: the turn pauses after the current step. Press Ctrl+C again to abort]")
+				} else {
+					fmt.Println("\n[Interrupted by user]")
+					currentCancel()
+					currentCancel = nil
+				}
+			} else {
+				if time.Since(lastSignalTime) < 1*time.Second {
+					restoreTerminal()
+					tui.Close()
+					fmt.Println("\nExiting...")
+					runSessionEndHooks(skills)
+					os.Exit(0)
+				}
+				lastSignalTime = time.Now()
+				fmt.Println("\n(Press Ctrl+C again to exit)")
+			}
+			mu.Unlock()
+		}
+	}()
+
+	warnHookTies(skills)
+
+	// Run startup hooks (using background context as this is init)
+	startupOutput, err := runSkillHooks(context.Background(), skills, "startup", nil)
+	if err != nil {
+		fmt.Printf("Startup aborted: %v\n%s", err, startupOutput)
+		os.Exit(1)
+	}
+
+	baseSystemPrompt := buildToolPrompt()
+	datePrompt := fmt.Sprintf("\n# Current Context\nToday's date is %s.\nNOTE: This date is injected by the system and is correct. It may seem like the future compared to your training data. Trust this date.\n", time.Now().Format("Monday, January 2, 2006"))
+	memory := loadMemory()
+	currentPlan = loadPlan()
+	interruptedEdits := recoverEditJournal()
+	if len(interruptedEdits) > 0 {
+		fmt.Printf("\033[33m⚠️  The last session was interrupted while editing:\033[0m\n")
+		for _, line := range interruptedEdits {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	if len(memory.Entries) == 0 {
+		if _, err := os.Stat("remember.txt"); err == nil {
+			fmt.Println("Found remember.txt. Run '/memory import' to migrate it into project memory.")
+		}
+	}
+	loadedInstructions = loadInstructionFiles(cfg.InstructionFiles)
+	var instructionPaths []string
+	for _, f := range loadedInstructions {
+		if f.Scope != "nested" {
+			instructionPaths = append(instructionPaths, f.Path)
+		}
+	}
+	if len(instructionPaths) > 0 {
+		fmt.Printf("Loaded instructions from %s (/instructions to show)\n", strings.Join(instructionPaths, ", "))
+	}
+	prelude, err := loadPromptPrelude(cfg.PromptPrelude)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	systemPrompt := prelude + baseSystemPrompt + datePrompt + projectProfile(".").PromptSection() + getResponseStylePrompt(cfg) + getSkillsExplanation() + skillsPrompt + memory.PromptSection() + instructionsPrompt(loadedInstructions)
+
+	messages := []Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+	}
+
+	if startupOutput != "" {
+		messages = append(messages, Message{Role: "system", Content: "Startup Instructions:\n" + startupOutput})
+	}
+	if len(interruptedEdits) > 0 {
+		messages = append(messages, Message{Role: "system", Content: "The previous session was interrupted while editing files. Check these before relying on them:\n" + strings.Join(interruptedEdits, "\n")})
+	}
+
+	// Load history
+	recoverTurn := *continueSession
+	if *continueSession {
+		savedMessages, live := loadHistory()
+		if live {
+			fmt.Printf("\033[33mThat session is still running in another process. Continuing from its last save; both sessions keep their own history.\033[0m\n")
+			// Its current turn isn't interrupted, just not finished yet
+			recoverTurn = false
+			savedMessages, _ = repairHistory(savedMessages, notExecutedResult("The other session was still running this tool call when this session started"))
+		}
+		if len(savedMessages) > 0 {
+			for _, m := range savedMessages {
+				if m.Role != "system" {
+					messages = append(messages, m)
+				}
+			}
+			fmt.Printf("Loaded %d messages from history.\n", len(messages)-1)
+			sessionTodos.Restore(messages)
+		}
+	}
+
+	client := &http.Client{}
+	env := &ToolEnv{
+		APIKey:       apiKey,
+		Client:       client,
+		Provider:     provider,
+		SystemPrompt: systemPrompt,
+		Skills:       skills,
+		SkillsPrompt: skillsPrompt,
+		AutoApprove:  *autoApprove,
+		Memory:       memory,
+		Patches:      newPatchStore(),
+		Approvals:    getScriptApprovals(),
+	}
+
+	// Webhooks report on unattended work; in the REPL the user is watching
+	if archive != nil || quick || watch || serve || acp {
+		enableWebhooks(cfg.Webhooks)
+	}
+
+	if archive != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		mu.Lock()
+		currentCancel = cancel
+		mu.Unlock()
+		err := runArchiveTask(ctx, env, archive, *taskFlag)
+		cancel()
+		runSessionEndHooks(skills)
+		flushWebhooks(30 * time.Second)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			archive.Cleanup()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if quick {
+		ctx, cancel := context.WithCancel(context.Background())
+		mu.Lock()
+		currentCancel = cancel
+		mu.Unlock()
+		err := runQuickTask(ctx, env, quickTask)
+		cancel()
+		runSessionEndHooks(skills)
+		flushWebhooks(30 * time.Second)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if watch {
+		signal.Stop(sigChan) // Ctrl+C stops the current run and exits
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		err := runWatch(ctx, env, watchOptions{
+			Prompt:   *watchPromptFlag,
+			Every:    *everyFlag,
+			OnChange: *onChangeFlag,
+			Report:   *reportFlag,
+			Issues:   *issuesFlag,
+		})
+		stop()
+		runSessionEndHooks(skills)
+		flushWebhooks(30 * time.Second)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if serve {
+		signal.Stop(sigChan) // The server handles Ctrl+C itself
+		ws := newWebServer(env, messages, serveToken(*tokenFlag))
+		ws.noUI = *noUIFlag
+		err := runServer(ws, net.JoinHostPort(*hostFlag, strconv.Itoa(*portFlag)))
+		runSessionEndHooks(skills)
+		flushWebhooks(30 * time.Second)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if acp {
+		signal.Stop(sigChan) // The editor stops the agent by closing stdin
+		err := runACP(env, messages, acpIn, acpOut)
+		runSessionEndHooks(skills)
+		flushWebhooks(30 * time.Second)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *tuiFlag {
+		if err := tui.Enable(); err != nil {
+			fmt.Printf("Warning: -tui unavailable (%v); using the plain REPL.\n", err)
+		}
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("Welcome to Simple Agent %s (Model: %s)\n", Version, ModelName)
+	if len(skills) > 0 {
+		fmt.Printf("Loaded %d skills from ./skills\n", len(skills))
+	}
+	fmt.Println("Type your message. Press Ctrl+D (or Ctrl+Z on Windows) on a new line to send. Type /help for commands (e.g. /clear). Ctrl+C to pause a turn (twice to abort) or exit.")
+
+	if cfg.FileWatcher {
+		root, _ := os.Getwd()
+		if fileWatch, err = startFileWatcher(root); err != nil {
+			fmt.Printf("Warning: File watcher disabled: %v\n", err)
+		}
+	}
+	if cfg.CoverageCheck {
+		if coverageWatch, err = startCoverageChecker(context.Background()); err != nil {
+			fmt.Printf("Warning: Coverage check disabled: %v\n", err)
+		}
+	}
+
+	if currentPlan != nil && currentPlan.nextPendingStep() != -1 {
+		fmt.Printf("Unfinished plan: %s (/plan to show, /plan resume to continue)\n", currentPlan.Goal)
+	}
+
+	transcript := openTranscript()
+
+	var pendingInput string
+	var commandHistory []string
+
+	if recoverTurn {
+		var resume bool
+		if messages, resume = recoverInterruptedTurn(env, messages); resume {
+			pendingInput = resumeTurnPrompt
+		}
+	}
+
+	var fixer *testFixer
+	if *fixTestsFlag {
+		command := *testCmdFlag
+		if command == "" {
+			command = projectProfile(".").TestCommand
+		}
+		if command == "" {
+			fmt.Println("-fix-tests: no test command found; pass -test-cmd or set test_command in the config.")
+			os.Exit(1)
+		}
+		fixer = &testFixer{Command: command, MaxRounds: *fixRoundsFlag}
+		if task := fixer.next(context.Background()); task != "" && pendingInput == "" {
+			pendingInput = task
+		} else {
+			fixer = nil
+		}
+	}
+
+	for {
+		var input string
+		// An approved plan feeds its next step in as the user message
+		if pendingInput == "" && currentPlan != nil && currentPlan.Active {
+			if prompt, ok := currentPlan.StartNextStep(); ok {
+				pendingInput = prompt
+			} else {
+				currentPlan.Active = false
+				currentPlan.save()
+			}
+		}
+		if pendingInput != "" {
+			fmt.Printf("> %s\n", pendingInput)
+			input = pendingInput
+			pendingInput = ""
+		} else {
+			fmt.Print("\033[1;32mUser 👤\033[0m > ")
+			var err error
+			stopIdle := watchIdle(messages)
+			input, err = readInteractiveInput(reader, commandHistory)
+			if away := stopIdle(); idleRecapAfter > 0 && away >= idleRecapAfter && err == nil {
+				fmt.Printf("\033[36mWelcome back (away %s). %s\033[0m\n", formatAway(away), sessionRecap(messages))
+			}
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				if err.Error() == "interrupted" {
+					restoreTerminal()
+					tui.Close()
+					fmt.Println("Exiting...")
+					runSessionEndHooks(skills)
+					os.Exit(0)
+				}
+				fmt.Printf("Error reading input: %v\n", err)
+				os.Exit(1)
+			}
+			if fields := strings.Fields(input); len(fields) > 0 && fields[0] == "/paste" {
+				terminator := ""
+				if len(fields) > 1 {
+					terminator = fields[1]
+				}
+				if input, err = readPastedBlock(reader, terminator); err != nil {
+					fmt.Printf("Error reading input: %v\n", err)
+					continue
+				}
+				fmt.Printf("(Pasted %d lines, %d bytes)\n", strings.Count(input, "\n")+1, len(input))
+			}
+			if strings.TrimSpace(input) == "" {
+				continue
+			}
+			commandHistory = append(commandHistory, input)
+
+			if handleSlashCommand(input, &messages, skills, memory, systemPrompt, apiKey, env.Provider) {
+				if pendingRetry != nil {
+					pendingInput, pendingAttachments = pendingRetry.Input, pendingRetry.Parts
+				} else if skillCommandInput != "" {
+					pendingInput, skillCommandInput = skillCommandInput, ""
+				}
+				continue
+			}
+			input = guardLargeMessage(context.Background(), "Your message", input, true)
+		}
+
+		// Capture the start index of the current turn's messages
+		startHistoryIndex := len(messages)
+		if *autoBranch {
+			ensureTaskBranch(input)
+		}
+		agentChanges.BeginTurn()
+
+		// Every message of the turn is also recorded in the transcript for /show
+		turn := transcript.NextTurn()
+		addMessage := func(m Message) {
+			messages = append(messages, m)
+			transcript.Record(turn, m)
+			// Saved as it goes so --continue can pick up a turn the process didn't survive
+			saveHistory(messages)
+		}
+
+		input, dropped := attachDroppedFiles(input, env.Provider)
+		addMessage(Message{
+			Role:    "user",
+			Content: input,
+			Parts:   append(pendingAttachments, dropped...),
+		})
+		pendingAttachments = nil
+
+		// Start of turn: Create context and register cancel function
+		ctx, cancel := context.WithCancel(context.Background())
+		mu.Lock()
+		currentCancel = cancel
+		mu.Unlock()
+		ctx, turnSpan := startSpan(ctx, "turn", spanKindInternal)
+		turnSpan.Set("simple_agent.turn", turn)
+		turnStarted := time.Now()
+		atomic.StoreInt32(&turnInProgress, 1)
+
+		var lastUsage int
+
+		// Guidance typed while paused is sent with the next model request, as
+		// it can't be inserted between a tool call and its result
+		atomic.StoreInt32(&pauseRequested, 0)
+		var pendingGuidance []string
+		pauseIfRequested := func() (aborted bool) {
+			if atomic.LoadInt32(&pauseRequested) == 0 {
+				return false
+			}
+			guidance, abort := pauseTurn(ctx)
+			if abort {
+				fmt.Println("[Turn aborted]")
+				cancel()
+				return true
+			}
+			pendingGuidance = append(pendingGuidance, guidance...)
+			atomic.StoreInt32(&pauseRequested, 0)
+			return false
+		}
+
+		budget := newTurnBudget()
+		wrapUp := false
+
+		// Interaction loop (handle tool calls)
+		for {
+			if ctx.Err() != nil || pauseIfRequested() {
+				break
+			}
+			if spent := budget.exceeded(); spent != "" && !wrapUp {
+				choice := askTurnBudget(ctx, spent)
+				if choice == "abort" {
+					fmt.Println("[Turn aborted]")
+					break
+				}
+				if choice == "continue" {
+					budget.extend()
+				} else {
+					wrapUp = true
+					addMessage(Message{Role: "system", Content: turnBudgetSummaryPrompt(spent)})
+				}
+			}
+			if len(pendingGuidance) > 0 {
+				addMessage(Message{
+					Role:    "user",
+					Content: "[Guidance added while the turn was paused]\n" + strings.Join(pendingGuidance, "\n"),
+				})
+				pendingGuidance = nil
+			}
+
+			if changes := fileWatch.Drain(); len(changes) > 0 {
+				fmt.Printf("\033[33m👀 Changed outside the agent: %s\033[0m\n", strings.Join(changes, ", "))
+				addMessage(Message{Role: "system", Content: externalChangesNotice(changes)})
+			}
+			if notice := coverageWatch.TakeNotice(); notice != "" {
+				addMessage(Message{Role: "system", Content: notice})
+			}
+
+			// Pre-prompt hook: inject dynamic context for this request only
+			requestMessages := messages
+			if hasHook(skills, "pre_prompt") {
+				inputFile, cleanup := writeHookPayload("pre_prompt", input)
+				promptHookOut, hookErr := runSkillHooks(ctx, skills, "pre_prompt", map[string]string{"input_file": inputFile})
+				cleanup()
+				if hookErr != nil {
+					fmt.Printf("Request blocked: %v\n%s", hookErr, promptHookOut)
+					break
+				}
+				if strings.TrimSpace(promptHookOut) != "" {
+					requestMessages = append(messages[:len(messages):len(messages)], Message{
+						Role:    "system",
+						Content: "[Dynamic Context]\n" + promptHookOut,
+					})
+				}
+			}
+			if relevant := memory.RelevantContext(input); relevant != "" {
+				requestMessages = append(requestMessages[:len(requestMessages):len(requestMessages)], Message{
+					Role:    "system",
+					Content: "[Relevant Memories]\n" + relevant,
+				})
+			}
+
+			reqBody := ChatCompletionRequest{
+				Model:           ModelName,
+				Messages:        requestMessages,
+				Tools:           enabledTools(allTools()),
+				ExtraBody:       getExtraBody(env.Provider),
+				ReasoningEffort: getReasoningEffort(env.Provider),
+			}
+			if wrapUp {
+				reqBody.Tools = nil
+			}
+
+			budget.requests++
+			chatResp, err := requestCompletion(ctx, client, apiKey, reqBody)
+			if err != nil {
+				// Let the model see what happened when the user follows up
+				var retryErr *RetryError
+				if errors.As(err, &retryErr) {
+					addMessage(Message{
+						Role:    "system",
+						Content: fmt.Sprintf("[System] The previous request could not be completed: %v. If this persists, consider a smaller request (e.g. shorten_context) or ask the user to retry later.", retryErr),
+					})
+				}
+				if ctx.Err() == nil {
+					if hookOut := runErrorHooks(ctx, skills, "api", "", err.Error()); hookOut != "" {
+						fmt.Printf("[On-Error Hook Output]\n%s\n", hookOut)
+					}
+				}
+				break
+			}
+
+			if chatResp.Usage != nil {
+				lastUsage = chatResp.Usage.TotalTokens
+			}
+
+			msg := chatResp.Choices[0].Message
+			if wrapUp {
+				// The summary ends the turn, whatever the model would call next
+				msg.ToolCalls = nil
+			}
+			addMessage(msg)
+
+			// Print thoughts if present
+			if len(msg.ToolCalls) > 0 {
+				extractAndPrintThoughts(msg.Content)
+			}
+			printThought(msg.ExtraContent)
+
+			// Post-response hook; output is added once the tool results are in
+			var responseHookOut string
+			if hasHook(skills, "post_response") {
+				responseFile, cleanup := writeHookPayload("post_response", msg.Content)
+				responseHookOut, _ = runSkillHooks(ctx, skills, "post_response", map[string]string{
+					"response_file": responseFile,
+					"tool_calls":    strconv.Itoa(len(msg.ToolCalls)),
+				})
+				cleanup()
+			}
+
+			contextReset := false
+
+			if len(msg.ToolCalls) > 0 {
+				for _, toolCall := range msg.ToolCalls {
+					if ctx.Err() != nil || pauseIfRequested() {
+						break
+					}
+
+					printThought(toolCall.ExtraContent)
+					budget.toolCalls++
+
+					var toolResult string
+					var toolErr error
+
+					if toolCall.Function.Name == "shorten_context" && !disabledTools["shorten_context"] {
+						fmt.Printf("\n\033[1;35m🛠  Tool Call: shorten_context\033[0m\n")
+						var args struct {
+							Task   string `json:"task_description"`
+							Future string `json:"future_plans"`
+							Vital  string `json:"vital_information"`
+						}
+						if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+							toolErr = invalidArguments(err)
+						} else {
+							fmt.Println("Summarizing context...")
+							summary, err := summarizeContext(apiKey, messages, args.Task, args.Future, args.Vital)
+							if err != nil {
+								toolErr = fmt.Errorf("failed to summarize: %v", err)
+							} else {
+								if strings.TrimSpace(summary) == "" {
+									summary = "(No summary provided by the model)"
+								}
+								// Reset context
+								sysMsg := messages[0]
+								messages = []Message{sysMsg}
+								addMessage(Message{
+									Role:    "user",
+									Content: fmt.Sprintf("Context has been shortened. Summary of previous conversation:\n%s", summary) + sessionTodos.Snapshot(),
+								})
+
+								fmt.Println("Context shortened.")
+								fmt.Println("Gemini (Summary):")
+								printMarkdown(summary)
+
+								contextReset = true
+							}
+						}
+					} else {
+						toolResult, toolErr = executeTool(ctx, env, toolCall)
+						toolResult = guardLargeMessage(ctx, "The "+toolCall.Function.Name+" result", toolResult, true)
+					}
+
+					// Append tool response
+					content := toolResult
+					if toolErr != nil {
+						fmt.Printf("Tool Error: %v\n", toolErr)
+						content = formatToolError(toolErr)
+						if hookOut := runErrorHooks(ctx, skills, "tool", toolCall.Function.Name, toolErr.Error()); hookOut != "" {
+							content += "\n\n[On-Error Hook Output]\n" + hookOut
+						}
+					}
+
+					if !contextReset {
+						addMessage(Message{
+							Role:       "tool",
+							Content:    content,
+							ToolCallID: toolCall.ID,
+						})
+					}
+				}
+
+				if contextReset {
+					break
+				}
+
+				if responseHookOut != "" {
+					addMessage(Message{
+						Role:    "system",
+						Content: "[Post-Response Hook Output]\n" + responseHookOut,
+					})
+				}
+
+				// Check for new skills
+				// Re-discover only project skills for dynamic updates
+				currentProjectSkills := projectSkillScanner.Scan()
+
+				// Merge again
+				for _, s := range currentProjectSkills {
+					skillMap[s.Name] = s
+				}
+
+				var newSkills []Skill
+				for _, s := range skillMap {
+					if !knownSkills[s.Name] {
+						newSkills = append(newSkills, s)
+						knownSkills[s.Name] = true
+					}
+				}
+
+				if len(newSkills) > 0 {
+					// Rebuild main skills list
+					skills = []Skill{}
+					for _, s := range skillMap {
+						skills = append(skills, s)
+					}
+					skillsPrompt = generateSkillsPrompt(skills)
+					env.Skills, env.SkillsPrompt = skills, skillsPrompt
+
+					var sb strings.Builder
+					sb.WriteString("SYSTEM NOTICE: New skills discovered:\n")
+					for _, s := range newSkills {
+						sb.WriteString(fmt.Sprintf("- %s: %s\n", s.Name, s.Description))
+					}
+
+					addMessage(Message{
+						Role:    "system",
+						Content: sb.String(),
+					})
+					fmt.Println(sb.String()) // Also print to console for user visibility
+				}
+
+				// Skill instructions edited mid-session would otherwise drift silently
+				if changed := changedSkills(skills); len(changed) > 0 {
+					var sb strings.Builder
+					sb.WriteString("SYSTEM NOTICE: The instructions of these skills changed on disk during this session. Follow the updated versions below instead of what you read earlier:\n")
+					for _, s := range changed {
+						body, _ := readSkillBody(s.DefinitionFile)
+						sb.WriteString(fmt.Sprintf("\n[Skill: %s Instructions]\n%s\n", s.Name, body))
+						fmt.Printf("\033[33mSkill '%s' changed; sent the updated instructions to the model.\033[0m\n", s.Name)
+					}
+					addMessage(Message{
+						Role:    "system",
+						Content: sb.String(),
+					})
+				}
+
+				// Loop back to send tool outputs to model
+				continue
+			}
+
+			if contextReset {
+				break
+			}
+
+			// No tool calls, just print response
+			cleanContent := extractAndPrintThoughts(msg.Content)
+			if strings.TrimSpace(cleanContent) != "" {
+				fmt.Printf("\n\033[1;34m🤖 Gemini:\033[0m\n")
+				printMarkdown(cleanContent)
+			}
+			if responseHookOut != "" {
+				fmt.Printf("\n[Post-Response Hook Output]\n%s\n", responseHookOut)
+				addMessage(Message{
+					Role:    "system",
+					Content: "[Post-Response Hook Output]\n" + responseHookOut,
+				})
+			}
+			break
+		}
+
+		turnInterrupted := ctx.Err() != nil
+		if turnInterrupted {
+			// Calls skipped by the abort have no results, which the API rejects
+			messages, _ = repairHistory(messages, notExecutedResult("The user aborted the turn before this tool call completed"))
+		}
+		turnSpan.Set("simple_agent.interrupted", turnInterrupted)
+		turnSpan.End(nil)
+		atomic.StoreInt32(&turnInProgress, 0)
+		if took := time.Since(turnStarted); !turnInterrupted && took >= notifyConfig.longTurn() {
+			notify("Simple Agent finished", fmt.Sprintf("Turn done after %s: %s", took.Round(time.Second), finalAnswer(messages[min(startHistoryIndex, len(messages)):])))
+		}
+
+		if pendingRetry != nil {
+			if pendingRetry.Diff && !turnInterrupted && startHistoryIndex <= len(messages) {
+				printAnswerDiff(pendingRetry.Previous, finalAnswer(messages[startHistoryIndex:]))
+			}
+			pendingRetry = nil
+		}
+
+		// End of turn cleanup
+		mu.Lock()
+		if currentCancel != nil {
+			cancel()
+			currentCancel = nil
+		}
+		atomic.StoreInt32(&pauseRequested, 0)
+		mu.Unlock()
+
+		// End of turn: Check for git changes and propose commit. Only files the
+		// agent changed are committed; the user's own edits are left alone.
+		agentChanges.EndTurn()
+		sessionTodos.PrintIfChanged()
+		if !turnInterrupted {
+			coverageWatch.AfterTurn(context.Background(), agentChanges.Pending())
+		}
+		if changed := agentChanges.Pending(); (*gitAutoCommit || *gitForceCommit) && len(changed) > 0 {
+			// Get conversation history for this turn
+			var turnHistory []Message
+			if startHistoryIndex < len(messages) {
+				turnHistory = messages[startHistoryIndex:]
+			}
+
+			// If history is empty (e.g. after context reset), use the full recent context
+			if len(turnHistory) == 0 && len(messages) > 0 {
+				if len(messages) > 1 && messages[0].Role == "system" {
+					turnHistory = messages[1:]
+				} else {
+					turnHistory = messages
+				}
+			}
+
+			if err := performGitCommit(context.Background(), apiKey, turnHistory, skills, changed, *gitForceCommit); err != nil {
+				fmt.Printf("Git commit workflow failed: %v\n", err)
+			}
+		}
+
+		if currentPlan != nil && currentPlan.runningStep() != -1 {
+			if turnInterrupted {
+				currentPlan.PauseStep()
+			} else {
+				currentPlan.FinishStep(context.Background(), env, messages)
+			}
+		}
+
+		// -fix-tests: an interrupted turn hands control back to the user
+		if fixer != nil {
+			if turnInterrupted {
+				fmt.Println("Test fixing stopped.")
+				fixer = nil
+			} else if task := fixer.next(context.Background()); task != "" {
+				pendingInput = task
+			} else {
+				fixer = nil
+			}
+		}
+
+		// Check token usage
+		if threshold := compactThreshold(ModelName); lastUsage > threshold && len(messages) > 2 && !disabledTools["shorten_context"] {
+			fmt.Printf("\n[System] Context size is %d tokens (>%d for %s).\n", lastUsage, threshold, ModelName)
+			fmt.Print("Would you like to ask the model to shorten the context? [y/N]: ")
+			confirm, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.ToLower(strings.TrimSpace(confirm)) == "y" {
+				pendingInput = fmt.Sprintf("The context size has exceeded %d tokens. Please use the 'shorten_context' tool to summarize the conversation and reset the context.", threshold)
+			}
+		}
+		saveHistory(messages)
+		tui.Refresh()
+	}
+
+	tui.Close()
+	runSessionEndHooks(skills)
+}
+
+// spinnerActive ensures only one spinner draws at a time when requests run
+// concurrently (e.g. parallel sub-agents).
+var spinnerActive int32
+
+// pauseTurn suspends a turn at a safe point so the user can inspect the
+// workspace and add guidance. It returns the guidance and whether the user
+// chose to abort the turn instead of resuming.
+func pauseTurn(ctx context.Context) ([]string, bool) {
+	fmt.Println("\n\033[1;33m⏸  Paused.\033[0m Type guidance for the agent, '!<command>' to run a shell command, an empty line to resume, or /abort to cancel the turn.")
+	reader := bufio.NewReader(os.Stdin)
+	var guidance []string
+	for {
+		fmt.Print("\033[1;33mpaused\033[0m > ")
+		line, err := reader.ReadString('\n')
+		if ctx.Err() != nil {
+			return nil, true
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "/abort":
+			return nil, true
+		case line == "":
+			if err != nil {
+				fmt.Println()
+			}
+			fmt.Println("Resuming...")
+			return guidance, false
+		case strings.HasPrefix(line, "!"):
+			cmd := exec.CommandContext(ctx, "sh", "-c", line[1:])
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				fmt.Printf("Command failed: %v\n", err)
+			}
+		default:
+			guidance = append(guidance, line)
+			fmt.Println("Guidance noted. Add more, or press Enter to resume.")
+		}
+	}
+}
+
+func startSpinner(stopChan chan struct{}, doneChan chan struct{}) {
+	defer close(doneChan)
+	if !atomic.CompareAndSwapInt32(&spinnerActive, 0, 1) {
+		<-stopChan
+		return
+	}
+	defer atomic.StoreInt32(&spinnerActive, 0)
+	chars := []rune{'|', '/', '-', '\\'}
+	i := 0
+	start := time.Now()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	// Initial print
+	fmt.Printf("\r%c Waiting... (0s)", chars[0])
+
+	for {
+		select {
+		case <-stopChan:
+			fmt.Print("\r\033[K") // Clear line
+			return
+		case <-ticker.C:
+			elapsed := time.Since(start).Round(time.Second)
+			fmt.Printf("\r%c Waiting... (%s)", chars[i%len(chars)], elapsed)
+			i++
+		}
+	}
+}
+
+func getLatestVersion() (string, error) {
+	resp, err := http.Get("https://api.github.com/repos/robert-at-pretension-io/simple-agent/releases/latest")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API status: %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	return release.TagName, nil
+}
+
+func parseVersion(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	parts := strings.Split(v, ".")
+	var res []int
+	for _, p := range parts {
+		i, _ := strconv.Atoi(p)
+		res = append(res, i)
+	}
+	return res
+}
+
+func isNewer(current, latest string) bool {
+	c := parseVersion(current)
+	l := parseVersion(latest)
+
+	lenC := len(c)
+	lenL := len(l)
+	maxLen := lenC
+	if lenL > maxLen {
+		maxLen = lenL
+	}
+
+	for i := 0; i < maxLen; i++ {
+		vC, vL := 0, 0
+		if i < lenC {
+			vC = c[i]
+		}
+		if i < lenL {
+			vL = l[i]
+		}
+		if vL > vC {
+			return true
+		}
+		if vL < vC {
+			return false
+		}
+	}
+	return false
+}
+
+// setupCoreSkills points CoreSkillsDir at ~/.simple_agent/core_skills and
+// installs the org skills there. The embedded skills are listed from the
+// binary (see loadCoreSkillsIndex) and only extracted when a script, hook or
+// file of one is first used (see ensureCoreSkills).
+func setupCoreSkills() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	// Create a hidden directory in user home for core skills
+	CoreSkillsDir = filepath.Join(home, ".simple_agent", "core_skills")
+	embeddedSkillsDir = CoreSkillsDir
+	return installOrgSkills()
+}
+
+// embeddedSkillsDir is where setupCoreSkills puts the embedded skills. A
+// CoreSkillsDir pointed elsewhere (as the golden tests do) is used as is.
+var embeddedSkillsDir string
+
+// usesEmbeddedSkills reports whether CoreSkillsDir holds the embedded skills.
+func usesEmbeddedSkills() bool {
+	return CoreSkillsDir != "" && CoreSkillsDir == embeddedSkillsDir
+}
+
+var (
+	coreSkillsOnce sync.Once
+	coreSkillsErr  error
+)
+
+// ensureCoreSkills extracts the embedded skills, once per session. The
+// extracted copy is reused while it matches this binary (see
+// coreSkillsStamp), so usually nothing is written; otherwise it is
+// re-extracted next to the old one and swapped in.
+func ensureCoreSkills() error {
+	if !usesEmbeddedSkills() {
+		return nil
+	}
+	coreSkillsOnce.Do(func() {
+		stamp := coreSkillsStamp()
+		if coreSkillsCurrent(stamp) {
+			return
+		}
+		if coreSkillsErr = extractCoreSkills(stamp); coreSkillsErr == nil {
+			coreSkillsErr = installOrgSkills() // The swap took them along
+		}
+		if coreSkillsErr != nil {
+			fmt.Printf("Warning: Failed to extract core skills: %v\n", coreSkillsErr)
+		}
+	})
+	return coreSkillsErr
+}
+
+// ensureCorePath extracts the core skills if path is inside them.
+func ensureCorePath(path string) {
+	if usesEmbeddedSkills() && (path == CoreSkillsDir || strings.HasPrefix(path, CoreSkillsDir+string(os.PathSeparator))) {
+		ensureCoreSkills()
+	}
+}
+
+// isEmbeddedSkill reports whether skill is one of the skills built into the
+// binary, as opposed to an org skill installed beside them.
+func isEmbeddedSkill(skill *Skill) bool {
+	return usesEmbeddedSkills() && isCoreSkill(skill) && !isOrgSkill(skill)
+}
+
+// embeddedSkillFile returns the built-in copy of a core skill file, which
+// can be read before the skills are extracted.
+func embeddedSkillFile(path string) ([]byte, bool) {
+	if !usesEmbeddedSkills() {
+		return nil, false
+	}
+	rel, err := filepath.Rel(CoreSkillsDir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") || strings.HasPrefix(rel, "_org") {
+		return nil, false
+	}
+	data, err := embeddedSkillsFS.ReadFile("skills/" + filepath.ToSlash(rel))
+	return data, err == nil
+}
+
+// coreSkillsIndex caches the parsed core skills and their entries in the
+// skills prompt in ~/.simple_agent/core_skills.json, keyed by the stamp, so
+// a start neither parses the embedded skills nor renders them again.
+type coreSkillsIndex struct {
+	Stamp   string            `json:"stamp"`
+	Dir     string            `json:"dir"` // CoreSkillsDir the skill paths point into
+	Skills  []Skill           `json:"skills"`
+	Prompts map[string]string `json:"prompts"` // Skill name -> its skillPromptEntry
+}
+
+var (
+	coreIndexOnce sync.Once
+	coreIndex     *coreSkillsIndex
+)
+
+func coreSkillsIndexPath() string {
+	return filepath.Join(getAgentHomeDir(), "core_skills.json")
+}
+
+// loadCoreSkillsIndex returns the index for this binary, rebuilding it from
+// the embedded skills when the cached one is for another build.
+func loadCoreSkillsIndex() *coreSkillsIndex {
+	if !usesEmbeddedSkills() {
+		return nil
+	}
+	coreIndexOnce.Do(func() {
+		stamp := coreSkillsStamp()
+		path := coreSkillsIndexPath()
+		var idx coreSkillsIndex
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &idx) == nil && idx.Stamp == stamp && idx.Dir == CoreSkillsDir {
+			coreIndex = &idx
+			return
+		}
+		idx = coreSkillsIndex{Stamp: stamp, Dir: CoreSkillsDir, Skills: parseEmbeddedSkills(), Prompts: make(map[string]string)}
+		for _, s := range idx.Skills {
+			idx.Prompts[s.Name] = skillPromptEntry("", s) // Core paths don't depend on the directory
+		}
+		if data, err := json.Marshal(idx); err == nil && os.MkdirAll(filepath.Dir(path), 0755) == nil {
+			os.WriteFile(path, data, 0644) // Best effort: rebuilt at the next start otherwise
+		}
+		coreIndex = &idx
+	})
+	return coreIndex
+}
+
+// cachedSkillPrompt returns the cached skills prompt entry of an embedded
+// skill.
+func cachedSkillPrompt(skill *Skill) (string, bool) {
+	if coreIndex == nil || !isEmbeddedSkill(skill) {
+		return "", false
+	}
+	entry, ok := coreIndex.Prompts[skill.Name]
+	return entry, ok
+}
+
+// parseEmbeddedSkills parses the SKILL.md of each embedded skill, with the
+// paths the skill has once extracted.
+func parseEmbeddedSkills() []Skill {
+	entries, err := fs.ReadDir(embeddedSkillsFS, "skills")
+	if err != nil {
+		return nil
+	}
+	var skills []Skill
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		data, err := embeddedSkillsFS.ReadFile("skills/" + e.Name() + "/SKILL.md")
+		if err != nil {
+			continue
+		}
+		var scripts []string
+		fs.WalkDir(embeddedSkillsFS, "skills/"+e.Name()+"/scripts", func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			scripts = append(scripts, filepath.Join(CoreSkillsDir, filepath.FromSlash(strings.TrimPrefix(p, "skills/"))))
+			return nil
+		})
+		skill, err := parseSkillDefinition(bytes.NewReader(data), filepath.Join(CoreSkillsDir, e.Name(), "SKILL.md"), scripts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to load core skill %s: %v\n", e.Name(), err)
+			continue
+		}
+		skills = append(skills, skill)
+	}
+	return skills
+}
+
+const coreSkillsStampFile = ".stamp"
+
+var (
+	coreStampOnce sync.Once
+	coreStamp     string
+)
+
+// coreSkillsStamp identifies the embedded skills: the version plus a hash of
+// their contents, so development builds that share a version still update.
+func coreSkillsStamp() string {
+	coreStampOnce.Do(func() {
+		h := sha256.New()
+		fs.WalkDir(embeddedSkillsFS, "skills", func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := embeddedSkillsFS.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00", path, len(data))
+			h.Write(data)
+			return nil
+		})
+		coreStamp = Version + " " + hex.EncodeToString(h.Sum(nil))
+	})
+	return coreStamp
+}
+
+// coreSkillsCurrent reports whether the extracted skills were written for
+// stamp and still have every embedded file at its size.
+func coreSkillsCurrent(stamp string) bool {
+	data, err := os.ReadFile(filepath.Join(CoreSkillsDir, coreSkillsStampFile))
+	if err != nil || strings.TrimSpace(string(data)) != stamp {
+		return false
+	}
+	err = fs.WalkDir(embeddedSkillsFS, "skills", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		embedded, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel("skills", path)
+		info, err := os.Stat(filepath.Join(CoreSkillsDir, relPath))
+		if err != nil || info.Size() != embedded.Size() {
+			return fs.ErrNotExist
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// extractCoreSkills writes the embedded skills to a new directory and swaps
+// it in, so a concurrent session never sees a half-written copy.
+func extractCoreSkills(stamp string) error {
+	tmpDir := fmt.Sprintf("%s.tmp-%d", CoreSkillsDir, os.Getpid())
+	os.RemoveAll(tmpDir)
+	err := fs.WalkDir(embeddedSkillsFS, "skills", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Rel path from "skills" root in embed
+		relPath, _ := filepath.Rel("skills", path)
+		targetPath := filepath.Join(tmpDir, relPath)
+
+		if d.IsDir() {
+			return os.MkdirAll(targetPath, 0755)
+		}
+
+		data, err := embeddedSkillsFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		// Write file (executable for scripts)
+		return os.WriteFile(targetPath, data, 0755)
+	})
+	if err == nil {
+		err = os.WriteFile(filepath.Join(tmpDir, coreSkillsStampFile), []byte(stamp+"\n"), 0644)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	oldDir := fmt.Sprintf("%s.old-%d", CoreSkillsDir, os.Getpid())
+	if err := os.Rename(CoreSkillsDir, oldDir); err != nil && !os.IsNotExist(err) {
+		// Renaming can fail on Windows while another session uses it
+		os.RemoveAll(CoreSkillsDir)
+	}
+	if err := os.Rename(tmpDir, CoreSkillsDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	os.RemoveAll(oldDir)
+	return nil
+}
+
+// --- Org Skills ---
+
+// A platform team can publish skills and instructions for every engineer's
+// agent: "org_skills" in the user's config names a git repository or an
+// https:// .tar.gz/.zip bundle. It is synced at startup into
+// ~/.simple_agent/org_skills (the last synced copy is used when offline) and
+// installed under the core skills as _org/, so org skills get the same
+// read-only, trusted treatment. Core skills override org skills of the same
+// name, and project skills override both. An AGENTS.md (or the configured
+// instruction file names) at the top of the source is loaded before the
+// user's global instructions.
+
+type OrgSkillsConfig struct {
+	Source string `json:"source"`        // git URL, or an https:// .tar.gz/.tgz/.zip bundle
+	Ref    string `json:"ref,omitempty"` // Branch or tag of a git source (default: the default branch)
+}
+
+var orgSkills OrgSkillsConfig
+
+const orgSyncTimeout = 20 * time.Second
+
+// orgSkillsDir is where the org skills are installed.
+func orgSkillsDir() string {
+	if CoreSkillsDir == "" || orgSkills.Source == "" {
+		return ""
+	}
+	return filepath.Join(CoreSkillsDir, "_org")
+}
+
+// orgSkillsCache is where the source is synced to.
+func orgSkillsCache() string {
+	return filepath.Join(getAgentHomeDir(), "org_skills")
+}
+
+func isOrgSkill(skill *Skill) bool {
+	dir := orgSkillsDir()
+	return dir != "" && strings.HasPrefix(skill.Path, dir+string(os.PathSeparator))
+}
+
+// discoverCoreSkills returns the core skills, with the org skills they
+// don't override.
+func discoverCoreSkills() []Skill {
+	var org, core []Skill
+	if idx := loadCoreSkillsIndex(); idx != nil {
+		if dir := orgSkillsDir(); dir != "" {
+			org = discoverSkills(dir)
+		}
+		core = append(core, idx.Skills...)
+		return mergeSkills(org, core)
+	}
+	for _, s := range discoverSkills(CoreSkillsDir) {
+		if isOrgSkill(&s) {
+			org = append(org, s)
+		} else {
+			core = append(core, s)
+		}
+	}
+	return mergeSkills(org, core)
+}
+
+func isBundleSource(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "https://") && (strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") || strings.HasSuffix(lower, ".zip"))
+}
+
+// syncOrgSkills updates the cached source and installs it.
+func syncOrgSkills() error {
+	if orgSkills.Source == "" {
+		return nil
+	}
+	cache := orgSkillsCache()
+	ctx, cancel := context.WithTimeout(context.Background(), orgSyncTimeout)
+	defer cancel()
+	fetch := fetchOrgGit
+	if isBundleSource(orgSkills.Source) {
+		fetch = fetchOrgBundle
+	}
+	if err := fetch(ctx, orgSkills, cache); err != nil {
+		if _, statErr := os.Stat(cache); statErr != nil {
+			return fmt.Errorf("failed to sync %s: %v", orgSkills.Source, err)
+		}
+		fmt.Printf("Warning: Failed to sync org skills from %s (%v); using the last synced copy.\n", orgSkills.Source, err)
+	}
+	return installOrgSkills()
+}
+
+// fetchOrgGit clones the repository into cache, or updates the clone.
+func fetchOrgGit(ctx context.Context, src OrgSkillsConfig, cache string) error {
+	git := func(args ...string) error {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if out, err := exec.Command("git", "-C", cache, "remote", "get-url", "origin").Output(); err == nil && strings.TrimSpace(string(out)) == src.Source {
+		ref := src.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		if err := git("-C", cache, "fetch", "--depth", "1", "origin", ref); err != nil {
+			return err
+		}
+		return git("-C", cache, "reset", "--hard", "--quiet", "FETCH_HEAD")
+	}
+
+	// First sync, or the source changed
+	tmp := cache + ".new"
+	os.RemoveAll(tmp)
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	if src.Ref != "" {
+		args = append(args, "--branch", src.Ref)
+	}
+	if err := git(append(args, src.Source, tmp)...); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	os.RemoveAll(cache)
+	return os.Rename(tmp, cache)
+}
+
+// fetchOrgBundle downloads and unpacks the bundle into cache. A bundle with
+// a single top-level directory (as GitHub archives have) is unwrapped.
+func fetchOrgBundle(ctx context.Context, src OrgSkillsConfig, cache string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.Source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+	f, err := os.CreateTemp("", "simple-agent-org-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	tmp := cache + ".new"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	switch format := archiveFormat(src.Source); format {
+	case "zip":
+		err = extractZip(f.Name(), tmp)
+	default:
+		err = extractTar(f.Name(), tmp, format == "tar.gz")
+	}
+	if err != nil {
+		return err
+	}
+	root := tmp
+	if entries, err := os.ReadDir(tmp); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmp, entries[0].Name())
+	}
+	os.RemoveAll(cache)
+	return os.Rename(root, cache)
+}
+
+// installOrgSkills copies the synced source under the core skills.
+// ensureCoreSkills installs it again after re-extracting them.
+func installOrgSkills() error {
+	dir := orgSkillsDir()
+	if dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(orgSkillsCache()); err != nil {
+		return nil // Never synced
+	}
+	os.RemoveAll(dir)
+	if err := copyDir(orgSkillsCache(), dir); err != nil {
+		return fmt.Errorf("failed to install org skills: %v", err)
+	}
+	return os.RemoveAll(filepath.Join(dir, ".git"))
+}
+
+// --- Models ---
+
+// ModelInfo describes a model's context window and price in USD per million
+// tokens. Entries can be added or overridden with "models" in the config.
+type ModelInfo struct {
+	Provider      string  `json:"provider"`
+	ContextWindow int     `json:"context_window"`
+	InputPrice    float64 `json:"input_price"`
+	OutputPrice   float64 `json:"output_price"`
+	ToolProtocol  string  `json:"tool_protocol,omitempty"` // "text" for backends without native tool calling
+}
+
+var knownModels = map[string]ModelInfo{
+	"gemini-3-pro-preview":   {Provider: "gemini", ContextWindow: 1048576, InputPrice: 2.00, OutputPrice: 12.00},
+	"gemini-3-flash-preview": {Provider: "gemini", ContextWindow: 1048576, InputPrice: 0.50, OutputPrice: 3.00},
+	"gemini-2.5-pro":         {Provider: "gemini", ContextWindow: 1048576, InputPrice: 1.25, OutputPrice: 10.00},
+	"gemini-2.5-flash":       {Provider: "gemini", ContextWindow: 1048576, InputPrice: 0.30, OutputPrice: 2.50},
+	"gpt-4o":                 {Provider: "openai", ContextWindow: 128000, InputPrice: 2.50, OutputPrice: 10.00},
+	"gpt-4o-mini":            {Provider: "openai", ContextWindow: 128000, InputPrice: 0.15, OutputPrice: 0.60},
+	"gpt-4.1":                {Provider: "openai", ContextWindow: 1047576, InputPrice: 2.00, OutputPrice: 8.00},
+	"gpt-4.1-mini":           {Provider: "openai", ContextWindow: 1047576, InputPrice: 0.40, OutputPrice: 1.60},
+}
+
+// modelAliases are shorthands accepted by -model and /model.
+var modelAliases = map[string]string{
+	"pro":   "gemini-3-pro-preview",
+	"flash": "gemini-3-flash-preview",
+}
+
+// compactFraction of the context window is where the user is offered to
+// shorten the conversation; quality drops well before the hard limit.
+const compactFraction = 0.4
+
+const defaultCompactThreshold = 400000
+
+var openAIReasoningModelRe = regexp.MustCompile(`^o\d`)
+
+// useModel points the API globals at the provider of a -model value, which
+// is a provider or a specific model of one, and returns the provider.
+func useModel(value string) (string, error) {
+	provider, model := value, ""
+	if provider != "gemini" && provider != "openai" {
+		model = resolveModelName(provider)
+		if provider = providerForModel(model); provider == "" {
+			provider = value
+		}
+	}
+
+	switch provider {
+	case "openai":
+		GeminiURL = OpenAIURL
+		ModelName = OpenAIModelName
+		FlashModelName = OpenAIModelName
+		EmbeddingURL = OpenAIEmbeddingURL
+		EmbeddingModelName = OpenAIEmbeddingModelName
+		// Any OpenAI-compatible server, e.g. a local model
+		if baseURL := os.Getenv("OPENAI_BASE_URL"); baseURL != "" {
+			GeminiURL = strings.TrimRight(baseURL, "/") + "/chat/completions"
+		}
+	case "gemini":
+		// Globals are already set to Gemini defaults
+	default:
+		return "", fmt.Errorf("Unknown model: %s. usage: -model gemini|openai|<model name>", value)
+	}
+	if model != "" {
+		ModelName = model
+	}
+	return provider, nil
+}
+
+func resolveModelName(name string) string {
+	if alias, ok := modelAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// providerForModel returns "gemini" or "openai" for a model name, or "" if
+// it can't tell.
+func providerForModel(name string) string {
+	if info, ok := knownModels[name]; ok && info.Provider != "" {
+		return info.Provider
+	}
+	switch {
+	case strings.HasPrefix(name, "gemini"):
+		return "gemini"
+	case strings.HasPrefix(name, "gpt-"), strings.HasPrefix(name, "chatgpt-"), openAIReasoningModelRe.MatchString(name):
+		return "openai"
+	}
+	return ""
+}
+
+func compactThreshold(model string) int {
+	info, ok := knownModels[model]
+	if !ok || info.ContextWindow == 0 {
+		return defaultCompactThreshold
+	}
+	return int(float64(info.ContextWindow) * compactFraction)
+}
+
+type modelUsage struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// UsageTracker accumulates token usage per model for the session, across the
+// main loop, sub-agents and helper requests.
+type UsageTracker struct {
+	mu         sync.Mutex
+	byModel    map[string]*modelUsage
+	lastPrompt int // Prompt tokens of the latest request, i.e. the context size
+}
+
+var sessionUsage = &UsageTracker{byModel: make(map[string]*modelUsage)}
+
+func (u *UsageTracker) Record(model string, usage *Usage) {
+	if usage == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entry := u.byModel[model]
+	if entry == nil {
+		entry = &modelUsage{}
+		u.byModel[model] = entry
+	}
+	entry.Requests++
+	entry.PromptTokens += usage.PromptTokens
+	entry.CompletionTokens += usage.CompletionTokens
+	u.lastPrompt = usage.PromptTokens
+}
+
+// Totals returns the session's input and output tokens, the estimated cost
+// of models with known pricing, and the latest context size.
+func (u *UsageTracker) Totals() (in, out int, cost float64, contextTokens int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for model, entry := range u.byModel {
+		in += entry.PromptTokens
+		out += entry.CompletionTokens
+		if info, ok := knownModels[model]; ok {
+			cost += (float64(entry.PromptTokens)*info.InputPrice + float64(entry.CompletionTokens)*info.OutputPrice) / 1e6
+		}
+	}
+	return in, out, cost, u.lastPrompt
+}
+
+// Print shows usage and estimated cost per model. Models without pricing are
+// listed without a cost.
+func (u *UsageTracker) Print() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.byModel) == 0 {
+		fmt.Println("No model requests yet.")
+		return
+	}
+	models := make([]string, 0, len(u.byModel))
+	for model := range u.byModel {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	var total float64
+	for _, model := range models {
+		entry := u.byModel[model]
+		line := fmt.Sprintf("  %-24s %4d requests, %9d in, %8d out", model, entry.Requests, entry.PromptTokens, entry.CompletionTokens)
+		if info, ok := knownModels[model]; ok {
+			cost := (float64(entry.PromptTokens)*info.InputPrice + float64(entry.CompletionTokens)*info.OutputPrice) / 1e6
+			total += cost
+			line += fmt.Sprintf("  $%.4f", cost)
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("  Estimated total: $%.4f\n", total)
+}
+
+// handleModelCommand handles "/model [name]". Switching is limited to the
+// current provider, whose API key and endpoint are already set up.
+func handleModelCommand(arg, provider string) {
+	if arg == "" {
+		info, ok := knownModels[ModelName]
+		fmt.Printf("Current model: %s", ModelName)
+		if ok {
+			fmt.Printf(" (context %d tokens, $%.2f/$%.2f per 1M tokens in/out)", info.ContextWindow, info.InputPrice, info.OutputPrice)
+		}
+		fmt.Println()
+		var names []string
+		for name, info := range knownModels {
+			if info.Provider == provider {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		fmt.Println("Known models (switch with /model <name>):")
+		for _, name := range names {
+			marker := " "
+			if name == ModelName {
+				marker = "*"
+			}
+			info := knownModels[name]
+			fmt.Printf(" %s %-24s %8d tokens  $%.2f/$%.2f\n", marker, name, info.ContextWindow, info.InputPrice, info.OutputPrice)
+		}
+		return
+	}
+
+	name := resolveModelName(arg)
+	if p := providerForModel(name); p != "" && p != provider {
+		fmt.Printf("%s is a %s model; restart with -model %s to switch providers.\n", name, p, name)
+		return
+	}
+	if _, ok := knownModels[name]; !ok {
+		fmt.Printf("Warning: %s is not a known model; cost and context limits won't be tracked for it.\n", name)
+	}
+	ModelName = name
+	fmt.Printf("Switched to %s (context shortening suggested above %d tokens).\n", ModelName, compactThreshold(ModelName))
+}
+
+// --- Retry Policy ---
+
+// RetryPolicy controls how failed API requests are retried. Rate limits,
+// server errors and network errors each have their own retry budget. Delays
+// grow exponentially with random jitter, and a Retry-After header from the
+// server takes precedence.
+type RetryPolicy struct {
+	RateLimitRetries   int     `json:"rate_limit_retries"`   // HTTP 429
+	ServerErrorRetries int     `json:"server_error_retries"` // HTTP 5xx
+	NetworkRetries     int     `json:"network_retries"`      // Connection and read errors
+	BaseDelayMs        int     `json:"base_delay_ms"`
+	MaxDelayMs         int     `json:"max_delay_ms"`
+	Jitter             float64 `json:"jitter"` // Fraction of each delay that is randomized (0-1)
+
+	// After DowngradeAfter rate-limit retries, each further retry of the
+	// request applies the next step of Downgrade: "thinking", "flash" or "shrink"
+	DowngradeAfter int      `json:"downgrade_after"`
+	Downgrade      []string `json:"downgrade"`
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	RateLimitRetries:   7,
+	ServerErrorRetries: 4,
+	NetworkRetries:     3,
+	BaseDelayMs:        2000,
+	MaxDelayMs:         60000,
+	Jitter:             0.2,
+	DowngradeAfter:     3,
+	Downgrade:          []string{"thinking", "flash", "shrink"},
+}
+
+// retryPolicy is the active policy; main sets it from the config.
+var retryPolicy = defaultRetryPolicy
+
+// Retry-After values beyond this are treated as a persistent failure.
+const maxRetryAfter = 5 * time.Minute
+
+var retryClassNames = map[string]string{
+	"rate_limit":   "rate limited",
+	"server_error": "server error",
+	"network":      "network error",
+}
+
+// RetryError reports a request that kept failing after all retries. Its
+// message is written for the model as well as the user.
+type RetryError struct {
+	Class    string // "rate_limit", "server_error" or "network"
+	Attempts int
+	Last     string
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("API request failed persistently (%s, %d attempts): %s", retryClassNames[e.Class], e.Attempts, e.Last)
+}
+
+// classifyFailure returns the retry class of a failed request, or "" if it
+// should not be retried.
+func classifyFailure(statusCode int, err error) string {
+	switch {
+	case err != nil:
+		return "network"
+	case statusCode == http.StatusTooManyRequests:
+		return "rate_limit"
+	case statusCode >= 500:
+		return "server_error"
+	}
+	return ""
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date.
+func parseRetryAfter(h http.Header) time.Duration {
+	value := strings.TrimSpace(h.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func truncateForError(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 300 {
+		return s[:300] + "..."
+	}
+	return s
+}
+
+// retrier tracks the retries of a single request.
+type retrier struct {
+	policy     RetryPolicy
+	attempts   int
+	used       map[string]int
+	downgrades int // Steps of policy.Downgrade tried so far
+}
+
+func newRetrier() *retrier {
+	return &retrier{policy: retryPolicy, used: make(map[string]int)}
+}
+
+// next returns how long to wait before retrying a failure of the given
+// class, or false when that class has used up its retries.
+func (r *retrier) next(class string, retryAfter time.Duration) (time.Duration, bool) {
+	limit := 0
+	switch class {
+	case "rate_limit":
+		limit = r.policy.RateLimitRetries
+	case "server_error":
+		limit = r.policy.ServerErrorRetries
+	case "network":
+		limit = r.policy.NetworkRetries
+	}
+	if r.used[class] >= limit || retryAfter > maxRetryAfter {
+		return 0, false
+	}
+	r.used[class]++
+	r.attempts++
+
+	if retryAfter > 0 {
+		return retryAfter, true
+	}
+	delay := time.Duration(r.policy.BaseDelayMs) * time.Millisecond
+	maxDelay := time.Duration(r.policy.MaxDelayMs) * time.Millisecond
+	for i := 1; i < r.attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if r.policy.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + r.policy.Jitter*(2*rand.Float64()-1)))
+	}
+	return delay, true
+}
+
+func (r *retrier) failure(class, last string) *RetryError {
+	return &RetryError{Class: class, Attempts: r.attempts + 1, Last: last}
+}
+
+// downgrade makes a request that keeps getting rate limited cheaper by
+// applying the next step of the policy that changes anything. It returns a
+// description of the change, or "" if there was none.
+func (r *retrier) downgrade(req *ChatCompletionRequest) string {
+	if r.used["rate_limit"] < r.policy.DowngradeAfter {
+		return ""
+	}
+	for r.downgrades < len(r.policy.Downgrade) {
+		step := r.policy.Downgrade[r.downgrades]
+		r.downgrades++
+		if desc := downgradeRequest(req, step); desc != "" {
+			return desc
+		}
+	}
+	return ""
+}
+
+const shrunkToolOutput = "[Tool output left out of this request because of rate limits]"
+
+// downgradeRequest applies one downgrade step to req.
+func downgradeRequest(req *ChatCompletionRequest, step string) string {
+	switch step {
+	case "thinking":
+		if req.ExtraBody != nil { // Only set for Gemini
+			config := map[string]any{"include_thoughts": false}
+			if strings.HasPrefix(req.Model, "gemini-3") {
+				config["thinking_level"] = "low"
+			}
+			data, _ := json.Marshal(map[string]any{"google": map[string]any{"thinking_config": config}})
+			if string(data) != string(req.ExtraBody) {
+				req.ExtraBody = data
+				return "thoughts off, minimal thinking"
+			}
+		}
+		if req.ReasoningEffort != "" && req.ReasoningEffort != "low" {
+			req.ReasoningEffort = "low"
+			return "low reasoning effort"
+		}
+	case "flash":
+		if FlashModelName != "" && req.Model != FlashModelName {
+			req.Model = FlashModelName
+			return "using " + FlashModelName
+		}
+	case "shrink":
+		// Results of the current turn are kept; the model is working with them
+		last := 0
+		for i, msg := range req.Messages {
+			if msg.Role == "user" {
+				last = i
+			}
+		}
+		count, saved := 0, 0
+		for i := range req.Messages[:last] {
+			if msg := &req.Messages[i]; msg.Role == "tool" && len(msg.Content) > len(shrunkToolOutput) {
+				saved += len(msg.Content) - len(shrunkToolOutput)
+				msg.Content = shrunkToolOutput
+				count++
+			}
+		}
+		if count > 0 {
+			return fmt.Sprintf("left out %d earlier tool output(s), ~%d tokens", count, saved/4)
+		}
+	}
+	return ""
+}
+
+// --- Project Profile ---
+
+// ProjectProfile is what the agent detects about a project from its build
+// files at startup: it goes into the system prompt, so the model doesn't
+// rediscover how to build and test, and into the environment of skill
+// scripts and hooks as SIMPLE_AGENT_* variables.
+type ProjectProfile struct {
+	Language       string // e.g. Go, TypeScript; empty if unknown
+	BuildTool      string // e.g. go, cargo, npm, make
+	BuildCommand   string // Builds or type-checks the project
+	TestCommand    string // test_command from the config wins
+	PackageManager string // e.g. go modules, pnpm, poetry
+}
+
+// configuredTestCommand is test_command from the config.
+var configuredTestCommand string
+
+// detectProjectProfile inspects the build files in dir. The first match
+// decides the language, so a Go module with a package.json for its docs is
+// still a Go project; a Makefile fills in what the language didn't.
+func detectProjectProfile(dir string) ProjectProfile {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	var p ProjectProfile
+	switch {
+	case exists("go.mod"):
+		p = ProjectProfile{Language: "Go", BuildTool: "go", BuildCommand: "go build ./...", TestCommand: "go test ./...", PackageManager: "go modules"}
+	case exists("Cargo.toml"):
+		p = ProjectProfile{Language: "Rust", BuildTool: "cargo", BuildCommand: "cargo check", TestCommand: "cargo test", PackageManager: "cargo"}
+	case exists("package.json"):
+		p.Language = "JavaScript"
+		if exists("tsconfig.json") {
+			p.Language = "TypeScript"
+		}
+		p.PackageManager = "npm"
+		switch {
+		case exists("pnpm-lock.yaml"):
+			p.PackageManager = "pnpm"
+		case exists("yarn.lock"):
+			p.PackageManager = "yarn"
+		case exists("bun.lockb"), exists("bun.lock"):
+			p.PackageManager = "bun"
+		}
+		p.BuildTool = p.PackageManager
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "package.json")); err == nil {
+			json.Unmarshal(data, &pkg)
+		}
+		if pkg.Scripts["build"] != "" {
+			p.BuildCommand = p.PackageManager + " run build"
+		} else if p.Language == "TypeScript" {
+			p.BuildCommand = "npx tsc --noEmit"
+		}
+		if pkg.Scripts["test"] != "" {
+			p.TestCommand = p.PackageManager + " test"
+			if p.PackageManager == "bun" {
+				p.TestCommand = "bun run test" // "bun test" is bun's own runner
+			}
+		}
+	case exists("pyproject.toml"), exists("setup.py"), exists("requirements.txt"), exists("pytest.ini"), exists("tox.ini"):
+		p = ProjectProfile{Language: "Python", PackageManager: "pip"}
+		switch {
+		case exists("uv.lock"):
+			p.PackageManager = "uv"
+		case exists("poetry.lock"):
+			p.PackageManager = "poetry"
+		case exists("Pipfile"):
+			p.PackageManager = "pipenv"
+		}
+		if exists("pyproject.toml") || exists("pytest.ini") || exists("setup.py") || exists("tox.ini") {
+			p.TestCommand = "pytest"
+		}
+	case exists("pom.xml"):
+		p = ProjectProfile{Language: "Java", BuildTool: "maven", BuildCommand: "mvn -q compile", TestCommand: "mvn -q test", PackageManager: "maven"}
+	case exists("build.gradle"), exists("build.gradle.kts"):
+		gradle := "gradle"
+		if exists("gradlew") {
+			gradle = "./gradlew"
+		}
+		p = ProjectProfile{Language: "Java", BuildTool: "gradle", BuildCommand: gradle + " assemble", TestCommand: gradle + " test", PackageManager: "gradle"}
+		if exists("build.gradle.kts") {
+			p.Language = "Kotlin"
+		}
+	case exists("Gemfile"):
+		p = ProjectProfile{Language: "Ruby", PackageManager: "bundler"}
+	case exists("CMakeLists.txt"):
+		p = ProjectProfile{Language: "C/C++", BuildTool: "cmake", BuildCommand: "cmake -S . -B build && cmake --build build"}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "Makefile")); err == nil {
+		if p.BuildTool == "" {
+			p.BuildTool, p.BuildCommand = "make", "make"
+		}
+		if p.TestCommand == "" && regexp.MustCompile(`(?m)^test:`).Match(data) {
+			p.TestCommand = "make test"
+		}
+	}
+	return p
+}
+
+// projectProfile is the detected profile of dir with the config applied.
+func projectProfile(dir string) ProjectProfile {
+	p := detectProjectProfile(dir)
+	if configuredTestCommand != "" {
+		p.TestCommand = configuredTestCommand
+	}
+	if configuredBuildCommand != "" {
+		p.BuildCommand = configuredBuildCommand
+	}
+	return p
+}
+
+func (p ProjectProfile) fields() [][2]string {
+	return [][2]string{
+		{"Language", p.Language},
+		{"Build tool", p.BuildTool},
+		{"Build command", p.BuildCommand},
+		{"Test command", p.TestCommand},
+		{"Package manager", p.PackageManager},
+	}
+}
+
+// PromptSection renders the profile for the system prompt, or "" if nothing
+// was detected.
+func (p ProjectProfile) PromptSection() string {
+	var sb strings.Builder
+	for _, f := range p.fields() {
+		if f[1] != "" {
+			fmt.Fprintf(&sb, "- %s: %s\n", f[0], f[1])
+		}
+	}
+	if sb.Len() == 0 {
+		return ""
+	}
+	return "\n# Project Profile\nDetected from the project's build files. Use these commands unless the user or the project's instructions say otherwise.\n" + sb.String()
+}
+
+// Env returns the profile as SIMPLE_AGENT_* variables for skill scripts.
+// Undetected values are set empty.
+func (p ProjectProfile) Env() []string {
+	return []string{
+		"SIMPLE_AGENT_PROJECT_LANGUAGE=" + p.Language,
+		"SIMPLE_AGENT_BUILD_TOOL=" + p.BuildTool,
+		"SIMPLE_AGENT_BUILD_COMMAND=" + p.BuildCommand,
+		"SIMPLE_AGENT_TEST_COMMAND=" + p.TestCommand,
+		"SIMPLE_AGENT_PACKAGE_MANAGER=" + p.PackageManager,
+	}
+}
+
+// --- Prompt Variables ---
+
+// Prompts can refer to the current context with {name} variables, resolved
+// when each request is sent so they follow the session (a branch switch, a
+// sub-agent's worktree, midnight). They work in the system prompt, which
+// includes skill descriptions, instruction files, memory and the prelude,
+// and in skill command prompts. Unknown names are left alone, so code and
+// JSON examples in prompts pass through untouched.
+var promptVariables = map[string]func(ctx context.Context, model string) string{
+	"cwd": func(ctx context.Context, model string) string {
+		dir, _ := getWorkDir(ctx)
+		return dir
+	},
+	"project": func(ctx context.Context, model string) string {
+		dir, _ := getWorkDir(ctx)
+		return filepath.Base(dir)
+	},
+	"git_branch": func(ctx context.Context, model string) string {
+		dir, _ := getWorkDir(ctx)
+		if out, err := exec.Command("git", "-C", dir, "symbolic-ref", "--short", "HEAD").Output(); err == nil {
+			return strings.TrimSpace(string(out))
+		}
+		if out, err := exec.Command("git", "-C", dir, "rev-parse", "--short", "HEAD").Output(); err == nil {
+			return "detached at " + strings.TrimSpace(string(out))
+		}
+		return "none"
+	},
+	"os":   func(ctx context.Context, model string) string { return runtime.GOOS },
+	"arch": func(ctx context.Context, model string) string { return runtime.GOARCH },
+	"shell": func(ctx context.Context, model string) string {
+		if shell := os.Getenv("SHELL"); shell != "" {
+			return filepath.Base(shell)
+		}
+		return "sh"
+	},
+	"date":  func(ctx context.Context, model string) string { return time.Now().Format("2006-01-02") },
+	"time":  func(ctx context.Context, model string) string { return time.Now().Format("15:04 MST") },
+	"model": func(ctx context.Context, model string) string { return model },
+	"language_detected": func(ctx context.Context, model string) string {
+		dir, _ := getWorkDir(ctx)
+		if language := detectProjectProfile(dir).Language; language != "" {
+			return language
+		}
+		return "unknown"
+	},
+}
+
+var promptVariablePattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// expandPromptVariables replaces known {name} variables in text. Each
+// variable is resolved at most once per call.
+func expandPromptVariables(ctx context.Context, model, text string) string {
+	if !strings.Contains(text, "{") {
+		return text
+	}
+	resolved := make(map[string]string)
+	return promptVariablePattern.ReplaceAllStringFunc(text, func(m string) string {
+		name := m[1 : len(m)-1]
+		resolve, ok := promptVariables[name]
+		if !ok {
+			return m
+		}
+		if _, done := resolved[name]; !done {
+			resolved[name] = resolve(ctx, model)
+		}
+		return resolved[name]
+	})
+}
+
+// loadPromptPrelude reads the user's prelude file, which goes at the top of
+// the system prompt. An empty path means no prelude.
+func loadPromptPrelude(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(expandPath(path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read prompt prelude: %v", err)
+	}
+	prelude := strings.TrimSpace(string(data))
+	if prelude == "" {
+		return "", nil
+	}
+	return prelude + "\n\n", nil
+}
+
+// --- Middleware ---
+
+// Model requests and replies pass through the middleware chain (see package
+// middleware). Requests whose reply the agent parses or reuses, such as PR
+// descriptions and plans, skip it (see internalRequest).
+
+type internalRequestKey struct{}
+
+// internalRequest marks requests made with ctx as internal: their replies
+// are parsed or reused rather than shown, so middleware must not touch them.
+func internalRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalRequestKey{}, true)
+}
+
+func isInternalRequest(ctx context.Context) bool {
+	internal, _ := ctx.Value(internalRequestKey{}).(bool)
+	return internal
+}
+
+// --- Text Tool Protocol ---
+
+// Backends without native tool calling (typically small local models) can use
+// a text protocol instead: the tools are described in the system prompt, the
+// model writes <tool_call> blocks, and they are parsed back into ToolCalls so
+// the agent loop is unchanged. Tool calls and results already in the
+// conversation are rendered as text for these backends.
+
+// toolProtocol forces "native" or "text" for all models; empty uses the
+// model's tool_protocol from the models config (default native).
+var toolProtocol string
+
+// maxToolProtocolRetries is how often a malformed tool call is sent back to
+// the model for correction before the request fails.
+const maxToolProtocolRetries = 2
+
+var toolCallBlockRe = regexp.MustCompile(`(?s)<tool_call>(.*?)</tool_call>`)
+
+func usesTextTools(model string) bool {
+	if toolProtocol != "" {
+		return toolProtocol == "text"
+	}
+	return knownModels[model].ToolProtocol == "text"
+}
+
+const textToolPrompt = `
+# Tool Calling
+Call tools by writing one block per call, anywhere in your reply:
+<tool_call>{"name": "<tool name>", "arguments": {<arguments as a JSON object>}}</tool_call>
+- The content of the block must be a single valid JSON object; the arguments must match the tool's parameter schema.
+- You may make several calls in one reply. Stop after your tool calls and wait: the results are sent back in <tool_result> blocks.
+- Never write <tool_result> blocks yourself. Reply without any <tool_call> block when you are done.
+
+Available tools:
+`
+
+// encodeTextTools rewrites a request for a backend without tool support.
+func encodeTextTools(req *ChatCompletionRequest) {
+	var sb strings.Builder
+	sb.WriteString(textToolPrompt)
+	for _, tool := range req.Tools {
+		var params bytes.Buffer
+		if err := json.Compact(&params, tool.Function.Parameters); err != nil {
+			params.Write(tool.Function.Parameters)
+		}
+		fmt.Fprintf(&sb, "\n## %s\n%s\nParameters: %s\n", tool.Function.Name, tool.Function.Description, params.String())
+	}
+	req.Tools = nil
+
+	names := make(map[string]string) // Tool call ID -> tool name
+	var messages []Message
+	if len(req.Messages) == 0 || req.Messages[0].Role != "system" {
+		messages = append(messages, Message{Role: "system"})
+	}
+	for _, msg := range req.Messages {
+		switch {
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			var content strings.Builder
+			content.WriteString(msg.Content)
+			for _, tc := range msg.ToolCalls {
+				names[tc.ID] = tc.Function.Name
+				args := tc.Function.Arguments
+				if args == "" {
+					args = "{}"
+				}
+				fmt.Fprintf(&content, "\n<tool_call>{\"name\": %q, \"arguments\": %s}</tool_call>", tc.Function.Name, args)
+			}
+			msg.Content, msg.ToolCalls = strings.TrimSpace(content.String()), nil
+		case msg.Role == "tool":
+			msg = Message{Role: "user", Content: fmt.Sprintf("<tool_result name=%q>\n%s\n</tool_result>", names[msg.ToolCallID], msg.Content)}
+		}
+		messages = append(messages, msg)
+	}
+	messages[0].Content += sb.String()
+	req.Messages = messages
+}
+
+// parseTextToolCalls extracts and validates the <tool_call> blocks of a reply.
+// It returns the calls and the reply text without them.
+func parseTextToolCalls(content string, tools []Tool) ([]ToolCall, string, error) {
+	schemas := make(map[string]json.RawMessage)
+	for _, tool := range tools {
+		schemas[tool.Function.Name] = tool.Function.Parameters
+	}
+
+	var calls []ToolCall
+	for i, match := range toolCallBlockRe.FindAllStringSubmatch(content, -1) {
+		block := strings.TrimSpace(match[1])
+		// Tolerate a code fence around the JSON
+		block = strings.TrimPrefix(strings.TrimPrefix(block, "```json"), "```")
+		block = strings.TrimSpace(strings.TrimSuffix(block, "```"))
+
+		var call struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal([]byte(block), &call); err != nil {
+			return nil, "", fmt.Errorf("tool call %d is not valid JSON: %v", i+1, err)
+		}
+		schema, ok := schemas[call.Name]
+		if !ok {
+			return nil, "", fmt.Errorf("tool call %d: unknown tool '%s'", i+1, call.Name)
+		}
+		if len(call.Arguments) == 0 || string(call.Arguments) == "null" {
+			call.Arguments = json.RawMessage("{}")
+		}
+		var args map[string]json.RawMessage
+		if err := json.Unmarshal(call.Arguments, &args); err != nil {
+			return nil, "", fmt.Errorf("tool call %d (%s): arguments must be a JSON object", i+1, call.Name)
+		}
+		var spec struct {
+			Required []string `json:"required"`
+		}
+		json.Unmarshal(schema, &spec)
+		for _, field := range spec.Required {
+			if _, ok := args[field]; !ok {
+				return nil, "", fmt.Errorf("tool call %d (%s): missing required argument '%s'", i+1, call.Name, field)
+			}
+		}
+		calls = append(calls, ToolCall{
+			ID:       fmt.Sprintf("call_%d_%d", time.Now().UnixNano(), i),
+			Type:     "function",
+			Function: ToolCallFunction{Name: call.Name, Arguments: string(call.Arguments)},
+		})
+	}
+
+	text := toolCallBlockRe.ReplaceAllString(content, "")
+	if strings.Contains(text, "<tool_call>") {
+		return nil, "", fmt.Errorf("a <tool_call> block is not closed with </tool_call>")
+	}
+	return calls, strings.TrimSpace(text), nil
+}
+
+// requestWithTextTools sends a request using the text protocol and re-prompts
+// the model when its tool calls are malformed.
+func requestWithTextTools(ctx context.Context, client *http.Client, apiKey string, reqBody ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	tools := reqBody.Tools
+	reqBody.Messages = append([]Message(nil), reqBody.Messages...)
+	encodeTextTools(&reqBody)
+
+	for attempt := 0; ; attempt++ {
+		resp, err := tracedCompletion(ctx, client, apiKey, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		msg := &resp.Choices[0].Message
+		calls, text, parseErr := parseTextToolCalls(msg.Content, tools)
+		if parseErr == nil {
+			msg.Content, msg.ToolCalls = text, calls
+			return resp, nil
+		}
+		if attempt == maxToolProtocolRetries {
+			return nil, fmt.Errorf("model kept producing malformed tool calls: %v", parseErr)
+		}
+		fmt.Printf("\033[33m[Tools] Malformed tool call (%v); asking the model to correct it.\033[0m\n", parseErr)
+		reqBody.Messages = append(reqBody.Messages,
+			Message{Role: "assistant", Content: msg.Content},
+			Message{Role: "user", Content: fmt.Sprintf("[System] Your tool call was rejected: %v. Resend your reply with every call written exactly as <tool_call>{\"name\": \"...\", \"arguments\": {...}}</tool_call>.", parseErr)},
+		)
+	}
+}
+
+// --- Model Requests ---
+
+// thinkingLevel controls how much the model reasons before answering: "off",
+// "low", "medium", "high", or "" for the provider's default.
+var thinkingLevel string
+
+var thinkingLevels = []string{"off", "low", "medium", "high"}
+
+// geminiThinkingBudgets are the token budgets used for models that take a
+// thinking_budget (Gemini 2.x); Gemini 3 takes a thinking_level instead.
+var geminiThinkingBudgets = map[string]int{"off": 0, "low": 1024, "medium": 8192, "high": 24576}
+
+func validThinkingLevel(level string) bool {
+	for _, l := range thinkingLevels {
+		if level == l {
+			return true
+		}
+	}
+	return level == ""
+}
+
+// getExtraBody returns provider-specific request options.
+func getExtraBody(provider string) json.RawMessage {
+	if provider != "gemini" {
+		return nil
+	}
+	config := map[string]any{"include_thoughts": thinkingLevel != "off"}
+	switch {
+	case thinkingLevel == "":
+	case strings.HasPrefix(ModelName, "gemini-3"):
+		// Gemini 3 can't turn thinking off; "low" is the minimum
+		level := thinkingLevel
+		if level == "off" {
+			level = "low"
+		}
+		config["thinking_level"] = level
+	default:
+		config["thinking_budget"] = geminiThinkingBudgets[thinkingLevel]
+	}
+	data, _ := json.Marshal(map[string]any{"google": map[string]any{"thinking_config": config}})
+	return data
+}
+
+// getReasoningEffort returns the reasoning_effort for OpenAI reasoning
+// models. Other models reject the parameter, so it is left unset for them.
+func getReasoningEffort(provider string) string {
+	if provider != "openai" || thinkingLevel == "" || thinkingLevel == "off" {
+		return ""
+	}
+	if !openAIReasoningModelRe.MatchString(ModelName) && !strings.HasPrefix(ModelName, "gpt-5") {
+		return ""
+	}
+	return thinkingLevel
+}
+
+// requestCompletion sends a chat completion request, retrying rate limits and
+// server errors with exponential backoff. Progress and errors are printed as
+// they happen; the returned error is for control flow. Response middleware
+// runs on the final reply, after text-protocol tool calls are parsed out.
+func requestCompletion(ctx context.Context, client *http.Client, apiKey string, reqBody ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	var chatResp *ChatCompletionResponse
+	var err error
+	if len(reqBody.Tools) > 0 && usesTextTools(reqBody.Model) {
+		chatResp, err = requestWithTextTools(ctx, client, apiKey, reqBody)
+	} else {
+		chatResp, err = tracedCompletion(ctx, client, apiKey, reqBody)
+	}
+	if err != nil || isInternalRequest(ctx) {
+		return chatResp, err
+	}
+	if err := middleware.ApplyResponse(ctx, chatResp); err != nil {
+		fmt.Printf("Error processing response: %v\n", err)
+		return nil, err
+	}
+	return chatResp, nil
+}
+
+// tracedCompletion sends one request in a tracing span.
+func tracedCompletion(ctx context.Context, client *http.Client, apiKey string, reqBody ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	ctx, span := startSpan(ctx, "chat "+reqBody.Model, spanKindClient)
+	chatResp, err := sendCompletion(ctx, client, apiKey, reqBody)
+	recordCompletion(span, reqBody.Model, chatResp, err)
+	return chatResp, err
+}
+
+func sendCompletion(ctx context.Context, client *http.Client, apiKey string, reqBody ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	// Middleware gets its own copy of the message list so rewrites don't leak
+	// into the caller's history
+	reqBody.Messages = append([]Message(nil), reqBody.Messages...)
+	if len(reqBody.Messages) > 0 && reqBody.Messages[0].Role == "system" {
+		reqBody.Messages[0].Content = expandPromptVariables(ctx, reqBody.Model, reqBody.Messages[0].Content)
+	}
+	if !isInternalRequest(ctx) {
+		if err := middleware.ApplyRequest(ctx, &reqBody); err != nil {
+			fmt.Printf("Error preparing request: %v\n", err)
+			return nil, err
+		}
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		fmt.Printf("Error marshaling request: %v\n", err)
+		return nil, fmt.Errorf("error marshaling request: %v", err)
+	}
+	messages := reqBody.Messages
+
+	var resp *http.Response
+	var body []byte
+	retries := newRetrier()
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, "POST", GeminiURL, bytes.NewBuffer(jsonData))
+		if err != nil {
+			fmt.Printf("Error creating request: %v\n", err)
+			return nil, fmt.Errorf("error creating request: %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+
+		spinnerStop := make(chan struct{})
+		spinnerDone := make(chan struct{})
+		go startSpinner(spinnerStop, spinnerDone)
+
+		started := time.Now()
+		resp, err = client.Do(req)
+
+		close(spinnerStop)
+		<-spinnerDone
+		if err == nil {
+			spanFromContext(ctx).Set("http.response.status_code", resp.StatusCode)
+		}
+
+		var class, lastFailure string
+		var retryAfter time.Duration
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				fmt.Printf("Error reading response: %v\n", err)
+			}
+		} else if ctx.Err() == context.Canceled {
+			fmt.Println("\nRequest canceled.")
+			return nil, ctx.Err()
+		} else {
+			fmt.Printf("Error sending request: %v\n", err)
+		}
+		logLLMExchange(req, apiKey, jsonData, resp, body, err, started)
+
+		if err != nil {
+			class, lastFailure = classifyFailure(0, err), err.Error()
+		} else {
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+
+			if resp.StatusCode == 400 {
+				fmt.Printf("API Error (Status 400): %s\nLogging to errors.txt\n", string(body))
+				if !debugLLM {
+					fmt.Println("Run with --debug-llm (or /debug on) to log the full request.")
+				}
+				f, err := os.OpenFile("errors.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				if err == nil {
+					timestamp := time.Now().Format(time.RFC3339)
+					f.WriteString(fmt.Sprintf("Timestamp: %s\nError: %s\n", timestamp, string(body)))
+					f.WriteString("Last Messages:\n")
+					start := 0
+					if len(messages) > 2 {
+						start = len(messages) - 2
+					}
+					for i := start; i < len(messages); i++ {
+						content, _ := json.Marshal(messages[i])
+						f.WriteString(fmt.Sprintf("%s\n", content))
+					}
+					f.WriteString("--------------------------------------------------\n")
+					f.Close()
+				}
+				break
+			}
+
+			fmt.Printf("API Error (Status %d): %s\n", resp.StatusCode, string(body))
+			class = classifyFailure(resp.StatusCode, nil)
+			if class == "" {
+				break
+			}
+			lastFailure = fmt.Sprintf("status %d: %s", resp.StatusCode, truncateForError(string(body)))
+			retryAfter = parseRetryAfter(resp.Header)
+		}
+
+		delay, ok := retries.next(class, retryAfter)
+		if !ok {
+			retryErr := retries.failure(class, lastFailure)
+			fmt.Printf("Giving up: %v\n", retryErr)
+			return nil, retryErr
+		}
+		fmt.Printf("Retrying in %v... (%s, attempt %d)\n", delay.Round(100*time.Millisecond), retryClassNames[class], retries.attempts+1)
+		if class == "rate_limit" {
+			if desc := retries.downgrade(&reqBody); desc != "" {
+				if data, err := json.Marshal(reqBody); err == nil {
+					jsonData = data
+					fmt.Printf("\033[33m[Rate limit] Downgrading this request to get through: %s.\033[0m\n", desc)
+				}
+			}
+		}
+		recordRetry(ctx, reqBody.Model, class)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API Error (Status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var chatResp ChatCompletionResponse
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		fmt.Printf("Error parsing response: %v\n", err)
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+
+	if chatResp.Error != nil {
+		fmt.Printf("API Error: %s\n", chatResp.Error.Message)
+		return nil, fmt.Errorf("API Error: %s", chatResp.Error.Message)
+	}
+
+	if len(chatResp.Choices) == 0 {
+		fmt.Println("No choices returned from API")
+		return nil, fmt.Errorf("no choices returned from API")
+	}
+
+	sessionUsage.Record(reqBody.Model, chatResp.Usage)
+	tui.Draw()
+
+	return &chatResp, nil
+}
+
+// --- LLM Debug Log ---
+
+// With --debug-llm (or /debug on), every request to the model API and its
+// response are written to ~/.simple_agent/debug, one timestamped JSON file
+// per attempt, so a 400 can be diagnosed from the exact payload. Credentials
+// are redacted.
+
+var debugLLM bool
+
+var debugLLMSeq atomic.Int64
+
+// debugLLMDir is where the exchanges are written.
+func debugLLMDir() string {
+	return filepath.Join(getAgentHomeDir(), "debug")
+}
+
+// debugExchange is one request and its response (or error).
+type debugExchange struct {
+	Time           string            `json:"time"`
+	URL            string            `json:"url"`
+	RequestHeaders map[string]string `json:"request_headers"`
+	Request        json.RawMessage   `json:"request"`
+	Status         int               `json:"status,omitempty"`
+	Response       json.RawMessage   `json:"response,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	DurationMs     int64             `json:"duration_ms"`
+}
+
+// redactedHeaders are replaced wholesale; the API key is also removed
+// wherever else it appears.
+var redactedHeaders = map[string]bool{"Authorization": true, "X-Api-Key": true, "X-Goog-Api-Key": true, "Api-Key": true}
+
+// logLLMExchange writes one exchange when debugging is on. resp and err may
+// be nil; respBody is the already-read response body.
+func logLLMExchange(req *http.Request, apiKey string, reqBody []byte, resp *http.Response, respBody []byte, err error, started time.Time) {
+	if !debugLLM {
+		return
+	}
+	redact := func(s string) string {
+		if apiKey != "" {
+			s = strings.ReplaceAll(s, apiKey, "REDACTED")
+		}
+		return s
+	}
+	asJSON := func(data []byte) json.RawMessage {
+		text := redact(string(data))
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+		quoted, _ := json.Marshal(text)
+		return quoted
+	}
+
+	entry := debugExchange{
+		Time:           started.Format(time.RFC3339Nano),
+		URL:            redact(req.URL.String()),
+		RequestHeaders: make(map[string]string),
+		Request:        asJSON(reqBody),
+		DurationMs:     time.Since(started).Milliseconds(),
+	}
+	for name, values := range req.Header {
+		value := strings.Join(values, ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			value = "REDACTED"
+		}
+		entry.RequestHeaders[name] = redact(value)
+	}
+	if resp != nil {
+		entry.Status = resp.StatusCode
+		entry.Response = asJSON(respBody)
+	}
+	if err != nil {
+		entry.Error = redact(err.Error())
+	}
+
+	dir := debugLLMDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	data, _ := json.MarshalIndent(entry, "", "  ")
+	name := fmt.Sprintf("%s-%s-%03d.json", started.Format("20060102-150405.000"), sessionID, debugLLMSeq.Add(1))
+	os.WriteFile(filepath.Join(dir, name), data, 0600)
+}
+
+// --- Notifications ---
+
+// Notifications tell a user who has tabbed away that the agent is waiting
+// for them: when a prompt needs an answer during a turn, and when a turn that
+// took at least LongTurnSeconds finishes. Methods:
+//   - bell: the terminal bell
+//   - osc9: OSC 9 desktop notification (iTerm2, Windows Terminal, WezTerm)
+//   - osc777: OSC 777 notification (urxvt, foot, VTE-based terminals)
+//   - desktop: notify-send on Linux, osascript on macOS
+type NotifyConfig struct {
+	Methods         []string `json:"methods,omitempty"`
+	LongTurnSeconds int      `json:"long_turn_seconds,omitempty"` // Default 30
+}
+
+var notifyMethods = []string{"bell", "osc9", "osc777", "desktop"}
+
+// notifyConfig is the active configuration; main sets it from the config.
+var notifyConfig NotifyConfig
+
+// turnInProgress is 1 while the main loop runs a turn; prompts shown then
+// are waiting on an absent user more often than not.
+var turnInProgress int32
+
+const defaultLongTurn = 30 * time.Second
+
+func (c NotifyConfig) check() error {
+	for _, m := range c.Methods {
+		known := false
+		for _, k := range notifyMethods {
+			known = known || m == k
+		}
+		if !known {
+			return fmt.Errorf("unknown method %q (use %s)", m, strings.Join(notifyMethods, ", "))
+		}
+	}
+	return nil
+}
+
+func (c NotifyConfig) longTurn() time.Duration {
+	if c.LongTurnSeconds > 0 {
+		return time.Duration(c.LongTurnSeconds) * time.Second
+	}
+	return defaultLongTurn
+}
+
+// notify sends a notification with every configured method.
+func notify(title, body string) {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f || r == ';' {
+				return ' '
+			}
+			return r
+		}, truncateLine(s, 200))
+	}
+	title, body = clean(title), clean(body)
+	for _, m := range notifyConfig.Methods {
+		switch m {
+		case "bell":
+			fmt.Print("\a")
+		case "osc9":
+			fmt.Printf("\033]9;%s: %s\007", title, body)
+		case "osc777":
+			fmt.Printf("\033]777;notify;%s;%s\007", title, body)
+		case "desktop":
+			var cmd *exec.Cmd
+			if _, err := exec.LookPath("notify-send"); err == nil {
+				cmd = exec.Command("notify-send", "--app-name=simple-agent", title, body)
+			} else if _, err := exec.LookPath("osascript"); err == nil {
+				quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+				cmd = exec.Command("osascript", "-e", fmt.Sprintf(`display notification "%s" with title "%s"`, quote(body), quote(title)))
+			}
+			if cmd != nil {
+				go cmd.Run()
+			}
+		}
+	}
+}
+
+// notifyPrompt is called before asking the user something.
+func notifyPrompt(prompt string) {
+	if atomic.LoadInt32(&turnInProgress) == 1 {
+		notify("Simple Agent needs you", prompt)
+	}
+}
+
+// --- Webhooks ---
+
+// Workspace events reported to webhooks in headless and server modes.
+const (
+	EventTaskStarted    = "task_started"
+	EventDiffApplied    = "diff_applied"
+	EventCommitCreated  = "commit_created"
+	EventTaskFinished   = "task_finished"
+	EventBudgetExceeded = "budget_exceeded"
+)
+
+type WebhookConfig struct {
+	URL     string            `json:"url"`
+	Events  []string          `json:"events,omitempty"` // Empty means all events
+	Secret  string            `json:"secret,omitempty"` // Signs payloads with HMAC-SHA256
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// WebhookEvent is the JSON payload POSTed to each webhook.
+type WebhookEvent struct {
+	Event     string         `json:"event"`
+	Time      time.Time      `json:"time"`
+	TaskID    string         `json:"task_id"`
+	Workspace string         `json:"workspace"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+const webhookAttempts = 3
+
+type webhookDispatcher struct {
+	hooks  []WebhookConfig
+	taskID string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// webhooks is only set in headless and server modes; emitEvent is a no-op
+// otherwise.
+var webhooks *webhookDispatcher
+
+func enableWebhooks(hooks []WebhookConfig) {
+	if len(hooks) == 0 {
+		return
+	}
+	webhooks = &webhookDispatcher{
+		hooks:  hooks,
+		taskID: strconv.FormatInt(time.Now().UnixNano(), 36),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (h WebhookConfig) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// emitEvent delivers an event to all subscribed webhooks in the background.
+// Call flushWebhooks before exiting so pending deliveries aren't lost.
+func emitEvent(event string, data map[string]any) {
+	d := webhooks
+	if d == nil {
+		return
+	}
+	cwd, _ := os.Getwd()
+	payload, err := json.Marshal(WebhookEvent{
+		Event:     event,
+		Time:      time.Now().UTC(),
+		TaskID:    d.taskID,
+		Workspace: cwd,
+		Data:      data,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to encode %s event: %v\n", event, err)
+		return
+	}
+	for _, hook := range d.hooks {
+		if !hook.wants(event) {
+			continue
+		}
+		d.wg.Add(1)
+		go func(hook WebhookConfig) {
+			defer d.wg.Done()
+			if err := d.deliver(hook, event, payload); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Webhook %s failed for %s: %v\n", hook.URL, event, err)
+			}
+		}(hook)
+	}
+}
+
+// startTaskEvents emits task_started for task and returns the function that
+// emits its task_finished, with the outcome and how long it took. extra is
+// added to both events.
+func startTaskEvents(task string, extra map[string]any) func(report string, err error) {
+	started := time.Now()
+	data := map[string]any{"task": task}
+	for k, v := range extra {
+		data[k] = v
+	}
+	emitEvent(EventTaskStarted, data)
+	return func(report string, err error) {
+		data := map[string]any{
+			"status":      "success",
+			"report":      report,
+			"duration_ms": time.Since(started).Milliseconds(),
+		}
+		for k, v := range extra {
+			data[k] = v
+		}
+		if err != nil {
+			data["status"], data["error"] = "error", err.Error()
+		}
+		emitEvent(EventTaskFinished, data)
+	}
+}
+
+func (d *webhookDispatcher) deliver(hook WebhookConfig, event string, payload []byte) error {
+	var lastErr error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "simple-agent/"+Version)
+		req.Header.Set("X-Simple-Agent-Event", event)
+		if hook.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(hook.Secret))
+			mac.Write(payload)
+			req.Header.Set("X-Simple-Agent-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		for k, v := range hook.Headers {
+			req.Header.Set(k, os.ExpandEnv(v))
+		}
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("status %d", resp.StatusCode)
+		// Client errors won't succeed on retry
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+	}
+	return lastErr
+}
+
+// flushWebhooks waits up to timeout for pending deliveries.
+func flushWebhooks(timeout time.Duration) {
+	d := webhooks
+	if d == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Fprintln(os.Stderr, "Warning: Gave up waiting for webhook deliveries.")
+	}
+}
+
+// --- Telemetry ---
+
+// Optional OTLP export of spans and metrics: API latency, retries, tool
+// durations and token usage. Payloads use the OTLP/HTTP JSON encoding, so any
+// OpenTelemetry collector can receive them without extra dependencies.
+
+type TelemetryConfig struct {
+	Enabled     bool              `json:"enabled"`
+	Endpoint    string            `json:"endpoint,omitempty"`         // OTLP/HTTP base URL, default $OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318
+	Headers     map[string]string `json:"headers,omitempty"`          // e.g. collector auth; $VARS are expanded
+	ServiceName string            `json:"service_name,omitempty"`     // Default simple-agent
+	Attributes  map[string]string `json:"attributes,omitempty"`       // Extra resource attributes, e.g. team
+	Interval    int               `json:"interval_seconds,omitempty"` // Export interval, default 15
+}
+
+const (
+	defaultTelemetryEndpoint = "http://localhost:4318"
+	defaultTelemetryInterval = 15 * time.Second
+	maxPendingSpans          = 2048
+)
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+// durationBuckets are the histogram bounds, in milliseconds, for API and tool durations.
+var durationBuckets = []float64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 120000}
+
+// telemetry is only set when enabled; recording is a no-op otherwise.
+var telemetry *telemetryExporter
+
+type telemetryExporter struct {
+	endpoint string
+	headers  map[string]string
+	resource map[string]any
+	client   *http.Client
+	started  time.Time
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	spans   []map[string]any
+	metrics map[string]*metricPoint
+	failing bool
+}
+
+// metricPoint is one cumulative counter or histogram series.
+type metricPoint struct {
+	name      string
+	unit      string
+	attrs     map[string]any
+	histogram bool
+	count     int64
+	sum       float64
+	buckets   []int64
+}
+
+func enableTelemetry(cfg TelemetryConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		endpoint = defaultTelemetryEndpoint
+	}
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	for k, v := range cfg.Headers {
+		headers[k] = os.ExpandEnv(v)
+	}
+
+	service := cfg.ServiceName
+	if service == "" {
+		service = "simple-agent"
+	}
+	resource := map[string]any{
+		"service.name":    service,
+		"service.version": Version,
+		"session.id":      sessionID,
+	}
+	if host, err := os.Hostname(); err == nil {
+		resource["host.name"] = host
+	}
+	for k, v := range cfg.Attributes {
+		resource[k] = v
+	}
+
+	interval := defaultTelemetryInterval
+	if cfg.Interval > 0 {
+		interval = time.Duration(cfg.Interval) * time.Second
+	}
+	telemetry = &telemetryExporter{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		headers:  headers,
+		resource: map[string]any{"attributes": otlpAttributes(resource)},
+		client:   &http.Client{Timeout: 10 * time.Second},
+		started:  time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		metrics:  make(map[string]*metricPoint),
+	}
+	go telemetry.run(interval)
+}
+
+func (t *telemetryExporter) run(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.export()
+		case <-t.stop:
+			t.export()
+			return
+		}
+	}
+}
+
+// shutdownTelemetry exports what is left, waiting up to timeout.
+func shutdownTelemetry(timeout time.Duration) {
+	t := telemetry
+	if t == nil {
+		return
+	}
+	telemetry = nil
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-time.After(timeout):
+		fmt.Fprintln(os.Stderr, "Warning: Gave up waiting for telemetry export.")
+	}
+}
+
+// telemetrySpan is an in-flight span. A nil span ignores all calls, so
+// callers don't need to check whether telemetry is enabled.
+type telemetrySpan struct {
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]any
+}
+
+type spanKey struct{}
+
+// startSpan starts a span as a child of the span in ctx, if any.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *telemetrySpan) {
+	if telemetry == nil {
+		return ctx, nil
+	}
+	span := &telemetrySpan{
+		spanID: fmt.Sprintf("%016x", rand.Uint64()),
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]any),
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.traceID, span.parentID = parent.traceID, parent.spanID
+	} else {
+		span.traceID = fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func spanFromContext(ctx context.Context) *telemetrySpan {
+	span, _ := ctx.Value(spanKey{}).(*telemetrySpan)
+	return span
+}
+
+func (s *telemetrySpan) Set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// End finishes the span, marking it failed if err is set.
+func (s *telemetrySpan) End(err error) {
+	t := telemetry
+	if s == nil || t == nil {
+		return
+	}
+	s.mu.Lock()
+	span := map[string]any{
+		"traceId":           s.traceID,
+		"spanId":            s.spanID,
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	s.mu.Unlock()
+	if s.parentID != "" {
+		span["parentSpanId"] = s.parentID
+	}
+	if err != nil {
+		span["status"] = map[string]any{"code": 2, "message": err.Error()}
+	}
+
+	t.mu.Lock()
+	if len(t.spans) >= maxPendingSpans {
+		t.spans = t.spans[1:]
+	}
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+}
+
+// addMetric adds value to a counter, or records it in a histogram.
+func addMetric(name, unit string, histogram bool, value float64, attrs map[string]any) {
+	t := telemetry
+	if t == nil {
+		return
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := name
+	for _, k := range keys {
+		series += fmt.Sprintf("|%s=%v", k, attrs[k])
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	point := t.metrics[series]
+	if point == nil {
+		point = &metricPoint{name: name, unit: unit, attrs: attrs, histogram: histogram}
+		if histogram {
+			point.buckets = make([]int64, len(durationBuckets)+1)
+		}
+		t.metrics[series] = point
+	}
+	point.count++
+	point.sum += value
+	if histogram {
+		point.buckets[sort.SearchFloat64s(durationBuckets, value)]++
+	}
+}
+
+// recordCompletion finishes the span of a chat completion request and
+// records its latency and token usage.
+func recordCompletion(span *telemetrySpan, model string, resp *ChatCompletionResponse, err error) {
+	if span == nil {
+		return
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	span.Set("gen_ai.request.model", model)
+	if resp != nil && resp.Usage != nil {
+		span.Set("gen_ai.usage.input_tokens", resp.Usage.PromptTokens)
+		span.Set("gen_ai.usage.output_tokens", resp.Usage.CompletionTokens)
+		addMetric("simple_agent.tokens", "{token}", false, float64(resp.Usage.PromptTokens), map[string]any{"model": model, "type": "input"})
+		addMetric("simple_agent.tokens", "{token}", false, float64(resp.Usage.CompletionTokens), map[string]any{"model": model, "type": "output"})
+	}
+	addMetric("simple_agent.api.duration", "ms", true, float64(time.Since(span.start).Milliseconds()), map[string]any{"model": model, "outcome": outcome})
+	span.End(err)
+}
+
+// recordRetry counts a retried API request.
+func recordRetry(ctx context.Context, model, class string) {
+	if span := spanFromContext(ctx); span != nil {
+		span.mu.Lock()
+		retries, _ := span.attrs["simple_agent.retries"].(int)
+		span.attrs["simple_agent.retries"] = retries + 1
+		span.mu.Unlock()
+	}
+	addMetric("simple_agent.api.retries", "{retry}", false, 1, map[string]any{"model": model, "reason": class})
+}
+
+// recordToolCall finishes the span of a tool call and records its duration.
+func recordToolCall(span *telemetrySpan, entry AuditEntry) {
+	if span == nil {
+		return
+	}
+	outcome := "ok"
+	var err error
+	if entry.Error != "" {
+		outcome, err = "error", errors.New(entry.Error)
+		span.Set("error.type", entry.ErrorType)
+	}
+	span.Set("simple_agent.tool.name", entry.Tool)
+	span.Set("simple_agent.tool.result_bytes", entry.ResultSize)
+	if entry.Agent != "" {
+		span.Set("simple_agent.agent", entry.Agent)
+	}
+	if entry.Approval != "" {
+		span.Set("simple_agent.tool.approval", entry.Approval)
+	}
+	if entry.ExitCode != nil {
+		span.Set("process.exit_code", *entry.ExitCode)
+	}
+	addMetric("simple_agent.tool.duration", "ms", true, float64(entry.DurationMs), map[string]any{"tool": entry.Tool, "outcome": outcome})
+	span.End(err)
+}
+
+// export sends pending spans and the current metric values to the collector.
+// Failures are reported once until an export succeeds again.
+func (t *telemetryExporter) export() {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(t.started.UnixNano(), 10)
+	scope := map[string]any{"name": "simple-agent", "version": Version}
+
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	byName := make(map[string]map[string]any)
+	var metrics []map[string]any
+	series := make([]string, 0, len(t.metrics))
+	for key := range t.metrics {
+		series = append(series, key)
+	}
+	sort.Strings(series)
+	for _, key := range series {
+		p := t.metrics[key]
+		metric := byName[p.name]
+		if metric == nil {
+			metric = map[string]any{"name": p.name, "unit": p.unit}
+			if p.histogram {
+				metric["histogram"] = map[string]any{"aggregationTemporality": 2, "dataPoints": []map[string]any{}}
+			} else {
+				metric["sum"] = map[string]any{"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": []map[string]any{}}
+			}
+			byName[p.name] = metric
+			metrics = append(metrics, metric)
+		}
+		point := map[string]any{
+			"attributes":        otlpAttributes(p.attrs),
+			"startTimeUnixNano": start,
+			"timeUnixNano":      now,
+		}
+		data := metric["sum"]
+		if p.histogram {
+			counts := make([]string, len(p.buckets))
+			for i, c := range p.buckets {
+				counts[i] = strconv.FormatInt(c, 10)
+			}
+			point["count"] = strconv.FormatInt(p.count, 10)
+			point["sum"] = p.sum
+			point["bucketCounts"] = counts
+			point["explicitBounds"] = durationBuckets
+			data = metric["histogram"]
+		} else {
+			point["asInt"] = strconv.FormatInt(int64(p.sum), 10)
+		}
+		data.(map[string]any)["dataPoints"] = append(data.(map[string]any)["dataPoints"].([]map[string]any), point)
+	}
+	t.mu.Unlock()
+
+	var errs []string
+	if len(spans) > 0 {
+		payload := map[string]any{"resourceSpans": []any{map[string]any{
+			"resource":   t.resource,
+			"scopeSpans": []any{map[string]any{"scope": scope, "spans": spans}},
+		}}}
+		if err := t.post("/v1/traces", payload); err != nil {
+			errs = append(errs, fmt.Sprintf("traces: %v", err))
+		}
+	}
+	if len(metrics) > 0 {
+		payload := map[string]any{"resourceMetrics": []any{map[string]any{
+			"resource":     t.resource,
+			"scopeMetrics": []any{map[string]any{"scope": scope, "metrics": metrics}},
+		}}}
+		if err := t.post("/v1/metrics", payload); err != nil {
+			errs = append(errs, fmt.Sprintf("metrics: %v", err))
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(errs) > 0 && !t.failing {
+		fmt.Fprintf(os.Stderr, "Warning: Telemetry export to %s failed (%s)\n", t.endpoint, strings.Join(errs, "; "))
+	}
+	t.failing = len(errs) > 0
+}
+
+func (t *telemetryExporter) post(path string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simple-agent/"+Version)
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpAttributes converts attributes to OTLP key/value pairs, sorted by key.
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]map[string]any, 0, len(keys))
+	for _, k := range keys {
+		var value map[string]any
+		switch v := attrs[k].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": k, "value": value})
+	}
+	return out
+}
+
+// --- TUI ---
+
+// With -tui the REPL runs full screen on the terminal's alternate screen:
+// the conversation, including streamed tool output, scrolls in the upper
+// region while a fixed panel at the bottom lists the files with pending
+// (uncommitted) changes and a status bar with the model, context size,
+// token usage and cost. It is drawn with plain ANSI escapes, so no terminal
+// library is needed; the plain REPL stays the default.
+
+const tuiPanelRows = 5 // Separator, three pending files, status bar
+
+type tuiScreen struct {
+	mu      sync.Mutex
+	active  bool
+	rows    int
+	cols    int
+	pending []string
+}
+
+var tui = &tuiScreen{}
+
+// termSize returns the terminal's rows and columns.
+func termSize() (int, int, error) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	var rows, cols int
+	if _, err := fmt.Sscan(string(out), &rows, &cols); err != nil {
+		return 0, 0, err
+	}
+	return rows, cols, nil
+}
+
+// Enable switches to the alternate screen and reserves the bottom panel.
+func (t *tuiScreen) Enable() error {
+	rows, cols, err := termSize()
+	if err != nil {
+		return fmt.Errorf("not a terminal: %v", err)
+	}
+	if rows < tuiPanelRows+5 {
+		return fmt.Errorf("terminal too small (%d rows)", rows)
+	}
+	t.mu.Lock()
+	t.active, t.rows, t.cols = true, rows, cols
+	// Alternate screen, scroll region above the panel, cursor at its top
+	fmt.Printf("\033[?1049h\033[2J\033[1;%dr\033[H", rows-tuiPanelRows)
+	t.mu.Unlock()
+	t.Refresh()
+	return nil
+}
+
+// Close restores the normal screen.
+func (t *tuiScreen) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active {
+		return
+	}
+	t.active = false
+	fmt.Print("\033[r\033[?1049l")
+}
+
+// Refresh picks up a resized terminal and the pending files, then redraws
+// the panel. It runs git, so it is called at turn boundaries.
+func (t *tuiScreen) Refresh() {
+	t.mu.Lock()
+	active := t.active
+	t.mu.Unlock()
+	if !active {
+		return
+	}
+	pending := agentChanges.Pending()
+	rows, cols, err := termSize()
+
+	t.mu.Lock()
+	t.pending = pending
+	if err == nil && (rows != t.rows || cols != t.cols) && rows >= tuiPanelRows+5 {
+		t.rows, t.cols = rows, cols
+		// Setting the scroll region homes the cursor, so keep it at the bottom
+		fmt.Printf("\033[1;%dr\033[%d;1H", rows-tuiPanelRows, rows-tuiPanelRows)
+	}
+	t.mu.Unlock()
+	t.Draw()
+}
+
+// Draw repaints the panel from cached state; it is cheap enough to call
+// after every keystroke.
+func (t *tuiScreen) Draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("\0337\033[?25l") // Save cursor, hide it while drawing
+	line := func(row int, text string) {
+		fmt.Fprintf(&sb, "\033[%d;1H\033[2K%s", row, text)
+	}
+
+	top := t.rows - tuiPanelRows + 1
+	title := fmt.Sprintf("─── Pending changes (%d) ", len(t.pending))
+	line(top, "\033[90m"+title+strings.Repeat("─", max(0, t.cols-utf8.RuneCountInString(title)))+"\033[0m")
+	for i := 0; i < tuiPanelRows-2; i++ {
+		text := ""
+		switch {
+		case i == tuiPanelRows-3 && len(t.pending) > tuiPanelRows-2:
+			text = fmt.Sprintf("  ... and %d more (/commit to review)", len(t.pending)-i)
+		case i < len(t.pending):
+			text = "  \033[33mM\033[0m " + truncateLine(t.pending[i], t.cols-4)
+		case i == 0 && len(t.pending) == 0:
+			text = "  \033[90mNo uncommitted changes by the agent.\033[0m"
+		}
+		line(top+1+i, text)
+	}
+
+	in, out, cost, contextTokens := sessionUsage.Totals()
+	status := fmt.Sprintf(" %s │ context %d │ in %d · out %d │ $%.4f │ Ctrl+C pause · /help", ModelName, contextTokens, in, out, cost)
+	if n := utf8.RuneCountInString(status); n < t.cols {
+		status += strings.Repeat(" ", t.cols-n)
+	} else {
+		status = string([]rune(status)[:t.cols])
+	}
+	line(t.rows, "\033[7m"+status+"\033[0m")
+
+	sb.WriteString("\0338\033[?25h")
+	fmt.Print(sb.String())
+}
+
+// --- Approval Policy ---
+
+// Headless runs (e.g. -quick -no-auto-accept in CI) can't answer approval
+// prompts on a terminal. -approval-policy names a JSON file that decides
+// them per tool call, and -approval-socket a Unix socket where another
+// process answers them, so a pipeline can gate only the dangerous actions:
+//
+//	{"rules": [{"tool": "run_command", "match": "git push*", "decision": "ask"},
+//	           {"tool": "apply_udiff", "match": "migrations/*", "decision": "deny"}],
+//	 "default": "allow"}
+//
+// Rules are checked in order; "match" is a command-style pattern (* matches
+// anything) tested against the call's command, path or arguments. "ask"
+// forwards the prompt to the socket, and is denied without one.
+
+type ApprovalRule struct {
+	Tool     string `json:"tool,omitempty"`  // Tool name glob, e.g. run_command or git_*
+	Match    string `json:"match,omitempty"` // Pattern for the call's subject
+	Decision string `json:"decision"`        // allow, deny or ask
+}
+
+type ApprovalPolicy struct {
+	Rules   []ApprovalRule `json:"rules"`
+	Default string         `json:"default,omitempty"` // allow, deny or ask (default: ask with a socket, else deny)
+}
+
+// approvalPrompter answers prompts instead of the terminal when set.
+var approvalPrompter Prompter
+
+func loadApprovalPolicy(path string) (*ApprovalPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy ApprovalPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid approval policy %s: %v", path, err)
+	}
+	decisions := []string{policy.Default}
+	if policy.Default == "" {
+		decisions = nil
+	}
+	for _, rule := range policy.Rules {
+		decisions = append(decisions, rule.Decision)
+	}
+	for _, decision := range decisions {
+		if decision != "allow" && decision != "deny" && decision != "ask" {
+			return nil, fmt.Errorf("invalid approval policy %s: decision must be allow, deny or ask, not '%s'", path, decision)
+		}
+	}
+	return &policy, nil
+}
+
+// approvalSubject is what rules match: the command of run_command, the path
+// (and arguments) of file tools and run_script, else the raw arguments.
+func approvalSubject(call ToolCall) string {
+	var args struct {
+		Command string   `json:"command"`
+		Path    string   `json:"path"`
+		Args    []string `json:"args"`
+	}
+	json.Unmarshal([]byte(call.Function.Arguments), &args)
+	switch {
+	case args.Command != "":
+		return args.Command
+	case args.Path != "":
+		return strings.TrimSpace(args.Path + " " + strings.Join(args.Args, " "))
+	}
+	return call.Function.Arguments
+}
+
+// Decide returns the decision for a tool call (nil when the prompt doesn't
+// come from one) and the rule that made it.
+func (p *ApprovalPolicy) Decide(call *ToolCall, hasSocket bool) (string, string) {
+	if call != nil {
+		subject := approvalSubject(*call)
+		for i, rule := range p.Rules {
+			if ok, _ := filepath.Match(rule.Tool, call.Function.Name); rule.Tool != "" && !ok {
+				continue
+			}
+			if rule.Match != "" && !matchCommand(rule.Match, subject) {
+				continue
+			}
+			return rule.Decision, fmt.Sprintf("rule %d", i+1)
+		}
+	}
+	switch {
+	case p.Default != "":
+		return p.Default, "default"
+	case hasSocket:
+		return "ask", "default"
+	}
+	return "deny", "default"
+}
+
+// approvalAnswer picks the prompt's answer for allowing or denying once. It
+// returns "" for prompts without options, such as asking for a reason.
+func approvalAnswer(prompt string, allow bool) string {
+	if strings.Contains(prompt, "[y/N]") {
+		if allow {
+			return "y"
+		}
+		return "n"
+	}
+	if allow && strings.Contains(prompt, "[s]ession") {
+		return "s" // Trust a skill for this session, not always
+	}
+	want := "reject_once"
+	if allow {
+		want = "allow_once"
+	}
+	var fallback string
+	for _, opt := range acpPermissionOptions(prompt) {
+		if opt["kind"] == want {
+			return opt["optionId"]
+		}
+		if !allow && fallback == "" && opt["kind"] == "reject_always" {
+			fallback = opt["optionId"]
+		}
+	}
+	return fallback
+}
+
+// approvalRequest is sent to the approval socket as one JSON line; the
+// answer is one JSON line too, either {"decision": "allow"|"deny"} or
+// {"answer": "<option>"} for prompts with other choices.
+type approvalRequest struct {
+	Session   string              `json:"session"`
+	Tool      string              `json:"tool,omitempty"`
+	Arguments json.RawMessage     `json:"arguments,omitempty"`
+	Subject   string              `json:"subject,omitempty"`
+	Prompt    string              `json:"prompt"`
+	Options   []map[string]string `json:"options,omitempty"`
+}
+
+type approvalResponse struct {
+	Decision string `json:"decision"`
+	Answer   string `json:"answer"`
+}
+
+// askApprovalSocket forwards one prompt to the socket and waits for the
+// answer, or until ctx is done.
+func askApprovalSocket(ctx context.Context, socket, prompt string, call *ToolCall) (string, error) {
+	req := approvalRequest{Session: sessionID, Prompt: prompt, Options: acpPermissionOptions(prompt)}
+	if call != nil {
+		req.Tool, req.Subject = call.Function.Name, approvalSubject(*call)
+		if json.Valid([]byte(call.Function.Arguments)) {
+			req.Arguments = json.RawMessage(call.Function.Arguments)
+		}
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	data, _ := json.Marshal(req)
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return "", err
+	}
+	var resp approvalResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return "", fmt.Errorf("invalid answer from the approval socket: %v", err)
+	}
+	switch resp.Decision {
+	case "allow", "deny":
+		return approvalAnswer(prompt, resp.Decision == "allow"), nil
+	}
+	return strings.TrimSpace(resp.Answer), nil
+}
+
+// newApprovalPrompter answers prompts from the policy and the socket, either
+// of which may be unset. Failures deny.
+func newApprovalPrompter(policy *ApprovalPolicy, socket string) Prompter {
+	if policy == nil {
+		policy = &ApprovalPolicy{}
+	}
+	return func(ctx context.Context, prompt string) string {
+		var call *ToolCall
+		if rec, ok := ctx.Value(auditKey{}).(*auditRecord); ok {
+			call = &rec.call
+		}
+		if approvalAnswer(prompt, true) == "" {
+			// Follow-up questions, e.g. the reason for a denial
+			return ""
+		}
+		decision, rule := policy.Decide(call, socket != "")
+		if decision == "ask" {
+			if socket == "" {
+				decision, rule = "deny", rule+", no approval socket"
+			} else {
+				answer, err := askApprovalSocket(ctx, socket, prompt, call)
+				if err == nil {
+					fmt.Printf("%s%s (approval socket)\n", prompt, answer)
+					return answer
+				}
+				fmt.Printf("\033[31mApproval socket failed: %v\033[0m\n", err)
+				decision, rule = "deny", "approval socket unavailable"
+			}
+		}
+		answer := approvalAnswer(prompt, decision == "allow")
+		fmt.Printf("%s%s (approval policy: %s, %s)\n", prompt, answer, decision, rule)
+		return answer
+	}
+}
+
+// --- Serve Mode ---
+
+// `simple-agent serve` runs the agent loop behind a small HTTP server: an
+// embedded web UI (chat, diffs, approval buttons) for the default session,
+// and an API for editors and scripts to create sessions, send messages,
+// answer approvals and follow events (SSE or WebSocket). Approval prompts
+// that would go to the terminal are sent to the clients instead. Every API
+// call needs the token printed at startup, as the agent can run commands on
+// this machine. Sessions share the working directory.
+
+//go:embed web/index.html
+var webIndexHTML []byte
+
+var errSessionBusy = errors.New("a turn is already running")
+
+// serveEvent is one entry of a session's event stream. Clients get the full
+// history when they connect, then live events.
+type serveEvent struct {
+	Seq     int      `json:"seq"`
+	Type    string   `json:"type"` // message, approval, answered, status, error
+	Message *Message `json:"message,omitempty"`
+	ID      string   `json:"id,omitempty"` // Approval id
+	Prompt  string   `json:"prompt,omitempty"`
+	Answer  string   `json:"answer,omitempty"`
+	Status  string   `json:"status,omitempty"` // busy or idle
+	// Why the turn ended, with status idle: end_turn, cancelled,
+	// max_turn_requests or error
+	StopReason string `json:"stop_reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// agentSession is a conversation driven by remote clients, one turn at a
+// time.
+type agentSession struct {
+	ID      string
+	Created time.Time
+	Dir     string // Working directory, if not the process's
+	env     *ToolEnv
+
+	mu        sync.Mutex
+	messages  []Message
+	events    []serveEvent
+	subs      map[chan serveEvent]bool
+	cancel    context.CancelFunc // Set while a turn runs
+	approvals map[string]*pendingApproval
+	nextID    int
+}
+
+// pendingApproval is a prompt waiting for a client's answer.
+type pendingApproval struct {
+	ID     string `json:"id"`
+	Prompt string `json:"prompt"`
+	answer chan string
+}
+
+func newAgentSession(id string, env *ToolEnv, messages []Message) *agentSession {
+	s := &agentSession{
+		ID:        id,
+		Created:   time.Now(),
+		env:       env,
+		subs:      make(map[chan serveEvent]bool),
+		approvals: make(map[string]*pendingApproval),
+	}
+	for _, m := range messages {
+		s.addMessage(m)
+	}
+	return s
+}
+
+// publish records ev and sends it to the subscribers. Subscribers that
+// fall behind are dropped; they reconnect and get the history again.
+func (s *agentSession) publish(ev serveEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publishLocked(ev)
+}
+
+func (s *agentSession) publishLocked(ev serveEvent) {
+	ev.Seq = len(s.events) + 1
+	s.events = append(s.events, ev)
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the events so far and a channel for the ones to come.
+func (s *agentSession) subscribe() ([]serveEvent, chan serveEvent, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan serveEvent, 256)
+	s.subs[ch] = true
+	past := append([]serveEvent(nil), s.events...)
+	return past, ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.subs[ch] {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (s *agentSession) addMessage(m Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+	s.publishLocked(serveEvent{Type: "message", Message: &m})
+}
+
+// Messages returns a copy of the conversation.
+func (s *agentSession) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Busy reports whether a turn is running.
+func (s *agentSession) Busy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancel != nil
+}
+
+// Pending returns the approvals waiting for an answer.
+func (s *agentSession) Pending() []pendingApproval {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := []pendingApproval{}
+	for _, a := range s.approvals {
+		pending = append(pending, *a)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		a, _ := strconv.Atoi(pending[i].ID)
+		b, _ := strconv.Atoi(pending[j].ID)
+		return a < b
+	})
+	return pending
+}
+
+// Send starts a turn for a user message.
+func (s *agentSession) Send(text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errors.New("empty message")
+	}
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return errSessionBusy
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if s.Dir != "" {
+		ctx = withWorkDir(ctx, s.Dir)
+	}
+	s.cancel = cancel
+	s.publishLocked(serveEvent{Type: "status", Status: "busy"})
+	s.mu.Unlock()
+
+	go s.runTurn(withPrompter(ctx, s.ask), text)
+	return nil
+}
+
+// Abort cancels the running turn, if any.
+func (s *agentSession) Abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// ask is the session's Prompter: it publishes the prompt and waits for a
+// client to answer it. An aborted turn answers "".
+func (s *agentSession) ask(ctx context.Context, prompt string) string {
+	s.mu.Lock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	ch := make(chan string, 1)
+	s.approvals[id] = &pendingApproval{ID: id, Prompt: prompt, answer: ch}
+	s.publishLocked(serveEvent{Type: "approval", ID: id, Prompt: prompt})
+	s.mu.Unlock()
+
+	fmt.Printf("%s\033[90m(waiting for a client to answer)\033[0m\n", prompt)
+	var answer string
+	select {
+	case answer = <-ch:
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(s.approvals, id)
+		s.publishLocked(serveEvent{Type: "answered", ID: id})
+		s.mu.Unlock()
+	}
+	return answer
+}
+
+// Answer answers a pending approval.
+func (s *agentSession) Answer(id, answer string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.approvals[id]
+	if !ok {
+		return fmt.Errorf("no pending approval %q", id)
+	}
+	delete(s.approvals, id)
+	answer = strings.TrimSpace(answer)
+	pending.answer <- answer
+	s.publishLocked(serveEvent{Type: "answered", ID: id, Answer: answer})
+	return nil
+}
+
+// serveTools are the tools of a remote session. shorten_context is left out
+// as only the REPL implements it.
+func serveTools() []Tool {
+	var tools []Tool
+	for _, t := range enabledTools(allTools()) {
+		if t.Function.Name != "shorten_context" {
+			tools = append(tools, t)
+		}
+	}
+	return tools
+}
+
+// runTurn runs the tool loop for one user message.
+func (s *agentSession) runTurn(ctx context.Context, text string) {
+	reason := "end_turn"
+	var report string
+	finish := startTaskEvents(text, map[string]any{"session": s.ID})
+	defer func() {
+		var err error
+		if reason != "end_turn" {
+			err = errors.New(reason)
+		}
+		finish(report, err)
+	}()
+	defer func() {
+		s.mu.Lock()
+		s.cancel()
+		s.cancel = nil
+		s.publishLocked(serveEvent{Type: "status", Status: "idle", StopReason: reason})
+		s.mu.Unlock()
+	}()
+
+	s.addMessage(Message{Role: "user", Content: guardLargeMessage(ctx, "The message", text, true)})
+	for turn := 1; turn <= maxSubAgentTurns; turn++ {
+		chatResp, err := requestCompletion(ctx, s.env.Client, s.env.APIKey, ChatCompletionRequest{
+			Model:           ModelName,
+			Messages:        s.Messages(),
+			Tools:           serveTools(),
+			ExtraBody:       getExtraBody(s.env.Provider),
+			ReasoningEffort: getReasoningEffort(s.env.Provider),
+		})
+		if err != nil {
+			reason = "error"
+			if ctx.Err() != nil {
+				reason = "cancelled"
+			}
+			s.publish(serveEvent{Type: "error", Error: err.Error()})
+			return
+		}
+		msg := chatResp.Choices[0].Message
+		s.addMessage(msg)
+		if len(msg.ToolCalls) == 0 {
+			report = msg.Content
+			return
+		}
+
+		for _, toolCall := range msg.ToolCalls {
+			if ctx.Err() != nil {
+				s.addMessage(Message{Role: "tool", Content: notExecutedResult("The user aborted the turn")(toolCall), ToolCallID: toolCall.ID})
+				continue
+			}
+			result, toolErr := executeTool(ctx, s.env, toolCall)
+			result = guardLargeMessage(ctx, "The "+toolCall.Function.Name+" result", result, true)
+			if toolErr != nil {
+				fmt.Printf("Tool Error: %v\n", toolErr)
+				result = formatToolError(toolErr)
+			}
+			s.addMessage(Message{Role: "tool", Content: result, ToolCallID: toolCall.ID})
+		}
+		if ctx.Err() != nil {
+			reason = "cancelled"
+			s.publish(serveEvent{Type: "error", Error: "Turn aborted."})
+			return
+		}
+	}
+	reason = "max_turn_requests"
+	s.publish(serveEvent{Type: "error", Error: fmt.Sprintf("Stopped after %d rounds of tool calls; send a message to continue.", maxSubAgentTurns)})
+}
+
+const defaultSessionID = "default"
+
+// webServer serves the UI and the API.
+type webServer struct {
+	env     *ToolEnv
+	initial []Message // Messages new sessions start with
+	token   string
+	noUI    bool
+
+	mu       sync.Mutex
+	sessions map[string]*agentSession
+}
+
+func newWebServer(env *ToolEnv, messages []Message, token string) *webServer {
+	ws := &webServer{env: env, token: token, sessions: make(map[string]*agentSession)}
+	for _, m := range messages {
+		if m.Role == "system" {
+			ws.initial = append(ws.initial, m)
+		}
+	}
+	// The default session keeps a -continue'd history
+	ws.sessions[defaultSessionID] = newAgentSession(defaultSessionID, env, messages)
+	return ws
+}
+
+// sessionHandler handles a request for one session.
+type sessionHandler func(w http.ResponseWriter, r *http.Request, s *agentSession)
+
+func (ws *webServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	if !ws.noUI {
+		mux.HandleFunc("/", ws.handleIndex)
+	}
+	// The UI's endpoints, for the default session
+	mux.HandleFunc("/api/messages", ws.auth(ws.defaultSession(ws.handleMessages)))
+	mux.HandleFunc("/api/approvals/", ws.auth(ws.defaultSession(ws.handleApproval)))
+	mux.HandleFunc("/api/abort", ws.auth(ws.defaultSession(ws.handleAbort)))
+	mux.HandleFunc("/api/ws", ws.auth(ws.defaultSession(ws.handleWebSocket)))
+	mux.HandleFunc("/sessions", ws.auth(ws.handleSessions))
+	mux.HandleFunc("/sessions/", ws.auth(ws.handleSessions))
+	return mux
+}
+
+func (ws *webServer) defaultSession(next sessionHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r, ws.session(defaultSessionID))
+	}
+}
+
+func (ws *webServer) session(id string) *agentSession {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.sessions[id]
+}
+
+// newSession starts a session with the startup system messages and its own
+// patch store.
+func (ws *webServer) newSession() *agentSession {
+	b := make([]byte, 8)
+	crand.Read(b)
+	env := *ws.env
+	env.Patches = newPatchStore()
+	s := newAgentSession(hex.EncodeToString(b), &env, ws.initial)
+	ws.mu.Lock()
+	ws.sessions[s.ID] = s
+	ws.mu.Unlock()
+	return s
+}
+
+// sessionInfo is a session as the API lists it.
+func sessionInfo(s *agentSession) map[string]any {
+	return map[string]any{"id": s.ID, "created": s.Created, "busy": s.Busy(), "messages": len(s.Messages())}
+}
+
+// handleSessions routes /sessions and /sessions/{id}[/...].
+func (ws *webServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/"), "/")
+	if parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			ws.mu.Lock()
+			list := []map[string]any{}
+			for _, s := range ws.sessions {
+				list = append(list, sessionInfo(s))
+			}
+			ws.mu.Unlock()
+			sort.Slice(list, func(i, j int) bool { return list[i]["created"].(time.Time).Before(list[j]["created"].(time.Time)) })
+			writeJSON(w, http.StatusOK, map[string]any{"sessions": list})
+		case http.MethodPost:
+			writeJSON(w, http.StatusCreated, sessionInfo(ws.newSession()))
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+		return
+	}
+
+	s := ws.session(parts[0])
+	if s == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no session %q", parts[0]))
+		return
+	}
+	switch rest := strings.Join(parts[1:], "/"); {
+	case rest == "":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]any{"id": s.ID, "busy": s.Busy(), "messages": s.Messages(), "pending_approvals": s.Pending()})
+		case http.MethodDelete:
+			s.Abort()
+			ws.mu.Lock()
+			delete(ws.sessions, s.ID)
+			ws.mu.Unlock()
+			writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or DELETE")
+		}
+	case rest == "messages":
+		ws.handleMessages(w, r, s)
+	case rest == "events":
+		ws.handleEvents(w, r, s)
+	case strings.HasPrefix(rest, "approvals/"):
+		ws.handleApproval(w, r, s)
+	case rest == "abort":
+		ws.handleAbort(w, r, s)
+	case rest == "transcript":
+		transcript, _ := buildShareReport(s.Messages(), false)
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		io.WriteString(w, transcript)
+	case rest == "ws":
+		ws.handleWebSocket(w, r, s)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// auth requires the token as a bearer token or, for WebSockets, which
+// browsers can't add headers to, as ?token=.
+func (ws *webServer) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			token = r.URL.Query().Get("token")
+		}
+		if !hmac.Equal([]byte(token), []byte(ws.token)) {
+			writeJSONError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		if r.Method == http.MethodPost && r.ContentLength != 0 && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			writeJSONError(w, http.StatusUnsupportedMediaType, "POST bodies must be application/json")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (ws *webServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Write(webIndexHTML)
+}
+
+// handleMessages returns the conversation (GET) or starts a turn (POST
+// {"text": ...}).
+func (ws *webServer) handleMessages(w http.ResponseWriter, r *http.Request, s *agentSession) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"messages": s.Messages(), "busy": s.Busy()})
+	case http.MethodPost:
+		var body struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 10<<20)).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+			return
+		}
+		if err := s.Send(body.Text); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errSessionBusy) {
+				status = http.StatusConflict
+			}
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "busy"})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
+
+// handleApproval answers a pending approval: POST .../approvals/{id}
+// {"answer": ...}.
+func (ws *webServer) handleApproval(w http.ResponseWriter, r *http.Request, s *agentSession) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var body struct {
+		Answer string `json:"answer"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+		return
+	}
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if err := s.Answer(id, body.Answer); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "answered"})
+}
+
+func (ws *webServer) handleAbort(w http.ResponseWriter, r *http.Request, s *agentSession) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	s.Abort()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "aborting"})
+}
+
+// handleWebSocket streams the session's events. Clients send
+// {"type":"message","text"}, {"type":"answer","id","answer"} or
+// {"type":"abort"}; failures come back as error events.
+func (ws *webServer) handleWebSocket(w http.ResponseWriter, r *http.Request, s *agentSession) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			writeJSONError(w, http.StatusForbidden, "cross-origin WebSocket refused")
+			return
+		}
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	past, events, unsubscribe := s.subscribe()
+	defer unsubscribe()
+	go func() {
+		for _, ev := range past {
+			if conn.WriteJSON(ev) != nil {
+				return
+			}
+		}
+		for ev := range events {
+			if conn.WriteJSON(ev) != nil {
+				conn.Close()
+				return
+			}
+		}
+		conn.Close() // Dropped for falling behind
+	}()
+
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var in struct {
+			Type   string `json:"type"`
+			Text   string `json:"text"`
+			ID     string `json:"id"`
+			Answer string `json:"answer"`
+		}
+		switch err = json.Unmarshal(data, &in); {
+		case err != nil:
+		case in.Type == "message":
+			err = s.Send(in.Text)
+		case in.Type == "answer":
+			err = s.Answer(in.ID, in.Answer)
+		case in.Type == "abort":
+			s.Abort()
+		default:
+			err = fmt.Errorf("unknown message type %q", in.Type)
+		}
+		if err != nil {
+			conn.WriteJSON(serveEvent{Type: "error", Error: err.Error()})
+		}
+	}
+}
+
+// handleEvents streams the session's events as server-sent events. The SSE
+// id is the event's seq; reconnecting clients get what they missed after
+// Last-Event-ID (or ?since=), new ones get everything.
+func (ws *webServer) handleEvents(w http.ResponseWriter, r *http.Request, s *agentSession) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	since, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, _ = strconv.Atoi(v)
+	}
+	past, events, unsubscribe := s.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	write := func(ev serveEvent) {
+		data, _ := json.Marshal(ev)
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+	}
+	for _, ev := range past {
+		if ev.Seq > since {
+			write(ev)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return // Dropped for falling behind
+			}
+			write(ev)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// runServer serves on addr until interrupted.
+func runServer(ws *webServer, addr string) error {
+	server := &http.Server{Addr: addr, Handler: ws.routes(), ReadHeaderTimeout: 10 * time.Second}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		ws.mu.Lock()
+		for _, s := range ws.sessions {
+			s.Abort()
+		}
+		ws.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	host, port, _ := net.SplitHostPort(addr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	base := "http://" + net.JoinHostPort(host, port)
+	if ws.noUI {
+		fmt.Printf("Simple Agent %s (Model: %s) serving the API on %s\n", Version, ModelName, base)
+		fmt.Printf("Token: %s\n", ws.token)
+	} else {
+		fmt.Printf("Simple Agent %s (Model: %s) serving on %s/?token=%s\n", Version, ModelName, base, ws.token)
+	}
+	fmt.Println("API: /sessions, /sessions/{id}/messages, /sessions/{id}/events (SSE) and more, with Authorization: Bearer <token>. Ctrl+C to stop.")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// serveToken returns the API token: -token, $SIMPLE_AGENT_SERVE_TOKEN, or a
+// random one.
+func serveToken(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv("SIMPLE_AGENT_SERVE_TOKEN"); env != "" {
+		return env
+	}
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// --- WebSocket ---
+
+// A minimal RFC 6455 server side for serve mode: text messages, ping/pong
+// and close. Extensions and binary messages are not supported.
+
+const (
+	websocketGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxWebSocketMessage = 10 << 20
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	wmu  sync.Mutex
+}
+
+// upgradeWebSocket performs the opening handshake and hijacks the
+// connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, errors.New("not a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be upgraded")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *wsConn) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(0x1, data)
+}
+
+// writeFrame writes one unmasked, final frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		for shift := 56; shift >= 0; shift -= 8 {
+			header = append(header, byte(uint64(n)>>shift))
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// ReadMessage returns the next text message, answering pings on the way.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return nil, err
+		}
+		final, opcode := head[0]&0x80 != 0, head[0]&0x0F
+		if head[1]&0x80 == 0 {
+			return nil, errors.New("unmasked client frame")
+		}
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(ext[0])<<8 | uint64(ext[1])
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return nil, err
+			}
+			length = 0
+			for _, b := range ext {
+				length = length<<8 | uint64(b)
+			}
+		}
+		if length > maxWebSocketMessage || uint64(len(message))+length > maxWebSocketMessage {
+			c.writeFrame(0x8, []byte{0x03, 0xF1}) // 1009: message too big
+			return nil, errors.New("WebSocket message too large")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case 0x8: // Close
+			c.writeFrame(0x8, nil)
+			return nil, io.EOF
+		case 0x9: // Ping
+			if err := c.writeFrame(0xA, payload); err != nil {
+				return nil, err
+			}
+		case 0xA: // Pong
+		case 0x0, 0x1: // Continuation, text
+			message = append(message, payload...)
+			if final {
+				return message, nil
+			}
+		default:
+			return nil, fmt.Errorf("unsupported WebSocket opcode %d", opcode)
+		}
+	}
+}
+
+// --- Editor Protocol ---
+
+// `simple-agent acp` speaks the Agent Client Protocol (JSON-RPC 2.0, one
+// message per line on stdin/stdout) so editors such as Zed can embed the
+// agent: session/new and session/prompt drive a serve-mode agentSession,
+// its events become session/update notifications, and approval prompts
+// become session/request_permission requests. stdout belongs to the
+// protocol, so everything the agent prints goes to stderr.
+
+const acpProtocolVersion = 1
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcMessage is any JSON-RPC message: a request (ID and Method), a
+// notification (Method only) or a response (ID and Result or Error).
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type acpServer struct {
+	env     *ToolEnv
+	initial []Message
+
+	wmu sync.Mutex
+	out io.Writer
+
+	mu       sync.Mutex
+	sessions map[string]*acpSession
+	nextID   int
+	pending  map[string]func(rpcMessage) // Our requests awaiting a response
+}
+
+// acpSession is an agentSession and the protocol state of its turn.
+type acpSession struct {
+	*agentSession
+	promptID json.RawMessage // The session/prompt request of the running turn
+	calls    []string        // Tool calls of the turn without a result yet
+}
+
+func newACPServer(env *ToolEnv, messages []Message, out io.Writer) *acpServer {
+	a := &acpServer{env: env, out: out, sessions: make(map[string]*acpSession), pending: make(map[string]func(rpcMessage))}
+	for _, m := range messages {
+		if m.Role == "system" {
+			a.initial = append(a.initial, m)
+		}
+	}
+	return a
+}
+
+func (a *acpServer) write(msg rpcMessage) {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("ACP: cannot encode message: %v\n", err)
+		return
+	}
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	a.out.Write(append(data, '\n'))
+}
+
+func mustJSON(v any) json.RawMessage {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func (a *acpServer) respond(id json.RawMessage, result any) {
+	a.write(rpcMessage{ID: id, Result: mustJSON(result)})
+}
+
+func (a *acpServer) respondError(id json.RawMessage, code int, message string) {
+	a.write(rpcMessage{ID: id, Error: &rpcError{Code: code, Message: message}})
+}
+
+func (a *acpServer) notify(method string, params any) {
+	a.write(rpcMessage{Method: method, Params: mustJSON(params)})
+}
+
+// request sends a request to the client; handle gets the response.
+func (a *acpServer) request(method string, params any, handle func(rpcMessage)) {
+	a.mu.Lock()
+	a.nextID++
+	id := mustJSON(a.nextID)
+	a.pending[string(id)] = handle
+	a.mu.Unlock()
+	a.write(rpcMessage{ID: id, Method: method, Params: mustJSON(params)})
+}
+
+// Serve handles messages from in until it is closed.
+func (a *acpServer) Serve(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxWebSocketMessage)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var msg rpcMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			a.respondError(json.RawMessage("null"), -32700, fmt.Sprintf("parse error: %v", err))
+			continue
+		}
+		if msg.Method == "" {
+			a.mu.Lock()
+			handle := a.pending[string(msg.ID)]
+			delete(a.pending, string(msg.ID))
+			a.mu.Unlock()
+			if handle != nil {
+				handle(msg)
+			}
+			continue
+		}
+		result, rerr := a.handle(msg)
+		if msg.ID == nil {
+			continue // Notification
+		}
+		if rerr != nil {
+			a.respondError(msg.ID, rerr.Code, rerr.Message)
+		} else if result != nil {
+			a.respond(msg.ID, result)
+		}
+	}
+	a.mu.Lock()
+	for _, s := range a.sessions {
+		s.Abort()
+	}
+	a.mu.Unlock()
+	return scanner.Err()
+}
+
+// handle runs a request. A nil result without an error means the response
+// is sent later (session/prompt answers when the turn ends).
+func (a *acpServer) handle(msg rpcMessage) (any, *rpcError) {
+	invalid := func(err error) *rpcError {
+		return &rpcError{Code: -32602, Message: fmt.Sprintf("invalid params: %v", err)}
+	}
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"protocolVersion": acpProtocolVersion,
+			"agentCapabilities": map[string]any{
+				"loadSession":        false,
+				"promptCapabilities": map[string]bool{"image": false, "audio": false, "embeddedContext": true},
+			},
+			"authMethods": []any{},
+		}, nil
+	case "authenticate":
+		return map[string]any{}, nil
+	case "session/new":
+		var params struct {
+			Cwd string `json:"cwd"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalid(err)
+		}
+		return map[string]string{"sessionId": a.newSession(params.Cwd)}, nil
+	case "session/prompt":
+		var params struct {
+			SessionID string            `json:"sessionId"`
+			Prompt    []json.RawMessage `json:"prompt"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalid(err)
+		}
+		s := a.session(params.SessionID)
+		if s == nil {
+			return nil, &rpcError{Code: -32602, Message: fmt.Sprintf("unknown session %q", params.SessionID)}
+		}
+		a.mu.Lock()
+		if s.promptID != nil {
+			a.mu.Unlock()
+			return nil, &rpcError{Code: -32603, Message: errSessionBusy.Error()}
+		}
+		s.promptID = msg.ID
+		a.mu.Unlock()
+		if err := s.Send(acpPromptText(params.Prompt)); err != nil {
+			a.mu.Lock()
+			s.promptID = nil
+			a.mu.Unlock()
+			return nil, &rpcError{Code: -32603, Message: err.Error()}
+		}
+		return nil, nil
+	case "session/cancel":
+		var params struct {
+			SessionID string `json:"sessionId"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		if s := a.session(params.SessionID); s != nil {
+			s.Abort()
+		}
+		return nil, nil
+	}
+	return nil, &rpcError{Code: -32601, Message: fmt.Sprintf("method not found: %s", msg.Method)}
+}
+
+func (a *acpServer) session(id string) *acpSession {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sessions[id]
+}
+
+// newSession starts a session in dir and forwards its events.
+func (a *acpServer) newSession(dir string) string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	env := *a.env
+	env.Patches = newPatchStore()
+	s := &acpSession{agentSession: newAgentSession(hex.EncodeToString(b), &env, a.initial)}
+	s.Dir = dir
+	a.mu.Lock()
+	a.sessions[s.ID] = s
+	a.mu.Unlock()
+
+	past, events, _ := s.subscribe()
+	seen := len(past)
+	go func() {
+		for ev := range events {
+			if ev.Seq > seen {
+				a.forward(s, ev)
+			}
+		}
+	}()
+	return s.ID
+}
+
+// acpPromptText flattens prompt content blocks into a message.
+func acpPromptText(blocks []json.RawMessage) string {
+	var parts []string
+	for _, raw := range blocks {
+		var block struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			URI      string `json:"uri"`
+			Name     string `json:"name"`
+			Resource struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"resource"`
+		}
+		if json.Unmarshal(raw, &block) != nil {
+			continue
+		}
+		switch block.Type {
+		case "text":
+			parts = append(parts, block.Text)
+		case "resource_link":
+			parts = append(parts, fmt.Sprintf("[@%s](%s)", block.Name, block.URI))
+		case "resource":
+			parts = append(parts, fmt.Sprintf("<context uri=%q>\n%s\n</context>", block.Resource.URI, block.Resource.Text))
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// acpToolKind maps a tool to the protocol's tool kinds.
+func acpToolKind(name string) string {
+	switch name {
+	case "read_file", "code_outline", "recall", "git_status", "git_diff", "git_log":
+		return "read"
+	case "apply_udiff", "edit_many":
+		return "edit"
+	case "semantic_search":
+		return "search"
+	case "run_command", "run_script", "run_tests", "build_project":
+		return "execute"
+	}
+	return "other"
+}
+
+// acpToolCall describes a tool call for the client: a title, the affected
+// path and, for edits, the diff.
+func acpToolCall(call ToolCall) map[string]any {
+	var args map[string]any
+	json.Unmarshal([]byte(call.Function.Arguments), &args)
+	str := func(key string) string {
+		v, _ := args[key].(string)
+		return v
+	}
+	update := map[string]any{
+		"sessionUpdate": "tool_call",
+		"toolCallId":    call.ID,
+		"title":         call.Function.Name,
+		"kind":          acpToolKind(call.Function.Name),
+		"status":        "pending",
+		"rawInput":      args,
+	}
+	if command := str("command"); command != "" {
+		update["title"] = truncateLine(command, 80)
+	} else if path := str("path"); path != "" {
+		update["title"] = call.Function.Name + " " + path
+		update["locations"] = []map[string]string{{"path": path}}
+	}
+	if diff := str("diff"); diff != "" {
+		update["content"] = []any{acpText("```diff\n" + diff + "\n```")}
+	}
+	return update
+}
+
+// acpText is tool call content holding text.
+func acpText(text string) map[string]any {
+	return map[string]any{"type": "content", "content": map[string]string{"type": "text", "text": text}}
+}
+
+// forward turns a session event into protocol messages.
+func (a *acpServer) forward(s *acpSession, ev serveEvent) {
+	update := func(u map[string]any) {
+		a.notify("session/update", map[string]any{"sessionId": s.ID, "update": u})
+	}
+	switch ev.Type {
+	case "message":
+		m := ev.Message
+		switch m.Role {
+		case "assistant":
+			for _, thought := range thoughtTagRe.FindAllString(m.Content, -1) {
+				thought = strings.TrimSuffix(strings.TrimPrefix(thought, "<thought>"), "</thought>")
+				update(map[string]any{"sessionUpdate": "agent_thought_chunk", "content": map[string]string{"type": "text", "text": thought}})
+			}
+			if text := strings.TrimSpace(thoughtTagRe.ReplaceAllString(m.Content, "")); text != "" {
+				update(map[string]any{"sessionUpdate": "agent_message_chunk", "content": map[string]string{"type": "text", "text": text}})
+			}
+			for _, call := range m.ToolCalls {
+				a.mu.Lock()
+				s.calls = append(s.calls, call.ID)
+				a.mu.Unlock()
+				update(acpToolCall(call))
+			}
+		case "tool":
+			a.mu.Lock()
+			for i, id := range s.calls {
+				if id == m.ToolCallID {
+					s.calls = append(s.calls[:i], s.calls[i+1:]...)
+					break
+				}
+			}
+			a.mu.Unlock()
+			status := "completed"
+			if isToolErrorResult(m.Content) || strings.HasPrefix(m.Content, "Error: Not executed") {
+				status = "failed"
+			}
+			update(map[string]any{
+				"sessionUpdate": "tool_call_update",
+				"toolCallId":    m.ToolCallID,
+				"status":        status,
+				"content":       []any{acpText(truncateMiddle(m.Content, maxSharedResultChars))},
+			})
+		}
+	case "approval":
+		a.requestPermission(s, ev)
+	case "error":
+		update(map[string]any{"sessionUpdate": "agent_message_chunk", "content": map[string]string{"type": "text", "text": "Error: " + ev.Error}})
+	case "status":
+		if ev.Status != "idle" {
+			return
+		}
+		a.mu.Lock()
+		id := s.promptID
+		s.promptID, s.calls = nil, nil
+		a.mu.Unlock()
+		if id != nil {
+			reason := ev.StopReason
+			if reason == "error" {
+				reason = "end_turn" // The error was sent as a message
+			}
+			a.respond(id, map[string]string{"stopReason": reason})
+		}
+	}
+}
+
+// acpPermissionKinds maps the answers of the approval prompts to the
+// protocol's option kinds; other answers count as allow_once. Answers that
+// need a terminal (editing a hunk) are not offered.
+var acpPermissionKinds = map[string]string{
+	"s": "allow_always", "a": "allow_always", "k": "allow_always",
+	"d": "reject_once", "n": "reject_once",
+}
+
+var approvalOptionRe = regexp.MustCompile(`\[(\w)\]([\w-]*)`)
+
+// acpPermissionOptions parses the options of an approval prompt, e.g.
+// "Run this command? [o]nce, [a]lways allow this command, [d]eny: " or
+// "Apply this hunk? [y,n,e,a,d,f,?]: ".
+func acpPermissionOptions(prompt string) []map[string]string {
+	var options []map[string]string
+	add := func(id, name string) {
+		kind, ok := acpPermissionKinds[id]
+		if !ok {
+			kind = "allow_once"
+		}
+		if id == "n" && strings.Contains(prompt, "[n]ever") {
+			kind = "reject_always"
+		}
+		options = append(options, map[string]string{"optionId": id, "name": name, "kind": kind})
+	}
+	for _, phrase := range strings.Split(prompt, ",") {
+		m := approvalOptionRe.FindStringSubmatch(phrase)
+		if m == nil {
+			continue
+		}
+		if i := strings.LastIndex(phrase, "? "); i >= 0 && i < strings.Index(phrase, m[0]) {
+			phrase = phrase[i+2:] // Drop the question
+		}
+		label := m[1] + m[2]
+		if m[2] == "" {
+			label = "" // "always allow skill 'x' [k]"
+		}
+		name := strings.TrimSpace(strings.TrimRight(strings.Replace(phrase, m[0], label, 1), "?: "))
+		add(m[1], strings.TrimPrefix(name, "or "))
+	}
+	if len(options) > 0 {
+		return options
+	}
+	if i, j := strings.LastIndex(prompt, "["), strings.LastIndex(prompt, "]"); i >= 0 && j > i {
+		names := map[string]string{"y": "Apply", "n": "Skip", "a": "Apply all", "d": "Skip all"}
+		for _, id := range strings.Split(prompt[i+1:j], ",") {
+			if name, ok := names[strings.ToLower(id)]; ok {
+				add(strings.ToLower(id), name)
+			}
+		}
+	}
+	return options
+}
+
+// requestPermission asks the client to answer an approval prompt. Prompts
+// without options (such as an optional reason) are answered with "".
+func (a *acpServer) requestPermission(s *acpSession, ev serveEvent) {
+	options := acpPermissionOptions(ev.Prompt)
+	if len(options) == 0 {
+		s.Answer(ev.ID, "")
+		return
+	}
+	a.mu.Lock()
+	toolCallID := ""
+	if len(s.calls) > 0 {
+		toolCallID = s.calls[0] // Tools run in order
+	}
+	a.mu.Unlock()
+	params := map[string]any{
+		"sessionId": s.ID,
+		"toolCall":  map[string]any{"toolCallId": toolCallID, "title": strings.TrimSpace(ev.Prompt)},
+		"options":   options,
+	}
+	a.request("session/request_permission", params, func(resp rpcMessage) {
+		var result struct {
+			Outcome struct {
+				Outcome  string `json:"outcome"`
+				OptionID string `json:"optionId"`
+			} `json:"outcome"`
+		}
+		json.Unmarshal(resp.Result, &result)
+		if resp.Error != nil || result.Outcome.Outcome != "selected" {
+			s.Answer(ev.ID, "") // Cancelled: deny
+			return
+		}
+		s.Answer(ev.ID, result.Outcome.OptionID)
+	})
+}
+
+// runACP serves the protocol on in/out until in is closed.
+func runACP(env *ToolEnv, messages []Message, in io.Reader, out io.Writer) error {
+	fmt.Printf("Simple Agent %s (Model: %s) speaking ACP on stdio\n", Version, ModelName)
+	return newACPServer(env, messages, out).Serve(in)
+}
+
+// --- Quick Mode ---
+
+// Quick mode runs one task in the current directory and exits, for
+// one-liners that don't need the REPL. It is what the `sa` alias does: the
+// binary checks the name it was invoked as, so `sa` can be a symlink to
+// simple-agent (install.sh creates one).
+
+const quickPrompt = `
+# Quick Mode
+You are running a one-off task from the command line. Nobody will follow up in this session.
+- Work autonomously until the task is done; only ask when the task is genuinely ambiguous.
+- Keep changes to what the task asks for.
+- When finished, reply WITHOUT tool calls with a short report: what you changed, and anything left undone.
+`
+
+// quickAliasNames are the program names that start quick mode.
+var quickAliasNames = []string{"sa"}
+
+// isQuickAlias reports whether the binary was invoked as the quick alias.
+func isQuickAlias(arg0 string) bool {
+	name := strings.TrimSuffix(filepath.Base(arg0), ".exe")
+	for _, n := range quickAliasNames {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// runQuickTask runs the task headless in the current directory and prints
+// the report.
+func runQuickTask(ctx context.Context, env *ToolEnv, task string) (err error) {
+	ctx, span := startSpan(ctx, "quick task", spanKindInternal)
+	defer func() { span.End(err) }()
+
+	var report string
+	finish := startTaskEvents(task, nil)
+	defer func() { finish(report, err) }()
+
+	started := time.Now()
+	atomic.StoreInt32(&turnInProgress, 1)
+	report, err = runAgentLoop(ctx, env, "Agent", quickPrompt, task, nil, maxSubAgentTurns)
+	atomic.StoreInt32(&turnInProgress, 0)
+	if err != nil {
+		return err
+	}
+	if took := time.Since(started); took >= notifyConfig.longTurn() {
+		notify("Simple Agent finished", fmt.Sprintf("Task done after %s: %s", took.Round(time.Second), report))
+	}
+	fmt.Printf("\n\033[1;34m[Report]\033[0m\n")
+	printMarkdown(report)
+	return nil
+}
+
+// --- Watch Mode ---
+
+// `simple-agent watch` turns the agent into a small automation daemon: it
+// runs one prompt headless against the project every -every interval and/or
+// whenever files change (-on-change), appends each report to a Markdown file
+// and optionally opens an issue with it. Every run starts from a fresh
+// conversation; the previous report is passed along so the model can tell
+// what is new.
+
+const watchPrompt = `
+# Watch Mode
+You are running unattended on a schedule or after files changed. Nobody will read your questions or follow up.
+- Work autonomously and keep changes to what the task asks for.
+- Your previous report, if any, is included; focus on what is new or changed since then.
+- When finished, reply WITHOUT tool calls with a short report for the project's maintainers.
+- If there is nothing new to report, reply with exactly: ` + watchNothingNew + `
+`
+
+const (
+	watchNothingNew = "Nothing new."
+	// watchSettle is how long files must stay unchanged before -on-change runs
+	watchSettle = 2 * fileWatchInterval
+)
+
+type watchOptions struct {
+	Prompt   string
+	Every    time.Duration // 0: no schedule
+	OnChange bool
+	Report   string // Markdown file the reports are appended to
+	Issues   bool   // Open an issue for every report with findings
+}
+
+// watchReportPath is the default -report file.
+func watchReportPath() string {
+	return filepath.Join(".simple_agent", "watch-report.md")
+}
+
+// runWatch runs opts.Prompt until ctx is cancelled.
+func runWatch(ctx context.Context, env *ToolEnv, opts watchOptions) error {
+	if strings.TrimSpace(opts.Prompt) == "" {
+		return fmt.Errorf("watch requires -prompt \"<task>\"")
+	}
+	if opts.Every <= 0 && !opts.OnChange {
+		return fmt.Errorf("watch requires -every <interval> (e.g. 1h), -on-change, or both")
+	}
+	if opts.Every > 0 && opts.Every < time.Minute {
+		return fmt.Errorf("-every must be at least 1m")
+	}
+	if opts.Report == "" {
+		opts.Report = watchReportPath()
+	}
+	var repo prRepo
+	if opts.Issues {
+		var err error
+		if repo, err = detectPRRepo(prConfig.remote()); err != nil {
+			return fmt.Errorf("-issues: %v", err)
+		}
+		if repo.token() == "" {
+			return fmt.Errorf("-issues: no %s token (set GITHUB_TOKEN or GITLAB_TOKEN)", repo.Platform)
+		}
+	}
+	root, _ := os.Getwd()
+	trigger := newWatchTrigger(root, opts.Report)
+	if opts.OnChange && fileWatch == nil { // Reuse a watcher -watch-files started
+		var err error
+		if fileWatch, err = startFileWatcher(root); err != nil {
+			return fmt.Errorf("-on-change: %v", err)
+		}
+	}
+
+	var schedule []string
+	if opts.Every > 0 {
+		schedule = append(schedule, "every "+opts.Every.String())
+	}
+	if opts.OnChange {
+		schedule = append(schedule, "when files change")
+	}
+	fmt.Printf("Watching %s: %q %s. Reports go to %s. Ctrl+C to stop.\n", filepath.Base(root), opts.Prompt, strings.Join(schedule, " and "), opts.Report)
+
+	var tick <-chan time.Time
+	if opts.Every > 0 {
+		ticker := time.NewTicker(opts.Every)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	poll := time.NewTicker(fileWatchInterval)
+	defer poll.Stop()
+
+	previous := ""
+	run := func(trigger string, changes []string) {
+		report, err := runWatchTask(ctx, env, opts.Prompt, previous, changes)
+		if ctx.Err() != nil {
+			return
+		}
+		entry := formatWatchEntry(time.Now(), trigger, report, err)
+		if werr := appendWatchReport(opts.Report, entry); werr != nil {
+			fmt.Printf("Warning: %v\n", werr)
+		}
+		if err != nil {
+			fmt.Printf("\033[31mRun failed: %v\033[0m\n", err)
+			return
+		}
+		previous = report
+		if opts.Issues && report != watchNothingNew {
+			title := fmt.Sprintf("%s (%s)", truncateLine(opts.Prompt, 60), time.Now().Format("2006-01-02 15:04"))
+			if url, err := repo.openIssue(ctx, title, report+"\n\n_Opened by `simple-agent watch`._"); err != nil {
+				fmt.Printf("Warning: Could not open an issue: %v\n", err)
+			} else {
+				fmt.Printf("\033[32mOpened %s\033[0m\n", url)
+			}
+		}
+	}
+
+	if opts.Every > 0 {
+		run("scheduled", nil)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+			run("scheduled", nil)
+		case <-poll.C:
+			if !opts.OnChange {
+				continue
+			}
+			now := time.Now()
+			trigger.Add(fileWatch.Drain(), now)
+			if changes := trigger.Ready(now); len(changes) > 0 {
+				run("files changed", changes)
+			}
+		}
+	}
+}
+
+// runWatchTask runs one headless pass and prints its report.
+func runWatchTask(ctx context.Context, env *ToolEnv, prompt, previous string, changes []string) (report string, err error) {
+	ctx, span := startSpan(ctx, "watch task", spanKindInternal)
+	defer func() { span.End(err) }()
+	finish := startTaskEvents(prompt, map[string]any{"changes": changes})
+	defer func() { finish(report, err) }()
+
+	task := prompt
+	if len(changes) > 0 {
+		task += "\n\nFiles changed since the last run:\n- " + strings.Join(changes, "\n- ")
+	}
+	if previous != "" {
+		task += "\n\nYour previous report:\n" + previous
+	}
+	fmt.Printf("\n\033[1;36m[%s] Running: %s\033[0m\n", time.Now().Format("15:04:05"), truncateLine(prompt, 80))
+	atomic.StoreInt32(&turnInProgress, 1)
+	report, err = runAgentLoop(ctx, env, "Watch agent", watchPrompt, task, nil, maxSubAgentTurns)
+	atomic.StoreInt32(&turnInProgress, 0)
+	if err != nil {
+		return "", err
+	}
+	report = strings.TrimSpace(report)
+	fmt.Printf("\n\033[1;34m[Report]\033[0m\n")
+	printMarkdown(report)
+	return report, nil
+}
+
+// watchTrigger collects the file watcher's changes until the files settle.
+// Changes to the report file don't count, or every report would start the
+// next run.
+type watchTrigger struct {
+	report     string // Report path relative to the root; "" if outside it
+	pending    []string
+	lastChange time.Time
+}
+
+func newWatchTrigger(root, report string) *watchTrigger {
+	t := &watchTrigger{}
+	if abs, err := filepath.Abs(report); err == nil {
+		if rel, err := filepath.Rel(root, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.report = filepath.ToSlash(rel)
+		}
+	}
+	return t
+}
+
+// Add records changes ("path (change)", as FileWatcher.Drain returns them).
+func (t *watchTrigger) Add(changes []string, now time.Time) {
+	var counted []string
+	for _, c := range changes {
+		if t.report == "" || changePath(c) != t.report {
+			counted = append(counted, c)
+		}
+	}
+	if len(counted) > 0 {
+		t.pending = mergeWatchChanges(t.pending, counted)
+		t.lastChange = now
+	}
+}
+
+// Ready returns the pending changes and forgets them once nothing has
+// changed for watchSettle.
+func (t *watchTrigger) Ready(now time.Time) []string {
+	if len(t.pending) == 0 || now.Sub(t.lastChange) < watchSettle {
+		return nil
+	}
+	changes := t.pending
+	t.pending = nil
+	return changes
+}
+
+// changePath strips the " (change)" suffix from a watcher change.
+func changePath(change string) string {
+	if i := strings.LastIndex(change, " ("); i != -1 {
+		return change[:i]
+	}
+	return change
+}
+
+// mergeWatchChanges adds changes to pending, keeping the latest change per
+// path.
+func mergeWatchChanges(pending, changes []string) []string {
+	byPath := make(map[string]string)
+	for _, list := range [][]string{pending, changes} {
+		for _, c := range list {
+			byPath[changePath(c)] = c
+		}
+	}
+	merged := make([]string, 0, len(byPath))
+	for _, c := range byPath {
+		merged = append(merged, c)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// formatWatchEntry renders one run for the report file.
+func formatWatchEntry(at time.Time, trigger, report string, err error) string {
+	body := report
+	if err != nil {
+		body = "Run failed: " + err.Error()
+	}
+	return fmt.Sprintf("## %s (%s)\n\n%s\n\n", at.Format("2006-01-02 15:04"), trigger, body)
+}
+
+func appendWatchReport(path, entry string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(entry); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// --- Archive Mode ---
+
+// Archive mode (-archive) unpacks a .zip/.tar/.tar.gz into a temporary
+// workspace, runs one headless task against it, and writes the result as a
+// patch or a re-packed archive. A baseline commit is kept in a git directory
+// outside the workspace, so archives containing their own .git are untouched.
+
+const archivePrompt = `
+# Archive Mode
+You are running headless against an unpacked archive in a temporary workspace. Nobody can answer questions.
+- Work autonomously until the task is done. All edits are applied automatically.
+- When finished, reply WITHOUT tool calls with a concise final report: what you changed and why, and anything left undone.
+`
+
+type archiveJob struct {
+	ArchivePath string
+	OutPath     string
+	TempDir     string
+	Root        string // Workspace root inside TempDir
+	gitEnv      []string
+}
+
+// archiveFormat returns "zip", "tar", "tar.gz" or "patch" for a file name.
+func archiveFormat(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	case strings.HasSuffix(lower, ".patch"), strings.HasSuffix(lower, ".diff"):
+		return "patch"
+	}
+	return ""
+}
+
+// prepareArchiveWorkspace unpacks the archive and records a baseline commit.
+// outPath defaults to <archive name>.patch in the current directory.
+func prepareArchiveWorkspace(archivePath, outPath string) (*archiveJob, error) {
+	format := archiveFormat(archivePath)
+	if format == "" || format == "patch" {
+		return nil, fmt.Errorf("unsupported archive '%s' (supported: .zip, .tar, .tar.gz, .tgz)", archivePath)
+	}
+	if outPath == "" {
+		base := filepath.Base(archivePath)
+		for _, ext := range []string{".zip", ".tar.gz", ".tgz", ".tar"} {
+			if strings.HasSuffix(strings.ToLower(base), ext) {
+				base = base[:len(base)-len(ext)]
+				break
+			}
+		}
+		outPath = base + ".patch"
+	}
+	if archiveFormat(outPath) == "" {
+		return nil, fmt.Errorf("unsupported output '%s' (use .patch, .diff, .zip, .tar or .tar.gz)", outPath)
+	}
+
+	job := &archiveJob{}
+	var err error
+	if job.ArchivePath, err = filepath.Abs(archivePath); err != nil {
+		return nil, err
+	}
+	if job.OutPath, err = filepath.Abs(outPath); err != nil {
+		return nil, err
+	}
+	if job.TempDir, err = os.MkdirTemp("", "simple-agent-archive-"); err != nil {
+		return nil, err
+	}
+
+	src := filepath.Join(job.TempDir, "src")
+	if format == "zip" {
+		err = extractZip(job.ArchivePath, src)
+	} else {
+		err = extractTar(job.ArchivePath, src, format == "tar.gz")
+	}
+	if err != nil {
+		job.Cleanup()
+		return nil, fmt.Errorf("failed to unpack %s: %v", archivePath, err)
+	}
+
+	// Archives commonly wrap everything in a single top-level directory
+	job.Root = src
+	if entries, err := os.ReadDir(src); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		job.Root = filepath.Join(src, entries[0].Name())
+	}
+
+	job.gitEnv = []string{
+		"GIT_DIR=" + filepath.Join(job.TempDir, "baseline.git"),
+		"GIT_WORK_TREE=" + job.Root,
+	}
+	if _, err := runGit(job.gitEnv, "init", "-q"); err != nil {
+		job.Cleanup()
+		return nil, err
+	}
+	if err := job.stage(); err != nil {
+		job.Cleanup()
+		return nil, err
+	}
+	if _, err := runGit(job.gitEnv, "-c", "user.name=simple-agent", "-c", "user.email=simple-agent@localhost",
+		"commit", "-q", "--no-verify", "--allow-empty", "-m", "baseline"); err != nil {
+		job.Cleanup()
+		return nil, err
+	}
+	return job, nil
+}
+
+// stage adds the whole workspace except agent state to the baseline index.
+func (j *archiveJob) stage() error {
+	args := []string{"-C", j.Root, "add", "-A", "--", "."}
+	for _, p := range agentStatePaths {
+		args = append(args, ":(exclude)"+p)
+	}
+	_, err := runGit(j.gitEnv, args...)
+	return err
+}
+
+// archiveTarget resolves an archive entry name inside dest, rejecting entries
+// that would escape it.
+func archiveTarget(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if target != dest && !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+		return "", fmt.Errorf("archive entry '%s' escapes the workspace", name)
+	}
+	return target, nil
+}
+
+func extractZip(archivePath, dest string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		target, err := archiveTarget(dest, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue // Symlinks and devices are skipped
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchiveFile(target, rc, f.Mode().Perm())
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(archivePath, dest string, gzipped bool) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := archiveTarget(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := writeArchiveFile(target, tr, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		}
+		// Links and special files are skipped
+	}
+}
+
+func writeArchiveFile(path string, r io.Reader, perm os.FileMode) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Finish writes the patch or re-packed archive and returns a diffstat.
+func (j *archiveJob) Finish() (string, error) {
+	if err := j.stage(); err != nil {
+		return "", err
+	}
+	stat, err := runGit(j.gitEnv, "diff", "--cached", "--stat", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	switch archiveFormat(j.OutPath) {
+	case "patch":
+		cmd := exec.Command("git", "diff", "--cached", "--binary", "HEAD")
+		cmd.Env = append(os.Environ(), j.gitEnv...)
+		patch, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("git diff: %v", err)
+		}
+		err = os.WriteFile(j.OutPath, patch, 0644)
+		return stat, err
+	case "zip":
+		return stat, j.writeZip()
+	default:
+		return stat, j.writeTar(archiveFormat(j.OutPath) == "tar.gz")
+	}
+}
+
+// workspaceFiles lists files to re-pack, relative to the root.
+func (j *archiveJob) workspaceFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(j.Root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(j.Root, path)
+		if rel != "." && isAgentStatePath(filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (j *archiveJob) writeZip() error {
+	files, err := j.workspaceFiles()
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(j.OutPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, rel := range files {
+		info, err := os.Stat(filepath.Join(j.Root, rel))
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		hdr.Method = zip.Deflate
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(w, filepath.Join(j.Root, rel)); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (j *archiveJob) writeTar(gzipped bool) error {
+	files, err := j.workspaceFiles()
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(j.OutPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var w io.Writer = out
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(out)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, rel := range files {
+		info, err := os.Stat(filepath.Join(j.Root, rel))
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyFileTo(tw, filepath.Join(j.Root, rel)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (j *archiveJob) Cleanup() {
+	os.RemoveAll(j.TempDir)
+}
+
+// runArchiveTask runs the task headless in the unpacked workspace and writes
+// the output. The process must already be in j.Root.
+func runArchiveTask(ctx context.Context, env *ToolEnv, j *archiveJob, task string) (err error) {
+	env.AutoApprove = true
+	started := time.Now()
+	ctx, span := startSpan(ctx, "archive task", spanKindInternal)
+	emitEvent(EventTaskStarted, map[string]any{"task": task, "archive": j.ArchivePath, "output": j.OutPath})
+	var report, stat string
+	defer func() {
+		span.End(err)
+		data := map[string]any{
+			"status":      "success",
+			"output":      j.OutPath,
+			"report":      report,
+			"diffstat":    stat,
+			"duration_ms": time.Since(started).Milliseconds(),
+		}
+		if err != nil {
+			data["status"], data["error"] = "error", err.Error()
+		}
+		emitEvent(EventTaskFinished, data)
+	}()
+
+	report, err = runAgentLoop(ctx, env, "Archive agent", archivePrompt, task, nil, maxSubAgentTurns)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n\033[1;34m[Report]\033[0m\n")
+	printMarkdown(report)
+
+	stat, err = j.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", j.OutPath, err)
+	}
+	if stat == "" {
+		stat = "No changes."
+	}
+	fmt.Printf("\n%s\n\033[32mWrote %s\033[0m\n", stat, j.OutPath)
+	return nil
+}
+
+// --- Tool Errors ---
+
+// A failed tool call returns an error envelope instead of a free-form
+// string, so the model can branch on the kind of failure:
+//
+//	{"error": {"code": "outside_workspace", "category": "policy_denied",
+//	  "retryable": false, "message": "...", "suggestion": "..."}}
+//
+// The category is one of the constants below. The code is more specific
+// where a call site knows more (and is the category otherwise). retryable
+// says whether the call is worth retrying, with corrected arguments if need
+// be; refusals by policy or by the user are not.
+const (
+	errParse           = "parse_error"      // Arguments or a diff couldn't be parsed
+	errValidation      = "validation_error" // Bad arguments; fix them and retry
+	errNotFound        = "not_found"        // A file, script or ref doesn't exist
+	errPolicyDenied    = "policy_denied"    // Refused by policy, the workspace boundary or a deployment setting
+	errUserRejected    = "user_rejected"    // The user (or the approval policy) said no
+	errTimeout         = "timeout"          // Ran out of time
+	errExecutionFailed = "execution_failed" // Ran, but failed
+)
+
+// toolErrorCategories holds each category's retryable flag and default
+// suggestion.
+var toolErrorCategories = map[string]struct {
+	Retryable  bool
+	Suggestion string
+}{
+	errParse:           {true, "Fix the syntax of the arguments (valid JSON; a diff with @@ hunk headers) and retry."},
+	errValidation:      {true, "Fix the arguments and retry."},
+	errNotFound:        {true, "Locate it (list, search) before retrying."},
+	errPolicyDenied:    {false, "Don't retry this call or work around the policy; take another approach or ask the user."},
+	errUserRejected:    {false, "Don't retry the same call; ask the user what they want instead."},
+	errTimeout:         {true, "Narrow the operation down or allow a longer timeout."},
+	errExecutionFailed: {true, "Read the output and fix the cause."},
+}
+
+const toolErrorPrompt = `- **TOOL ERRORS**: A failed tool call returns a JSON envelope: {"error": {"code", "category", "retryable", "message", "suggestion"}}. Branch on the category:
+    - 'parse_error': The arguments (or the diff) couldn't be parsed. Fix the syntax and retry.
+    - 'validation_error': The arguments were wrong (missing fields, patch context not found). Fix them and retry.
+    - 'not_found': The file, script or ref doesn't exist. Locate it (list, search) before retrying.
+    - 'policy_denied': Refused by policy or the workspace boundary. Don't retry or work around it; take another approach or ask the user.
+    - 'user_rejected': The user declined. Don't retry the same call; ask what they want instead.
+    - 'timeout': The operation ran out of time. Narrow it down or allow a longer timeout.
+    - 'execution_failed': The operation ran and failed. Read the output and fix the cause.
+  When 'retryable' is false, do not repeat the call in any form.`
+
+// ToolError is a tool failure of a known category, optionally with a more
+// specific code and suggestion.
+type ToolError struct {
+	Type       string
+	Code       string
+	Suggestion string
+	Err        error
+}
+
+func (e *ToolError) Error() string { return e.Err.Error() }
+
+func (e *ToolError) Unwrap() error { return e.Err }
+
+// toolError tags err with an error category.
+func toolError(typ string, err error) error {
+	return &ToolError{Type: typ, Err: err}
+}
+
+// codedToolError tags err with a category, a specific code and, if not
+// empty, a suggestion that replaces the category's.
+func codedToolError(typ, code, suggestion string, err error) error {
+	return &ToolError{Type: typ, Code: code, Suggestion: suggestion, Err: err}
+}
+
+// invalidArguments reports tool arguments that aren't valid JSON.
+func invalidArguments(err error) error {
+	return codedToolError(errParse, "invalid_json", "", fmt.Errorf("error parsing arguments: %v", err))
+}
+
+// toolErrorType returns the category of err. Untagged errors are classified
+// by their cause, and are execution failures otherwise.
+func toolErrorType(err error) string {
+	var tagged *ToolError
+	switch {
+	case errors.As(err, &tagged):
+		return tagged.Type
+	case errors.Is(err, fs.ErrNotExist):
+		return errNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return errPolicyDenied
+	case errors.Is(err, context.DeadlineExceeded):
+		return errTimeout
+	}
+	return errExecutionFailed
+}
+
+// withToolErrorMessage replaces the message of err, keeping its category,
+// code and suggestion.
+func withToolErrorMessage(err error, message string) error {
+	var tagged *ToolError
+	if errors.As(err, &tagged) {
+		return &ToolError{Type: tagged.Type, Code: tagged.Code, Suggestion: tagged.Suggestion, Err: errors.New(message)}
+	}
+	return toolError(toolErrorType(err), errors.New(message))
+}
+
+// toolErrorEnvelope is the error a tool message carries.
+type toolErrorEnvelope struct {
+	Code       string `json:"code"`
+	Category   string `json:"category"`
+	Retryable  bool   `json:"retryable"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func newToolErrorEnvelope(err error) toolErrorEnvelope {
+	env := toolErrorEnvelope{Category: toolErrorType(err), Message: err.Error()}
+	var tagged *ToolError
+	if errors.As(err, &tagged) {
+		env.Code, env.Suggestion = tagged.Code, tagged.Suggestion
+	}
+	if env.Code == "" {
+		env.Code = env.Category
+		if errors.Is(err, fs.ErrPermission) {
+			env.Code = "permission_denied"
+		}
+	}
+	category := toolErrorCategories[env.Category]
+	env.Retryable = category.Retryable
+	if env.Suggestion == "" {
+		env.Suggestion = category.Suggestion
+	}
+	return env
+}
+
+// formatToolError renders err as the content of a tool message.
+func formatToolError(err error) string {
+	data, jsonErr := json.MarshalIndent(map[string]toolErrorEnvelope{"error": newToolErrorEnvelope(err)}, "", "  ")
+	if jsonErr != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return string(data)
+}
+
+// isToolErrorResult reports whether a tool message holds an error envelope.
+func isToolErrorResult(content string) bool {
+	return strings.HasPrefix(content, "{\n  \"error\": {")
+}
+
+// --- Tool Execution ---
+
+// ToolEnv carries the session state that tool implementations need. The main
+// loop keeps Skills and SkillsPrompt current as new skills are discovered.
+type ToolEnv struct {
+	APIKey       string
+	Client       *http.Client
+	Provider     string // "gemini" or "openai"
+	SystemPrompt string
+	Skills       []Skill
+	SkillsPrompt string
+	AutoApprove  bool
+	IsSubAgent   bool
+	AgentLabel   string // Distinguishes parallel sub-agents in the output
+	Memory       *Memory
+	Index        *CodeIndex // Loaded on first semantic_search
+	Patches      *PatchStore
+	Approvals    *ScriptApprovals // Persistent run_script approvals
+}
+
+// executeTool runs a single tool call and normalizes the paths in its result.
+// shorten_context is handled by the turn loop itself since it rewrites the
+// conversation.
+func executeTool(ctx context.Context, env *ToolEnv, toolCall ToolCall) (string, error) {
+	if fileChangingTools[toolCall.Function.Name] {
+		fileWatch.Suspend()
+	}
+	toolResult, toolErr := auditToolCall(ctx, env, toolCall, func(ctx context.Context) (string, error) {
+		return dispatchTool(ctx, env, toolCall)
+	})
+	if fileChangingTools[toolCall.Function.Name] {
+		seenFiles.Refresh()
+		fileWatch.Resume()
+	}
+	root, _ := getWorkDir(ctx)
+	toolResult = normalizeOutputPaths(root, toolResult)
+	message := ""
+	if toolErr != nil {
+		message = normalizeOutputPaths(root, toolErr.Error())
+	}
+	// Secrets never reach the history or the provider
+	if redactSecrets {
+		var n, m int
+		toolResult, n = redact(toolResult)
+		message, m = redact(message)
+		if n+m > 0 {
+			fmt.Printf("\033[33m🔒 Redacted %d secret(s) from the %s output.\033[0m\n", n+m, toolCall.Function.Name)
+		}
+	}
+	if toolErr != nil {
+		toolErr = withToolErrorMessage(toolErr, message)
+	}
+	return toolResult, toolErr
+}
+
+func dispatchTool(ctx context.Context, env *ToolEnv, toolCall ToolCall) (toolResult string, toolErr error) {
+	if injected := chaos.ToolFailure(toolCall.Function.Name); injected != nil {
+		return "", injected
+	}
+	if disabledTools[toolCall.Function.Name] {
+		return "", codedToolError(errPolicyDenied, "tool_disabled", "", fmt.Errorf("tool '%s' is disabled in this deployment", toolCall.Function.Name))
+	}
+
+	switch toolCall.Function.Name {
+	case "apply_udiff":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: apply_udiff\033[0m\n")
+		var args struct {
+			Path         string `json:"path"`
+			Diff         string `json:"diff"`
+			ReplaceHunks []int  `json:"replace_hunks"`
+			Force        bool   `json:"force"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if patchKey, err := validatePath(ctx, args.Path); err != nil {
+			toolErr = err
+		} else if root, _ := getWorkDir(ctx); patchKey == filepath.Join(root, agentIgnoreFile) {
+			toolErr = codedToolError(errPolicyDenied, "protected_path", "", fmt.Errorf("access denied by policy: %s is read-only for the agent; ask the user to change it", agentIgnoreFile))
+		} else if err := seenFiles.Check(args.Path, patchKey); err != nil {
+			toolErr = err
+		} else if op := diffengine.ParseFileOp(args.Diff); op.Deleted || op.RenameTo != "" {
+			toolResult, toolErr = applyFileOp(ctx, env, args.Path, args.Diff, op)
+		} else if err := checkEditableFile(args.Path, patchKey, args.Force); err != nil {
+			toolErr = err
+		} else if amended, err := env.Patches.Amend(patchKey, args.ReplaceHunks, args.Diff); err != nil {
+			toolErr = err
+		} else {
+			args.Diff = amended
+			// Dry run first to check validity and generate helpful errors
+			_, err := applyUDiff(ctx, args.Path, args.Diff, true)
+			if err != nil {
+				toolErr = env.Patches.SaveFailed(patchKey, args.Diff, err)
+			} else {
+				env.Patches.Clear(patchKey)
+				spelling := checkSpelling(args.Path, args.Diff)
+				var review hunkReview
+				if env.AutoApprove {
+					fmt.Printf("Proposed changes to %s:\n", args.Path)
+					printColoredDiff(args.Diff)
+					printSpellingIssues(spelling)
+					fmt.Println("Auto-approving changes...")
+					review.Diff = args.Diff
+					noteApproval(ctx, "auto")
+				} else {
+					// Review hunk by hunk
+					fmt.Printf("Proposed changes to %s:\n", args.Path)
+					printSpellingIssues(spelling)
+					review = reviewHunks(ctx, args.Path, args.Diff)
+					noteApproval(ctx, review.Decision())
+				}
+
+				if ctx.Err() != nil {
+					toolErr = fmt.Errorf("interrupted by user")
+				} else if review.Diff == "" && !review.FileEdited {
+					fmt.Println("Changes rejected.")
+					toolResult = "User rejected the changes."
+					if review.Reason != "" {
+						toolResult += " Reason: " + review.Reason
+					}
+				} else {
+					// Pre-edit hook
+					preHookOut, hookErr := runSkillHooks(ctx, env.Skills, "pre_edit", map[string]string{"path": args.Path})
+					if hookErr != nil {
+						toolErr = codedToolError(errExecutionFailed, "hook_blocked", "Read the hook output: change the edit so the hook passes, or leave the file alone if the hook forbids the change.", fmt.Errorf("edit not applied: %v\n\n[Pre-Edit Hook Output]\n%s", hookErr, preHookOut))
+					} else {
+						var syntaxNote string
+						if review.FileEdited {
+							toolErr = writeEditedFile(ctx, args.Path, review.Content)
+						} else {
+							before, _ := os.ReadFile(patchKey)
+							toolResult, toolErr = applyUDiff(ctx, args.Path, review.Diff, false)
+							if toolErr == nil {
+								syntaxNote, toolErr = syntaxGate(ctx, args.Path, patchKey, before)
+							}
+						}
+						if toolErr == nil {
+							agentChanges.Record(ctx, args.Path)
+							seenFiles.Touch(patchKey)
+							fmt.Printf("Successfully applied diff to %s\n", args.Path)
+							toolResult = review.Result()
+							if syntaxNote != "" {
+								toolResult += "\n\n" + syntaxNote
+							}
+							if len(spelling) > 0 {
+								toolResult += "\n\n[Spell Check] Possible issues in the added text; fix them unless they are intended:\n" + strings.Join(spelling, "\n")
+							}
+							emitEvent(EventDiffApplied, map[string]any{"path": args.Path, "agent": env.AgentLabel, "diff": review.Diff})
+						}
+						if preHookOut != "" {
+							toolResult = "[Pre-Edit Hook Output]\n" + preHookOut + "\n\n" + toolResult
+						}
+
+						// Post-edit hook
+						hookOut, hookErr := runSkillHooks(ctx, env.Skills, "post_edit", map[string]string{"path": args.Path})
+						if hookErr != nil && toolErr == nil {
+							toolErr = fmt.Errorf("diff applied, but %v\n\n[Hook Output]\n%s", hookErr, hookOut)
+						} else if hookOut != "" {
+							toolResult += "\n\n[Hook Output]\n" + hookOut
+						}
+					}
+				}
+			}
+		}
+
+	case "run_script":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: run_script\033[0m\n")
+		var args struct {
+			Path string   `json:"path"`
+			Args []string `json:"args"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else {
+			for i, arg := range args.Args {
+				args.Args[i] = expandPathsInArg(arg)
+			}
+			hookContext := map[string]string{"path": args.Path, "args": strings.Join(args.Args, " ")}
+
+			approved, denial := true, ""
+			absPath, resolveErr := resolveScript(ctx, args.Path, env.SkillsPrompt)
+			if resolveErr == nil {
+				approved, denial = trustSkill(ctx, findSkillForPath(env.Skills, absPath))
+			}
+			if !approved {
+				noteApproval(ctx, "denied")
+			} else if resolveErr == nil && isShellRunner(absPath) {
+				// The command policy applies to shell runner skills too
+				command := strings.Join(args.Args, " ")
+				root, _ := getWorkDir(ctx)
+				switch decision, reason := commandPolicy.Check(command); {
+				case decision == commandDenied:
+					approved, denial = false, "Command refused by policy: "+reason
+					noteApproval(ctx, "policy")
+				case decision == commandAllowed:
+					noteApproval(ctx, "allowlist")
+				case !env.AutoApprove || len(commandPolicy.Allow) > 0:
+					approved, denial = approveCommand(ctx, env, command, root, reason)
+				default:
+					noteApproval(ctx, "auto")
+				}
+			} else if resolveErr == nil && !env.AutoApprove {
+				approved, denial = approveScript(ctx, env, absPath, args.Args)
+			} else {
+				noteApproval(ctx, "auto")
+			}
+
+			// Pre-run hook
+			var preHookOut string
+			var hookErr error
+			if approved {
+				preHookOut, hookErr = runSkillHooks(ctx, env.Skills, "pre_run", hookContext)
+			}
+			if !approved {
+				category := errUserRejected
+				if strings.HasPrefix(denial, "Command refused by policy") {
+					category = errPolicyDenied
+				}
+				toolErr = toolError(category, errors.New(denial))
+			} else if hookErr != nil {
+				toolErr = fmt.Errorf("script not executed: %v\n\n[Pre-Run Hook Output]\n%s", hookErr, preHookOut)
+			} else {
+				fmt.Printf("Executing script: %s %v\n", args.Path, args.Args)
+				toolResult, toolErr = runSafeScript(ctx, args.Path, args.Args, env.SkillsPrompt)
+				if preHookOut != "" {
+					toolResult = "[Pre-Run Hook Output]\n" + preHookOut + "\n\n" + toolResult
+				}
+
+				// Post-run hook
+				hookOut, hookErr := runSkillHooks(ctx, env.Skills, "post_run", hookContext)
+				if hookErr != nil && toolErr == nil {
+					toolErr = fmt.Errorf("script finished, but %v\n\n[Hook Output]\n%s", hookErr, hookOut)
+				} else if hookOut != "" {
+					toolResult += "\n\n[Hook Output]\n" + hookOut
+				}
+			}
+		}
+
+	case "run_command":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: run_command\033[0m\n")
+		var args struct {
+			Command string `json:"command"`
+			Workdir string `json:"workdir"`
+			Timeout int    `json:"timeout_seconds"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+			break
+		}
+		if strings.TrimSpace(args.Command) == "" {
+			toolErr = toolError(errValidation, fmt.Errorf("command must not be empty"))
+			break
+		}
+		dir, err := validatePath(ctx, args.Workdir)
+		if err != nil {
+			toolErr = err
+			break
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			toolErr = toolError(errValidation, fmt.Errorf("workdir '%s' is not a directory", args.Workdir))
+			break
+		}
+
+		if toolErr = authorizeCommand(ctx, env, args.Command, dir); toolErr != nil {
+			break
+		}
+
+		timeout := commandPolicy.timeout()
+		if args.Timeout > 0 && time.Duration(args.Timeout)*time.Second < timeout {
+			timeout = time.Duration(args.Timeout) * time.Second
+		}
+		hookContext := map[string]string{"command": args.Command, "args": args.Command}
+		preHookOut, hookErr := runSkillHooks(ctx, env.Skills, "pre_run", hookContext)
+		if hookErr != nil {
+			toolErr = fmt.Errorf("command not executed: %v\n\n[Pre-Run Hook Output]\n%s", hookErr, preHookOut)
+			break
+		}
+		root, _ := getWorkDir(ctx)
+		fmt.Printf("Executing: %s \033[90m(in %s)\033[0m\n", args.Command, displayPath(root, dir))
+		toolResult, toolErr = runShellCommand(ctx, args.Command, dir, timeout)
+		if preHookOut != "" {
+			toolResult = "[Pre-Run Hook Output]\n" + preHookOut + "\n\n" + toolResult
+		}
+		hookOut, hookErr := runSkillHooks(ctx, env.Skills, "post_run", hookContext)
+		if hookErr != nil && toolErr == nil {
+			toolErr = fmt.Errorf("command finished, but %v\n\n[Hook Output]\n%s", hookErr, hookOut)
+		} else if hookOut != "" {
+			toolResult += "\n\n[Hook Output]\n" + hookOut
+		}
+
+	case "run_tests":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: run_tests\033[0m\n")
+		var args struct {
+			Path     string `json:"path"`
+			Test     string `json:"test"`
+			Coverage bool   `json:"coverage"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+			break
+		}
+		root, _ := getWorkDir(ctx)
+		if args.Path != "" {
+			absPath, err := validatePath(ctx, args.Path)
+			if err != nil {
+				toolErr = err
+				break
+			}
+			if _, err := os.Stat(absPath); err != nil {
+				toolErr = toolError(errNotFound, fmt.Errorf("path '%s' does not exist", args.Path))
+				break
+			}
+			args.Path, _ = filepath.Rel(root, absPath)
+		}
+		profile := projectProfile(root)
+		var coverageOut, coverageFormat string
+		if args.Coverage {
+			dir, err := os.MkdirTemp("", "simple-agent-coverage-")
+			if err != nil {
+				toolErr = err
+				break
+			}
+			defer os.RemoveAll(dir)
+			coverageOut = filepath.Join(dir, "coverage.out")
+			if profile.TestCommand, coverageFormat, toolErr = coverageCommandFor(profile, coverageOut); toolErr != nil {
+				break
+			}
+		}
+		command, err := testCommandFor(profile, args.Path, args.Test)
+		if err != nil {
+			toolErr = err
+			break
+		}
+		if toolErr = authorizeCommand(ctx, env, command, root); toolErr != nil {
+			break
+		}
+		summary := summarizeTestRun(runTests(ctx, command))
+		if args.Coverage {
+			files, err := readCoverage(coverageFormat, coverageOut, root)
+			var changed []string
+			for path := range dirtyFiles() {
+				changed = append(changed, path)
+			}
+			if summary.Coverage = changedFileCoverage(files, root, changed); err != nil {
+				summary.Note = strings.TrimSpace(summary.Note + " Coverage: " + err.Error())
+			} else if len(summary.Coverage) == 0 {
+				summary.Note = strings.TrimSpace(summary.Note + " None of the changed files are in the coverage report.")
+			}
+		}
+		if summary.Passed {
+			fmt.Println("\033[32m✅ Tests pass.\033[0m")
+		} else {
+			fmt.Printf("\033[31m❌ Tests fail (%d failing test(s) found).\033[0m\n", len(summary.Failures))
+		}
+		toolResult = toJSON(summary)
+
+	case "manage_todos":
+		var args struct {
+			Todos []Todo `json:"todos"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if err := sessionTodos.Set(args.Todos); err != nil {
+			toolErr = toolError(errValidation, err)
+		} else {
+			toolResult = sessionTodos.result()
+		}
+
+	case "build_project":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: build_project\033[0m\n")
+		root, _ := getWorkDir(ctx)
+		command := projectProfile(root).BuildCommand
+		if command == "" {
+			toolErr = codedToolError(errNotFound, "no_build_command", "Set build_command in the config, or build with run_command.", fmt.Errorf("no build command found for this project"))
+			break
+		}
+		if toolErr = authorizeCommand(ctx, env, command, root); toolErr != nil {
+			break
+		}
+		summary := runBuild(ctx, command)
+		if summary.Success {
+			fmt.Println("\033[32m✅ Build succeeded.\033[0m")
+		} else {
+			fmt.Printf("\033[31m❌ Build failed (%d diagnostic(s)).\033[0m\n", len(summary.Diagnostics)+summary.Omitted)
+		}
+		toolResult = toJSON(summary)
+
+	case "remember":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: remember\033[0m\n")
+		var args struct {
+			Kind string   `json:"kind"`
+			Text string   `json:"text"`
+			Tags []string `json:"tags"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if env.Memory == nil {
+			toolErr = fmt.Errorf("project memory is not available")
+		} else {
+			entry, err := env.Memory.Add(args.Kind, args.Text, args.Tags)
+			if err != nil {
+				toolErr = err
+			} else {
+				fmt.Printf("Remembered %s\n", formatMemoryEntry(entry))
+				toolResult = fmt.Sprintf("Saved memory #%d.", entry.ID)
+			}
+		}
+
+	case "recall":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: recall\033[0m\n")
+		var args struct {
+			Query string `json:"query"`
+			Limit int    `json:"limit"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if env.Memory == nil {
+			toolErr = fmt.Errorf("project memory is not available")
+		} else {
+			fmt.Printf("Query: %s\n", args.Query)
+			var sb strings.Builder
+			for _, e := range env.Memory.Search(args.Query, args.Limit) {
+				sb.WriteString(formatMemoryEntry(e) + "\n")
+			}
+			toolResult = sb.String()
+			if toolResult == "" {
+				toolResult = "No matching memories."
+			}
+		}
+
+	case "git_status", "git_diff", "git_log", "git_branch", "git_stash", "git_commit", "git_checkout", "git_reset":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: %s\033[0m\n", toolCall.Function.Name)
+		toolResult, toolErr = runGitTool(ctx, env, toolCall.Function.Name, toolCall.Function.Arguments)
+
+	case "edit_many":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: edit_many\033[0m\n")
+		toolResult, toolErr = runEditMany(ctx, env, toolCall.Function.Arguments)
+
+	case "code_outline":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: code_outline\033[0m\n")
+		var args struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else {
+			fmt.Printf("File: %s\n", args.Path)
+			toolResult, toolErr = outlineFile(ctx, args.Path)
+		}
+
+	case "create_pr":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: create_pr\033[0m\n")
+		var args prRequest
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if env.IsSubAgent {
+			toolErr = toolError(errPolicyDenied, fmt.Errorf("create_pr is not available to sub-agents"))
+		} else {
+			args.Draft = args.Draft || prConfig.Draft
+			toolResult, toolErr = createPullRequest(ctx, env.APIKey, nil, args, func(branch string, pr prRequest) bool {
+				printPRRequest(branch, pr)
+				if env.AutoApprove {
+					noteApproval(ctx, "auto")
+					return true
+				}
+				ok := strings.ToLower(askUser(ctx, "Push and open this pull request? [y/N]: ")) == "y"
+				noteApproval(ctx, approvalDecision(ok))
+				return ok
+			})
+		}
+
+	case "read_file":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: read_file\033[0m\n")
+		var args struct {
+			Path      string `json:"path"`
+			StartLine int    `json:"start_line"`
+			EndLine   int    `json:"end_line"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else {
+			if args.StartLine > 0 || args.EndLine > 0 {
+				fmt.Printf("File: %s (lines %d-%d)\n", args.Path, args.StartLine, args.EndLine)
+			} else {
+				fmt.Printf("File: %s\n", args.Path)
+			}
+			toolResult, toolErr = readFileRange(ctx, args.Path, args.StartLine, args.EndLine)
+		}
+
+	case "semantic_search":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: semantic_search\033[0m\n")
+		var args struct {
+			Query string `json:"query"`
+			Limit int    `json:"limit"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if env.IsSubAgent {
+			toolErr = toolError(errPolicyDenied, fmt.Errorf("semantic_search is not available to sub-agents"))
+		} else {
+			if args.Limit <= 0 {
+				args.Limit = 5
+			} else if args.Limit > 20 {
+				args.Limit = 20
+			}
+			fmt.Printf("Query: %s\n", args.Query)
+			if env.Index == nil {
+				env.Index = loadCodeIndex()
+			}
+			if _, err := env.Index.Refresh(ctx, env.Client, env.APIKey); err != nil {
+				toolErr = fmt.Errorf("failed to update index: %v", err)
+			} else if results, err := env.Index.Search(ctx, env.Client, env.APIKey, args.Query, args.Limit); err != nil {
+				toolErr = fmt.Errorf("search failed: %v", err)
+			} else {
+				toolResult = formatSearchResults(results)
+			}
+		}
+
+	case "spawn_agent":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: spawn_agent\033[0m\n")
+		var args struct {
+			Task         string   `json:"task"`
+			AllowedTools []string `json:"allowed_tools"`
+			MaxTurns     int      `json:"max_turns"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if env.IsSubAgent {
+			toolErr = toolError(errPolicyDenied, fmt.Errorf("sub-agents cannot spawn further sub-agents"))
+		} else {
+			toolResult, toolErr = runSubAgent(ctx, env, args.Task, args.AllowedTools, args.MaxTurns)
+		}
+
+	case "orchestrate_agents":
+		fmt.Printf("\n\033[1;35m🛠  Tool Call: orchestrate_agents\033[0m\n")
+		var args struct {
+			Agents []struct {
+				Label string `json:"label"`
+				Task  string `json:"task"`
+			} `json:"agents"`
+			AllowedTools []string `json:"allowed_tools"`
+			MaxTurns     int      `json:"max_turns"`
+		}
+		if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+			toolErr = invalidArguments(err)
+		} else if env.IsSubAgent {
+			toolErr = toolError(errPolicyDenied, fmt.Errorf("sub-agents cannot orchestrate further sub-agents"))
+		} else {
+			var runs []*agentRun
+			for _, a := range args.Agents {
+				runs = append(runs, &agentRun{Label: a.Label, Task: a.Task})
+			}
+			toolResult, toolErr = runOrchestration(ctx, env, runs, args.AllowedTools, args.MaxTurns)
+		}
+
+	default:
+		toolErr = codedToolError(errValidation, "unknown_tool", "Call only the tools you were given.", fmt.Errorf("unknown tool: %s", toolCall.Function.Name))
+	}
+	return toolResult, toolErr
+}
+
+// --- Audit Log ---
+
+// Every tool call is appended to ~/.simple_agent/logs/audit.jsonl with its
+// arguments, outcome, duration and the approval decision, so what the agent
+// actually did can be reviewed later (/audit).
+
+type AuditEntry struct {
+	Time       time.Time       `json:"time"`
+	Session    string          `json:"session"`
+	Workspace  string          `json:"workspace"`
+	Agent      string          `json:"agent,omitempty"`
+	Tool       string          `json:"tool"`
+	Args       json.RawMessage `json:"args"`
+	ResultSize int             `json:"result_bytes"`
+	Error      string          `json:"error,omitempty"`
+	ErrorType  string          `json:"error_type,omitempty"`
+	ExitCode   *int            `json:"exit_code,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+	Approval   string          `json:"approval,omitempty"` // auto, allowlist, saved, approved, partial, edited, denied or policy
+}
+
+const maxAuditArgChars = 20000
+
+// sessionID identifies this process in the shared audit log and the
+// project's session history.
+var sessionID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+var auditMu sync.Mutex
+
+type auditKey struct{}
+
+// auditRecord collects what a tool call reports about itself while it runs.
+type auditRecord struct {
+	call     ToolCall
+	mu       sync.Mutex
+	approval string
+	exitCode *int
+}
+
+func getAuditLogPath() string {
+	return filepath.Join(getAgentHomeDir(), "logs", "audit.jsonl")
+}
+
+// noteApproval records the approval decision of the current tool call.
+func noteApproval(ctx context.Context, decision string) {
+	if rec, ok := ctx.Value(auditKey{}).(*auditRecord); ok {
+		rec.mu.Lock()
+		rec.approval = decision
+		rec.mu.Unlock()
+	}
+}
+
+func approvalDecision(approved bool) string {
+	if approved {
+		return "approved"
+	}
+	return "denied"
+}
+
+// noteExitCode records the exit code of a process run by the current tool call.
+func noteExitCode(ctx context.Context, state *os.ProcessState) {
+	rec, ok := ctx.Value(auditKey{}).(*auditRecord)
+	if !ok || state == nil {
+		return
+	}
+	code := state.ExitCode()
+	rec.mu.Lock()
+	rec.exitCode = &code
+	rec.mu.Unlock()
+}
+
+// auditToolCall runs a tool call and logs it.
+func auditToolCall(ctx context.Context, env *ToolEnv, toolCall ToolCall, run func(context.Context) (string, error)) (string, error) {
+	ctx, span := startSpan(ctx, "tool "+toolCall.Function.Name, spanKindInternal)
+	rec := &auditRecord{call: toolCall}
+	started := time.Now()
+	result, err := run(context.WithValue(ctx, auditKey{}, rec))
+
+	entry := AuditEntry{
+		Time:       started,
+		Session:    sessionID,
+		Agent:      env.AgentLabel,
+		Tool:       toolCall.Function.Name,
+		ResultSize: len(result),
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	entry.Workspace, _ = getWorkDir(ctx)
+	args := toolCall.Function.Arguments
+	if redactSecrets {
+		args, _ = redact(args)
+	}
+	if len(args) > maxAuditArgChars || !json.Valid([]byte(args)) {
+		if len(args) > maxAuditArgChars {
+			args = args[:maxAuditArgChars] + "... (truncated)"
+		}
+		quoted, _ := json.Marshal(args)
+		args = string(quoted)
+	}
+	entry.Args = json.RawMessage(args)
+	if err != nil {
+		entry.Error, entry.ErrorType = err.Error(), toolErrorType(err)
+		if redactSecrets {
+			entry.Error, _ = redact(entry.Error)
+		}
+	}
+	rec.mu.Lock()
+	entry.Approval, entry.ExitCode = rec.approval, rec.exitCode
+	rec.mu.Unlock()
+
+	recordToolCall(span, entry)
+	if err := appendAuditEntry(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to write audit log: %v\n", err)
+	}
+	return result, err
+}
+
+func appendAuditEntry(entry AuditEntry) error {
+	if getAgentHomeDir() == "" {
+		return nil
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(getAuditLogPath()), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(getAuditLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readAuditLog returns the entries of a session.
+func readAuditLog(session string) ([]AuditEntry, error) {
+	f, err := os.Open(getAuditLogPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Session == session {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// auditSummary is a one-line description of a call's arguments.
+func auditSummary(entry AuditEntry) string {
+	var args map[string]any
+	if json.Unmarshal(entry.Args, &args) == nil {
+		for _, key := range []string{"command", "path", "action", "query", "task", "message", "text"} {
+			if v, ok := args[key].(string); ok && v != "" {
+				return truncateLine(v, 60)
+			}
+		}
+	}
+	return truncateLine(string(entry.Args), 60)
+}
+
+func truncateLine(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > max {
+		return string(r[:max-3]) + "..."
+	}
+	return s
+}
+
+// handleAuditCommand lists this session's tool calls, optionally only those
+// of one tool.
+func handleAuditCommand(arg string) {
+	entries, err := readAuditLog(sessionID)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", getAuditLogPath(), err)
+		return
+	}
+	var shown int
+	for _, e := range entries {
+		if arg != "" && e.Tool != arg {
+			continue
+		}
+		shown++
+		status := "\033[32mok\033[0m"
+		if e.Error != "" {
+			status = "\033[31merror\033[0m"
+		}
+		if e.ExitCode != nil {
+			status += fmt.Sprintf(" (exit %d)", *e.ExitCode)
+		}
+		approval := e.Approval
+		if approval == "" {
+			approval = "-"
+		}
+		agent := ""
+		if e.Agent != "" {
+			agent = "[" + e.Agent + "] "
+		}
+		fmt.Printf("%s %s%-14s %-9s %6dms %7dB %s  \033[90m%s\033[0m\n", e.Time.Format("15:04:05"), agent, e.Tool, approval, e.DurationMs, e.ResultSize, status, auditSummary(e))
+	}
+	if shown == 0 {
+		fmt.Println("No tool calls in this session yet.")
+		return
+	}
+	fmt.Printf("\n%d tool calls. Full log: %s\n", shown, getAuditLogPath())
+}
+
+// --- Sub-Agents ---
+
+const (
+	defaultSubAgentTurns = 20
+	maxSubAgentTurns     = 50
+)
+
+// delegableTools are the tools a sub-agent may be granted.
+var delegableTools = map[string]Tool{
+	"apply_udiff":   udiffTool,
+	"edit_many":     editManyTool,
+	"run_command":   runCommandTool,
+	"run_script":    runScriptTool,
+	"read_file":     readFileTool,
+	"run_tests":     runTestsTool,
+	"build_project": buildProjectTool,
+}
+
+const subAgentPrompt = `
+# Sub-Agent Mode
+You are a sub-agent. A parent agent delegated a single task to you. You have your own isolated context and cannot talk to the user.
+- Work autonomously until the task is done.
+- When finished, reply WITHOUT tool calls with a concise final report: what you did, which files changed, results, and open issues.
+- Your final report is the only thing the parent agent sees. Include every detail it needs to continue.
+`
+
+// runSubAgent runs an isolated agent loop for a delegated task and returns
+// only its final report. The child starts from the parent's system prompt but
+// none of its conversation, can only use the allowlisted tools, and cannot
+// spawn further agents.
+func runSubAgent(ctx context.Context, env *ToolEnv, task string, allowedTools []string, maxTurns int) (string, error) {
+	agentName := "Sub-agent"
+	if env.AgentLabel != "" {
+		agentName += " " + env.AgentLabel
+	}
+	return runAgentLoop(ctx, env, agentName, subAgentPrompt, task, allowedTools, maxTurns)
+}
+
+// runAgentLoop drives a non-interactive agent until it replies without tool
+// calls or runs out of turns, and returns that final reply.
+func runAgentLoop(ctx context.Context, env *ToolEnv, agentName, modePrompt, task string, allowedTools []string, maxTurns int) (string, error) {
+	if strings.TrimSpace(task) == "" {
+		return "", toolError(errValidation, fmt.Errorf("task must not be empty"))
+	}
+	if maxTurns <= 0 {
+		maxTurns = defaultSubAgentTurns
+	}
+	if maxTurns > maxSubAgentTurns {
+		maxTurns = maxSubAgentTurns
+	}
+	if len(allowedTools) == 0 {
+		allowedTools = []string{"apply_udiff", "run_command", "run_script"}
+	}
+
+	allowed := make(map[string]bool)
+	var tools []Tool
+	for _, name := range allowedTools {
+		tool, ok := delegableTools[name]
+		if !ok {
+			return "", toolError(errValidation, fmt.Errorf("tool '%s' cannot be delegated to a sub-agent (allowed: apply_udiff, run_command, run_script, read_file)", name))
+		}
+		if !allowed[name] {
+			allowed[name] = true
+			tools = append(tools, tool)
+		}
+	}
+
+	childEnv := *env
+	childEnv.IsSubAgent = true
+	childEnv.Patches = newPatchStore()
+
+	messages := []Message{
+		{Role: "system", Content: env.SystemPrompt + modePrompt},
+		{Role: "user", Content: task},
+	}
+
+	fmt.Printf("\033[1;36m[%s] Started (tools: %s, budget: %d turns)\033[0m\n", agentName, strings.Join(allowedTools, ", "), maxTurns)
+
+	for turn := 1; ; turn++ {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		if turn > maxTurns {
+			emitEvent(EventBudgetExceeded, map[string]any{"agent": agentName, "max_turns": maxTurns})
+			messages = append(messages, Message{
+				Role:    "user",
+				Content: "Your turn budget is exhausted. Do not call any more tools. Reply now with your final report: what you accomplished, what remains, and any problems.",
+			})
+		}
+
+		chatResp, err := requestCompletion(ctx, env.Client, env.APIKey, ChatCompletionRequest{
+			Model:           ModelName,
+			Messages:        messages,
+			Tools:           tools,
+			ExtraBody:       getExtraBody(env.Provider),
+			ReasoningEffort: getReasoningEffort(env.Provider),
+		})
+		if err != nil {
+			return "", fmt.Errorf("%s request failed: %v", strings.ToLower(agentName), err)
+		}
+
+		msg := chatResp.Choices[0].Message
+		messages = append(messages, msg)
+		printThought(msg.ExtraContent)
+		report := strings.TrimSpace(extractAndPrintThoughts(msg.Content))
+
+		if len(msg.ToolCalls) == 0 || turn > maxTurns {
+			fmt.Printf("\033[1;36m[%s] Finished after %d turns\033[0m\n", agentName, turn)
+			if report == "" {
+				report = fmt.Sprintf("(The %s finished without a report.)", strings.ToLower(agentName))
+			}
+			if len(msg.ToolCalls) > 0 {
+				report = fmt.Sprintf("%s exhausted its budget of %d turns before finishing.\n\n%s", agentName, maxTurns, report)
+			}
+			return report, nil
+		}
+
+		for _, toolCall := range msg.ToolCalls {
+			var result string
+			var toolErr error
+			if allowed[toolCall.Function.Name] {
+				result, toolErr = executeTool(ctx, &childEnv, toolCall)
+				result = guardLargeMessage(ctx, "The "+toolCall.Function.Name+" result", result, false)
+			} else {
+				toolErr = toolError(errPolicyDenied, fmt.Errorf("tool '%s' is not available to this agent", toolCall.Function.Name))
+			}
+			content := result
+			if toolErr != nil {
+				fmt.Printf("Tool Error: %v\n", toolErr)
+				content = formatToolError(toolErr)
+			}
+			messages = append(messages, Message{Role: "tool", Content: content, ToolCallID: toolCall.ID})
+		}
+	}
+}
+
+// --- Parallel Orchestration ---
+
+const (
+	maxParallelAgents = 5
+	maxDiffPerAgent   = 15000 // Characters of each diff returned to the model
+)
+
+// agentRun is one sub-agent of an orchestration and its outcome.
+type agentRun struct {
+	Label     string
+	Task      string
+	Dir       string
+	Report    string
+	Err       error
+	DiffStat  string
+	Diff      string
+	PatchFile string
+}
+
+// runOrchestration runs sub-agents concurrently, each in its own git worktree
+// created from a snapshot of the current working tree (including uncommitted
+// changes). The user's working tree is never modified: each agent's changes
+// are saved as a patch under .simple_agent/orchestrations/ for comparison.
+func runOrchestration(ctx context.Context, env *ToolEnv, runs []*agentRun, allowedTools []string, maxTurns int) (string, error) {
+	if len(runs) < 1 || len(runs) > maxParallelAgents {
+		return "", toolError(errValidation, fmt.Errorf("between 1 and %d agents are required, got %d", maxParallelAgents, len(runs)))
+	}
+	seen := make(map[string]bool)
+	for _, run := range runs {
+		if !checkpointNameRe.MatchString(run.Label) || seen[run.Label] {
+			return "", toolError(errValidation, fmt.Errorf("agent labels must be unique and use only letters, digits, '.', '_' or '-' (got '%s')", run.Label))
+		}
+		seen[run.Label] = true
+	}
+	if !isGitRepo() {
+		return "", fmt.Errorf("orchestrate_agents requires a git repository")
+	}
+
+	id := time.Now().Format("20060102-150405")
+	_, base, err := snapshotWorktree("simple-agent orchestration: "+id, "refs/simple-agent/orchestrations/"+id)
+	if err != nil {
+		return "", fmt.Errorf("failed to snapshot working tree: %v", err)
+	}
+
+	worktreeRoot := filepath.Join(os.TempDir(), "simple-agent-worktrees", id)
+	for _, run := range runs {
+		run.Dir = filepath.Join(worktreeRoot, run.Label)
+		if _, err := runGit(nil, "worktree", "add", "--detach", run.Dir, base); err != nil {
+			removeWorktrees(runs)
+			return "", fmt.Errorf("failed to create worktree: %v", err)
+		}
+	}
+	defer removeWorktrees(runs)
+
+	coreSkills := discoverCoreSkills()
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		wg.Add(1)
+		go func(run *agentRun) {
+			defer wg.Done()
+			childEnv := *env
+			childEnv.AutoApprove = true // Edits land in an isolated worktree
+			childEnv.AgentLabel = run.Label
+			childEnv.Skills = mergeSkills(coreSkills, discoverSkills(filepath.Join(run.Dir, "skills")))
+			childEnv.SkillsPrompt = generateSkillsPrompt(childEnv.Skills)
+			run.Report, run.Err = runSubAgent(withWorkDir(ctx, run.Dir), &childEnv, run.Task, allowedTools, maxTurns)
+		}(run)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	outDir := filepath.Join(".simple_agent", "orchestrations", id)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", err
+	}
+	for _, run := range runs {
+		if _, err := runGit(nil, "-C", run.Dir, "add", "-A"); err != nil {
+			run.Err = fmt.Errorf("failed to collect changes: %v", err)
+			continue
+		}
+		run.DiffStat, _ = runGit(nil, "-C", run.Dir, "diff", "--cached", "--stat", base)
+		run.Diff, _ = runGit(nil, "-C", run.Dir, "diff", "--cached", base)
+		if run.Diff != "" {
+			run.PatchFile = filepath.Join(outDir, run.Label+".patch")
+			if err := os.WriteFile(run.PatchFile, []byte(run.Diff+"\n"), 0644); err != nil {
+				run.PatchFile = ""
+			}
+		}
+	}
+
+	printOrchestrationSummary(runs)
+	return formatOrchestrationResult(runs), nil
+}
+
+func removeWorktrees(runs []*agentRun) {
+	for _, run := range runs {
+		if run.Dir != "" {
+			runGit(nil, "worktree", "remove", "--force", run.Dir)
+		}
+	}
+}
+
+// mergeSkills combines skill tiers; skills in later tiers override earlier ones by name.
+func mergeSkills(tiers ...[]Skill) []Skill {
+	skillMap := make(map[string]Skill)
+	for _, tier := range tiers {
+		for _, s := range tier {
+			skillMap[s.Name] = s
+		}
+	}
+	var skills []Skill
+	for _, s := range skillMap {
+		skills = append(skills, s)
+	}
+	sort.Slice(skills, func(i, j int) bool { return skills[i].Name < skills[j].Name })
+	return skills
+}
+
+// diffStatSummary returns the last line of `git diff --stat`, e.g. "3 files changed, 10 insertions(+)".
+func diffStatSummary(stat string) string {
+	if stat == "" {
+		return "no changes"
+	}
+	lines := strings.Split(stat, "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func printOrchestrationSummary(runs []*agentRun) {
+	fmt.Println("\n\033[1;36m═══ Orchestration Results ═══\033[0m")
+	for _, run := range runs {
+		status := "\033[32mdone\033[0m"
+		if run.Err != nil {
+			status = "\033[31mfailed\033[0m"
+		}
+		fmt.Printf("- %-16s %s  %s\n", run.Label, status, diffStatSummary(run.DiffStat))
+		if run.PatchFile != "" {
+			fmt.Printf("  patch: %s\n", run.PatchFile)
+		}
+	}
+}
+
+func formatOrchestrationResult(runs []*agentRun) string {
+	var sb strings.Builder
+	sb.WriteString("All sub-agents finished. The working tree was NOT modified. To adopt a result, apply its patch (e.g. `git apply <patch>`).\n")
+	for _, run := range runs {
+		sb.WriteString(fmt.Sprintf("\n## Agent: %s\n", run.Label))
+		if run.Err != nil {
+			sb.WriteString(fmt.Sprintf("Status: failed (%v)\n", run.Err))
+		} else {
+			sb.WriteString("Status: done\n")
+		}
+		if run.Report != "" {
+			sb.WriteString(fmt.Sprintf("Report:\n%s\n", run.Report))
+		}
+		sb.WriteString(fmt.Sprintf("Changes: %s\n", diffStatSummary(run.DiffStat)))
+		if run.PatchFile != "" {
+			sb.WriteString(fmt.Sprintf("Patch: %s\n", run.PatchFile))
+			diff := run.Diff
+			if len(diff) > maxDiffPerAgent {
+				diff = diff[:maxDiffPerAgent] + "\n... (diff truncated, see patch file)"
+			}
+			sb.WriteString("```diff\n" + diff + "\n```\n")
+		}
+	}
+	return sb.String()
+}
+
+// --- Diff Review ---
+
+// hunkReview is the outcome of reviewing a diff hunk by hunk. Diff holds the
+// accepted hunks, including the user's edits; hunk numbers are 1-based.
+type hunkReview struct {
+	Diff     string
+	Accepted []int
+	Rejected []int
+	Edited   []int
+	Reason   string
+
+	// FileEdited is set when the user edited the resulting file in $EDITOR;
+	// Content then replaces the file and Changes describes the edits.
+	FileEdited bool
+	Content    string
+	Changes    string
+}
+
+// Decision summarizes the review for the audit log.
+func (r hunkReview) Decision() string {
+	switch {
+	case r.FileEdited || len(r.Edited) > 0:
+		return "edited"
+	case r.Diff == "":
+		return "denied"
+	case len(r.Rejected) > 0:
+		return "partial"
+	}
+	return "approved"
+}
+
+// Result is the tool result reported to the model after the accepted hunks
+// were applied.
+func (r hunkReview) Result() string {
+	if r.FileEdited {
+		note := "The user edited the file in their editor before applying your changes; the result differs from your patch."
+		if len(r.Rejected) > 0 {
+			note += fmt.Sprintf(" Hunks %s were rejected first.", joinInts(r.Rejected))
+		}
+		return note + " Re-read the file before editing it again.\n" + r.Changes
+	}
+	if len(r.Rejected) == 0 && len(r.Edited) == 0 {
+		return "Diff applied successfully."
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Diff partially applied. The user reviewed each hunk: applied %s", joinInts(r.Accepted)))
+	if len(r.Rejected) > 0 {
+		sb.WriteString(fmt.Sprintf("; rejected %s", joinInts(r.Rejected)))
+	}
+	sb.WriteString(".")
+	if len(r.Edited) > 0 {
+		sb.WriteString(fmt.Sprintf(" The user edited hunks %s before applying them; re-read the file before editing it again.", joinInts(r.Edited)))
+	}
+	if r.Reason != "" {
+		sb.WriteString("\nThe user's reason for rejecting: " + r.Reason)
+	}
+	if len(r.Rejected) > 0 {
+		sb.WriteString("\nDo not resend the rejected hunks unchanged; adjust your approach or ask the user.")
+	}
+	return sb.String()
+}
+
+func joinInts(nums []int) string {
+	parts := make([]string, len(nums))
+	for i, n := range nums {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ", ")
+}
+
+const hunkReviewHelp = `y - apply this hunk
+n - do not apply this hunk
+e - edit this hunk in $EDITOR
+a - apply this hunk and all remaining hunks
+d - do not apply this hunk or any remaining hunks
+f - edit the whole file, with this and the remaining hunks applied, in $EDITOR`
+
+// reviewHunks asks the user to accept, reject or edit each hunk of a diff
+// against path. An edited hunk must still apply, or the hunk is asked again.
+func reviewHunks(ctx context.Context, path, diff string) hunkReview {
+	var review hunkReview
+	hunks := diffengine.Split(diff)
+	var accepted []string
+	decided := ""
+	for i := 0; i < len(hunks) && ctx.Err() == nil; i++ {
+		hunk, n := hunks[i], i+1
+		answer := decided
+		if answer == "" {
+			fmt.Printf("\n\033[1mHunk %d/%d of %s:\033[0m\n", n, len(hunks), path)
+			printColoredDiff(hunk)
+			answer = askUser(ctx, "Apply this hunk? [y,n,e,a,d,f,?]: ")
+			if answer != "f" {
+				answer = strings.ToLower(answer)
+			}
+		}
+		switch answer {
+		case "y":
+			accepted = append(accepted, hunk)
+			review.Accepted = append(review.Accepted, n)
+		case "a":
+			decided = "y"
+			accepted = append(accepted, hunk)
+			review.Accepted = append(review.Accepted, n)
+		case "n", "":
+			review.Rejected = append(review.Rejected, n)
+		case "d":
+			decided = "n"
+			review.Rejected = append(review.Rejected, n)
+		case "e":
+			edited, err := editHunk(hunk)
+			if err == nil && edited == "" {
+				fmt.Println("Hunk emptied; not applying it.")
+				review.Rejected = append(review.Rejected, n)
+				continue
+			}
+			if err == nil {
+				_, err = applyUDiff(ctx, path, strings.Join(append(append([]string(nil), accepted...), edited), "\n")+"\n", true)
+			}
+			if err != nil {
+				fmt.Printf("\033[31mEdited hunk does not apply: %v\033[0m\n", err)
+				i-- // Ask again
+				continue
+			}
+			accepted = append(accepted, edited)
+			review.Accepted = append(review.Accepted, n)
+			review.Edited = append(review.Edited, n)
+		case "f":
+			proposal := strings.Join(append(append([]string(nil), accepted...), hunks[i:]...), "\n") + "\n"
+			content, err := applyUDiff(ctx, path, proposal, true)
+			var edited []byte
+			if err == nil {
+				edited, err = editContent(path, []byte(content))
+			}
+			if err != nil {
+				fmt.Printf("\033[31mCannot edit the file: %v\033[0m\n", err)
+				i--
+				continue
+			}
+			review.FileEdited = true
+			review.Content = string(edited)
+			review.Changes = describeEdit(path, []byte(content), edited)
+			return review
+		default:
+			fmt.Println(hunkReviewHelp)
+			i--
+		}
+	}
+	if len(accepted) > 0 {
+		review.Diff = strings.Join(accepted, "\n") + "\n"
+	}
+	if len(review.Rejected) > 0 && ctx.Err() == nil {
+		review.Reason = askUser(ctx, "Why were hunks rejected? (optional, sent to the model): ")
+	}
+	return review
+}
+
+// editHunk opens a hunk in the user's editor and returns the edited hunk,
+// or "" if the user deleted everything.
+func editHunk(hunk string) (string, error) {
+	f, err := os.CreateTemp("", "simple-agent-hunk-*.diff")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	header := "# Edit the hunk below. Lines starting with '#' are removed.\n" +
+		"# To drop a '-' line, make it a context line (' '); to drop a '+' line, delete it.\n" +
+		"# Delete everything to skip the hunk.\n"
+	_, err = f.WriteString(header + hunk + "\n")
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := openInEditor(f.Name()); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	edited := strings.TrimRight(strings.Join(lines, "\n"), "\n")
+	if strings.TrimSpace(edited) == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(strings.TrimLeft(edited, "\n"), "@@") {
+		return "", toolError(errParse, fmt.Errorf("the hunk must start with an '@@' header"))
+	}
+	return strings.TrimLeft(edited, "\n"), nil
+}
+
+// editContent opens content in the user's editor, in a temp file with the
+// same extension as path for syntax highlighting, and returns the result.
+func editContent(path string, content []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "simple-agent-edit-*"+filepath.Ext(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := openInEditor(f.Name()); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(f.Name())
+}
+
+const maxEditNoteChars = 4000
+
+// describeEdit summarizes the user's changes to path as a unified diff for
+// the model.
+func describeEdit(path string, before, after []byte) string {
+	if bytes.Equal(before, after) {
+		return "The user saved the file without changes."
+	}
+	if diff := unifiedDiff(before, after, 2); diff != "" {
+		if len(diff) > maxEditNoteChars {
+			diff = diff[:maxEditNoteChars] + "\n... (truncated)"
+		}
+		return fmt.Sprintf("The user's changes to %s:\n%s", path, diff)
+	}
+	return fmt.Sprintf("The user changed %s starting at line %d.", path, firstDiffLine(string(before), string(after)))
+}
+
+// unifiedDiff returns the hunks of a diff from before to after with the given
+// number of context lines, or "" if there is no difference or git is missing.
+func unifiedDiff(before, after []byte, context int) string {
+	dir, err := os.MkdirTemp("", "simple-agent-diff-")
+	if err != nil {
+		return ""
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	os.WriteFile(a, before, 0644)
+	os.WriteFile(b, after, 0644)
+	// --no-index exits with 1 when the files differ
+	out, _ := exec.Command("git", "diff", "--no-index", "--no-color", fmt.Sprintf("-U%d", context), a, b).Output()
+	diff := string(out)
+	if i := strings.Index(diff, "@@"); i >= 0 {
+		return diff[i:]
+	}
+	return ""
+}
+
+// writeEditedFile replaces path with content the user edited, with the same
+// checks and journaling as applyUDiff.
+func writeEditedFile(ctx context.Context, path, content string) error {
+	absPath, err := validatePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	if CoreSkillsDir != "" && strings.HasPrefix(absPath, CoreSkillsDir) {
+		return codedToolError(errPolicyDenied, "core_skill_readonly", "Create or edit a project skill under ./skills instead.", fmt.Errorf("access denied: cannot modify core skills in '%s'", CoreSkillsDir))
+	}
+	old, err := os.ReadFile(absPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return journaledWrite(absPath, old, []byte(content))
+}
+
+// handleEditCommand opens a file (default: the file the agent edited last)
+// in $EDITOR and tells the model about the user's changes.
+func handleEditCommand(arg string, messages *[]Message) {
+	path := arg
+	if path == "" {
+		if path = lastJournaledEdit(); path == "" {
+			fmt.Println("Usage: /edit <path> (no file has been edited by the agent yet)")
+			return
+		}
+	}
+	absPath, err := validatePath(context.Background(), path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	before, err := os.ReadFile(absPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if err := openInEditor(absPath); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	after, err := os.ReadFile(absPath)
+	if err != nil || bytes.Equal(before, after) {
+		fmt.Println("No changes.")
+		return
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(cwd, absPath); err == nil {
+			path = rel
+		}
+	}
+	agentChanges.Record(context.Background(), path)
+	*messages = append(*messages, Message{
+		Role:    "system",
+		Content: "[System] The user edited " + path + " in their editor. Re-read it before editing it again.\n" + describeEdit(path, before, after),
+	})
+	saveHistory(*messages)
+	fmt.Printf("Changes to %s noted for the model.\n", path)
+}
+
+// openInEditor runs $VISUAL or $EDITOR (default vi) on path and waits for it.
+func openInEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// The editor may carry arguments, e.g. "code --wait"
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %s failed: %v", parts[0], err)
+	}
+	return nil
+}
+
+// --- Spell Check ---
+
+// SpellcheckConfig enables a lightweight spelling and consistency pass over
+// the text an edit adds to documentation and string literals. Issues are
+// shown with the diff and reported to the model.
+type SpellcheckConfig struct {
+	Enabled  bool              `json:"enabled"`
+	Glossary []string          `json:"glossary,omitempty"` // Canonical spellings, e.g. "GitHub", flagged when cased differently
+	Replace  map[string]string `json:"replace,omitempty"`  // Discouraged term -> preferred term, e.g. "e-mail": "email"
+	Ignore   []string          `json:"ignore,omitempty"`   // Words never flagged
+	Docs     []string          `json:"docs,omitempty"`     // Globs of files checked as prose (default: Markdown, text and changelogs)
+}
+
+// spellcheck is the active configuration; main sets it from the config.
+var spellcheck SpellcheckConfig
+
+var defaultDocGlobs = []string{"*.md", "*.markdown", "*.txt", "*.rst", "*.adoc", "CHANGELOG*", "README*"}
+
+// commonMisspellings maps frequent typos to their correction.
+var commonMisspellings = map[string]string{
+	"accomodate": "accommodate", "accross": "across", "acess": "access", "acheive": "achieve",
+	"adress": "address", "agian": "again", "alot": "a lot", "aquire": "acquire",
+	"arguement": "argument", "availible": "available", "becuase": "because", "begining": "beginning",
+	"beleive": "believe", "calender": "calendar", "commited": "committed", "comming": "coming",
+	"compatability": "compatibility", "completly": "completely", "concensus": "consensus", "configration": "configuration",
+	"definately": "definitely", "dependancy": "dependency", "dependant": "dependent", "desription": "description",
+	"enviroment": "environment", "existance": "existence", "existant": "existent", "explicitely": "explicitly",
+	"familar": "familiar", "finaly": "finally", "fucntion": "function", "funtion": "function",
+	"guarentee": "guarantee", "happend": "happened", "immediatly": "immediately", "independant": "independent",
+	"intial": "initial", "interupt": "interrupt", "knowlege": "knowledge", "lastest": "latest",
+	"lenght": "length", "neccessary": "necessary", "necesary": "necessary", "noticable": "noticeable",
+	"occassion": "occasion", "occured": "occurred", "occurence": "occurrence", "occurrance": "occurrence",
+	"paramter": "parameter", "persistant": "persistent", "posession": "possession", "prefered": "preferred",
+	"presense": "presence", "publically": "publicly", "recieve": "receive", "recieved": "received",
+	"recomend": "recommend", "reccomend": "recommend", "refered": "referred", "relevent": "relevant",
+	"reponse": "response", "repsonse": "response", "retreive": "retrieve", "retrun": "return",
+	"seperate": "separate", "seperated": "separated", "succesful": "successful", "successfull": "successful",
+	"sucessfully": "successfully", "sucess": "success", "supercede": "supersede", "suprise": "surprise",
+	"sytem": "system", "teh": "the", "thier": "their", "threshhold": "threshold",
+	"tommorow": "tomorrow", "truely": "truly", "udpate": "update", "untill": "until",
+	"usefull": "useful", "wich": "which", "wierd": "weird", "writting": "writing",
+}
+
+var (
+	spellURLRe     = regexp.MustCompile(`\S+://\S+|` + "`[^`]*`")
+	spellStringRe  = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` + "`[^`]*`")
+	spellPlainWord = regexp.MustCompile(`^[\p{L}'-]+$`)
+)
+
+// isDocFile reports whether path is checked as prose rather than code.
+func isDocFile(path string) bool {
+	globs := spellcheck.Docs
+	if len(globs) == 0 {
+		globs = defaultDocGlobs
+	}
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filepath.ToSlash(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSpelling returns the spelling and consistency issues in the lines a
+// diff adds to path. For code files only string literals are checked.
+func checkSpelling(path, diff string) []string {
+	if !spellcheck.Enabled {
+		return nil
+	}
+	ignore := make(map[string]bool)
+	for _, w := range spellcheck.Ignore {
+		ignore[strings.ToLower(w)] = true
+	}
+	glossary := make(map[string]string)
+	for _, term := range spellcheck.Glossary {
+		glossary[strings.ToLower(term)] = term
+	}
+	prose := isDocFile(path)
+
+	var issues []string
+	seen := make(map[string]bool)
+	report := func(issue, line string) {
+		if seen[issue] {
+			return
+		}
+		seen[issue] = true
+		excerpt := truncateLine(line, 80)
+		issues = append(issues, fmt.Sprintf("%s in: %s", issue, excerpt))
+	}
+
+	for _, line := range strings.Split(diff, "\n") {
+		if !strings.HasPrefix(line, "+") || strings.HasPrefix(line, "+++") {
+			continue
+		}
+		line = line[1:]
+		texts := []string{line}
+		if !prose {
+			texts = spellStringRe.FindAllString(line, -1)
+		}
+		for _, text := range texts {
+			text = spellURLRe.ReplaceAllString(text, " ")
+			lower := strings.ToLower(text)
+			for term, preferred := range spellcheck.Replace {
+				if containsWord(lower, strings.ToLower(term)) {
+					report(fmt.Sprintf("%q: prefer %q", term, preferred), line)
+				}
+			}
+
+			prev := ""
+			for _, field := range strings.Fields(text) {
+				word := strings.Trim(field, ".,;:!?()[]{}\"'*_<>")
+				if !spellPlainWord.MatchString(word) {
+					prev = "" // Identifiers, paths and numbers are not prose
+					continue
+				}
+				key := strings.ToLower(word)
+				switch {
+				case ignore[key]:
+				case commonMisspellings[key] != "":
+					report(fmt.Sprintf("%q → %q", word, matchCase(word, commonMisspellings[key])), line)
+				case glossary[key] != "" && glossary[key] != word:
+					report(fmt.Sprintf("%q → %q (glossary)", word, glossary[key]), line)
+				case key == prev:
+					report(fmt.Sprintf("repeated word %q", word), line)
+				}
+				prev = key
+				if field != strings.TrimRight(field, ".,;:!?") {
+					prev = "" // A sentence or clause ends here
+				}
+			}
+		}
+	}
+	return issues
+}
+
+func printSpellingIssues(issues []string) {
+	if len(issues) == 0 {
+		return
+	}
+	fmt.Printf("\033[33m✎ Spelling/consistency:\033[0m\n")
+	for _, issue := range issues {
+		fmt.Printf("  \033[33m%s\033[0m\n", issue)
+	}
+}
+
+// containsWord reports whether term occurs in text delimited by non-letters.
+func containsWord(text, term string) bool {
+	for from := 0; ; {
+		i := strings.Index(text[from:], term)
+		if i == -1 {
+			return false
+		}
+		start, end := from+i, from+i+len(term)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start == 0 || !unicode.IsLetter(before)) && (end == len(text) || !unicode.IsLetter(after)) {
+			return true
+		}
+		from = start + 1
+	}
+}
+
+// matchCase capitalizes the correction like the original word.
+func matchCase(word, fix string) string {
+	if r, _ := utf8.DecodeRuneInString(word); unicode.IsUpper(r) {
+		f, size := utf8.DecodeRuneInString(fix)
+		return string(unicode.ToUpper(f)) + fix[size:]
+	}
+	return fix
+}
+
+// --- Syntax Check ---
+
+// SyntaxCheckConfig runs a parser over each file apply_udiff writes. In
+// "report" mode parse errors are added to the tool result; in "strict" mode
+// an edit that breaks a file that parsed before is reverted and fails.
+type SyntaxCheckConfig struct {
+	Mode     string            `json:"mode,omitempty"`     // off (default), report or strict
+	Checkers map[string]string `json:"checkers,omitempty"` // Extension -> command with {path}, e.g. ".rb": "ruby -c {path}"
+}
+
+// syntaxCheck is the active configuration; main sets it from the config.
+var syntaxCheck SyntaxCheckConfig
+
+const syntaxCheckTimeout = 20 * time.Second
+
+// yamlSyntaxChecker exits with status 3, meaning no checker, without PyYAML.
+const yamlSyntaxChecker = `python3 -c "import importlib.util, sys; importlib.util.find_spec('yaml') or sys.exit(3); import yaml; sys.excepthook = lambda t, e, tb: print(e); list(yaml.safe_load_all(open(sys.argv[1])))" {path}`
+
+// defaultSyntaxCheckers are the external checkers by extension. Go and JSON
+// are parsed in-process. A checker whose program isn't installed is skipped.
+var defaultSyntaxCheckers = map[string]string{
+	".py":   "python3 -m py_compile {path}",
+	".js":   "node --check {path}",
+	".mjs":  "node --check {path}",
+	".cjs":  "node --check {path}",
+	".sh":   "bash -n {path}",
+	".yaml": yamlSyntaxChecker,
+	".yml":  yamlSyntaxChecker,
+}
+
+func validSyntaxCheckMode(mode string) bool {
+	return mode == "" || mode == "off" || mode == "report" || mode == "strict"
+}
+
+func syntaxCheckEnabled() bool {
+	return syntaxCheck.Mode == "report" || syntaxCheck.Mode == "strict"
+}
+
+// checkSyntax parses data as the content of path and returns the parse
+// error, or nil when it parses or no checker handles the file type.
+func checkSyntax(ctx context.Context, path string, data []byte) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	command, ok := syntaxCheck.Checkers[ext]
+	if !ok {
+		switch ext {
+		case ".go":
+			_, err := parser.ParseFile(token.NewFileSet(), filepath.Base(path), data, parser.AllErrors)
+			return err
+		case ".json":
+			var v any
+			if err := json.Unmarshal(data, &v); err != nil {
+				return fmt.Errorf("%s: %v", filepath.Base(path), err)
+			}
+			return nil
+		}
+		if command, ok = defaultSyntaxCheckers[ext]; !ok {
+			return nil
+		}
+	}
+	args, err := parseArgs(command)
+	if err != nil || len(args) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil
+	}
+
+	// Checkers read a copy in a temp directory, so the content before an edit
+	// can be checked too and byproducts (e.g. __pycache__) are thrown away
+	dir, err := os.MkdirTemp("", "simple-agent-syntax-")
+	if err != nil {
+		return nil
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, filepath.Base(path))
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return nil
+	}
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{path}", file)
+	}
+	ctx, cancel := context.WithTimeout(ctx, syntaxCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err == nil || ctx.Err() != nil || !errors.As(err, &exitErr) || exitErr.ExitCode() == 3 {
+		return nil
+	}
+	msg := strings.TrimSpace(strings.ReplaceAll(string(out), file, filepath.Base(path)))
+	if len(msg) > maxEditNoteChars {
+		msg = msg[:maxEditNoteChars] + "\n... (truncated)"
+	}
+	if msg == "" {
+		msg = err.Error()
+	}
+	return errors.New(msg)
+}
+
+// syntaxGate checks path after an edit replaced before (nil for a new file).
+// It returns a note for the tool result in report mode, or when the file
+// didn't parse before the edit either; in strict mode an edit that broke the
+// file is reverted and reported as an error.
+func syntaxGate(ctx context.Context, path, absPath string, before []byte) (string, error) {
+	if !syntaxCheckEnabled() {
+		return "", nil
+	}
+	after, err := os.ReadFile(absPath)
+	if err != nil {
+		return "", nil
+	}
+	parseErr := checkSyntax(ctx, path, after)
+	if parseErr == nil {
+		return "", nil
+	}
+	fmt.Printf("\033[31m⚠️  %s does not parse:\033[0m\n%v\n", path, parseErr)
+	if syntaxCheck.Mode != "strict" || (before != nil && checkSyntax(ctx, path, before) != nil) {
+		return fmt.Sprintf("[Syntax Check] %s does not parse after this edit; fix it:\n%v", path, parseErr), nil
+	}
+
+	var revertErr error
+	if before == nil {
+		revertErr = journaledRemove(absPath, after)
+	} else {
+		revertErr = journaledWrite(absPath, after, before)
+	}
+	if revertErr != nil {
+		return "", fmt.Errorf("the edit broke the syntax of %s and could not be reverted: %v\n%v", path, revertErr, parseErr)
+	}
+	fmt.Println("Edit reverted (strict syntax check).")
+	return "", codedToolError(errValidation, "syntax_error", "Fix the diff so the file still parses (balanced brackets, complete statements, indentation) and resend it.", fmt.Errorf("edit reverted: %s would no longer parse:\n%v", path, parseErr))
+}
+
+// --- Edit Journal ---
+
+// Edits are journaled in .simple_agent/edits.jsonl: a "started" entry before
+// the file is replaced and a "done" or "failed" entry after. Files are
+// replaced atomically, so an edit either landed completely or not at all; an
+// entry without a completion tells the next session to check which.
+
+type EditJournalEntry struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Before string    `json:"before,omitempty"` // SHA-256 of the old content; empty for a new file
+	After  string    `json:"after,omitempty"`  // SHA-256 of the new content; empty for a deletion
+	Status string    `json:"status"`           // started, done or failed
+	Error  string    `json:"error,omitempty"`
+}
+
+var editJournalMu sync.Mutex
+
+func getEditJournalPath() string {
+	return filepath.Join(".simple_agent", "edits.jsonl")
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func appendEditJournal(entry EditJournalEntry) error {
+	editJournalMu.Lock()
+	defer editJournalMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(getEditJournalPath()), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(getEditJournalPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, _ := json.Marshal(entry)
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if !durableWrites {
+		return nil
+	}
+	return f.Sync()
+}
+
+// journaledWrite atomically replaces path with data, recording the edit in
+// the journal. old is the previous content, or nil for a new file.
+func journaledWrite(path string, old, data []byte) error {
+	entry := EditJournalEntry{
+		ID:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		Time:   time.Now(),
+		Path:   path,
+		After:  contentHash(data),
+		Status: "started",
+	}
+	if old != nil {
+		entry.Before = contentHash(old)
+	}
+	if err := appendEditJournal(entry); err != nil {
+		return fmt.Errorf("failed to journal edit: %v", err)
+	}
+
+	err := writeFileAtomic(path, data, newFileMode(path, data))
+	entry.Time, entry.Status = time.Now(), "done"
+	if err != nil {
+		entry.Status, entry.Error = "failed", err.Error()
+	}
+	if jerr := appendEditJournal(entry); jerr != nil && err == nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to journal edit of %s: %v\n", path, jerr)
+	}
+	return err
+}
+
+// newFileMode is the mode for a file the agent creates: executable for
+// scripts (a shebang or a shell extension), 0644 otherwise.
+func newFileMode(path string, data []byte) os.FileMode {
+	if bytes.HasPrefix(data, []byte("#!")) {
+		return 0755
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".sh", ".bash", ".zsh", ".command":
+		return 0755
+	}
+	return 0644
+}
+
+// copyFileMode gives path the permission bits (including setuid, setgid and
+// sticky) and, where allowed, the owner and group of the file described by
+// info. The owner goes first because chown clears the setuid bits.
+func copyFileMode(path string, info os.FileInfo) error {
+	preserveOwner(path, info)
+	return os.Chmod(path, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+// durableWrites fsyncs written files, their directories and the edit journal.
+// Renaming a temp file already protects against the agent crashing; fsync
+// also covers the OS crashing or losing power, at the cost of slower edits.
+var durableWrites bool
+
+// syncDir fsyncs a directory so a rename or removal in it is on disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into
+// place, so readers and crashes never see a partial file. An existing file
+// keeps its mode and ownership (perm applies to new files only), and a
+// symlink is followed rather than replaced.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	existing, statErr := os.Stat(path)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(data)
+	if err == nil && durableWrites {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && statErr == nil {
+		err = copyFileMode(tmpPath, existing)
+	} else if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	} else if durableWrites {
+		err = syncDir(filepath.Dir(path))
+	}
+	return err
+}
+
+// journaledRemove deletes path, recording the deletion in the journal as an
+// edit with no new content. old is the content being deleted.
+func journaledRemove(path string, old []byte) error {
+	entry := EditJournalEntry{
+		ID:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		Time:   time.Now(),
+		Path:   path,
+		Before: contentHash(old),
+		Status: "started",
+	}
+	if err := appendEditJournal(entry); err != nil {
+		return fmt.Errorf("failed to journal edit: %v", err)
+	}
+
+	err := os.Remove(path)
+	if err == nil && durableWrites {
+		err = syncDir(filepath.Dir(path))
+	}
+	entry.Time, entry.Status = time.Now(), "done"
+	if err != nil {
+		entry.Status, entry.Error = "failed", err.Error()
+	}
+	if jerr := appendEditJournal(entry); jerr != nil && err == nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to journal deletion of %s: %v\n", path, jerr)
+	}
+	return err
+}
+
+// lastJournaledEdit returns the path of the most recent completed edit.
+func lastJournaledEdit() string {
+	data, err := os.ReadFile(getEditJournalPath())
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		var entry EditJournalEntry
+		if json.Unmarshal([]byte(lines[i]), &entry) == nil && entry.Status == "done" {
+			return entry.Path
+		}
+	}
+	return ""
+}
+
+// recoverEditJournal reports edits an earlier session started but never
+// completed, saying whether each one landed, and then clears the journal.
+func recoverEditJournal() []string {
+	data, err := os.ReadFile(getEditJournalPath())
+	if err != nil {
+		return nil
+	}
+
+	var pending []EditJournalEntry
+	seen := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		var entry EditJournalEntry
+		if line == "" || json.Unmarshal([]byte(line), &entry) != nil {
+			continue // A torn final line is an edit that never started
+		}
+		if entry.Status == "started" {
+			seen[entry.ID] = len(pending)
+			pending = append(pending, entry)
+		} else if i, ok := seen[entry.ID]; ok {
+			pending[i].Status = entry.Status
+		}
+	}
+
+	cwd, _ := os.Getwd()
+	var report []string
+	for _, entry := range pending {
+		if entry.Status != "started" {
+			continue
+		}
+		state := "may have landed; the file has changed since"
+		current, err := os.ReadFile(entry.Path)
+		switch {
+		case err == nil && contentHash(current) == entry.After, os.IsNotExist(err) && entry.After == "":
+			state = "landed"
+		case err == nil && contentHash(current) == entry.Before, os.IsNotExist(err) && entry.Before == "":
+			state = "did not land"
+		}
+		path := entry.Path
+		if rel, err := filepath.Rel(cwd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			path = rel
+		}
+		report = append(report, fmt.Sprintf("%s (%s): the edit %s", path, entry.Time.Format("2006-01-02 15:04:05"), state))
+	}
+
+	if err := os.Remove(getEditJournalPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to clear %s: %v\n", getEditJournalPath(), err)
+	}
+	return report
+}
+
+// --- Conflict Detection ---
+
+// The model's picture of a file dates from when it last read or edited it.
+// If the file changed on disk since (the user edited it meanwhile), a diff
+// built from that picture can land in the wrong place, so apply_udiff refuses
+// it once and asks the model to re-read. Changes the agent's own commands and
+// hooks make are known: the hashes are refreshed after every tool call that
+// can modify files.
+
+// fileTracker maps absolute paths to the SHA-256 of the content the model
+// last saw.
+type fileTracker struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+var seenFiles = &fileTracker{hashes: make(map[string]string)}
+
+// fileChangingTools are the tools after which tracked files are re-hashed.
+var fileChangingTools = map[string]bool{
+	"apply_udiff": true, "edit_many": true, "run_command": true, "run_script": true, "run_tests": true, "build_project": true,
+	"git_checkout": true, "git_reset": true, "git_stash": true, "spawn_agent": true,
+}
+
+// Record notes the content of absPath the model has seen.
+func (t *fileTracker) Record(absPath string, data []byte) {
+	t.mu.Lock()
+	t.hashes[absPath] = contentHash(data)
+	t.mu.Unlock()
+}
+
+// Touch records the current content of absPath, after the agent wrote it.
+func (t *fileTracker) Touch(absPath string) {
+	if data, err := os.ReadFile(absPath); err == nil {
+		t.Record(absPath, data)
+	} else {
+		t.Drop(absPath)
+	}
+}
+
+func (t *fileTracker) Drop(absPath string) {
+	t.mu.Lock()
+	delete(t.hashes, absPath)
+	t.mu.Unlock()
+}
+
+// Forget drops everything, when the conversation no longer knows any files.
+func (t *fileTracker) Forget() {
+	t.mu.Lock()
+	t.hashes = make(map[string]string)
+	t.mu.Unlock()
+}
+
+// Refresh re-hashes the tracked files, accepting their current content.
+func (t *fileTracker) Refresh() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for path := range t.hashes {
+		if data, err := os.ReadFile(path); err == nil {
+			t.hashes[path] = contentHash(data)
+		} else {
+			delete(t.hashes, path)
+		}
+	}
+}
+
+// Check returns an error if absPath changed on disk since the model last saw
+// it. The current content then counts as seen, so the edit goes through once
+// the model has re-read the file (or resends it regardless).
+func (t *fileTracker) Check(path, absPath string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen, ok := t.hashes[absPath]
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(absPath)
+	switch {
+	case os.IsNotExist(err):
+		delete(t.hashes, absPath)
+		return codedToolError(errValidation, "file_changed", "Check with the user whether the file should still be edited.", fmt.Errorf("%s was deleted since you last read it (probably by the user); nothing was changed", path))
+	case err != nil, contentHash(data) == seen:
+		return nil
+	}
+	t.hashes[absPath] = contentHash(data)
+	fmt.Printf("\033[33m⚠️  %s changed on disk since the agent last read it; asking it to re-read.\033[0m\n", path)
+	return codedToolError(errValidation, "file_changed", "Re-read the file with read_file and rebuild the edit against its current content; keep the changes made since.", fmt.Errorf("%s changed on disk since you last read it (probably edited by the user); the edit was not applied", path))
+}
+
+// --- File Watcher ---
+
+// With file_watcher enabled (or -watch-files), the workspace is polled for
+// changes made outside the agent: the user's editor, a build in another
+// terminal, a git checkout. Before each model request the changed files are
+// listed in a system notice, so the model re-reads them instead of editing
+// from stale context. Whatever changes while a tool call that can modify
+// files runs is attributed to the agent. Polling instead of OS notifications
+// keeps the binary free of dependencies.
+
+const (
+	fileWatchInterval  = 2 * time.Second
+	fileWatchMaxFiles  = 20000
+	fileWatchMaxListed = 20
+)
+
+type FileWatcher struct {
+	root    string
+	mu      sync.Mutex
+	state   map[string]string // Relative path -> size:mtime
+	changed map[string]string // Relative path -> created, modified or deleted
+	busy    int               // Tool calls in progress that may change files
+	gen     int               // Bumped by every tool call, to discard scans that overlap one
+}
+
+// fileWatch is nil unless the watcher runs.
+var fileWatch *FileWatcher
+
+// startFileWatcher takes the first snapshot of root and starts polling it.
+func startFileWatcher(root string) (*FileWatcher, error) {
+	w := &FileWatcher{root: root, changed: make(map[string]string)}
+	state, ok := w.scan()
+	if !ok {
+		return nil, fmt.Errorf("more than %d files to watch", fileWatchMaxFiles)
+	}
+	w.state = state
+	go func() {
+		for range time.Tick(fileWatchInterval) {
+			w.poll()
+		}
+	}()
+	return w, nil
+}
+
+// scan fingerprints the files below root that git doesn't ignore.
+func (w *FileWatcher) scan() (map[string]string, bool) {
+	files := listBatchFiles(w.root)
+	if len(files) > fileWatchMaxFiles {
+		return nil, false
+	}
+	state := make(map[string]string, len(files))
+	for _, name := range files {
+		name = filepath.ToSlash(name)
+		if name == "" || isAgentStatePath(name) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(w.root, name)); err == nil && info.Mode().IsRegular() {
+			state[name] = fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return state, true
+}
+
+func (w *FileWatcher) poll() {
+	w.mu.Lock()
+	gen := w.gen
+	w.mu.Unlock()
+	state, ok := w.scan()
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.busy > 0 || w.gen != gen {
+		return
+	}
+	for path, fp := range state {
+		if old, seen := w.state[path]; !seen {
+			w.changed[path] = "created"
+		} else if old != fp {
+			w.changed[path] = "modified"
+		}
+	}
+	for path := range w.state {
+		if _, ok := state[path]; !ok {
+			w.changed[path] = "deleted"
+		}
+	}
+	w.state = state
+}
+
+// Suspend marks a tool call that may change files as running.
+func (w *FileWatcher) Suspend() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.busy++
+	w.gen++
+	w.mu.Unlock()
+}
+
+// Resume ends a tool call started with Suspend and takes its changes as the
+// new baseline.
+func (w *FileWatcher) Resume() {
+	if w == nil {
+		return
+	}
+	state, ok := w.scan()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.busy--
+	w.gen++
+	if ok && w.busy == 0 {
+		w.state = state
+	}
+}
+
+// Drain returns the files changed outside the agent since the last call,
+// as "path (change)", and forgets them.
+func (w *FileWatcher) Drain() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var changes []string
+	for path, change := range w.changed {
+		changes = append(changes, fmt.Sprintf("%s (%s)", path, change))
+	}
+	sort.Strings(changes)
+	w.changed = make(map[string]string)
+	return changes
+}
+
+// externalChangesNotice tells the model which files changed under it.
+func externalChangesNotice(changes []string) string {
+	listed := changes
+	if len(listed) > fileWatchMaxListed {
+		listed = append(listed[:fileWatchMaxListed:fileWatchMaxListed], fmt.Sprintf("... and %d more", len(changes)-fileWatchMaxListed))
+	}
+	return "[System] These files changed outside the agent (e.g. edited by the user) since the last request: " + strings.Join(listed, ", ") + ". Re-read any of them before editing it, and keep those changes."
+}
+
+// --- Path Normalization ---
+
+// Paths shown to the model are normalized so prompts stay short and stable
+// across machines: workspace files are relative, core skills use the "core:"
+// prefix, and agent data in the home directory uses "~/.simple_agent/".
+// expandPath and expandPathsInArg translate these forms back on tool input.
+
+const corePathPrefix = "core:"
+
+var corePathArgRe = regexp.MustCompile(`(^|[\s'"=(])core:([A-Za-z0-9._-])`)
+
+func getAgentHomeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".simple_agent")
+}
+
+// displayPath returns the model-facing form of path, relative to root where possible.
+func displayPath(root, path string) string {
+	if !filepath.IsAbs(path) {
+		return filepath.ToSlash(path)
+	}
+	if CoreSkillsDir != "" {
+		if rel, err := filepath.Rel(CoreSkillsDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return corePathPrefix + filepath.ToSlash(rel)
+		}
+	}
+	if rel, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	if agentHome := getAgentHomeDir(); agentHome != "" {
+		if rel, err := filepath.Rel(agentHome, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return "~/.simple_agent/" + filepath.ToSlash(rel)
+		}
+	}
+	return path
+}
+
+// normalizeOutputPaths rewrites absolute paths inside free-form tool output.
+func normalizeOutputPaths(root, text string) string {
+	sep := string(os.PathSeparator)
+	if CoreSkillsDir != "" {
+		text = strings.ReplaceAll(text, CoreSkillsDir+sep, corePathPrefix)
+	}
+	if root != "" && root != sep {
+		text = strings.ReplaceAll(text, root+sep, "")
+	}
+	if agentHome := getAgentHomeDir(); agentHome != "" {
+		text = strings.ReplaceAll(text, agentHome+sep, "~/.simple_agent/")
+	}
+	return text
+}
+
+// expandPath translates a model-facing path back to a real one.
+func expandPath(path string) string {
+	if strings.HasPrefix(path, corePathPrefix) && CoreSkillsDir != "" {
+		ensureCoreSkills()
+		return filepath.Join(CoreSkillsDir, strings.TrimPrefix(path, corePathPrefix))
+	}
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+// expandPathsInArg expands core: paths anywhere in a script argument, so
+// shell command strings like "cat core:remember/SKILL.md" work.
+func expandPathsInArg(arg string) string {
+	if strings.HasPrefix(arg, "~/") {
+		arg = expandPath(arg)
+	}
+	if CoreSkillsDir == "" || !corePathArgRe.MatchString(arg) {
+		return arg
+	}
+	ensureCoreSkills()
+	return corePathArgRe.ReplaceAllString(arg, "${1}"+CoreSkillsDir+string(os.PathSeparator)+"${2}")
+}
+
+// --- Script Approvals ---
+
+// ScriptApprovals records the scripts and skills the user allowed to run
+// without asking again. They are stored per project in
+// ~/.simple_agent/projects/<hash>/approvals.json, keyed by model-facing script
+// path. An approvals file inside the workspace is ignored: a cloned repo
+// could otherwise ship its own.
+type ScriptApprovals struct {
+	mu           sync.Mutex
+	Scripts      []string        `json:"scripts,omitempty"`
+	Skills       []string        `json:"skills,omitempty"`
+	DeniedSkills []string        `json:"denied_skills,omitempty"` // Skills never allowed to run scripts
+	Commands     []string        `json:"commands,omitempty"`      // Exact run_command command lines
+	session      map[string]bool // Skills allowed for this session only
+	memoryOnly   bool            // Decisions are not saved (see useEmptyApprovals)
+}
+
+var (
+	projectApprovalsOnce sync.Once
+	projectApprovals     *ScriptApprovals
+)
+
+// getScriptApprovals returns the approvals of the current project, loaded on
+// first use and shared by the session and its sub-agents.
+func getScriptApprovals() *ScriptApprovals {
+	projectApprovalsOnce.Do(func() { projectApprovals = loadScriptApprovals() })
+	return projectApprovals
+}
+
+// useEmptyApprovals starts the session without saved approvals and keeps new
+// ones in memory, for workspaces that aren't the user's project (-archive).
+// It must be called before getScriptApprovals.
+func useEmptyApprovals() {
+	projectApprovalsOnce.Do(func() { projectApprovals = &ScriptApprovals{memoryOnly: true} })
+}
+
+// getApprovalsPath returns the approvals file of the current project, or ""
+// without an agent home.
+func getApprovalsPath() string {
+	dir := getProjectStateDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "approvals.json")
+}
+
+func loadScriptApprovals() *ScriptApprovals {
+	a := &ScriptApprovals{}
+	path := getApprovalsPath()
+	if path == "" {
+		return a
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, a); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to parse %s: %v\n", path, err)
+		}
+	}
+	return a
+}
+
+func (a *ScriptApprovals) Allowed(script, skill string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range a.Scripts {
+		if s == script {
+			return true
+		}
+	}
+	for _, s := range a.Skills {
+		if skill != "" && s == skill {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow records a permanent approval for a script or, if script is empty, a skill.
+func (a *ScriptApprovals) Allow(script, skill string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if script != "" {
+		a.Scripts = append(a.Scripts, script)
+	} else {
+		a.Skills = append(a.Skills, skill)
+	}
+	return a.save()
+}
+
+func (a *ScriptApprovals) CommandAllowed(command string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// SkillDecision reports whether the user trusted the skill, for this session
+// or always, or blocked it for good. Neither means it was not asked yet.
+func (a *ScriptApprovals) SkillDecision(skill string) (allowed, denied bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range a.DeniedSkills {
+		if s == skill {
+			return false, true
+		}
+	}
+	for _, s := range a.Skills {
+		if s == skill {
+			return true, false
+		}
+	}
+	return a.session[skill], false
+}
+
+// AllowSkillForSession trusts a skill until the agent exits.
+func (a *ScriptApprovals) AllowSkillForSession(skill string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.session == nil {
+		a.session = make(map[string]bool)
+	}
+	a.session[skill] = true
+}
+
+// DenySkill records that a skill may never run its scripts in this project.
+func (a *ScriptApprovals) DenySkill(skill string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.DeniedSkills = append(a.DeniedSkills, skill)
+	return a.save()
+}
+
+// AllowCommand records a permanent approval for an exact command line.
+func (a *ScriptApprovals) AllowCommand(command string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Commands = append(a.Commands, command)
+	return a.save()
+}
+
+// save writes the approvals; the caller holds a.mu.
+func (a *ScriptApprovals) save() error {
+	if a.memoryOnly {
+		return nil
+	}
+	path := getApprovalsPath()
+	if path == "" {
+		return fmt.Errorf("no home directory to save approvals in")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// findSkillForPath returns the skill whose directory contains absPath.
+func findSkillForPath(skills []Skill, absPath string) *Skill {
+	for i := range skills {
+		dir, err := filepath.Abs(skills[i].Path)
+		if err == nil && strings.HasPrefix(absPath, dir+string(os.PathSeparator)) {
+			return &skills[i]
+		}
+	}
+	return nil
+}
+
+func scriptPreview(path string, maxLines int) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("(unreadable: %v)", err)
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	var sb strings.Builder
+	for i, line := range lines {
+		if i == maxLines {
+			sb.WriteString(fmt.Sprintf("   \033[90m... (%d more lines)\033[0m\n", len(lines)-maxLines))
+			break
+		}
+		sb.WriteString(fmt.Sprintf("   \033[90m%3d |\033[0m %s\n", i+1, line))
+	}
+	return sb.String()
+}
+
+// approveScript shows the user what is about to run and asks for a decision.
+// It returns whether the script may run and, if not, the message for the
+// model.
+func approveScript(ctx context.Context, env *ToolEnv, absPath string, args []string) (bool, string) {
+	root, _ := getWorkDir(ctx)
+	script := displayPath(root, absPath)
+	skillName := ""
+	skill := findSkillForPath(env.Skills, absPath)
+	if skill != nil {
+		skillName = skill.Name
+	}
+	if env.Approvals != nil && env.Approvals.Allowed(script, skillName) {
+		noteApproval(ctx, "saved")
+		return true, ""
+	}
+
+	fmt.Printf("\n\033[1;33m[Approval required]\033[0m\n")
+	fmt.Printf("  Script: %s\n", absPath)
+	if skill != nil {
+		fmt.Printf("  Skill:  %s - %s\n", skill.Name, skill.Description)
+	}
+	if len(args) > 0 {
+		fmt.Printf("  Args:   %s\n", strings.Join(args, " "))
+	}
+	fmt.Print(scriptPreview(absPath, 10))
+
+	options := "[o]nce, always allow this [s]cript"
+	if skill != nil {
+		options += fmt.Sprintf(", always allow skill '%s' [k]", skill.Name)
+	}
+	choice := askUser(ctx, fmt.Sprintf("Run %s? %s, [d]eny: ", script, options))
+	if ctx.Err() != nil {
+		return false, "Interrupted by user."
+	}
+
+	var persistErr error
+	switch strings.ToLower(choice) {
+	case "o", "y":
+		noteApproval(ctx, "approved")
+		return true, ""
+	case "s":
+		if env.Approvals != nil {
+			persistErr = env.Approvals.Allow(script, "")
+		}
+	case "k":
+		if skill == nil {
+			noteApproval(ctx, "denied")
+			return false, "User denied running the script."
+		}
+		if env.Approvals != nil {
+			persistErr = env.Approvals.Allow("", skill.Name)
+		}
+	default:
+		noteApproval(ctx, "denied")
+		fmt.Println("Script denied.")
+		reason := askUser(ctx, "Reason for the agent (optional): ")
+		if reason != "" {
+			return false, "User denied running the script: " + reason
+		}
+		return false, "User denied running the script."
+	}
+	if persistErr != nil {
+		fmt.Printf("Warning: Failed to save approval: %v\n", persistErr)
+	}
+	noteApproval(ctx, "approved")
+	return true, ""
+}
+
+// --- Skill Trust ---
+
+// Discovered skills are not trusted implicitly: the first time a session runs
+// one of a project skill's scripts (directly or through a hook), the user sees
+// what the skill declares and decides. Core skills ship with the binary and
+// are always trusted.
+
+// skillTrustMu serializes the prompts, so parallel sub-agents ask only once.
+var skillTrustMu sync.Mutex
+
+func isCoreSkill(skill *Skill) bool {
+	return CoreSkillsDir != "" && strings.HasPrefix(skill.Path, CoreSkillsDir+string(os.PathSeparator))
+}
+
+// trustSkill reports whether skill may run its scripts, asking the user if
+// this session has not decided yet. If not, it also returns the message for
+// the model.
+func trustSkill(ctx context.Context, skill *Skill) (bool, string) {
+	if skill == nil || isCoreSkill(skill) {
+		return true, ""
+	}
+	approvals := getScriptApprovals()
+	skillTrustMu.Lock()
+	defer skillTrustMu.Unlock()
+	allowed, denied := approvals.SkillDecision(skill.Name)
+	if allowed {
+		return true, ""
+	}
+	if denied {
+		return false, fmt.Sprintf("The user does not allow skill '%s' to run scripts in this project.", skill.Name)
+	}
+
+	cwd, _ := os.Getwd()
+	fmt.Printf("\n\033[1;33m[New skill]\033[0m %s", skill.Name)
+	if skill.Version != "" {
+		fmt.Printf(" (v%s)", skill.Version)
+	}
+	fmt.Printf("\n  %s\n", skill.Description)
+	fmt.Printf("  Location:     %s\n", displayPath(cwd, skill.Path))
+	if len(skill.Dependencies) > 0 {
+		fmt.Printf("  Dependencies: %s\n", strings.Join(skill.Dependencies, ", "))
+	}
+	if len(skill.Permissions) > 0 {
+		fmt.Printf("  Permissions:  %s\n", strings.Join(skill.Permissions, ", "))
+	} else {
+		fmt.Printf("  Permissions:  \033[90m(none declared)\033[0m\n")
+	}
+	if len(skill.Hooks) > 0 {
+		var events []string
+		for event := range skill.Hooks {
+			events = append(events, event)
+		}
+		sort.Strings(events)
+		fmt.Printf("  Hooks:        %s\n", strings.Join(events, ", "))
+	}
+	fmt.Printf("  Scripts:      %d\n", len(skill.Scripts))
+
+	var persistErr error
+	choice := askUser(ctx, fmt.Sprintf("Allow skill '%s' to run scripts? for this [s]ession, [a]lways, [n]ever, [d]eny this time: ", skill.Name))
+	switch strings.ToLower(choice) {
+	case "s", "y":
+		approvals.AllowSkillForSession(skill.Name)
+	case "a":
+		approvals.AllowSkillForSession(skill.Name)
+		persistErr = approvals.Allow("", skill.Name)
+	case "n":
+		if err := approvals.DenySkill(skill.Name); err != nil {
+			fmt.Printf("Warning: Failed to save decision: %v\n", err)
+		}
+		return false, fmt.Sprintf("The user does not allow skill '%s' to run scripts in this project.", skill.Name)
+	default:
+		return false, fmt.Sprintf("The user did not allow skill '%s' to run scripts.", skill.Name)
+	}
+	if persistErr != nil {
+		fmt.Printf("Warning: Failed to save decision: %v\n", persistErr)
+	}
+	return true, ""
+}
+
+// --- Shell Commands ---
+
+// CommandPolicy controls run_command. Patterns match a command and its
+// arguments word by word ("go test" matches "go test ./..."), and '*' matches
+// anything. Chained commands ("a && b | c") are checked part by part.
+type CommandPolicy struct {
+	Allow          []string `json:"allow,omitempty"`           // Run without asking; when set, everything else needs approval
+	Deny           []string `json:"deny,omitempty"`            // Always refused, in addition to the built-in list
+	EnvPassthrough []string `json:"env_passthrough,omitempty"` // Variables kept although they look like secrets
+	EnvScrub       []string `json:"env_scrub,omitempty"`       // Extra variable name globs removed, e.g. "ACME_*"
+	Timeout        int      `json:"timeout_seconds,omitempty"` // Default 600
+}
+
+// commandPolicy is the active policy; main sets it from the config.
+var commandPolicy CommandPolicy
+
+var defaultDeniedCommands = []string{"sudo", "su", "rm -rf /", "rm -rf ~", "rm -rf ~/", "mkfs*", "shutdown", "reboot"}
+
+// secretEnvPatterns are environment variable name globs removed from the
+// environment of run_command.
+var secretEnvPatterns = []string{"*KEY*", "*TOKEN*", "*SECRET*", "*PASSWORD*", "*PASSWD*", "*CREDENTIAL*", "*AUTH*", "AWS_*", "AZURE_*"}
+
+var defaultEnvPassthrough = []string{"SSH_AUTH_SOCK"}
+
+const defaultCommandTimeout = 10 * time.Minute
+
+// commandDecision is the outcome of checking a command against the policy.
+type commandDecision int
+
+const (
+	commandAsk commandDecision = iota
+	commandAllowed
+	commandDenied
+)
+
+// Check decides whether command may run. The reason names the deny pattern
+// or why approval is needed.
+func (p CommandPolicy) Check(command string) (commandDecision, string) {
+	segments, opaque := splitShellCommand(command)
+	for _, seg := range segments {
+		for _, pattern := range append(append([]string(nil), defaultDeniedCommands...), p.Deny...) {
+			if matchCommand(pattern, seg) {
+				return commandDenied, fmt.Sprintf("'%s' matches the denied pattern '%s'", seg, pattern)
+			}
+		}
+	}
+	if len(p.Allow) == 0 {
+		return commandAsk, ""
+	}
+	if opaque {
+		return commandAsk, "it contains command substitution"
+	}
+	for _, seg := range segments {
+		allowed := false
+		for _, pattern := range p.Allow {
+			if matchCommand(pattern, seg) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return commandAsk, fmt.Sprintf("'%s' is not in the allowlist", seg)
+		}
+	}
+	return commandAllowed, ""
+}
+
+func (p CommandPolicy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return time.Duration(p.Timeout) * time.Second
+	}
+	return defaultCommandTimeout
+}
+
+var envAssignmentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=\S*\s+`)
+
+// splitShellCommand splits a command line at unquoted ;, &&, ||, | and &
+// and newlines. opaque reports command or process substitution, whose
+// contents can't be checked.
+func splitShellCommand(command string) (segments []string, opaque bool) {
+	var current strings.Builder
+	var quote rune
+	flush := func() {
+		seg := strings.TrimSpace(current.String())
+		for envAssignmentRe.MatchString(seg) {
+			seg = envAssignmentRe.ReplaceAllString(seg, "") // FOO=1 cmd
+		}
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+		current.Reset()
+	}
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && quote != '\'' && i+1 < len(runes):
+			current.WriteRune(r)
+			i++
+			current.WriteRune(runes[i])
+			continue
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if quote == '"' && (r == '`' || (r == '$' && i+1 < len(runes) && runes[i+1] == '(')) {
+				opaque = true
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '`' || (r == '$' || r == '<' || r == '>') && i+1 < len(runes) && runes[i+1] == '(':
+			opaque = true
+		case r == '&' && (i > 0 && (runes[i-1] == '>' || runes[i-1] == '<') || i+1 < len(runes) && runes[i+1] == '>'):
+			// Redirection such as 2>&1 or &>file
+		case r == ';' || r == '|' || r == '&' || r == '\n':
+			flush()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	flush()
+	return segments, opaque
+}
+
+// matchCommand reports whether a command matches a policy pattern.
+func matchCommand(pattern, command string) bool {
+	pattern = strings.Join(strings.Fields(pattern), " ")
+	command = strings.Join(strings.Fields(command), " ")
+	if pattern == "" {
+		return false
+	}
+	re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + `(\s.*)?$`
+	ok, _ := regexp.MatchString(re, command)
+	return ok
+}
+
+// scrubbedEnv returns the process environment without variables that look
+// like secrets.
+func scrubbedEnv(p CommandPolicy) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !isSecretEnv(p, name) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+func isSecretEnv(p CommandPolicy, name string) bool {
+	for _, keep := range append(append([]string(nil), defaultEnvPassthrough...), p.EnvPassthrough...) {
+		if keep == name {
+			return false
+		}
+	}
+	upper := strings.ToUpper(name)
+	for _, pattern := range append(append([]string(nil), secretEnvPatterns...), p.EnvScrub...) {
+		if ok, _ := filepath.Match(strings.ToUpper(pattern), upper); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isShellRunner reports whether a skill script runs arbitrary commands, like
+// yolo-runner's run_command.sh.
+func isShellRunner(absPath string) bool {
+	return strings.HasSuffix(filepath.ToSlash(absPath), "yolo-runner/scripts/run_command.sh")
+}
+
+// authorizeCommand applies the command policy to command and, where the
+// policy or the session asks for it, the user's approval. A nil error means
+// command may run in dir.
+func authorizeCommand(ctx context.Context, env *ToolEnv, command, dir string) error {
+	decision, reason := commandPolicy.Check(command)
+	switch {
+	case decision == commandDenied:
+		fmt.Printf("\033[31mRefused: %s\033[0m\n", reason)
+		noteApproval(ctx, "policy")
+		return codedToolError(errPolicyDenied, "command_denied", "", fmt.Errorf("command refused by policy: %s", reason))
+	case decision == commandAllowed:
+		noteApproval(ctx, "allowlist")
+	case !env.AutoApprove || len(commandPolicy.Allow) > 0:
+		if approved, denial := approveCommand(ctx, env, command, dir, reason); !approved {
+			return toolError(errUserRejected, errors.New(denial))
+		}
+	default:
+		noteApproval(ctx, "auto")
+	}
+	return nil
+}
+
+// approveCommand asks the user whether command may run. It returns whether
+// it may and, if not, the message for the model.
+func approveCommand(ctx context.Context, env *ToolEnv, command, dir, reason string) (bool, string) {
+	if env.Approvals != nil && env.Approvals.CommandAllowed(command) {
+		noteApproval(ctx, "saved")
+		return true, ""
+	}
+	fmt.Printf("\n\033[1;33m[Approval required]\033[0m\n")
+	fmt.Printf("  Command: %s\n", command)
+	fmt.Printf("  In:      %s\n", dir)
+	if reason != "" {
+		fmt.Printf("  Why:     %s\n", reason)
+	}
+	choice := askUser(ctx, "Run this command? [o]nce, [a]lways allow this command, [d]eny: ")
+	if ctx.Err() != nil {
+		return false, "Interrupted by user."
+	}
+	switch strings.ToLower(choice) {
+	case "o", "y":
+		noteApproval(ctx, "approved")
+		return true, ""
+	case "a":
+		if env.Approvals != nil {
+			if err := env.Approvals.AllowCommand(command); err != nil {
+				fmt.Printf("Warning: Failed to save approval: %v\n", err)
+			}
+		}
+		noteApproval(ctx, "approved")
+		return true, ""
+	}
+	noteApproval(ctx, "denied")
+	fmt.Println("Command denied.")
+	if reason := askUser(ctx, "Reason for the agent (optional): "); reason != "" {
+		return false, "User denied running the command: " + reason
+	}
+	return false, "User denied running the command."
+}
+
+// runShellCommand runs command with the shell in dir, with a scrubbed
+// environment and the policy's timeout.
+func runShellCommand(ctx context.Context, command, dir string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	shell := "bash"
+	if _, err := exec.LookPath(shell); err != nil {
+		shell = "sh"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	cmd.Dir = dir
+	cmd.Env = scrubbedEnv(commandPolicy)
+	out, err := cmd.CombinedOutput()
+	noteExitCode(ctx, cmd.ProcessState)
+	output := boundOutput(out)
+	if ctx.Err() == context.DeadlineExceeded {
+		return output, codedToolError(errTimeout, "command_timeout", "Run a narrower command, or pass a longer timeout if the policy allows it.", fmt.Errorf("command timed out after %s\nOutput:\n%s", timeout, output))
+	}
+	if err != nil {
+		return output, fmt.Errorf("command failed: %w\nOutput:\n%s", err, output)
+	}
+	return output, nil
+}
+
+// --- Protected Paths ---
+
+// An .agentignore file in the project root lists paths the agent must never
+// read or modify, in .gitignore syntax: '#' comments, '!' negation, a
+// trailing '/' for directories, and '*', '?' and '**' globs. Patterns
+// without a '/' match at any depth. The file itself is read-only.
+
+const agentIgnoreFile = ".agentignore"
+
+type ignoreRule struct {
+	Pattern string
+	Line    int
+	Negate  bool
+	re      *regexp.Regexp
+}
+
+type agentIgnoreCache struct {
+	modTime time.Time
+	rules   []ignoreRule
+}
+
+var (
+	agentIgnoreMu    sync.Mutex
+	agentIgnoreRules = make(map[string]agentIgnoreCache) // Root -> parsed rules
+)
+
+// loadAgentIgnore returns the rules of root's .agentignore, re-reading the
+// file when it changes.
+func loadAgentIgnore(root string) []ignoreRule {
+	path := filepath.Join(root, agentIgnoreFile)
+	info, err := os.Stat(path)
+	agentIgnoreMu.Lock()
+	defer agentIgnoreMu.Unlock()
+	if err != nil {
+		delete(agentIgnoreRules, root)
+		return nil
+	}
+	if cached, ok := agentIgnoreRules[root]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.rules
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	rules := parseIgnoreRules(string(data))
+	agentIgnoreRules[root] = agentIgnoreCache{modTime: info.ModTime(), rules: rules}
+	return rules
+}
+
+func parseIgnoreRules(data string) []ignoreRule {
+	var rules []ignoreRule
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{Pattern: line, Line: i + 1}
+		if strings.HasPrefix(line, "!") {
+			rule.Negate, line = true, line[1:]
+		}
+		line = strings.TrimSuffix(line, "/")
+		// A slash other than a trailing one anchors the pattern to the root
+		prefix := `^(?:.*/)?`
+		if strings.Contains(line, "/") {
+			prefix, line = "^", strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(prefix + globToRegexp(line) + `(?:/.*)?$`)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Ignoring %s line %d: %v\n", agentIgnoreFile, i+1, err)
+			continue
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// globToRegexp translates a gitignore-style glob to a regular expression.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString(`(?:.*/)?`)
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(`.*`)
+			i++
+		case c == '*':
+			sb.WriteString(`[^/]*`)
+		case c == '?':
+			sb.WriteString(`[^/]`)
+		case c == '[':
+			if end := strings.IndexByte(glob[i:], ']'); end > 0 {
+				class := glob[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				sb.WriteString("[" + class + "]")
+				i += end
+			} else {
+				sb.WriteString(`\[`)
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// agentIgnored returns the rule that protects rel, a slash-separated path
+// relative to root, or nil. The last matching rule wins, as in .gitignore.
+func agentIgnored(root, rel string) *ignoreRule {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	if rel == "." {
+		return nil
+	}
+	var match *ignoreRule
+	rules := loadAgentIgnore(root)
+	for i := range rules {
+		if rules[i].re.MatchString(rel) {
+			match = &rules[i]
+		}
+	}
+	if match == nil || match.Negate {
+		return nil
+	}
+	return match
+}
+
+// checkProtectedPath returns a policy error if absPath is listed in the
+// .agentignore of root.
+func checkProtectedPath(root, absPath string) error {
+	// Follow symlinks so a link can't be used to reach a protected file
+	paths := []string{absPath}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil && resolved != absPath {
+		paths = append(paths, resolved)
+	}
+	if realRoot, err := filepath.EvalSymlinks(root); err == nil && len(paths) > 1 {
+		root = realRoot
+	}
+	for _, path := range paths {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if rule := agentIgnored(root, rel); rule != nil {
+			return codedToolError(errPolicyDenied, "protected_path", "", fmt.Errorf("access denied by policy: '%s' is protected by %s (line %d: %s). It must not be read or modified; don't try to reach it another way, and ask the user if you need its contents", filepath.ToSlash(rel), agentIgnoreFile, rule.Line, rule.Pattern))
+		}
+	}
+	return nil
+}
+
+// agentIgnorePathspecs returns git pathspecs that leave out the protected
+// paths of root, for git output shown to the model.
+func agentIgnorePathspecs(root string) []string {
+	var specs []string
+	for _, rule := range loadAgentIgnore(root) {
+		if rule.Negate {
+			continue
+		}
+		pattern := strings.TrimSuffix(rule.Pattern, "/")
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+		} else {
+			pattern = "**/" + pattern
+		}
+		specs = append(specs, ":(exclude,glob)"+pattern, ":(exclude,glob)"+pattern+"/**")
+	}
+	return specs
+}
+
+// --- Tool Implementations ---
+
+type workDirKey struct{}
+
+// withWorkDir returns a context whose tool calls operate in dir instead of the
+// process working directory (used for sub-agents running in git worktrees).
+func withWorkDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, workDirKey{}, dir)
+}
+
+// getWorkDir returns the working directory tools should use for ctx.
+func getWorkDir(ctx context.Context) (string, error) {
+	if dir, ok := ctx.Value(workDirKey{}).(string); ok && dir != "" {
+		return dir, nil
+	}
+	return os.Getwd()
+}
+
+// validatePath ensures the path is within the working directory of ctx
+func validatePath(ctx context.Context, path string) (string, error) {
+	if path == "" {
+		path = "."
+	}
+	path = expandPath(path)
+
+	cwd, err := getWorkDir(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get CWD: %w", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cwd, path)
+	}
+
+	// Resolve virtual "skills/" path to CoreSkillsDir if needed
+	if CoreSkillsDir != "" {
+		relPath, _ := filepath.Rel(cwd, path)
+		magicPrefix := "skills" + string(os.PathSeparator)
+		if strings.HasPrefix(relPath, magicPrefix) {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				ensureCoreSkills()
+				suffix := strings.TrimPrefix(relPath, magicPrefix)
+				candidatePath := filepath.Join(CoreSkillsDir, suffix)
+				if _, err := os.Stat(candidatePath); err == nil {
+					path = candidatePath
+				}
+			}
+		}
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+	ensureCorePath(absPath)
+
+	// Check if path is within CoreSkillsDir (Read-Only/Exec allowed)
+	isCore := false
+	if CoreSkillsDir != "" {
+		relCore, err := filepath.Rel(CoreSkillsDir, absPath)
+		if err == nil && !strings.HasPrefix(relCore, "..") {
+			isCore = true
+		}
+	}
+
+	// Check if path is within CWD using filepath.Rel
+	rel, err := filepath.Rel(cwd, absPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to check path relation: %w", err)
+	}
+
+	if strings.HasPrefix(rel, "..") && !isCore {
+		return "", codedToolError(errPolicyDenied, "outside_workspace", "Use a path inside the working directory.", fmt.Errorf("access denied: path '%s' is outside the current working directory", path))
+	}
+	if !isCore {
+		if err := checkProtectedPath(cwd, absPath); err != nil {
+			return "", err
+		}
+	}
+
+	return absPath, nil
+}
+
+func parseArgs(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var inQuote rune
+	escaped := false
+
+	for _, r := range command {
+		if escaped {
+			current.WriteRune(r)
+			escaped = false
+			continue
+		}
+
+		if r == '\\' {
+			escaped = true
+			continue
+		}
+
+		if inQuote != 0 {
+			if r == inQuote {
+				inQuote = 0
+			} else {
+				current.WriteRune(r)
+			}
+			continue
+		}
+
+		if r == '"' || r == '\'' {
+			inQuote = r
+			continue
+		}
+
+		if unicode.IsSpace(r) {
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+			continue
+		}
+
+		current.WriteRune(r)
+	}
+
+	if inQuote != 0 {
+		return nil, fmt.Errorf("unclosed quote")
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// resolveScript validates that scriptPath is a script inside a skill's scripts
+// folder and returns its absolute path.
+func resolveScript(ctx context.Context, scriptPath string, skillsPrompt string) (string, error) {
+	// Validate path
+	absPath, err := validatePath(ctx, scriptPath)
+	if err != nil {
+		return "", fmt.Errorf("%w\n\nREMINDER: run_script can only execute scripts defined within a 'skills' directory (Local or Core).\n%s", err, skillsPrompt)
+	}
+
+	// Check if file exists
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", fmt.Errorf("script not found: %w\n\nREMINDER: run_script can only execute scripts defined within the 'skills' directory.\n%s", err, skillsPrompt)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("path is a directory, not a file\n\nREMINDER: run_script can only execute scripts defined within the 'skills' directory.\n%s", skillsPrompt)
+	}
+
+	// Check if it is inside a "scripts" folder within "skills"
+	cwd, _ := getWorkDir(ctx)
+	localSkillsDir := filepath.Join(cwd, "skills")
+
+	// Validate it's in either Local or Core skills dir
+	isLocal := strings.HasPrefix(absPath, localSkillsDir)
+	isCore := CoreSkillsDir != "" && strings.HasPrefix(absPath, CoreSkillsDir)
+
+	if !isLocal && !isCore {
+		return "", fmt.Errorf("script must be inside a 'skills' directory (Local or Core).\n%s", skillsPrompt)
+	}
+
+	// Check for 'scripts' in the path components
+	// We use string(os.PathSeparator) to be cross-platform
+	sep := string(os.PathSeparator)
+	if !strings.Contains(absPath, sep+"scripts"+sep) {
+		return "", fmt.Errorf("script must be inside a 'scripts' folder.\n%s", skillsPrompt)
+	}
+	return absPath, nil
+}
+
+func runSafeScript(ctx context.Context, scriptPath string, args []string, skillsPrompt string) (string, error) {
+	absPath, err := resolveScript(ctx, scriptPath, skillsPrompt)
+	if err != nil {
+		return "", err
+	}
+	cwd, _ := getWorkDir(ctx)
+
+	// Determine execution method
+	var cmd *exec.Cmd
+	ext := filepath.Ext(absPath)
+
+	switch ext {
+	case ".py":
+		cmdArgs := append([]string{absPath}, args...)
+		cmd = exec.CommandContext(ctx, "python3", cmdArgs...)
+	case ".sh":
+		cmdArgs := append([]string{absPath}, args...)
+		cmd = exec.CommandContext(ctx, "bash", cmdArgs...)
+	case ".js":
+		cmdArgs := append([]string{absPath}, args...)
+		cmd = exec.CommandContext(ctx, "node", cmdArgs...)
+	default:
+		// Try to execute directly
+		cmd = exec.CommandContext(ctx, absPath, args...)
+	}
+	cmd.Dir = cwd
+	cmd.Env = append(os.Environ(), projectProfile(cwd).Env()...)
+
+	out, err := cmd.CombinedOutput()
+	noteExitCode(ctx, cmd.ProcessState)
+	output := boundOutput(out)
+	if err != nil {
+		return output, fmt.Errorf("script execution failed: %w\nOutput:\n%s", err, output)
+	}
+	return output, nil
+}
+
+// boundOutput returns command output for the model. Output too large for the
+// context is saved to a file and replaced with a pointer to it.
+func boundOutput(out []byte) string {
+	output := string(out)
+
+	// Output size check to prevent context overflow
+	const MaxOutputChars = 50000 // ~12.5k tokens
+	if len(output) > MaxOutputChars {
+		home, homeErr := os.UserHomeDir()
+		if homeErr == nil {
+			outputDir := filepath.Join(home, ".simple_agent", "outputs")
+			_ = os.MkdirAll(outputDir, 0755)
+
+			filename := fmt.Sprintf("output_%d.txt", time.Now().UnixNano())
+			filePath := filepath.Join(outputDir, filename)
+
+			if writeErr := os.WriteFile(filePath, out, 0644); writeErr == nil {
+				output = fmt.Sprintf("Output too large (%d chars). Saved to %s\nRead this file to see the results.", len(output), filePath)
+			}
+		}
+	}
+	return output
+}
+
+// lineEndings forces the line endings of edited files: "lf" or "crlf". By
+// default ("auto") each file keeps its own.
+var lineEndings string
+
+// applyHunks applies hunks to content and returns the result in the
+// content's format: its line endings, byte order mark and final newline.
+func applyHunks(content string, hunks []diffengine.Hunk) (string, error) {
+	format := diffengine.DetectFormat(content)
+	switch lineEndings {
+	case "lf":
+		format.EOL = "\n"
+	case "crlf":
+		format.EOL = "\r\n"
+	}
+	newContent, err := diffengine.Apply(content, hunks)
+	if err != nil {
+		return "", err
+	}
+	return format.Restore(newContent), nil
+}
+
+// applyUDiff applies a unified diff to a file
+func applyUDiff(ctx context.Context, path string, diff string, dryRun bool) (string, error) {
+	absPath, err := validatePath(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	// Protect CoreSkillsDir from modification
+	if CoreSkillsDir != "" && strings.HasPrefix(absPath, CoreSkillsDir) {
+		return "", codedToolError(errPolicyDenied, "core_skill_readonly", "Create or edit a project skill under ./skills instead.", fmt.Errorf("access denied: cannot modify core skills in '%s'", CoreSkillsDir))
+	}
+
+	// Read original file
+	var content string
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read file: %w", err)
+		}
+		content = "" // New file
+	} else {
+		content = string(data)
+	}
+
+	hunks := diffengine.Parse(diff)
+	if len(hunks) == 0 {
+		return "", codedToolError(errParse, "no_hunks", "", diffengine.ErrNoHunks)
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	newContent, err := applyHunks(content, hunks)
+	if err != nil {
+		return "", codedToolError(errValidation, "patch_failed", "Re-read the file and copy the context lines exactly, then resend the diff.", err)
+	}
+
+	if dryRun {
+		return newContent, nil
+	}
+
+	// Ensure directory exists
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// An interrupt before this point leaves the file untouched; past it the
+	// edit is completed, since the replace itself is atomic.
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err := journaledWrite(absPath, data, []byte(newContent)); err != nil {
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return "Success", nil
+}
+
+// applyFileOp renames or deletes path as the headers of diff say, once the
+// user confirms. Hunks in a rename diff are applied to the moved file; a
+// deletion ignores them.
+func applyFileOp(ctx context.Context, env *ToolEnv, path, diff string, op diffengine.FileOp) (string, error) {
+	if op.RenameFrom != "" && op.RenameTo != "" && path == op.RenameTo {
+		path = op.RenameFrom // The path may name either side of the rename
+	}
+	absPath, err := validatePath(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if CoreSkillsDir != "" && strings.HasPrefix(absPath, CoreSkillsDir) {
+		return "", codedToolError(errPolicyDenied, "core_skill_readonly", "Create or edit a project skill under ./skills instead.", fmt.Errorf("access denied: cannot modify core skills in '%s'", CoreSkillsDir))
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", toolError(errNotFound, fmt.Errorf("cannot %s '%s': %v", fileOpVerb(op), path, err))
+	}
+	if info.IsDir() {
+		return "", toolError(errValidation, fmt.Errorf("'%s' is a directory; only files can be renamed or deleted", path))
+	}
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var destPath, content string
+	if !op.Deleted {
+		if destPath, err = validatePath(ctx, op.RenameTo); err != nil {
+			return "", err
+		}
+		if CoreSkillsDir != "" && strings.HasPrefix(destPath, CoreSkillsDir) {
+			return "", codedToolError(errPolicyDenied, "core_skill_readonly", "Create or edit a project skill under ./skills instead.", fmt.Errorf("access denied: cannot modify core skills in '%s'", CoreSkillsDir))
+		}
+		if _, err := os.Lstat(destPath); err == nil {
+			return "", toolError(errValidation, fmt.Errorf("cannot rename '%s': '%s' already exists", path, op.RenameTo))
+		}
+		content = string(data)
+		if hunks := diffengine.Parse(diff); len(hunks) > 0 {
+			if content, err = applyHunks(content, hunks); err != nil {
+				return "", codedToolError(errValidation, "patch_failed", "Re-read the file and copy the context lines exactly, then resend the diff.", err)
+			}
+		}
+	}
+
+	if op.Deleted {
+		fmt.Printf("Proposed deletion of %s\n", path)
+	} else {
+		fmt.Printf("Proposed rename of %s to %s\n", path, op.RenameTo)
+		if content != string(data) {
+			printColoredDiff(diff[strings.Index(diff, "@@"):])
+		}
+	}
+	if env.AutoApprove {
+		noteApproval(ctx, "auto")
+	} else {
+		prompt := fmt.Sprintf("Delete %s? [y/N]: ", path)
+		if !op.Deleted {
+			prompt = fmt.Sprintf("Rename %s to %s? [y/N]: ", path, op.RenameTo)
+		}
+		answer := strings.ToLower(askUser(ctx, prompt))
+		noteApproval(ctx, approvalDecision(answer == "y"))
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("interrupted by user")
+		}
+		if answer != "y" {
+			fmt.Println("Changes rejected.")
+			return "User rejected the changes.", nil
+		}
+	}
+
+	preHookOut, hookErr := runSkillHooks(ctx, env.Skills, "pre_edit", map[string]string{"path": path})
+	if hookErr != nil {
+		return "", codedToolError(errExecutionFailed, "hook_blocked", "Read the hook output: change the edit so the hook passes, or leave the file alone if the hook forbids the change.", fmt.Errorf("edit not applied: %v\n\n[Pre-Edit Hook Output]\n%s", hookErr, preHookOut))
+	}
+	var result string
+	if op.Deleted {
+		if err := journaledRemove(absPath, data); err != nil {
+			return "", fmt.Errorf("failed to delete file: %w", err)
+		}
+		agentChanges.Record(ctx, path)
+		seenFiles.Drop(absPath)
+		fmt.Printf("Deleted %s\n", path)
+		result = fmt.Sprintf("Deleted %s.", path)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return "", fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := journaledWrite(destPath, nil, []byte(content)); err != nil {
+			return "", fmt.Errorf("failed to write file: %w", err)
+		}
+		copyFileMode(destPath, info)
+		if err := journaledRemove(absPath, data); err != nil {
+			return "", fmt.Errorf("wrote '%s' but failed to remove '%s': %w", op.RenameTo, path, err)
+		}
+		agentChanges.Record(ctx, path)
+		agentChanges.Record(ctx, op.RenameTo)
+		seenFiles.Drop(absPath)
+		seenFiles.Touch(destPath)
+		fmt.Printf("Renamed %s to %s\n", path, op.RenameTo)
+		result = fmt.Sprintf("Renamed %s to %s.", path, op.RenameTo)
+		if content != string(data) {
+			result += " The diff was applied to the moved file."
+		}
+	}
+	emitEvent(EventDiffApplied, map[string]any{"path": path, "agent": env.AgentLabel, "diff": diff})
+	if preHookOut != "" {
+		result = "[Pre-Edit Hook Output]\n" + preHookOut + "\n\n" + result
+	}
+	if !op.Deleted {
+		hookOut, hookErr := runSkillHooks(ctx, env.Skills, "post_edit", map[string]string{"path": op.RenameTo})
+		if hookErr != nil {
+			return result, fmt.Errorf("file renamed, but %v\n\n[Hook Output]\n%s", hookErr, hookOut)
+		} else if hookOut != "" {
+			result += "\n\n[Hook Output]\n" + hookOut
+		}
+	}
+	return result, nil
+}
+
+func fileOpVerb(op diffengine.FileOp) string {
+	if op.Deleted {
+		return "delete"
+	}
+	return "rename"
+}
+
+// PatchStore remembers the last failed patch per file so the model can retry
+// by resending only the hunks that need fixing.
+type PatchStore struct {
+	mu      sync.Mutex
+	patches map[string][]string // Absolute path -> raw hunks
+}
+
+func newPatchStore() *PatchStore {
+	return &PatchStore{patches: make(map[string][]string)}
+}
+
+// Amend rebuilds the full diff from the saved patch with the given hunks
+// replaced. With no replacements, diff is returned unchanged.
+func (s *PatchStore) Amend(key string, replace []int, diff string) (string, error) {
+	if len(replace) == 0 {
+		return diff, nil
+	}
+	if s == nil {
+		return "", toolError(errValidation, fmt.Errorf("replace_hunks is not available here; resend the full diff"))
+	}
+	s.mu.Lock()
+	saved := append([]string(nil), s.patches[key]...)
+	s.mu.Unlock()
+	if len(saved) == 0 {
+		return "", toolError(errValidation, fmt.Errorf("no failed patch is saved for this path; resend the full diff without replace_hunks"))
+	}
+
+	replacements := diffengine.Split(diff)
+	if len(replacements) != len(replace) {
+		return "", toolError(errValidation, fmt.Errorf("replace_hunks lists %d hunks but the diff contains %d", len(replace), len(replacements)))
+	}
+	for i, n := range replace {
+		if n < 1 || n > len(saved) {
+			return "", toolError(errValidation, fmt.Errorf("hunk %d does not exist; the saved patch has %d hunks", n, len(saved)))
+		}
+		saved[n-1] = replacements[i]
+	}
+	return strings.Join(saved, "\n") + "\n", nil
+}
+
+// SaveFailed stores a patch that failed to apply and extends the error with
+// instructions for amending it.
+func (s *PatchStore) SaveFailed(key, diff string, applyErr error) error {
+	hunks := diffengine.Split(diff)
+	if s == nil || len(hunks) < 2 {
+		return applyErr
+	}
+	s.mu.Lock()
+	s.patches[key] = hunks
+	s.mu.Unlock()
+	return fmt.Errorf("%w\n\nThis patch (%d hunks) was saved. To retry, resend only the hunks that need fixing: call apply_udiff with the same path, 'replace_hunks' set to their numbers, and a diff containing just the corrected hunks in the same order. All other hunks are reused.", applyErr, len(hunks))
+}
+
+func (s *PatchStore) Clear(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.patches, key)
+	s.mu.Unlock()
+}
+
+func printThought(extraContent json.RawMessage) {
+	if len(extraContent) == 0 {
+		return
+	}
+	var content struct {
+		Google struct {
+			Thought string `json:"thought"`
+		} `json:"google"`
+	}
+	if err := json.Unmarshal(extraContent, &content); err == nil && content.Google.Thought != "" {
+		fmt.Printf("\n\033[90m─── [Thought] ───\033[0m\n")
+		printMarkdown(content.Google.Thought)
+		fmt.Printf("\033[90m───────────────────\033[0m\n")
+	}
+}
+
+func extractAndPrintThoughts(content string) string {
+	re := regexp.MustCompile(`(?s)<thought>(.*?)</thought>`)
+	matches := re.FindAllStringSubmatch(content, -1)
+	for _, match := range matches {
+		if len(match) > 1 {
+			fmt.Printf("\n\033[90m─── [Thought] ───\033[0m\n")
+			printMarkdown(strings.TrimSpace(match[1]))
+			fmt.Printf("\033[90m───────────────────\033[0m\n")
+		}
+	}
+	return re.ReplaceAllString(content, "")
+}
+
+func printMarkdown(content string) {
+	lines := strings.Split(content, "\n")
+	inCodeBlock := false
+
+	// ANSI codes
+	reset := "\033[0m"
+	bold := "\033[1m"
+	cyan := "\033[36m"
+	blue := "\033[34m"
+
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCodeBlock = !inCodeBlock
+			fmt.Println(cyan + line + reset)
+			continue
+		}
+
+		if inCodeBlock {
+			fmt.Println(cyan + line + reset)
+			continue
+		}
+
+		// Headers
+		if strings.HasPrefix(line, "#") {
+			fmt.Println(bold + blue + line + reset)
+			continue
+		}
+
+		line = linkCitations(line)
+
+		// Inline formatting (simple)
+		// Bold **text**
+		line = regexp.MustCompile(`\*\*(.*?)\*\*`).ReplaceAllString(line, bold+"$1"+reset)
+		// Code `text`
+		line = regexp.MustCompile("`([^`]+)`").ReplaceAllString(line, cyan+"$1"+reset)
+
+		fmt.Println(line)
+	}
+}
+
+func printColoredDiff(diff string) {
+	lines := strings.Split(diff, "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++") {
+			fmt.Printf("\033[32m%s\033[0m\n", line)
+		} else if strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "---") {
+			fmt.Printf("\033[31m%s\033[0m\n", line)
+		} else {
+			fmt.Println(line)
+		}
+	}
+}
+
+func summarizeContext(apiKey string, history []Message, task, future, vital string) (string, error) {
+	var historyBuf bytes.Buffer
+	for i, msg := range history {
+		if i == 0 {
+			continue
+		} // Skip system prompt
+		historyBuf.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, msg.Content))
+		if msg.Content == "" && len(msg.ToolCalls) > 0 {
+			historyBuf.WriteString(fmt.Sprintf("%s: [Tool Call: %s]\n", msg.Role, msg.ToolCalls[0].Function.Name))
+		}
+	}
+
+	instructions := fmt.Sprintf(`1. **Current Task**: %s
+2. **Future Plans**: %s
+3. **Vital Information**: %s
+
+Ensure the summary is concise but retains all information necessary to continue working on the task and future plans.
+Preserve code snippets or specific data mentioned in "Vital Information".`, task, future, vital)
+
+	prompt := fmt.Sprintf(`Please summarize the provided conversation history, adhering to the following constraints:
+
+%s
+
+Conversation History:
+%s
+
+---
+friendly reminder: Please summarize the conversation history above based on the following constraints:
+%s
+`, instructions, historyBuf.String(), instructions)
+
+	reqBody := ChatCompletionRequest{
+		Model: ModelName,
+		Messages: []Message{
+			{Role: "user", Content: prompt},
+		},
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", GeminiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{}
+
+	spinnerStop := make(chan struct{})
+	spinnerDone := make(chan struct{})
+	go startSpinner(spinnerStop, spinnerDone)
+
+	started := time.Now()
+	resp, err := client.Do(req)
+
+	close(spinnerStop)
+	<-spinnerDone
+
+	if err != nil {
+		logLLMExchange(req, apiKey, jsonData, nil, nil, err, started)
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	logLLMExchange(req, apiKey, jsonData, resp, body, err, started)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API Error (Status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var chatResp ChatCompletionResponse
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		return "", fmt.Errorf("error parsing response: %v", err)
+	}
+
+	if len(chatResp.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from API")
+	}
+
+	return chatResp.Choices[0].Message.Content, nil
+}
+
+// --- Batch Edits ---
+
+// edit_many applies one regex find/replace to every matching file below a
+// directory, for renames that would otherwise take an apply_udiff call per
+// file. The user reviews the combined diff once; the files are then written
+// together, and if one write fails the files already written are restored.
+
+const maxBatchEditFiles = 200
+
+var editManyTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "edit_many",
+		Description: "Find and replace a regular expression (Go RE2 syntax) in every file below a directory that matches a glob, e.g. to rename an API across many files. Shows the user one combined diff and applies all files together. Use 'dry_run' to preview the diff first. Use 'apply_udiff' for anything that isn't a mechanical replacement.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"pattern": {
+					"type": "string",
+					"description": "The regular expression to find, e.g. '\\bOldName\\('. Use (?m) for ^/$ per line."
+				},
+				"replacement": {
+					"type": "string",
+					"description": "The replacement; $1 or ${name} insert capture groups unless 'literal' is set"
+				},
+				"glob": {
+					"type": "string",
+					"description": "Files to edit, matched against the path below 'path' or the file name, e.g. '*.go' or 'pkg/*/*.ts'. Default: all files"
+				},
+				"path": {
+					"type": "string",
+					"description": "The directory to search (default: the working directory)"
+				},
+				"literal": {
+					"type": "boolean",
+					"description": "Treat pattern and replacement as plain text"
+				},
+				"dry_run": {
+					"type": "boolean",
+					"description": "Return the combined diff without changing any file"
+				}
+			},
+			"required": ["pattern", "replacement"]
+		}`),
+	},
+}
+
+// batchEdit is the planned change to one file.
+type batchEdit struct {
+	Path    string // Relative to the working directory
+	AbsPath string
+	Before  []byte
+	After   []byte
+	Count   int // Replacements made
+}
+
+// listBatchFiles returns the regular files below dir relative to it: those
+// git doesn't ignore inside a repository, else all files outside hidden and
+// vendored directories.
+func listBatchFiles(dir string) []string {
+	cmd := exec.Command("git", "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	cmd.Dir = dir
+	if out, err := cmd.Output(); err == nil {
+		return strings.Split(strings.TrimRight(string(out), "\x00"), "\x00")
+	}
+	var files []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != dir && (strings.HasPrefix(name, ".") || name == "node_modules" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files
+}
+
+// planBatchEdit returns the changes replacing re makes to the files below dir
+// that match glob. Binary files, files over max_edit_bytes, symlinks,
+// protected paths and the agent's own state are skipped.
+func planBatchEdit(ctx context.Context, dir, glob string, re *regexp.Regexp, replacement string, literal bool) ([]batchEdit, error) {
+	root, err := getWorkDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var edits []batchEdit
+	for _, name := range listBatchFiles(dir) {
+		if name == "" || (glob != "" && !hookFilterMatches([]string{glob}, filepath.ToSlash(name))) {
+			continue
+		}
+		absPath := filepath.Join(dir, name)
+		rel, err := filepath.Rel(root, absPath)
+		if err != nil || isAgentStatePath(filepath.ToSlash(rel)) || checkProtectedPath(root, absPath) != nil {
+			continue
+		}
+		if info, err := os.Lstat(absPath); err != nil || !info.Mode().IsRegular() || (maxEditBytes > 0 && info.Size() > int64(maxEditBytes)) {
+			continue
+		}
+		data, err := os.ReadFile(absPath)
+		if err != nil || looksBinary(data) {
+			continue
+		}
+		matches := re.FindAllIndex(data, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var after []byte
+		if literal {
+			after = re.ReplaceAllLiteral(data, []byte(replacement))
+		} else {
+			after = re.ReplaceAll(data, []byte(replacement))
+		}
+		if bytes.Equal(data, after) {
+			continue
+		}
+		if len(edits) == maxBatchEditFiles {
+			return nil, toolError(errValidation, fmt.Errorf("the pattern changes more than %d files; narrow it down with 'glob' or 'path'", maxBatchEditFiles))
+		}
+		edits = append(edits, batchEdit{Path: filepath.ToSlash(rel), AbsPath: absPath, Before: data, After: after, Count: len(matches)})
+	}
+	return edits, nil
+}
+
+// batchDiff renders the edits as one unified diff.
+func batchDiff(edits []batchEdit) string {
+	var sb strings.Builder
+	for _, e := range edits {
+		fmt.Fprintf(&sb, "--- a/%s\n+++ b/%s\n", e.Path, e.Path)
+		if diff := unifiedDiff(e.Before, e.After, 2); diff != "" {
+			sb.WriteString(diff)
+		} else {
+			fmt.Fprintf(&sb, "(%d replacements)\n", e.Count)
+		}
+	}
+	return sb.String()
+}
+
+// applyBatchEdit writes every edit, or none: a file that changed since the
+// diff was made aborts the batch, and a failed write restores the files
+// already written.
+func applyBatchEdit(edits []batchEdit) error {
+	for _, e := range edits {
+		if current, err := os.ReadFile(e.AbsPath); err != nil || !bytes.Equal(current, e.Before) {
+			return toolError(errValidation, fmt.Errorf("%s changed while the edit was reviewed; no file was modified", e.Path))
+		}
+	}
+	for i, e := range edits {
+		if err := journaledWrite(e.AbsPath, e.Before, e.After); err != nil {
+			for _, done := range edits[:i] {
+				if rerr := journaledWrite(done.AbsPath, done.After, done.Before); rerr != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Failed to restore %s: %v\n", done.Path, rerr)
+				}
+			}
+			return fmt.Errorf("failed to write %s: %v; the other files were restored", e.Path, err)
+		}
+	}
+	return nil
+}
+
+// runEditMany implements the edit_many tool.
+func runEditMany(ctx context.Context, env *ToolEnv, arguments string) (string, error) {
+	var args struct {
+		Pattern     string `json:"pattern"`
+		Replacement string `json:"replacement"`
+		Glob        string `json:"glob"`
+		Path        string `json:"path"`
+		Literal     bool   `json:"literal"`
+		DryRun      bool   `json:"dry_run"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", invalidArguments(err)
+	}
+	if args.Pattern == "" {
+		return "", toolError(errValidation, fmt.Errorf("pattern must not be empty"))
+	}
+	pattern := args.Pattern
+	if args.Literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", toolError(errParse, fmt.Errorf("invalid pattern: %v", err))
+	}
+	if args.Glob != "" {
+		if _, err := filepath.Match(args.Glob, ""); err != nil {
+			return "", toolError(errParse, fmt.Errorf("invalid glob '%s': %v", args.Glob, err))
+		}
+	}
+	dir, err := validatePath(ctx, args.Path)
+	if err != nil {
+		return "", err
+	}
+	if CoreSkillsDir != "" && strings.HasPrefix(dir, CoreSkillsDir) {
+		return "", codedToolError(errPolicyDenied, "core_skill_readonly", "Create or edit a project skill under ./skills instead.", fmt.Errorf("access denied: cannot modify core skills in '%s'", CoreSkillsDir))
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", toolError(errValidation, fmt.Errorf("path '%s' is not a directory", args.Path))
+	}
+
+	root, _ := getWorkDir(ctx)
+	where := displayPath(root, dir)
+	if args.Glob != "" {
+		where += " (" + args.Glob + ")"
+	}
+	fmt.Printf("Replace /%s/ with %q in %s\n", args.Pattern, args.Replacement, where)
+	edits, err := planBatchEdit(ctx, dir, args.Glob, re, args.Replacement, args.Literal)
+	if err != nil {
+		return "", err
+	}
+	if len(edits) == 0 {
+		fmt.Println("No matches.")
+		return "No file matches the pattern; nothing was changed.", nil
+	}
+	total := 0
+	var summary []string
+	for _, e := range edits {
+		total += e.Count
+		summary = append(summary, fmt.Sprintf("%s: %d", e.Path, e.Count))
+	}
+	diff := batchDiff(edits)
+	shownDiff := diff
+	if len(shownDiff) > maxEditNoteChars {
+		shownDiff = shownDiff[:maxEditNoteChars] + "\n... (truncated)"
+	}
+	counts := fmt.Sprintf("%d replacements in %d files:\n%s", total, len(edits), strings.Join(summary, "\n"))
+	if args.DryRun {
+		fmt.Printf("Dry run: %d replacements in %d files\n", total, len(edits))
+		return "Dry run, no file was changed. " + counts + "\n\n" + shownDiff, nil
+	}
+
+	printColoredDiff(diff)
+	if env.AutoApprove {
+		fmt.Println("Auto-approving changes...")
+		noteApproval(ctx, "auto")
+	} else {
+		answer := strings.ToLower(askUser(ctx, fmt.Sprintf("Apply %d replacements to %d files? [y/N]: ", total, len(edits))))
+		noteApproval(ctx, approvalDecision(answer == "y"))
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("interrupted by user")
+		}
+		if answer != "y" {
+			fmt.Println("Changes rejected.")
+			result := "User rejected the changes."
+			if reason := askUser(ctx, "Why? (optional, sent to the model): "); reason != "" {
+				result += " Reason: " + reason
+			}
+			return result, nil
+		}
+	}
+
+	var preHookOut []string
+	for _, e := range edits {
+		out, err := runSkillHooks(ctx, env.Skills, "pre_edit", map[string]string{"path": e.Path})
+		if err != nil {
+			return "", codedToolError(errExecutionFailed, "hook_blocked", "Read the hook output: change the edit so the hook passes, or leave the files alone if the hook forbids the change.", fmt.Errorf("no file was changed: %v\n\n[Pre-Edit Hook Output]\n%s", err, out))
+		}
+		if out != "" {
+			preHookOut = append(preHookOut, out)
+		}
+	}
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("interrupted by user")
+	}
+	if err := applyBatchEdit(edits); err != nil {
+		return "", err
+	}
+	for _, e := range edits {
+		agentChanges.Record(ctx, e.Path)
+		seenFiles.Touch(e.AbsPath)
+		emitEvent(EventDiffApplied, map[string]any{"path": e.Path, "agent": env.AgentLabel, "diff": unifiedDiff(e.Before, e.After, 2)})
+	}
+	fmt.Printf("Applied %d replacements to %d files\n", total, len(edits))
+
+	result := "Applied " + counts
+	if len(preHookOut) > 0 {
+		result = "[Pre-Edit Hook Output]\n" + strings.Join(preHookOut, "\n") + "\n\n" + result
+	}
+	var hookErrs []string
+	for _, e := range edits {
+		out, err := runSkillHooks(ctx, env.Skills, "post_edit", map[string]string{"path": e.Path})
+		if err != nil {
+			hookErrs = append(hookErrs, err.Error())
+		}
+		if out != "" {
+			result += "\n\n[Hook Output]\n" + out
+		}
+	}
+	if len(hookErrs) > 0 {
+		return result, fmt.Errorf("files changed, but %s\n\n%s", strings.Join(hookErrs, "; "), result)
+	}
+	return result, nil
+}
+
+// --- Citation Links ---
+
+// The model is asked to cite code as path:line, and printMarkdown turns
+// citations of files that exist into OSC 8 hyperlinks, so they open in the
+// editor with a click. "links" in the config picks the URL scheme: vscode,
+// cursor, idea, file, a template with {path} and {line}, or off. The default
+// is vscode inside VS Code's terminal and file elsewhere.
+
+var linkScheme string
+
+var linkTemplates = map[string]string{
+	"vscode": "vscode://file{path}:{line}",
+	"cursor": "cursor://file{path}:{line}",
+	"idea":   "idea://open?file={path}&line={line}",
+	"file":   "file://{path}",
+}
+
+// citationRe matches path:line and path:start-end with a file extension.
+var citationRe = regexp.MustCompile("(^|[\\s(\\[`'\"])((?:[\\w.~-]*/)*[\\w.-]+\\.[A-Za-z0-9]+):(\\d+)(?:-\\d+)?")
+
+const citationPrompt = "- **Citations**: When you refer to specific code, cite it as `path/to/file.go:42` (or `path/to/file.go:42-57` for a range), relative to the working directory, so the user can jump to it.\n"
+
+func validLinkScheme(scheme string) bool {
+	_, ok := linkTemplates[scheme]
+	return ok || scheme == "" || scheme == "off" || strings.Contains(scheme, "{path}")
+}
+
+// linkTemplate returns the URL template in effect, or "" for none.
+func linkTemplate() string {
+	switch scheme := linkScheme; {
+	case scheme == "off":
+		return ""
+	case scheme == "":
+		if os.Getenv("TERM_PROGRAM") == "vscode" {
+			return linkTemplates["vscode"]
+		}
+		return linkTemplates["file"]
+	case linkTemplates[scheme] != "":
+		return linkTemplates[scheme]
+	default:
+		return scheme
+	}
+}
+
+// linkCitations wraps citations of existing files in OSC 8 hyperlinks.
+func linkCitations(line string) string {
+	tmpl := linkTemplate()
+	if tmpl == "" || !strings.Contains(line, ":") {
+		return line
+	}
+	return citationRe.ReplaceAllStringFunc(line, func(match string) string {
+		m := citationRe.FindStringSubmatch(match)
+		prefix, path, lineNo := m[1], m[2], m[3]
+		abs, err := filepath.Abs(expandPath(path))
+		if err != nil {
+			return match
+		}
+		if info, err := os.Stat(abs); err != nil || info.IsDir() {
+			return match
+		}
+		urlPath := filepath.ToSlash(abs)
+		if !strings.HasPrefix(urlPath, "/") {
+			urlPath = "/" + urlPath // Windows drive letters
+		}
+		url := strings.NewReplacer("{path}", urlPath, "{line}", lineNo).Replace(tmpl)
+		return prefix + "\033]8;;" + url + "\033\\" + match[len(prefix):] + "\033]8;;\033\\"
+	})
+}
+
+// --- Git Integration ---
+
+func isGitDirty() bool {
+	cmd := exec.Command("git", "status", "--porcelain")
+	out, err := cmd.Output()
+	if err != nil {
+		// If git fails (e.g. not a repo), assume not dirty
+		return false
+	}
+	return len(bytes.TrimSpace(out)) > 0
+}
+
+func generateCommitMessage(apiKey string, history []Message, paths []string) (string, error) {
+	// Convert history to a transcript string to avoid tool call complexity with Flash
+	var historyBuf bytes.Buffer
+	for _, msg := range history {
+		historyBuf.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, msg.Content))
+		if len(msg.ToolCalls) > 0 {
+			for _, tc := range msg.ToolCalls {
+				historyBuf.WriteString(fmt.Sprintf("Tool Call: %s (%s)\n", tc.Function.Name, tc.Function.Arguments))
+			}
+		}
+	}
+
+	if historyBuf.Len() == 0 {
+		return "", fmt.Errorf("no conversation history available to generate commit message")
+	}
+
+	if commitConvention.template() == "" {
+		systemPrompt := "You are an expert developer. Generate a tight git commit message (less than 15 words) describing the changes made in the provided conversation history. Output ONLY the commit message. Do not use markdown or quotes."
+		return completeCommitPrompt(apiKey, systemPrompt, historyBuf.String())
+	}
+
+	if len(paths) == 0 {
+		if out, err := runGit(nil, "diff", "--name-only", "HEAD"); err == nil && out != "" {
+			paths = strings.Split(out, "\n")
+		}
+	}
+	systemPrompt := commitConvention.Prompt(paths)
+	input := historyBuf.String()
+	for attempt := 0; attempt < 2; attempt++ {
+		content, err := completeCommitPrompt(apiKey, systemPrompt, input)
+		if err != nil {
+			return "", err
+		}
+		message, err := commitConvention.Render(content, paths)
+		if err == nil {
+			err = commitConvention.Validate(message)
+		}
+		if err == nil {
+			return message, nil
+		}
+		if attempt == 1 {
+			return "", err
+		}
+		input += fmt.Sprintf("\n\nYour previous answer was rejected: %v\nPrevious answer: %s", err, content)
+	}
+	return "", fmt.Errorf("unreachable")
+}
+
+// completeCommitPrompt sends a one-shot request to the flash model.
+func completeCommitPrompt(apiKey, systemPrompt, input string) (string, error) {
+	reqBody := ChatCompletionRequest{
+		Model: FlashModelName,
+		Messages: []Message{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: input},
+		},
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", GeminiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{}
+
+	spinnerStop := make(chan struct{})
+	spinnerDone := make(chan struct{})
+	go startSpinner(spinnerStop, spinnerDone)
+
+	started := time.Now()
+	resp, err := client.Do(req)
+
+	close(spinnerStop)
+	<-spinnerDone
+
+	if err != nil {
+		logLLMExchange(req, apiKey, jsonData, nil, nil, err, started)
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	logLLMExchange(req, apiKey, jsonData, resp, body, err, started)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API Error (Status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var chatResp ChatCompletionResponse
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		return "", fmt.Errorf("error parsing response: %v", err)
+	}
+
+	if len(chatResp.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from API")
+	}
+
+	return strings.TrimSpace(chatResp.Choices[0].Message.Content), nil
+}
+
+// CommitConvention is the commit message format from the "commit" config.
+// Messages are rendered from a template whose placeholders are {type},
+// {scope}, {ticket} and {summary}. The model only writes the type, scope and
+// summary; the ticket comes from the branch name and the scope defaults to
+// one inferred from the changed paths.
+type CommitConvention struct {
+	Style         string            `json:"style,omitempty"`          // conventional or ticket; ignored when template is set
+	Template      string            `json:"template,omitempty"`       // e.g. "{ticket} {type}: {summary}"
+	Types         []string          `json:"types,omitempty"`          // Allowed {type} values
+	Scopes        map[string]string `json:"scopes,omitempty"`         // Path prefix -> scope
+	TicketPattern string            `json:"ticket_pattern,omitempty"` // Regexp finding the ticket in the branch name
+	MaxLength     int               `json:"max_length,omitempty"`     // Subject line limit (default 72)
+	PolicyCommand string            `json:"policy_command,omitempty"` // Script that may rewrite, split or veto commits
+	Metadata      string            `json:"metadata,omitempty"`       // notes or trailers: record the session behind each agent commit
+}
+
+var commitConvention CommitConvention
+
+var defaultCommitTypes = []string{"feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert"}
+
+const defaultTicketPattern = `[A-Z][A-Z0-9]+-\d+`
+
+var commitStyleTemplates = map[string]string{
+	"conventional": "{type}({scope}): {summary}",
+	"ticket":       "{ticket}: {summary}",
+}
+
+func (c CommitConvention) template() string {
+	if c.Template != "" {
+		return c.Template
+	}
+	return commitStyleTemplates[c.Style]
+}
+
+func (c CommitConvention) types() []string {
+	if len(c.Types) > 0 {
+		return c.Types
+	}
+	return defaultCommitTypes
+}
+
+func (c CommitConvention) ticketRe() *regexp.Regexp {
+	pattern := c.TicketPattern
+	if pattern == "" {
+		pattern = defaultTicketPattern
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// check validates the configuration at startup.
+func (c CommitConvention) check() error {
+	if c.Template == "" && c.Style != "" && commitStyleTemplates[c.Style] == "" {
+		return fmt.Errorf("unknown style '%s' (use conventional or ticket, or set a template)", c.Style)
+	}
+	if c.TicketPattern != "" {
+		if _, err := regexp.Compile(c.TicketPattern); err != nil {
+			return fmt.Errorf("invalid ticket_pattern: %v", err)
+		}
+	}
+	if tmpl := c.template(); tmpl != "" && !strings.Contains(tmpl, "{summary}") {
+		return fmt.Errorf("template must contain {summary}")
+	}
+	if c.Metadata != "" && c.Metadata != "notes" && c.Metadata != "trailers" {
+		return fmt.Errorf("unknown metadata '%s' (use notes or trailers)", c.Metadata)
+	}
+	return nil
+}
+
+// ticket extracts the ticket from the current branch name.
+func (c CommitConvention) ticket() string {
+	branch, err := runGit(nil, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return c.ticketRe().FindString(branch)
+}
+
+// inferScope picks the configured scope whose path prefix covers all changed
+// paths, or else their shared top-level directory.
+func (c CommitConvention) inferScope(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	scopeOf := func(path string) string {
+		best, scope := -1, ""
+		for prefix, s := range c.Scopes {
+			if strings.HasPrefix(path, prefix) && len(prefix) > best {
+				best, scope = len(prefix), s
+			}
+		}
+		if best == -1 {
+			if dir, _, ok := strings.Cut(path, "/"); ok {
+				return dir
+			}
+		}
+		return scope
+	}
+	scope := scopeOf(paths[0])
+	for _, path := range paths[1:] {
+		if scopeOf(path) != scope {
+			return ""
+		}
+	}
+	return scope
+}
+
+// Prompt returns the system prompt asking the model for the template fields.
+func (c CommitConvention) Prompt(paths []string) string {
+	tmpl := c.template()
+	var sb strings.Builder
+	sb.WriteString("You are an expert developer. Describe the changes made in the provided conversation history for a git commit.\n")
+	sb.WriteString(`Return ONLY a JSON object: {"type": "...", "scope": "...", "summary": "..."}` + "\n")
+	if strings.Contains(tmpl, "{type}") {
+		sb.WriteString(fmt.Sprintf("- type: one of %s.\n", strings.Join(c.types(), ", ")))
+	}
+	if strings.Contains(tmpl, "{scope}") {
+		if scope := c.inferScope(paths); scope != "" {
+			sb.WriteString(fmt.Sprintf("- scope: the area of the code that changed; the changed paths suggest '%s'. Empty if the change spans unrelated areas.\n", scope))
+		} else {
+			sb.WriteString("- scope: the area of the code that changed, one lowercase word; empty if the change spans unrelated areas.\n")
+		}
+	}
+	sb.WriteString(fmt.Sprintf("- summary: imperative mood, lowercase first word, no trailing period, under %d characters.\n", c.maxLength()-20))
+	if len(paths) > 0 {
+		sb.WriteString("Changed paths: " + strings.Join(paths, ", ") + "\n")
+	}
+	return sb.String()
+}
+
+func (c CommitConvention) maxLength() int {
+	if c.MaxLength > 0 {
+		return c.MaxLength
+	}
+	return 72
+}
+
+// Render fills the template from the model's JSON answer.
+func (c CommitConvention) Render(answer string, paths []string) (string, error) {
+	if start, end := strings.Index(answer, "{"), strings.LastIndex(answer, "}"); start != -1 && end > start {
+		answer = answer[start : end+1]
+	}
+	var fields struct {
+		Type    string `json:"type"`
+		Scope   string `json:"scope"`
+		Summary string `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(answer), &fields); err != nil {
+		return "", fmt.Errorf("answer is not the requested JSON object: %v", err)
+	}
+	tmpl := c.template()
+	scope := strings.TrimSpace(fields.Scope)
+	if scope == "" {
+		scope = c.inferScope(paths)
+	}
+	if scope == "" {
+		tmpl = strings.ReplaceAll(tmpl, "({scope})", "")
+	}
+	ticket := ""
+	if strings.Contains(tmpl, "{ticket}") {
+		if ticket = c.ticket(); ticket == "" {
+			return "", fmt.Errorf("the template needs a {ticket}, but the branch name contains none")
+		}
+	}
+	message := strings.NewReplacer(
+		"{type}", strings.TrimSpace(fields.Type),
+		"{scope}", scope,
+		"{ticket}", ticket,
+		"{summary}", strings.TrimSuffix(strings.TrimSpace(fields.Summary), "."),
+	).Replace(tmpl)
+	return strings.TrimSpace(message), nil
+}
+
+// Validate checks a message's subject line against the template.
+func (c CommitConvention) Validate(message string) error {
+	tmpl := c.template()
+	if tmpl == "" {
+		return nil
+	}
+	subject := strings.SplitN(message, "\n", 2)[0]
+	if len(subject) > c.maxLength() {
+		return fmt.Errorf("subject line is %d characters (max %d)", len(subject), c.maxLength())
+	}
+	pattern := regexp.QuoteMeta(tmpl)
+	types := make([]string, len(c.types()))
+	for i, t := range c.types() {
+		types[i] = regexp.QuoteMeta(t)
+	}
+	pattern = strings.NewReplacer(
+		regexp.QuoteMeta("({scope})"), `(\([a-z0-9._/-]+\))?`,
+		regexp.QuoteMeta("{scope}"), `[a-z0-9._/-]+`,
+		regexp.QuoteMeta("{type}"), "("+strings.Join(types, "|")+")",
+		regexp.QuoteMeta("{ticket}"), "("+c.ticketRe().String()+")",
+		regexp.QuoteMeta("{summary}"), `\S.*`,
+	).Replace(pattern)
+	if !regexp.MustCompile("^" + pattern + "$").MatchString(subject) {
+		return fmt.Errorf("'%s' does not match the commit format '%s'", subject, tmpl)
+	}
+	return nil
+}
+
+// agentNotesRef holds the notes written with "metadata": "notes".
+const agentNotesRef = "agent"
+
+// commitMetadata describes the session behind an agent commit, as git
+// trailers: the session id, model, token usage so far and the transcript.
+func commitMetadata() []string {
+	in, out, cost, _ := sessionUsage.Totals()
+	usage := fmt.Sprintf("%d in, %d out", in, out)
+	if cost > 0 {
+		usage += fmt.Sprintf(" ($%.4f)", cost)
+	}
+	lines := []string{
+		"Agent-Session: " + sessionID,
+		"Agent-Model: " + ModelName,
+		"Agent-Tokens: " + usage,
+	}
+	if path := getHistoryPath(); path != "" {
+		lines = append(lines, "Agent-Transcript: "+path)
+	}
+	return lines
+}
+
+// withMetadataTrailers appends the session trailers to message when
+// "metadata" is "trailers".
+func (c CommitConvention) withMetadataTrailers(message string) string {
+	if c.Metadata != "trailers" {
+		return message
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + strings.Join(commitMetadata(), "\n")
+}
+
+// noteMetadata attaches the session metadata to HEAD as a git note when
+// "metadata" is "notes". Failures only warn: the commit already exists.
+func (c CommitConvention) noteMetadata(ctx context.Context) {
+	if c.Metadata != "notes" {
+		return
+	}
+	note := strings.Join(commitMetadata(), "\n")
+	if _, err := gitIn(ctx, "notes", "--ref", agentNotesRef, "add", "-f", "-m", note, "HEAD"); err != nil {
+		fmt.Printf("\033[33m[Git] Warning: Failed to add the session note: %v\033[0m\n", err)
+	}
+}
+
+// commitOptions relax git's checks when retrying a failed commit.
+type commitOptions struct {
+	NoVerify bool // Skip pre-commit and commit-msg hooks
+	NoSign   bool // Disable commit signing
+}
+
+// CommitError keeps git's output so the failure can be diagnosed.
+type CommitError struct {
+	Output string
+	Err    error
+}
+
+func (e *CommitError) Error() string {
+	return fmt.Sprintf("git commit failed: %v\n%s", e.Err, e.Output)
+}
+
+// gitCommit commits exactly the given paths, staging new and deleted files
+// among them; anything else in the index stays staged but uncommitted. With no
+// paths, all modified tracked files are committed ('git commit -a').
+func gitCommit(message string, paths []string, opts commitOptions) error {
+	if len(paths) > 0 {
+		addCmd := exec.Command("git", append([]string{"add", "-A", "--"}, paths...)...)
+		if out, err := addCmd.CombinedOutput(); err != nil {
+			return &CommitError{Output: string(out), Err: err}
+		}
+	}
+	var args []string
+	if opts.NoSign {
+		args = append(args, "-c", "commit.gpgsign=false")
+	}
+	full := commitConvention.withMetadataTrailers(message)
+	if len(paths) > 0 {
+		args = append(args, "commit", "-m", full)
+	} else {
+		args = append(args, "commit", "-am", full)
+	}
+	if opts.NoVerify {
+		args = append(args, "--no-verify")
+	}
+	if len(paths) > 0 {
+		args = append(append(args, "--"), paths...)
+	}
+	commitCmd := exec.Command("git", args...)
+	if out, err := commitCmd.CombinedOutput(); err != nil {
+		return &CommitError{Output: string(out), Err: err}
+	}
+	commitConvention.noteMetadata(context.Background())
+	agentChanges.Prune()
+	hash, _ := exec.Command("git", "rev-parse", "HEAD").Output()
+	emitEvent(EventCommitCreated, map[string]any{"commit": strings.TrimSpace(string(hash)), "message": message})
+	return nil
+}
+
+// changeTracker records which files the agent changed since they were last
+// committed, so commits include the agent's new files but never the user's
+// unrelated edits. Files edited with apply_udiff are recorded directly; files
+// changed any other way (e.g. by a script) are found by comparing the dirty
+// files at the start and end of each turn.
+type changeTracker struct {
+	mu       sync.Mutex
+	paths    map[string]bool   // Paths relative to the working directory
+	baseline map[string]string // Dirty files and their state when the turn began
+}
+
+var agentChanges = &changeTracker{paths: make(map[string]bool)}
+
+// dirtyFiles maps every modified, deleted or untracked (not ignored) file
+// below the working directory to a cheap fingerprint of its current state.
+func dirtyFiles() map[string]string {
+	out, err := exec.Command("git", "status", "--porcelain", "-z", "--untracked-files=all", "--", ".").Output()
+	if err != nil {
+		return nil
+	}
+	// Porcelain paths are relative to the repository root
+	prefix, _ := runGit(nil, "rev-parse", "--show-prefix")
+	files := make(map[string]string)
+	entries := strings.Split(string(out), "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		path := strings.TrimPrefix(entry[3:], prefix)
+		if entry[0] == 'R' || entry[0] == 'C' {
+			i++ // The original path follows as a separate entry
+		}
+		if isAgentStatePath(path) {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			files[path] = fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+		} else {
+			files[path] = "deleted"
+		}
+	}
+	return files
+}
+
+func (t *changeTracker) BeginTurn() {
+	if !isGitRepo() {
+		return
+	}
+	baseline := dirtyFiles()
+	t.mu.Lock()
+	t.baseline = baseline
+	t.mu.Unlock()
+}
+
+// EndTurn adds the files whose state changed during the turn.
+func (t *changeTracker) EndTurn() {
+	if !isGitRepo() {
+		return
+	}
+	current := dirtyFiles()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.baseline == nil {
+		return
+	}
+	for path, state := range current {
+		if t.baseline[path] != state {
+			t.paths[path] = true
+		}
+	}
+	t.baseline = nil
+}
+
+// Record notes a file the agent edited. Edits outside the working directory
+// (e.g. in a sub-agent's worktree) are ignored.
+func (t *changeTracker) Record(ctx context.Context, path string) {
+	absPath, err := validatePath(ctx, path)
+	if err != nil {
+		return
+	}
+	cwd, _ := os.Getwd()
+	rel, err := filepath.Rel(cwd, absPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	t.mu.Lock()
+	t.paths[filepath.ToSlash(rel)] = true
+	t.mu.Unlock()
+	tui.Refresh()
+}
+
+// Pending returns the recorded files that still have uncommitted changes.
+func (t *changeTracker) Pending() []string {
+	t.Prune()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var paths []string
+	for path := range t.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Prune forgets files that no longer differ from HEAD (committed or reverted).
+func (t *changeTracker) Prune() {
+	dirty := dirtyFiles()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for path := range t.paths {
+		if _, ok := dirty[path]; !ok {
+			delete(t.paths, path)
+		}
+	}
+}
+
+// printCommitFiles lists the files a commit will include with their status.
+func printCommitFiles(paths []string) {
+	if len(paths) == 0 {
+		fmt.Println("[Git] Files: all modified tracked files")
+		return
+	}
+	fmt.Println("[Git] Files to commit:")
+	for _, path := range paths {
+		status := "modified"
+		if out, err := runGit(nil, "status", "--porcelain", "--", path); err == nil && len(out) >= 2 {
+			switch {
+			case strings.HasPrefix(out, "??") || out[0] == 'A':
+				status = "new"
+			case out[0] == 'D' || out[1] == 'D':
+				status = "deleted"
+			}
+		}
+		fmt.Printf("  %-8s %s\n", status, path)
+	}
+}
+
+func promptUser(prompt string) string {
+	notifyPrompt(prompt)
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer)
+}
+
+// Prompter asks the user a question and returns the trimmed answer. Serve
+// mode puts one in the context so approvals go to the browser instead of
+// the terminal.
+type Prompter func(ctx context.Context, prompt string) string
+
+type prompterKey struct{}
+
+func withPrompter(ctx context.Context, p Prompter) context.Context {
+	return context.WithValue(ctx, prompterKey{}, p)
+}
+
+// askUser asks through the context's prompter, the approval policy (see
+// approvalPrompter), or on the terminal.
+func askUser(ctx context.Context, prompt string) string {
+	if p, ok := ctx.Value(prompterKey{}).(Prompter); ok {
+		return p(ctx, prompt)
+	}
+	if approvalPrompter != nil {
+		return approvalPrompter(ctx, prompt)
+	}
+	return promptUser(prompt)
+}
+
+// commitFix is a diagnosed commit failure. Apply is nil when the user has to
+// resolve the problem by hand.
+type commitFix struct {
+	Cause string
+	Hint  string
+	Offer string
+	Apply func(ctx context.Context, opts *commitOptions) error
+}
+
+func diagnoseCommitFailure(output string) commitFix {
+	switch {
+	case strings.Contains(output, "Please tell me who you are") ||
+		strings.Contains(output, "empty ident name") ||
+		strings.Contains(output, "unable to auto-detect email address"):
+		return commitFix{
+			Cause: "Git doesn't know who you are (user.name / user.email are not set).",
+			Offer: "Set your git identity for this repository now?",
+			Apply: func(ctx context.Context, opts *commitOptions) error {
+				current, _ := runGit(nil, "config", "user.name")
+				name := askUser(ctx, fmt.Sprintf("Name [%s]: ", current))
+				if name == "" {
+					name = current
+				}
+				current, _ = runGit(nil, "config", "user.email")
+				email := askUser(ctx, fmt.Sprintf("Email [%s]: ", current))
+				if email == "" {
+					email = current
+				}
+				if name == "" || email == "" {
+					return fmt.Errorf("name and email are both required")
+				}
+				if _, err := runGit(nil, "config", "user.name", name); err != nil {
+					return err
+				}
+				_, err := runGit(nil, "config", "user.email", email)
+				return err
+			},
+		}
+	case strings.Contains(output, "index.lock") && strings.Contains(output, "File exists"):
+		return commitFix{
+			Cause: "Another git process seems to be running (index.lock exists).",
+			Hint:  "If no other git command is running, the lock is stale and can be removed.",
+			Offer: "Remove the stale lock file? Only do this if no other git command is running.",
+			Apply: func(ctx context.Context, opts *commitOptions) error {
+				lock, err := runGit(nil, "rev-parse", "--git-path", "index.lock")
+				if err != nil {
+					return err
+				}
+				return os.Remove(lock)
+			},
+		}
+	case strings.Contains(output, "gpg failed to sign") || strings.Contains(output, "error: cannot run gpg"):
+		return commitFix{
+			Cause: "Commit signing failed (commit.gpgsign is enabled but gpg is not working).",
+			Hint:  "Check that your signing key is available and gpg-agent is running.",
+			Offer: "Commit without signing this time?",
+			Apply: func(ctx context.Context, opts *commitOptions) error {
+				opts.NoSign = true
+				return nil
+			},
+		}
+	case strings.Contains(output, "unmerged files") || strings.Contains(output, "unresolved conflict"):
+		return commitFix{
+			Cause: "The repository has unresolved merge conflicts.",
+			Hint:  "Resolve the conflicts listed by 'git status', stage the files, and run /commit again.",
+		}
+	case strings.Contains(output, "nothing added to commit") || strings.Contains(output, "nothing to commit"):
+		return commitFix{
+			Cause: "Nothing to commit: the remaining changes are untracked files the agent did not create.",
+			Hint:  "Stage new files with 'git add <file>' and run /commit again.",
+		}
+	case hasCommitHooks():
+		return commitFix{
+			Cause: "A git hook (pre-commit or commit-msg) rejected the commit.",
+			Hint:  "Fix the problems reported above, or skip the hooks for this commit.",
+			Offer: "Retry, skipping git hooks (--no-verify)?",
+			Apply: func(ctx context.Context, opts *commitOptions) error {
+				opts.NoVerify = true
+				return nil
+			},
+		}
+	}
+	return commitFix{Cause: "Unrecognized git error.", Hint: "See git's output above."}
+}
+
+func hasCommitHooks() bool {
+	for _, hook := range []string{"pre-commit", "commit-msg"} {
+		path, err := runGit(nil, "rev-parse", "--git-path", "hooks/"+hook)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode()&0111 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureBranch offers to create a branch when HEAD is detached, since commits
+// made there are easy to lose.
+func ensureBranch(ctx context.Context, force bool) {
+	if _, err := runGit(nil, "symbolic-ref", "-q", "HEAD"); err == nil {
+		return
+	}
+	fmt.Println("\033[33m[Git] HEAD is detached; a commit here is not on any branch and is easy to lose.\033[0m")
+	if force {
+		return
+	}
+	branch := askUser(ctx, "Create a branch for it? Branch name (empty to commit on detached HEAD): ")
+	if branch == "" {
+		return
+	}
+	if _, err := runGit(nil, "switch", "-c", branch); err != nil {
+		fmt.Printf("Failed to create branch: %v\n", err)
+		return
+	}
+	fmt.Printf("Switched to new branch '%s'.\n", branch)
+}
+
+// commitWithFixes commits and, when git refuses, explains the cause and offers
+// a guided fix before retrying.
+func commitWithFixes(ctx context.Context, message string, paths []string) error {
+	var opts commitOptions
+	for attempt := 0; attempt < 3; attempt++ {
+		err := gitCommit(message, paths, opts)
+		if err == nil {
+			return nil
+		}
+		commitErr, ok := err.(*CommitError)
+		if !ok {
+			return err
+		}
+
+		fix := diagnoseCommitFailure(commitErr.Output)
+		fmt.Printf("\n\033[31m[Git] Commit failed:\033[0m %s\n", strings.TrimSpace(commitErr.Output))
+		fmt.Printf("\033[33mCause:\033[0m %s\n", fix.Cause)
+		if fix.Hint != "" {
+			fmt.Printf("\033[33mHint:\033[0m %s\n", fix.Hint)
+		}
+		if fix.Apply == nil {
+			return fmt.Errorf("commit not created: %s", fix.Cause)
+		}
+		if strings.ToLower(askUser(ctx, fix.Offer+" [y/N]: ")) != "y" {
+			return fmt.Errorf("commit not created: %s", fix.Cause)
+		}
+		if err := fix.Apply(ctx, &opts); err != nil {
+			return fmt.Errorf("fix failed: %v", err)
+		}
+		fmt.Println("Retrying commit...")
+	}
+	return fmt.Errorf("commit still failing after guided fixes")
+}
+
+// performGitCommit proposes a commit of paths (all modified tracked files
+// when empty) with a generated message.
+func performGitCommit(ctx context.Context, apiKey string, history []Message, skills []Skill, paths []string, force bool) error {
+	if !isGitDirty() {
+		return fmt.Errorf("git clean")
+	}
+
+	commitMsg, err := generateCommitMessage(apiKey, history, paths)
+	if err != nil {
+		fmt.Printf("\033[31m[Git] Failed to generate commit message:\033[0m %v\n", err)
+		if tmpl := commitConvention.template(); tmpl != "" {
+			fmt.Printf("Expected format: %s\n", tmpl)
+		}
+		commitMsg = askUser(ctx, "Enter a commit message (empty to skip the commit): ")
+		if commitMsg == "" {
+			return fmt.Errorf("failed to generate commit message: %v", err)
+		}
+		if err := commitConvention.Validate(commitMsg); err != nil {
+			fmt.Printf("\033[33m[Git] Warning: %v\033[0m\n", err)
+		}
+	}
+
+	proposals := []commitpolicy.Proposal{{Message: commitMsg, Paths: paths}}
+	if len(commitpolicy.Registered()) > 0 || commitConvention.PolicyCommand != "" {
+		if len(paths) == 0 {
+			paths = modifiedTrackedFiles()
+		}
+		proposals, err = applyCommitPolicies(ctx, commitpolicy.Proposal{Message: commitMsg, Paths: paths})
+		if err != nil {
+			return fmt.Errorf("commit aborted: %v", err)
+		}
+		if len(proposals) == 0 {
+			return fmt.Errorf("commit aborted: the commit policies left no files to commit")
+		}
+	}
+
+	// Pre-commit hook
+	var messages []string
+	for _, p := range proposals {
+		messages = append(messages, p.Message)
+	}
+	hookOut, hookErr := runSkillHooks(ctx, skills, "pre_commit", map[string]string{"message": strings.Join(messages, "\n\n")})
+	if hookOut != "" {
+		fmt.Printf("\n[Pre-Commit Hook Output]\n%s\n", hookOut)
+	}
+	if hookErr != nil {
+		return fmt.Errorf("commit aborted: %v", hookErr)
+	}
+
+	for i, p := range proposals {
+		if len(proposals) > 1 {
+			fmt.Printf("\n[Git] Commit %d of %d", i+1, len(proposals))
+		}
+		fmt.Printf("\n[Git] Proposed commit message: %s\n", p.Message)
+		printCommitFiles(p.Paths)
+	}
+
+	confirm := "y"
+	if !force {
+		question := "Commit these changes? [y/N]: "
+		if len(proposals) > 1 {
+			question = fmt.Sprintf("Create these %d commits? [y/N]: ", len(proposals))
+		}
+		confirm = askUser(ctx, question)
+	}
+
+	if strings.ToLower(confirm) == "y" {
+		ensureBranch(ctx, force)
+		for _, p := range proposals {
+			if err := commitWithFixes(ctx, p.Message, p.Paths); err != nil {
+				return err
+			}
+		}
+		fmt.Println("Changes committed successfully.")
+	} else {
+		fmt.Println("Commit aborted.")
+	}
+	return nil
+}
+
+// modifiedTrackedFiles lists the files "git commit -a" would commit,
+// relative to the working directory.
+func modifiedTrackedFiles() []string {
+	out, err := runGit(nil, "diff", "--name-only", "--relative", "HEAD")
+	if err != nil {
+		// No HEAD yet
+		out, _ = runGit(nil, "ls-files", "--modified", "--deleted")
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !seen[line] {
+			seen[line] = true
+			paths = append(paths, line)
+		}
+	}
+	return paths
+}
+
+// --- Commit Policies ---
+
+// Commits the agent proposes pass through the Go policies registered in
+// package commitpolicy and then, if set, "policy_command" from the "commit"
+// config. The command is run with the proposal as JSON on stdin. It may print
+// {"commits": [{"message", "paths"}, ...]} to replace it, or nothing to keep
+// it; a non-zero exit or {"veto": "reason"} vetoes the commit.
+
+const commitPolicyTimeout = time.Minute
+
+// scriptCommitPolicy runs command as a commit policy.
+func scriptCommitPolicy(command string) commitpolicy.Policy {
+	return commitpolicy.Policy{
+		Name: command,
+		Apply: func(ctx context.Context, p commitpolicy.Proposal) ([]commitpolicy.Proposal, error) {
+			branch, _ := runGit(nil, "symbolic-ref", "--short", "HEAD")
+			var input bytes.Buffer
+			enc := json.NewEncoder(&input)
+			enc.SetEscapeHTML(false) // Keep "Name <email>" readable
+			enc.Encode(map[string]any{
+				"message": p.Message,
+				"paths":   p.Paths,
+				"branch":  branch,
+				"ticket":  commitConvention.ticket(),
+			})
+			ctx, cancel := context.WithTimeout(ctx, commitPolicyTimeout)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, "sh", "-c", command)
+			cmd.Stdin = &input
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				reason := strings.TrimSpace(stderr.String() + "\n" + string(out))
+				if reason == "" {
+					reason = err.Error()
+				}
+				return nil, errors.New(reason)
+			}
+			if strings.TrimSpace(string(out)) == "" {
+				return []commitpolicy.Proposal{p}, nil
+			}
+			var result struct {
+				Commits *[]commitpolicy.Proposal `json:"commits"`
+				Veto    string                   `json:"veto"`
+			}
+			if err := json.Unmarshal(out, &result); err != nil {
+				return nil, fmt.Errorf("invalid output (expected JSON): %v", err)
+			}
+			if result.Veto != "" {
+				return nil, errors.New(result.Veto)
+			}
+			if result.Commits == nil {
+				return []commitpolicy.Proposal{p}, nil
+			}
+			return *result.Commits, nil
+		},
+	}
+}
+
+// applyCommitPolicies runs the proposal through every policy. Its paths are
+// the files the agent may commit; policies can only narrow them.
+func applyCommitPolicies(ctx context.Context, proposal commitpolicy.Proposal) ([]commitpolicy.Proposal, error) {
+	policies := commitpolicy.Registered()
+	if commitConvention.PolicyCommand != "" {
+		policies = append(policies, scriptCommitPolicy(commitConvention.PolicyCommand))
+	}
+	return commitpolicy.Run(ctx, proposal, policies)
+}
+
+// --- Task Branches ---
+
+// With -auto-branch, each new task gets its own branch so auto-commits never
+// land on the user's branch directly. /merge squashes the task branch back
+// into the branch it started from.
+
+type TaskBranch struct {
+	Name    string    `json:"name"`
+	Base    string    `json:"base"`
+	Task    string    `json:"task"`
+	Created time.Time `json:"created"`
+}
+
+var taskBranchSlugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+func getTaskBranchPath() string {
+	return filepath.Join(".simple_agent", "task_branch.json")
+}
+
+// loadTaskBranch returns the task branch if it is currently checked out.
+func loadTaskBranch() *TaskBranch {
+	data, err := os.ReadFile(getTaskBranchPath())
+	if err != nil {
+		return nil
+	}
+	var tb TaskBranch
+	if json.Unmarshal(data, &tb) != nil {
+		return nil
+	}
+	if current, err := runGit(nil, "symbolic-ref", "--short", "HEAD"); err != nil || current != tb.Name {
+		return nil
+	}
+	return &tb
+}
+
+func (tb *TaskBranch) save() error {
+	if err := os.MkdirAll(filepath.Dir(getTaskBranchPath()), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(tb, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getTaskBranchPath(), data, 0644)
+}
+
+// taskBranchName derives a branch name like "agent/add-login-form" from the
+// first words of the task.
+func taskBranchName(task string) string {
+	slug := taskBranchSlugRe.ReplaceAllString(strings.ToLower(task), "-")
+	words := strings.FieldsFunc(slug, func(r rune) bool { return r == '-' })
+	if len(words) > 6 {
+		words = words[:6]
+	}
+	slug = strings.Join(words, "-")
+	if len(slug) > 40 {
+		slug = strings.TrimRight(slug[:40], "-")
+	}
+	if slug == "" {
+		slug = time.Now().Format("20060102-150405")
+	}
+	name := "agent/" + slug
+	for i := 2; ; i++ {
+		if _, err := runGit(nil, "rev-parse", "--verify", "-q", "refs/heads/"+name); err != nil {
+			return name
+		}
+		name = fmt.Sprintf("agent/%s-%d", slug, i)
+	}
+}
+
+// ensureTaskBranch switches to a new task branch unless one is already
+// checked out. Uncommitted changes move along with the switch.
+func ensureTaskBranch(task string) {
+	if !isGitRepo() || loadTaskBranch() != nil {
+		return
+	}
+	base, err := runGit(nil, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		fmt.Println("\033[33m[Git] HEAD is detached; not creating a task branch.\033[0m")
+		return
+	}
+	if _, err := runGit(nil, "rev-parse", "--verify", "-q", "HEAD"); err != nil {
+		return // No commits yet; a branch can't be created from nothing
+	}
+	title := strings.SplitN(strings.TrimSpace(task), "\n", 2)[0]
+	tb := &TaskBranch{Name: taskBranchName(title), Base: base, Task: title, Created: time.Now()}
+	if _, err := runGit(nil, "switch", "-c", tb.Name); err != nil {
+		fmt.Printf("Warning: Failed to create task branch: %v\n", err)
+		return
+	}
+	if err := tb.save(); err != nil {
+		fmt.Printf("Warning: Failed to save task branch state: %v\n", err)
+	}
+	fmt.Printf("\033[36m[Git] Working on branch %s (from %s). Use /merge to squash it back when done.\033[0m\n", tb.Name, base)
+}
+
+// handleMergeCommand handles "/merge [abort]".
+func handleMergeCommand(arg string) {
+	ctx := context.Background()
+	tb := loadTaskBranch()
+	if tb == nil {
+		fmt.Println("No task branch is checked out (start one with -auto-branch).")
+		return
+	}
+
+	if arg == "abort" {
+		if len(dirtyFiles()) > 0 {
+			fmt.Println("Commit or discard the uncommitted changes first.")
+			return
+		}
+		if _, err := runGit(nil, "switch", tb.Base); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		os.Remove(getTaskBranchPath())
+		fmt.Printf("Switched back to %s. The task branch %s was kept.\n", tb.Base, tb.Name)
+		return
+	}
+	if arg != "" {
+		fmt.Println("Usage: /merge [abort]")
+		return
+	}
+
+	if len(dirtyFiles()) > 0 {
+		fmt.Println("There are uncommitted changes. Commit them (/commit) or discard them before merging.")
+		return
+	}
+	commits, _ := runGit(nil, "log", "--reverse", "--format=%s", tb.Base+".."+tb.Name)
+	if commits == "" {
+		fmt.Printf("%s has no commits that are not on %s.\n", tb.Name, tb.Base)
+		return
+	}
+	stat, _ := runGit(nil, "diff", "--stat", tb.Base+"..."+tb.Name)
+	fmt.Printf("\n\033[1mSquash %s into %s:\033[0m\n", tb.Name, tb.Base)
+	for _, subject := range strings.Split(commits, "\n") {
+		fmt.Printf("  - %s\n", subject)
+	}
+	fmt.Printf("\n %s\n\n", stat) // runGit trims the diffstat's leading space
+
+	title := truncateLine(tb.Task, 72)
+	if custom := askUser(ctx, fmt.Sprintf("Commit message [%s]: ", title)); custom != "" {
+		title = custom
+	}
+	if strings.ToLower(askUser(ctx, "Squash-merge now? [y/N]: ")) != "y" {
+		fmt.Println("Merge cancelled.")
+		return
+	}
+
+	if _, err := runGit(nil, "switch", tb.Base); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if _, err := runGit(nil, "merge", "--squash", tb.Name); err != nil {
+		fmt.Printf("\033[31m[Git] Squash merge failed:\033[0m %v\n", err)
+		runGit(nil, "reset", "--merge")
+		runGit(nil, "switch", tb.Name)
+		fmt.Printf("Merge undone; back on %s. Rebase it onto %s and try again.\n", tb.Name, tb.Base)
+		return
+	}
+	body := "Squashed from " + tb.Name + ":\n"
+	for _, subject := range strings.Split(commits, "\n") {
+		body += "- " + subject + "\n"
+	}
+	if err := commitWithFixes(ctx, title+"\n\n"+body, nil); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Printf("The squashed changes are staged on %s.\n", tb.Base)
+		return
+	}
+	os.Remove(getTaskBranchPath())
+	fmt.Printf("\033[32mMerged %s into %s.\033[0m\n", tb.Name, tb.Base)
+	if strings.ToLower(askUser(ctx, fmt.Sprintf("Delete branch %s? [y/N]: ", tb.Name))) == "y" {
+		if _, err := runGit(nil, "branch", "-D", tb.Name); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+}
+
+// --- Git Tools ---
+
+// gitTools give the model structured access to git instead of parsing shell
+// output. Tools that change the repository ask for approval unless diffs are
+// auto-accepted.
+var gitTools = []Tool{
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_status",
+			Description: "Show the current branch, upstream tracking, and staged, unstaged, untracked and conflicted files as JSON.",
+			Parameters:  json.RawMessage(`{"type": "object", "properties": {}}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_diff",
+			Description: "Show changes as JSON: per-file added/deleted line counts and the unified diff. By default compares the working tree with the index.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"staged": {"type": "boolean", "description": "Show staged changes (index vs HEAD)"},
+					"ref": {"type": "string", "description": "Compare against this commit, branch or range (e.g. 'main', 'HEAD~3..HEAD')"},
+					"paths": {"type": "array", "items": {"type": "string"}, "description": "Limit to these paths"},
+					"stat_only": {"type": "boolean", "description": "Only return the per-file counts, not the diff"}
+				}
+			}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_log",
+			Description: "List commits as JSON (hash, author, date, subject), newest first.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"max_count": {"type": "integer", "description": "Number of commits (default 20, max 200)"},
+					"ref": {"type": "string", "description": "Branch, commit or range to list (default HEAD)"},
+					"path": {"type": "string", "description": "Only commits touching this path"}
+				}
+			}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_branch",
+			Description: "List local branches as JSON, or create or delete a branch. Create and delete require approval.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"action": {"type": "string", "enum": ["list", "create", "delete"], "description": "Default: list"},
+					"name": {"type": "string", "description": "Branch to create or delete"},
+					"start_point": {"type": "string", "description": "Commit or branch the new branch starts from (default HEAD)"}
+				}
+			}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_stash",
+			Description: "List stashes as JSON, or push, pop, apply or drop one. Everything but list requires approval.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"action": {"type": "string", "enum": ["list", "push", "pop", "apply", "drop"], "description": "Default: list"},
+					"message": {"type": "string", "description": "Message for push"},
+					"include_untracked": {"type": "boolean", "description": "Also stash untracked files (push)"},
+					"index": {"type": "integer", "description": "Stash index for pop, apply and drop (default 0)"}
+				}
+			}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_commit",
+			Description: "Create a commit. Stages the given paths first; with all=true, commits all tracked changes. Requires approval.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"message": {"type": "string", "description": "Commit message"},
+					"paths": {"type": "array", "items": {"type": "string"}, "description": "Paths to stage before committing (new files must be listed here)"},
+					"all": {"type": "boolean", "description": "Stage all modified and deleted tracked files"}
+				},
+				"required": ["message"]
+			}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_checkout",
+			Description: "Switch to a branch or commit, optionally creating the branch, or restore paths from a commit (discarding their changes). Requires approval.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"ref": {"type": "string", "description": "Branch or commit (default HEAD when restoring paths)"},
+					"create": {"type": "boolean", "description": "Create ref as a new branch"},
+					"paths": {"type": "array", "items": {"type": "string"}, "description": "Restore only these paths from ref"}
+				}
+			}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        "git_reset",
+			Description: "Reset HEAD to a commit (soft, mixed or hard), or unstage paths. 'hard' discards uncommitted changes. Requires approval.",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"ref": {"type": "string", "description": "Target commit (default HEAD)"},
+					"mode": {"type": "string", "enum": ["soft", "mixed", "hard"], "description": "Default: mixed"},
+					"paths": {"type": "array", "items": {"type": "string"}, "description": "Unstage only these paths (mode is ignored)"}
+				}
+			}`),
+		},
+	},
+}
+
+// maxGitDiffChars bounds the diff returned by git_diff.
+const maxGitDiffChars = 40000
+
+type gitFileStatus struct {
+	Path   string `json:"path"`
+	From   string `json:"from,omitempty"` // Original path of a rename or copy
+	Status string `json:"status"`
+}
+
+type gitStatusResult struct {
+	Branch     string          `json:"branch"`
+	Upstream   string          `json:"upstream,omitempty"`
+	Ahead      int             `json:"ahead,omitempty"`
+	Behind     int             `json:"behind,omitempty"`
+	Clean      bool            `json:"clean"`
+	Staged     []gitFileStatus `json:"staged,omitempty"`
+	Unstaged   []gitFileStatus `json:"unstaged,omitempty"`
+	Untracked  []string        `json:"untracked,omitempty"`
+	Conflicted []string        `json:"conflicted,omitempty"`
+}
+
+var gitStatusNames = map[byte]string{
+	'M': "modified",
+	'A': "added",
+	'D': "deleted",
+	'R': "renamed",
+	'C': "copied",
+	'T': "type_changed",
+}
+
+// gitIn runs git in the context's work directory. Errors include git's output.
+func gitIn(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir, _ = getWorkDir(ctx)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("git %s failed: %v\n%s", args[0], err, strings.TrimSpace(stderr.String()+"\n"+string(out)))
+	}
+	return string(out), nil
+}
+
+func toJSON(v any) string {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	return string(data)
+}
+
+// approveGitWrite asks before a repository-changing git command unless
+// changes are auto-approved.
+func approveGitWrite(ctx context.Context, env *ToolEnv, args []string) bool {
+	fmt.Printf("Command: git %s\n", strings.Join(args, " "))
+	if env.AutoApprove {
+		noteApproval(ctx, "auto")
+		return true
+	}
+	ok := strings.ToLower(askUser(ctx, "Run this git command? [y/N]: ")) == "y"
+	noteApproval(ctx, approvalDecision(ok))
+	return ok
+}
+
+// runGitTool executes one of the gitTools.
+func runGitTool(ctx context.Context, env *ToolEnv, name, arguments string) (string, error) {
+	var args struct {
+		Staged           bool     `json:"staged"`
+		Ref              string   `json:"ref"`
+		Paths            []string `json:"paths"`
+		Path             string   `json:"path"`
+		StatOnly         bool     `json:"stat_only"`
+		MaxCount         int      `json:"max_count"`
+		Action           string   `json:"action"`
+		Name             string   `json:"name"`
+		StartPoint       string   `json:"start_point"`
+		Message          string   `json:"message"`
+		IncludeUntracked bool     `json:"include_untracked"`
+		Index            int      `json:"index"`
+		All              bool     `json:"all"`
+		Create           bool     `json:"create"`
+		Mode             string   `json:"mode"`
+	}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", invalidArguments(err)
+		}
+	}
+	for _, p := range append(args.Paths, args.Path) {
+		if p == "" {
+			continue
+		}
+		if _, err := validatePath(ctx, p); err != nil {
+			return "", err
+		}
+	}
+	// Refs starting with '-' would be parsed as options
+	for _, ref := range []string{args.Ref, args.Name, args.StartPoint} {
+		if strings.HasPrefix(ref, "-") {
+			return "", toolError(errValidation, fmt.Errorf("invalid ref: %s", ref))
+		}
+	}
+
+	switch name {
+	case "git_status":
+		return gitStatusJSON(ctx)
+	case "git_diff":
+		return gitDiffJSON(ctx, args.Staged, args.Ref, args.Paths, args.StatOnly)
+	case "git_log":
+		return gitLogJSON(ctx, args.MaxCount, args.Ref, args.Path)
+	}
+
+	// Everything below changes the repository
+	var cmdArgs []string
+	switch name {
+	case "git_branch":
+		switch args.Action {
+		case "", "list":
+			return gitBranchesJSON(ctx)
+		case "create":
+			cmdArgs = []string{"branch", args.Name}
+			if args.StartPoint != "" {
+				cmdArgs = append(cmdArgs, args.StartPoint)
+			}
+		case "delete":
+			cmdArgs = []string{"branch", "-d", args.Name}
+		default:
+			return "", toolError(errValidation, fmt.Errorf("unknown action: %s", args.Action))
+		}
+		if args.Name == "" {
+			return "", toolError(errValidation, fmt.Errorf("name is required to %s a branch", args.Action))
+		}
+	case "git_stash":
+		ref := fmt.Sprintf("stash@{%d}", args.Index)
+		switch args.Action {
+		case "", "list":
+			return gitStashesJSON(ctx)
+		case "push":
+			cmdArgs = []string{"stash", "push"}
+			if args.IncludeUntracked {
+				cmdArgs = append(cmdArgs, "--include-untracked")
+			}
+			if args.Message != "" {
+				cmdArgs = append(cmdArgs, "-m", args.Message)
+			}
+		case "pop", "apply", "drop":
+			cmdArgs = []string{"stash", args.Action, ref}
+		default:
+			return "", toolError(errValidation, fmt.Errorf("unknown action: %s", args.Action))
+		}
+	case "git_commit":
+		if strings.TrimSpace(args.Message) == "" {
+			return "", toolError(errValidation, fmt.Errorf("message is required"))
+		}
+		cmdArgs = []string{"commit", "-m", commitConvention.withMetadataTrailers(args.Message)}
+		if args.All {
+			cmdArgs = append(cmdArgs, "-a")
+		}
+	case "git_checkout":
+		switch {
+		case len(args.Paths) > 0:
+			ref := args.Ref
+			if ref == "" {
+				ref = "HEAD"
+			}
+			cmdArgs = append([]string{"checkout", ref, "--"}, args.Paths...)
+		case args.Ref == "":
+			return "", toolError(errValidation, fmt.Errorf("ref is required"))
+		case args.Create:
+			cmdArgs = []string{"checkout", "-b", args.Ref}
+		default:
+			cmdArgs = []string{"checkout", args.Ref}
+		}
+	case "git_reset":
+		ref := args.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		if len(args.Paths) > 0 {
+			cmdArgs = append([]string{"reset", "-q", ref, "--"}, args.Paths...)
+		} else {
+			mode := args.Mode
+			if mode == "" {
+				mode = "mixed"
+			}
+			if mode != "soft" && mode != "mixed" && mode != "hard" {
+				return "", toolError(errValidation, fmt.Errorf("unknown mode: %s", mode))
+			}
+			cmdArgs = []string{"reset", "--" + mode, ref}
+		}
+	default:
+		return "", fmt.Errorf("unknown git tool: %s", name)
+	}
+
+	if name == "git_commit" && len(args.Paths) > 0 {
+		fmt.Printf("Stage: %s\n", strings.Join(args.Paths, " "))
+	}
+	if !approveGitWrite(ctx, env, cmdArgs) {
+		fmt.Println("Git command rejected.")
+		return "User rejected the git command.", nil
+	}
+	if name == "git_commit" && len(args.Paths) > 0 {
+		if _, err := gitIn(ctx, append([]string{"add", "--"}, args.Paths...)...); err != nil {
+			return "", err
+		}
+	}
+	out, err := gitIn(ctx, cmdArgs...)
+	if err != nil {
+		return "", err
+	}
+	result := map[string]any{"ok": true, "output": strings.TrimSpace(out)}
+	if head, err := gitIn(ctx, "rev-parse", "--short", "HEAD"); err == nil {
+		result["head"] = strings.TrimSpace(head)
+	}
+	if name == "git_commit" {
+		commitConvention.noteMetadata(ctx)
+		emitEvent(EventCommitCreated, map[string]any{"commit": result["head"], "message": args.Message})
+	}
+	return toJSON(result), nil
+}
+
+func gitStatusJSON(ctx context.Context) (string, error) {
+	out, err := gitIn(ctx, "status", "--porcelain=v2", "--branch")
+	if err != nil {
+		return "", err
+	}
+	var status gitStatusResult
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "# branch.head "):
+			status.Branch = strings.TrimPrefix(line, "# branch.head ")
+		case strings.HasPrefix(line, "# branch.upstream "):
+			status.Upstream = strings.TrimPrefix(line, "# branch.upstream ")
+		case strings.HasPrefix(line, "# branch.ab "):
+			fmt.Sscanf(strings.TrimPrefix(line, "# branch.ab "), "+%d -%d", &status.Ahead, &status.Behind)
+		case strings.HasPrefix(line, "? "):
+			status.Untracked = append(status.Untracked, line[2:])
+		case strings.HasPrefix(line, "u "):
+			if fields := strings.SplitN(line, " ", 11); len(fields) == 11 {
+				status.Conflicted = append(status.Conflicted, fields[10])
+			}
+		case strings.HasPrefix(line, "1 "), strings.HasPrefix(line, "2 "):
+			n := 9
+			if line[0] == '2' {
+				n = 10
+			}
+			fields := strings.SplitN(line, " ", n)
+			if len(fields) != n {
+				continue
+			}
+			path, from, _ := strings.Cut(fields[n-1], "\t")
+			xy := fields[1]
+			if name, ok := gitStatusNames[xy[0]]; ok {
+				status.Staged = append(status.Staged, gitFileStatus{Path: path, From: from, Status: name})
+			}
+			if name, ok := gitStatusNames[xy[1]]; ok {
+				status.Unstaged = append(status.Unstaged, gitFileStatus{Path: path, Status: name})
+			}
+		}
+	}
+	status.Clean = len(status.Staged)+len(status.Unstaged)+len(status.Untracked)+len(status.Conflicted) == 0
+	return toJSON(status), nil
+}
+
+func gitDiffJSON(ctx context.Context, staged bool, ref string, paths []string, statOnly bool) (string, error) {
+	base := []string{"diff"}
+	if staged {
+		base = append(base, "--cached")
+	}
+	if ref != "" {
+		base = append(base, ref)
+	}
+	pathArgs := append([]string{"--"}, paths...)
+	if root, err := getWorkDir(ctx); err == nil {
+		pathArgs = append(pathArgs, agentIgnorePathspecs(root)...)
+	}
+
+	numstat, err := gitIn(ctx, append(append(append([]string{}, base...), "--numstat"), pathArgs...)...)
+	if err != nil {
+		return "", err
+	}
+	type fileStat struct {
+		Path      string `json:"path"`
+		Additions int    `json:"additions"`
+		Deletions int    `json:"deletions"`
+		Binary    bool   `json:"binary,omitempty"`
+	}
+	result := struct {
+		Files     []fileStat `json:"files"`
+		Diff      string     `json:"diff,omitempty"`
+		Truncated bool       `json:"truncated,omitempty"`
+	}{Files: []fileStat{}}
+	for _, line := range strings.Split(strings.TrimSpace(numstat), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		stat := fileStat{Path: fields[2], Binary: fields[0] == "-"}
+		stat.Additions, _ = strconv.Atoi(fields[0])
+		stat.Deletions, _ = strconv.Atoi(fields[1])
+		result.Files = append(result.Files, stat)
+	}
+	if !statOnly && len(result.Files) > 0 {
+		diff, err := gitIn(ctx, append(base, pathArgs...)...)
+		if err != nil {
+			return "", err
+		}
+		if len(diff) > maxGitDiffChars {
+			diff, result.Truncated = diff[:maxGitDiffChars], true
+		}
+		result.Diff = diff
+	}
+	out := toJSON(result)
+	if result.Truncated {
+		out += "\n\nThe diff was truncated. Pass 'paths' to see the rest."
+	}
+	return out, nil
+}
+
+func gitLogJSON(ctx context.Context, maxCount int, ref, path string) (string, error) {
+	if maxCount <= 0 {
+		maxCount = 20
+	} else if maxCount > 200 {
+		maxCount = 200
+	}
+	args := []string{"log", fmt.Sprintf("-n%d", maxCount), "--format=%H%x1f%an%x1f%aI%x1f%s"}
+	if ref != "" {
+		args = append(args, ref)
+	}
+	if path != "" {
+		args = append(args, "--", path)
+	}
+	out, err := gitIn(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	type commit struct {
+		Hash    string `json:"hash"`
+		Author  string `json:"author"`
+		Date    string `json:"date"`
+		Subject string `json:"subject"`
+	}
+	commits := []commit{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if fields := strings.Split(line, "\x1f"); len(fields) == 4 {
+			commits = append(commits, commit{fields[0], fields[1], fields[2], fields[3]})
+		}
+	}
+	return toJSON(commits), nil
+}
+
+func gitBranchesJSON(ctx context.Context) (string, error) {
+	out, err := gitIn(ctx, "for-each-ref", "--format=%(refname:short)%1f%(upstream:short)%1f%(objectname:short)%1f%(HEAD)%1f%(subject)", "refs/heads")
+	if err != nil {
+		return "", err
+	}
+	type branch struct {
+		Name     string `json:"name"`
+		Upstream string `json:"upstream,omitempty"`
+		Head     string `json:"head"`
+		Current  bool   `json:"current,omitempty"`
+		Subject  string `json:"subject"`
+	}
+	branches := []branch{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if fields := strings.Split(line, "\x1f"); len(fields) == 5 {
+			branches = append(branches, branch{fields[0], fields[1], fields[2], fields[3] == "*", fields[4]})
+		}
+	}
+	return toJSON(branches), nil
+}
+
+func gitStashesJSON(ctx context.Context) (string, error) {
+	out, err := gitIn(ctx, "stash", "list", "--format=%gd%x1f%s")
+	if err != nil {
+		return "", err
+	}
+	type stash struct {
+		Ref     string `json:"ref"`
+		Message string `json:"message"`
+	}
+	stashes := []stash{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if ref, msg, ok := strings.Cut(line, "\x1f"); ok {
+			stashes = append(stashes, stash{ref, msg})
+		}
+	}
+	return toJSON(stashes), nil
+}
+
+// --- Pull Requests ---
+
+// /pr and the create_pr tool push the current branch and open a GitHub pull
+// request or GitLab merge request. The host is taken from the remote URL;
+// tokens come from GITHUB_TOKEN/GH_TOKEN and GITLAB_TOKEN or the config file.
+
+var createPRTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "create_pr",
+		Description: "Push the current branch and open a pull request (GitHub) or merge request (GitLab). Commit your changes first. Returns the PR URL. Title and description are generated from the branch's commits unless given.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"base": {"type": "string", "description": "Target branch (default: the remote's default branch)"},
+				"title": {"type": "string", "description": "PR title"},
+				"body": {"type": "string", "description": "PR description (Markdown)"},
+				"draft": {"type": "boolean", "description": "Open as a draft"}
+			}
+		}`),
+	},
+}
+
+// PRConfig configures pull request creation. Token values may reference
+// environment variables ("$MY_TOKEN").
+type PRConfig struct {
+	Remote      string   `json:"remote,omitempty"` // Default: origin
+	GitHubToken string   `json:"github_token,omitempty"`
+	GitLabToken string   `json:"gitlab_token,omitempty"`
+	GitLabHosts []string `json:"gitlab_hosts,omitempty"` // Self-hosted GitLab hosts without "gitlab" in the name
+	Draft       bool     `json:"draft,omitempty"`
+}
+
+var prConfig PRConfig
+
+const prPrompt = `Write a pull request title and description for the changes below.
+Return ONLY a JSON object: {"title": "...", "body": "..."}
+- title: under 72 characters, imperative mood, no trailing period.
+- body: Markdown. Start with one or two sentences on what changed and why, then a short bullet list of the notable changes. Mention anything reviewers should check. No headings for trivial changes.`
+
+type prRequest struct {
+	Base  string `json:"base"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Draft bool   `json:"draft"`
+}
+
+// prRepo identifies the hosting service and repository of a git remote.
+type prRepo struct {
+	Platform string // github or gitlab
+	Host     string
+	Path     string // owner/repo (GitLab: group/subgroup/repo)
+}
+
+// parseRemoteURL understands https://, ssh:// and scp-style (git@host:path) remotes.
+func parseRemoteURL(remote string) (host, path string, err error) {
+	remote = strings.TrimSpace(remote)
+	if strings.Contains(remote, "://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid remote URL '%s': %v", remote, err)
+		}
+		host, path = u.Hostname(), u.Path
+	} else if at := strings.Index(remote, "@"); at != -1 && strings.Contains(remote[at:], ":") {
+		host, path, _ = strings.Cut(remote[at+1:], ":")
+	} else {
+		return "", "", fmt.Errorf("unsupported remote URL '%s'", remote)
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || !strings.Contains(path, "/") {
+		return "", "", fmt.Errorf("cannot determine the repository from remote URL '%s'", remote)
+	}
+	return host, path, nil
+}
+
+func detectPRRepo(remote string) (prRepo, error) {
+	remoteURL, err := runGit(nil, "remote", "get-url", remote)
+	if err != nil {
+		return prRepo{}, fmt.Errorf("remote '%s' not found", remote)
+	}
+	host, path, err := parseRemoteURL(remoteURL)
+	if err != nil {
+		return prRepo{}, err
+	}
+	repo := prRepo{Host: host, Path: path}
+	switch {
+	case strings.Contains(host, "github"):
+		repo.Platform = "github"
+	case strings.Contains(host, "gitlab"):
+		repo.Platform = "gitlab"
+	default:
+		for _, h := range prConfig.GitLabHosts {
+			if h == host {
+				repo.Platform = "gitlab"
+			}
+		}
+		if repo.Platform == "" {
+			return prRepo{}, fmt.Errorf("unknown hosting service '%s' (add it to pr.gitlab_hosts for self-hosted GitLab)", host)
+		}
+	}
+	return repo, nil
+}
+
+func (r prRepo) token() string {
+	if r.Platform == "github" {
+		for _, v := range []string{os.Getenv("GITHUB_TOKEN"), os.Getenv("GH_TOKEN"), os.ExpandEnv(prConfig.GitHubToken)} {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	if v := os.Getenv("GITLAB_TOKEN"); v != "" {
+		return v
+	}
+	return os.ExpandEnv(prConfig.GitLabToken)
+}
+
+func (r prRepo) apiBase() string {
+	switch {
+	case r.Platform == "gitlab":
+		return "https://" + r.Host + "/api/v4"
+	case r.Host == "github.com":
+		return "https://api.github.com"
+	default:
+		return "https://" + r.Host + "/api/v3" // GitHub Enterprise
+	}
+}
+
+// apiRequest sends a JSON request to the hosting API and decodes the response into out.
+func (r prRepo) apiRequest(ctx context.Context, method, endpoint string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.apiBase()+endpoint, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simple-agent/"+Version)
+	if r.Platform == "github" {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Authorization", "Bearer "+r.token())
+	} else {
+		req.Header.Set("PRIVATE-TOKEN", r.token())
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s API error (status %d): %s", r.Platform, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("error parsing %s response: %v", r.Platform, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// open creates the pull/merge request, or returns the URL of the open one
+// that already exists for the branch.
+func (r prRepo) open(ctx context.Context, branch string, pr prRequest) (string, error) {
+	var created struct {
+		HTMLURL string `json:"html_url"` // GitHub
+		WebURL  string `json:"web_url"`  // GitLab
+	}
+	var existing []struct {
+		HTMLURL string `json:"html_url"`
+		WebURL  string `json:"web_url"`
+	}
+
+	if r.Platform == "github" {
+		owner, _, _ := strings.Cut(r.Path, "/")
+		status, err := r.apiRequest(ctx, "POST", "/repos/"+r.Path+"/pulls", map[string]any{
+			"title": pr.Title, "body": pr.Body, "head": branch, "base": pr.Base, "draft": pr.Draft,
+		}, &created)
+		if err == nil {
+			return created.HTMLURL, nil
+		}
+		if status != http.StatusUnprocessableEntity || !strings.Contains(err.Error(), "already exists") {
+			return "", err
+		}
+		query := url.Values{"head": {owner + ":" + branch}, "state": {"open"}}
+		if _, err := r.apiRequest(ctx, "GET", "/repos/"+r.Path+"/pulls?"+query.Encode(), nil, &existing); err != nil || len(existing) == 0 {
+			return "", fmt.Errorf("a pull request for '%s' already exists", branch)
+		}
+		return existing[0].HTMLURL, nil
+	}
+
+	project := "/projects/" + url.PathEscape(r.Path)
+	title := pr.Title
+	if pr.Draft {
+		title = "Draft: " + title
+	}
+	status, err := r.apiRequest(ctx, "POST", project+"/merge_requests", map[string]any{
+		"title": title, "description": pr.Body, "source_branch": branch, "target_branch": pr.Base,
+	}, &created)
+	if err == nil {
+		return created.WebURL, nil
+	}
+	if status != http.StatusConflict {
+		return "", err
+	}
+	query := url.Values{"source_branch": {branch}, "state": {"opened"}}
+	if _, err := r.apiRequest(ctx, "GET", project+"/merge_requests?"+query.Encode(), nil, &existing); err != nil || len(existing) == 0 {
+		return "", fmt.Errorf("a merge request for '%s' already exists", branch)
+	}
+	return existing[0].WebURL, nil
+}
+
+// openIssue opens an issue and returns its URL.
+func (r prRepo) openIssue(ctx context.Context, title, body string) (string, error) {
+	var created struct {
+		HTMLURL string `json:"html_url"` // GitHub
+		WebURL  string `json:"web_url"`  // GitLab
+	}
+	if r.Platform == "github" {
+		if _, err := r.apiRequest(ctx, "POST", "/repos/"+r.Path+"/issues", map[string]any{"title": title, "body": body}, &created); err != nil {
+			return "", err
+		}
+		return created.HTMLURL, nil
+	}
+	if _, err := r.apiRequest(ctx, "POST", "/projects/"+url.PathEscape(r.Path)+"/issues", map[string]any{"title": title, "description": body}, &created); err != nil {
+		return "", err
+	}
+	return created.WebURL, nil
+}
+
+// defaultBaseBranch returns the remote's default branch, falling back to main.
+func defaultBaseBranch(remote string) string {
+	if ref, err := runGit(nil, "symbolic-ref", "--short", "refs/remotes/"+remote+"/HEAD"); err == nil {
+		return strings.TrimPrefix(ref, remote+"/")
+	}
+	for _, name := range []string{"main", "master"} {
+		if _, err := runGit(nil, "rev-parse", "--verify", "-q", "refs/remotes/"+remote+"/"+name); err == nil {
+			return name
+		}
+	}
+	return "main"
+}
+
+// generatePRText asks the model for a title and description based on the
+// branch's commits, diffstat and the session's conversation.
+func generatePRText(apiKey, base string, history []Message) (string, string, error) {
+	upstream := prConfig.remote() + "/" + base
+	if _, err := runGit(nil, "rev-parse", "--verify", "-q", upstream); err != nil {
+		upstream = base
+	}
+	commits, _ := runGit(nil, "log", "--format=- %s%n%b", upstream+"..HEAD")
+	stat, _ := runGit(nil, "diff", "--stat", upstream+"...HEAD")
+	var requests []string
+	for _, msg := range history {
+		if msg.Role == "user" && msg.Content != "" {
+			requests = append(requests, "- "+strings.SplitN(strings.TrimSpace(msg.Content), "\n", 2)[0])
+		}
+	}
+	if len(requests) > 20 {
+		requests = requests[len(requests)-20:]
+	}
+	input := fmt.Sprintf("Commits:\n%s\n\nDiffstat:\n%s\n\nUser requests in this session:\n%s", commits, stat, strings.Join(requests, "\n"))
+
+	resp, err := requestCompletion(internalRequest(context.Background()), &http.Client{}, apiKey, ChatCompletionRequest{
+		Model: FlashModelName,
+		Messages: []Message{
+			{Role: "system", Content: prPrompt},
+			{Role: "user", Content: input},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	content := strings.TrimSpace(resp.Choices[0].Message.Content)
+	if start, end := strings.Index(content, "{"), strings.LastIndex(content, "}"); start != -1 && end > start {
+		content = content[start : end+1]
+	}
+	var text struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}
+	if err := json.Unmarshal([]byte(content), &text); err != nil || text.Title == "" {
+		return "", "", fmt.Errorf("model returned an invalid PR description")
+	}
+	return text.Title, text.Body, nil
+}
+
+func (c PRConfig) remote() string {
+	if c.Remote != "" {
+		return c.Remote
+	}
+	return "origin"
+}
+
+// createPullRequest pushes the current branch and opens a PR. confirm is
+// called with the final request before anything leaves the machine.
+func createPullRequest(ctx context.Context, apiKey string, history []Message, pr prRequest, confirm func(branch string, pr prRequest) bool) (string, error) {
+	if !isGitRepo() {
+		return "", fmt.Errorf("not a git repository")
+	}
+	remote := prConfig.remote()
+	repo, err := detectPRRepo(remote)
+	if err != nil {
+		return "", err
+	}
+	if repo.token() == "" {
+		if repo.Platform == "github" {
+			return "", fmt.Errorf("no GitHub token: set GITHUB_TOKEN (or GH_TOKEN) or pr.github_token in the config")
+		}
+		return "", fmt.Errorf("no GitLab token: set GITLAB_TOKEN or pr.gitlab_token in the config")
+	}
+	branch, err := runGit(nil, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("HEAD is detached; create a branch first")
+	}
+	if pr.Base == "" {
+		pr.Base = defaultBaseBranch(remote)
+	}
+	if branch == pr.Base {
+		return "", fmt.Errorf("the current branch is the base branch '%s'; create a feature branch first", branch)
+	}
+	if isGitDirty() {
+		fmt.Println("\033[33m[PR] Warning: there are uncommitted changes; they will not be part of the PR.\033[0m")
+	}
+	if pr.Title == "" {
+		title, body, err := generatePRText(apiKey, pr.Base, history)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate PR description: %v", err)
+		}
+		pr.Title = title
+		if pr.Body == "" {
+			pr.Body = body
+		}
+	}
+	if !confirm(branch, pr) {
+		return "", toolError(errUserRejected, fmt.Errorf("pull request cancelled by the user"))
+	}
+
+	fmt.Printf("[PR] Pushing %s to %s...\n", branch, remote)
+	if out, err := exec.CommandContext(ctx, "git", "push", "-u", remote, branch).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git push failed: %v\n%s", err, out)
+	}
+	prURL, err := repo.open(ctx, branch, pr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("\033[32m[PR] %s\033[0m\n", prURL)
+	return prURL, nil
+}
+
+func printPRRequest(branch string, pr prRequest) {
+	kind := "Pull request"
+	if pr.Draft {
+		kind = "Draft pull request"
+	}
+	fmt.Printf("\n\033[1m%s: %s → %s\033[0m\n", kind, branch, pr.Base)
+	fmt.Printf("Title: %s\n\n%s\n\n", pr.Title, pr.Body)
+}
+
+// handlePRCommand handles "/pr [base]".
+func handlePRCommand(arg string, messages []Message, apiKey string) {
+	ctx := context.Background()
+	pr := prRequest{Base: arg, Draft: prConfig.Draft}
+	_, err := createPullRequest(ctx, apiKey, messages, pr, func(branch string, pr prRequest) bool {
+		printPRRequest(branch, pr)
+		return strings.ToLower(askUser(ctx, "Push and open this pull request? [y/N]: ")) == "y"
+	})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// --- Code Outline ---
+
+// code_outline lists the symbols of a source file with line ranges. Go files
+// are parsed with go/parser; TypeScript/JavaScript and Python use lightweight
+// scanners (brace matching and indentation) so the binary keeps building
+// without cgo or third-party parsers.
+
+var codeOutlineTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "code_outline",
+		Description: "List the symbols (types, functions, methods, classes) defined in a source file with their line ranges, without reading the whole file. Supports Go, TypeScript/JavaScript and Python. Use it to navigate large files, then read only the line ranges you need.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"path": {
+					"type": "string",
+					"description": "The source file to outline"
+				}
+			},
+			"required": ["path"]
+		}`),
+	},
+}
+
+type OutlineSymbol struct {
+	Kind  string // func, method, type, class, interface, ...
+	Name  string
+	Start int // 1-based, inclusive
+	End   int
+	Depth int // Nesting level for indentation
+}
+
+func outlineFile(ctx context.Context, path string) (string, error) {
+	absPath, err := validatePath(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(absPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var symbols []OutlineSymbol
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".go":
+		symbols, err = outlineGo(absPath, content)
+	case ".py":
+		symbols = outlinePython(string(content))
+	case ".ts", ".tsx", ".js", ".jsx", ".mjs", ".cjs":
+		symbols = outlineJS(string(content))
+	default:
+		return "", toolError(errValidation, fmt.Errorf("unsupported file type '%s' (supported: .go, .ts, .tsx, .js, .jsx, .py)", filepath.Ext(path)))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	lineCount := strings.Count(string(content), "\n") + 1
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s (%d lines, %d symbols)\n", path, lineCount, len(symbols)))
+	for _, s := range symbols {
+		sb.WriteString(fmt.Sprintf("%s%s %s  L%d-%d\n", strings.Repeat("  ", s.Depth), s.Kind, s.Name, s.Start, s.End))
+	}
+	return sb.String(), nil
+}
+
+func outlineGo(path string, content []byte) ([]OutlineSymbol, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, content, parser.SkipObjectResolution)
+	if file == nil {
+		return nil, fmt.Errorf("failed to parse Go file: %v", err)
+	}
+	// Partial ASTs of files with syntax errors are still useful
+
+	lines := func(n ast.Node) (int, int) {
+		return fset.Position(n.Pos()).Line, fset.Position(n.End()).Line
+	}
+	var symbols []OutlineSymbol
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			start, end := lines(d)
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				recv := types.ExprString(d.Recv.List[0].Type)
+				symbols = append(symbols, OutlineSymbol{Kind: "method", Name: "(" + recv + ") " + d.Name.Name, Start: start, End: end})
+			} else {
+				symbols = append(symbols, OutlineSymbol{Kind: "func", Name: d.Name.Name, Start: start, End: end})
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					kind := "type"
+					switch s.Type.(type) {
+					case *ast.StructType:
+						kind = "struct"
+					case *ast.InterfaceType:
+						kind = "interface"
+					}
+					start, end := lines(s)
+					if len(d.Specs) == 1 {
+						start, end = lines(d)
+					}
+					symbols = append(symbols, OutlineSymbol{Kind: kind, Name: s.Name.Name, Start: start, End: end})
+				case *ast.ValueSpec:
+					start, end := lines(s)
+					for _, name := range s.Names {
+						if name.Name != "_" {
+							symbols = append(symbols, OutlineSymbol{Kind: d.Tok.String(), Name: name.Name, Start: start, End: end})
+						}
+					}
+				}
+			}
+		}
+	}
+	return symbols, nil
+}
+
+var pythonDefRe = regexp.MustCompile(`^(\s*)(async\s+def|def|class)\s+(\w+)`)
+
+func outlinePython(content string) []OutlineSymbol {
+	lines := strings.Split(content, "\n")
+	indentOf := func(line string) int {
+		return len(line) - len(strings.TrimLeft(line, " \t"))
+	}
+
+	var symbols []OutlineSymbol
+	var stack []int // Indents of enclosing definitions
+	for i, line := range lines {
+		m := pythonDefRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		indent := len(m[1])
+		for len(stack) > 0 && stack[len(stack)-1] >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		// The body ends before the next non-blank line at the same or lower indent
+		end := i
+		for j := i + 1; j < len(lines); j++ {
+			trimmed := strings.TrimSpace(lines[j])
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			if indentOf(lines[j]) <= indent {
+				break
+			}
+			end = j
+		}
+
+		kind := "def"
+		if m[2] == "class" {
+			kind = "class"
+		} else if len(stack) > 0 {
+			kind = "method"
+		}
+		symbols = append(symbols, OutlineSymbol{Kind: kind, Name: m[3], Start: i + 1, End: end + 1, Depth: len(stack)})
+		stack = append(stack, indent)
+	}
+	return symbols
+}
+
+var (
+	jsDeclRe   = regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:declare\s+)?(?:abstract\s+)?(?:async\s+)?(function\*?|class|interface|enum|type|namespace)\s+([A-Za-z_$][\w$]*)`)
+	jsArrowRe  = regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+([A-Za-z_$][\w$]*)\s*(?::[^=]+)?=\s*(?:async\s+)?(?:function\b|(?:\([^)]*\)|[A-Za-z_$][\w$]*)\s*(?::\s*[^=]+)?=>)`)
+	jsMethodRe = regexp.MustCompile(`^\s*(?:(?:public|private|protected|static|async|readonly|override|get|set)\s+)*\*?([A-Za-z_$#][\w$]*)\s*(?:<[^>]*>)?\s*\(`)
+)
+
+var jsControlKeywords = map[string]bool{"if": true, "for": true, "while": true, "switch": true, "catch": true, "return": true, "function": true, "with": true}
+
+// stripJSCode blanks out strings and comments (keeping newlines) so braces
+// can be counted reliably.
+func stripJSCode(content string) string {
+	out := []byte(content)
+	for i := 0; i < len(out); i++ {
+		switch {
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '*':
+			for ; i < len(out) && !(out[i] == '*' && i+1 < len(out) && out[i+1] == '/'); i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			if i+1 < len(out) {
+				out[i], out[i+1] = ' ', ' '
+				i++
+			}
+		case out[i] == '"' || out[i] == '\'' || out[i] == '`':
+			quote := out[i]
+			for i++; i < len(out) && out[i] != quote; i++ {
+				if out[i] == '\\' && i+1 < len(out) {
+					out[i] = ' '
+					i++
+				}
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+		}
+	}
+	return string(out)
+}
+
+func outlineJS(content string) []OutlineSymbol {
+	lines := strings.Split(stripJSCode(content), "\n")
+
+	// depth[i] is the brace depth at the start of line i
+	depth := make([]int, len(lines)+1)
+	for i, line := range lines {
+		depth[i+1] = depth[i] + strings.Count(line, "{") - strings.Count(line, "}")
+	}
+
+	// blockEnd finds the line closing the first block opened on or shortly
+	// after line i
+	blockEnd := func(i int) int {
+		for j := i; j < len(lines) && j < i+5; j++ {
+			if !strings.Contains(lines[j], "{") {
+				if strings.Contains(lines[j], ";") {
+					return j
+				}
+				continue
+			}
+			for k := j; k < len(lines); k++ {
+				if depth[k+1] <= depth[i] {
+					return k
+				}
+			}
+			return len(lines) - 1
+		}
+		return i
+	}
+
+	var symbols []OutlineSymbol
+	var classes []OutlineSymbol // Enclosing classes, for methods
+	for i, line := range lines {
+		for len(classes) > 0 && i+1 > classes[len(classes)-1].End {
+			classes = classes[:len(classes)-1]
+		}
+
+		var kind, name string
+		if m := jsDeclRe.FindStringSubmatch(line); m != nil {
+			kind, name = strings.TrimSuffix(m[1], "*"), m[2]
+		} else if m := jsArrowRe.FindStringSubmatch(line); m != nil {
+			kind, name = "function", m[1]
+		} else if m := jsMethodRe.FindStringSubmatch(line); m != nil && len(classes) > 0 &&
+			depth[i] == depth[classes[len(classes)-1].Start-1]+1 && !jsControlKeywords[m[1]] {
+			kind, name = "method", m[1]
+		}
+		if kind == "" {
+			continue
+		}
+
+		sym := OutlineSymbol{Kind: kind, Name: name, Start: i + 1, End: blockEnd(i) + 1, Depth: len(classes)}
+		symbols = append(symbols, sym)
+		if kind == "class" {
+			classes = append(classes, sym)
+		}
+	}
+	return symbols
+}
+
+// --- File Limits ---
+
+// The text tools refuse binary files, and files over a size limit, with an
+// error that points the model at a better tool. The limits come from the
+// config (max_edit_bytes, max_read_bytes; 0 disables them), and apply_udiff
+// takes "force" for an intentional edit of a large file.
+
+var (
+	maxEditBytes = 1 << 20
+	maxReadBytes = 10 << 20
+)
+
+// looksBinary reports whether data is not text: it contains a NUL byte or
+// isn't valid UTF-8.
+func looksBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) != -1 || !utf8.Valid(data)
+}
+
+func binaryFileError(path string, size int64) error {
+	return codedToolError(errValidation, "binary_file", "Don't edit or read binary files as text; use a command or script that understands the format.", fmt.Errorf("'%s' is a binary file (%d bytes)", path, size))
+}
+
+// checkEditableFile refuses edits to binary files and, unless force is set,
+// to files over max_edit_bytes. A file that doesn't exist yet passes.
+func checkEditableFile(path, absPath string, force bool) error {
+	info, err := os.Stat(absPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if !force && maxEditBytes > 0 && info.Size() > int64(maxEditBytes) {
+		return codedToolError(errValidation, "file_too_large", "Check that the edit is intended (generated files are better regenerated), then resend it with \"force\": true.", fmt.Errorf("'%s' is %d bytes, over the %d byte limit for edits", path, info.Size(), maxEditBytes))
+	}
+	if data, err := os.ReadFile(absPath); err == nil && looksBinary(data) {
+		return binaryFileError(path, info.Size())
+	}
+	return nil
+}
+
+// --- File Reading ---
+
+// read_file returns small files whole. Files too large for the context get a
+// structural outline instead, and the model then requests line ranges.
+// apply_udiff always matches hunks against the full file on disk, using the
+// line numbers of the hunk header to pick between repeated context.
+
+var readFileTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "read_file",
+		Description: "Read a text file with line numbers. Large files return an outline (symbols or sections with line ranges) instead of their content; call again with start_line/end_line to read a range. Ranges are limited to 800 lines.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"path": {"type": "string", "description": "The file to read"},
+				"start_line": {"type": "integer", "description": "First line to read (1-based)"},
+				"end_line": {"type": "integer", "description": "Last line to read (inclusive)"}
+			},
+			"required": ["path"]
+		}`),
+	},
+}
+
+const (
+	maxReadLines      = 800    // Lines per range
+	maxWholeFileLines = 1000   // Larger files return an outline when no range is given
+	maxWholeFileBytes = 100000 // Likewise for files with very long lines
+	outlineChunkLines = 200    // Section size of the generic outline
+)
+
+// readFileRange implements read_file.
+func readFileRange(ctx context.Context, path string, start, end int) (string, error) {
+	absPath, err := validatePath(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(absPath); err == nil && maxReadBytes > 0 && info.Size() > int64(maxReadBytes) {
+		return "", codedToolError(errValidation, "file_too_large", "Look at parts of it with run_command (head, tail, grep -n, sed -n).", fmt.Errorf("'%s' is %d bytes, over the %d byte limit for read_file", path, info.Size(), maxReadBytes))
+	}
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	if looksBinary(data) {
+		return "", binaryFileError(path, int64(len(data)))
+	}
+	seenFiles.Record(absPath, data)
+	lines := strings.Split(strings.TrimSuffix(diffengine.Normalize(string(data)), "\n"), "\n")
+
+	if start <= 0 && end <= 0 {
+		if len(lines) <= maxWholeFileLines && len(data) <= maxWholeFileBytes {
+			return numberLines(lines, 1), nil
+		}
+		return largeFileOutline(ctx, path, lines, len(data)), nil
+	}
+
+	if start <= 0 {
+		start = 1
+	}
+	if end <= 0 || end > len(lines) {
+		end = len(lines)
+	}
+	if start > len(lines) {
+		return "", toolError(errValidation, fmt.Errorf("start_line %d is past the end of the file (%d lines)", start, len(lines)))
+	}
+	if start > end {
+		return "", toolError(errValidation, fmt.Errorf("start_line %d is after end_line %d", start, end))
+	}
+	truncated := false
+	if end-start+1 > maxReadLines {
+		end, truncated = start+maxReadLines-1, true
+	}
+	out := fmt.Sprintf("%s lines %d-%d of %d:\n%s", path, start, end, len(lines), numberLines(lines[start-1:end], start))
+	if truncated {
+		out += fmt.Sprintf("\n[Range limited to %d lines. Continue with start_line=%d.]", maxReadLines, end+1)
+	}
+	return out, nil
+}
+
+// numberLines prefixes each line with its number. The prefix is not part of
+// the file and must not be copied into diffs.
+func numberLines(lines []string, first int) string {
+	var sb strings.Builder
+	for i, line := range lines {
+		fmt.Fprintf(&sb, "%6d\t%s\n", first+i, line)
+	}
+	return sb.String()
+}
+
+// largeFileOutline describes a file that is too large to return whole. Source
+// files use code_outline; other files are split into headings (Markdown) or
+// fixed-size sections with a preview of their first line.
+func largeFileOutline(ctx context.Context, path string, lines []string, size int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s is too large to read at once (%d lines, %d bytes). Read it in ranges with start_line/end_line (up to %d lines each).\n\n", path, len(lines), size, maxReadLines)
+	if outline, err := outlineFile(ctx, path); err == nil {
+		sb.WriteString(outline)
+		return sb.String()
+	}
+
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".md" || ext == ".markdown" {
+		inCode := false
+		var headings []string
+		for i, line := range lines {
+			if strings.HasPrefix(line, "```") {
+				inCode = !inCode
+			}
+			if !inCode && strings.HasPrefix(line, "#") {
+				headings = append(headings, fmt.Sprintf("L%d  %s", i+1, line))
+			}
+		}
+		if len(headings) > 0 {
+			sb.WriteString("Headings:\n")
+			sb.WriteString(strings.Join(headings, "\n"))
+			return sb.String() + "\n"
+		}
+	}
+
+	sb.WriteString("Sections:\n")
+	for start := 0; start < len(lines); start += outlineChunkLines {
+		end := min(start+outlineChunkLines, len(lines))
+		preview := ""
+		for _, line := range lines[start:end] {
+			if strings.TrimSpace(line) != "" {
+				preview = strings.TrimSpace(line)
+				break
+			}
+		}
+		preview = truncateLine(preview, 80)
+		fmt.Fprintf(&sb, "L%d-%d  %s\n", start+1, end, preview)
+	}
+	return sb.String()
+}
+
+// --- Semantic Index ---
+
+// CodeIndex stores embeddings of project files in .simple_agent/index.json so
+// the model can search code by meaning. Chunk text is not stored; results are
+// read back from the files, which are re-indexed whenever their content
+// changes.
+
+const (
+	indexChunkLines   = 60
+	indexChunkOverlap = 10
+	indexMaxFileSize  = 512 * 1024
+	indexMaxChunks    = 20000
+	indexBatchSize    = 50
+)
+
+var semanticSearchTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "semantic_search",
+		Description: "Search the project's code by meaning using an embedding index. Use it to find where a concept is implemented when you don't know the exact identifiers to grep for (e.g. 'where are API retries handled'). Returns the best matching file regions with line numbers. The index is updated automatically before each search.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"query": {
+					"type": "string",
+					"description": "A natural-language description of the code you are looking for"
+				},
+				"limit": {
+					"type": "integer",
+					"description": "Maximum number of results (default 5, max 20)"
+				}
+			},
+			"required": ["query"]
+		}`),
+	},
+}
+
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type EmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Error *APIError `json:"error,omitempty"`
+}
+
+type IndexedChunk struct {
+	StartLine int       `json:"start"`
+	EndLine   int       `json:"end"`
+	Vector    []float32 `json:"vector"`
+}
+
+type IndexedFile struct {
+	Hash    string         `json:"hash"`
+	ModTime time.Time      `json:"mod_time"`
+	Size    int64          `json:"size"`
+	Chunks  []IndexedChunk `json:"chunks"`
+}
+
+type CodeIndex struct {
+	mu    sync.Mutex
+	path  string
+	Model string                  `json:"model"`
+	Files map[string]*IndexedFile `json:"files"`
+}
+
+type SearchResult struct {
+	Path      string
+	StartLine int
+	EndLine   int
+	Score     float64
+}
+
+func getIndexPath() string {
+	return filepath.Join(".simple_agent", "index.json")
+}
+
+func loadCodeIndex() *CodeIndex {
+	idx := &CodeIndex{path: getIndexPath(), Model: EmbeddingModelName, Files: make(map[string]*IndexedFile)}
+	data, err := os.ReadFile(idx.path)
+	if err != nil {
+		return idx
+	}
+	var stored CodeIndex
+	if err := json.Unmarshal(data, &stored); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to parse index %s, rebuilding: %v\n", idx.path, err)
+		return idx
+	}
+	// Vectors from different models are not comparable
+	if stored.Model == EmbeddingModelName && stored.Files != nil {
+		idx.Files = stored.Files
+	}
+	return idx
+}
+
+func (idx *CodeIndex) save() error {
+	if err := os.MkdirAll(filepath.Dir(idx.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(idx.path, data, 0644)
+}
+
+// listIndexableFiles returns text files tracked by git (or, outside a
+// repository, all non-hidden files), relative to the working directory.
+func listIndexableFiles() []string {
+	var candidates []string
+	if out, err := runGit(nil, "ls-files", "--cached", "--others", "--exclude-standard"); err == nil {
+		candidates = strings.Split(out, "\n")
+	} else {
+		filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			name := d.Name()
+			if d.IsDir() {
+				if path != "." && (strings.HasPrefix(name, ".") || name == "node_modules" || name == "vendor") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			candidates = append(candidates, path)
+			return nil
+		})
+	}
+
+	cwd, _ := os.Getwd()
+	var files []string
+	for _, path := range candidates {
+		if path == "" || isAgentStatePath(path) || agentIgnored(cwd, path) != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > indexMaxFileSize {
+			continue
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+func chunkLines(lines []string) [][2]int {
+	var chunks [][2]int
+	step := indexChunkLines - indexChunkOverlap
+	for start := 0; start < len(lines); start += step {
+		end := start + indexChunkLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+		chunks = append(chunks, [2]int{start, end})
+		if end == len(lines) {
+			break
+		}
+	}
+	return chunks
+}
+
+// Refresh re-embeds new and changed files and drops deleted ones. It returns
+// the number of files that were (re-)indexed.
+func (idx *CodeIndex) Refresh(ctx context.Context, client *http.Client, apiKey string) (int, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	type pendingChunk struct {
+		path string
+		text string
+		span [2]int
+	}
+	var pending []pendingChunk
+	updated := make(map[string]*IndexedFile)
+	expected := make(map[string]int)
+	present := make(map[string]bool)
+	totalChunks := 0
+
+	files := listIndexableFiles()
+	for _, path := range files {
+		present[path] = true
+	}
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		existing := idx.Files[path]
+		if existing != nil && existing.ModTime.Equal(info.ModTime()) && existing.Size == info.Size() {
+			totalChunks += len(existing.Chunks)
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil || bytes.IndexByte(content, 0) != -1 {
+			continue // Unreadable or binary
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(content))
+		if existing != nil && existing.Hash == hash {
+			existing.ModTime, existing.Size = info.ModTime(), info.Size()
+			totalChunks += len(existing.Chunks)
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		spans := chunkLines(lines)
+		if totalChunks+len(spans) > indexMaxChunks {
+			fmt.Printf("\033[33m[Index] Chunk limit (%d) reached; skipping remaining files.\033[0m\n", indexMaxChunks)
+			break
+		}
+		totalChunks += len(spans)
+		expected[path] = len(spans)
+		updated[path] = &IndexedFile{Hash: hash, ModTime: info.ModTime(), Size: info.Size()}
+		for _, span := range spans {
+			text := path + "\n" + strings.Join(lines[span[0]:span[1]], "\n")
+			pending = append(pending, pendingChunk{path: path, text: text, span: span})
+		}
+	}
+
+	for path := range idx.Files {
+		if !present[path] {
+			delete(idx.Files, path)
+		}
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("[Index] Embedding %d chunks from %d files...\n", len(pending), len(updated))
+	}
+	for start := 0; start < len(pending); start += indexBatchSize {
+		end := start + indexBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		inputs := make([]string, 0, end-start)
+		for _, p := range pending[start:end] {
+			inputs = append(inputs, p.text)
+		}
+		vectors, err := requestEmbeddings(ctx, client, apiKey, inputs)
+		if err != nil {
+			// Keep what was embedded so far; unfinished files are retried next time
+			idx.save()
+			return 0, err
+		}
+		for i, p := range pending[start:end] {
+			f := updated[p.path]
+			f.Chunks = append(f.Chunks, IndexedChunk{StartLine: p.span[0] + 1, EndLine: p.span[1], Vector: normalizeVector(vectors[i])})
+			if len(f.Chunks) == expected[p.path] {
+				idx.Files[p.path] = f
+			}
+		}
+	}
+
+	if len(updated) > 0 {
+		if err := idx.save(); err != nil {
+			return len(updated), fmt.Errorf("failed to save index: %v", err)
+		}
+	}
+	return len(updated), nil
+}
+
+func normalizeVector(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+// Search returns the chunks most similar to query. Vectors are stored
+// normalized, so the dot product is the cosine similarity.
+func (idx *CodeIndex) Search(ctx context.Context, client *http.Client, apiKey, query string, limit int) ([]SearchResult, error) {
+	vectors, err := requestEmbeddings(ctx, client, apiKey, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	q := normalizeVector(vectors[0])
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var results []SearchResult
+	for path, f := range idx.Files {
+		for _, c := range f.Chunks {
+			if len(c.Vector) != len(q) {
+				continue
+			}
+			var dot float64
+			for i := range q {
+				dot += float64(q[i]) * float64(c.Vector[i])
+			}
+			results = append(results, SearchResult{Path: path, StartLine: c.StartLine, EndLine: c.EndLine, Score: dot})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (idx *CodeIndex) Stats() (files, chunks int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, f := range idx.Files {
+		chunks += len(f.Chunks)
+	}
+	return len(idx.Files), chunks
+}
+
+// formatSearchResults renders results with the current file content.
+func formatSearchResults(results []SearchResult) string {
+	if len(results) == 0 {
+		return "No matches found."
+	}
+	var sb strings.Builder
+	for _, r := range results {
+		sb.WriteString(fmt.Sprintf("%s:%d-%d (score %.2f)\n", r.Path, r.StartLine, r.EndLine, r.Score))
+		content, err := os.ReadFile(r.Path)
+		if err != nil {
+			sb.WriteString(fmt.Sprintf("(unreadable: %v)\n\n", err))
+			continue
+		}
+		lines := strings.Split(string(content), "\n")
+		end := r.EndLine
+		if end > len(lines) {
+			end = len(lines)
+		}
+		sb.WriteString("```\n")
+		for i := r.StartLine - 1; i < end && i >= 0; i++ {
+			sb.WriteString(fmt.Sprintf("%4d| %s\n", i+1, lines[i]))
+		}
+		sb.WriteString("```\n\n")
+	}
+	return sb.String()
+}
+
+// requestEmbeddings calls the provider's OpenAI-compatible embeddings endpoint,
+// retrying rate limits and server errors a few times.
+func requestEmbeddings(ctx context.Context, client *http.Client, apiKey string, inputs []string) ([][]float32, error) {
+	jsonData, err := json.Marshal(EmbeddingRequest{Model: EmbeddingModelName, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	retries := newRetrier()
+	for {
+		req, err := http.NewRequestWithContext(ctx, "POST", EmbeddingURL, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+
+		var class, lastFailure string
+		var retryAfter time.Duration
+		var body []byte
+		started := time.Now()
+		resp, err := client.Do(req)
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logLLMExchange(req, apiKey, jsonData, resp, body, err, started)
+		if err != nil {
+			class, lastFailure = classifyFailure(0, err), err.Error()
+		} else if class = classifyFailure(resp.StatusCode, nil); class != "" {
+			lastFailure = fmt.Sprintf("status %d: %s", resp.StatusCode, truncateForError(string(body)))
+			retryAfter = parseRetryAfter(resp.Header)
+		} else if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("embedding API Error (Status %d): %s", resp.StatusCode, string(body))
+		}
+
+		if class != "" {
+			delay, ok := retries.next(class, retryAfter)
+			if !ok {
+				return nil, retries.failure(class, lastFailure)
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		var embResp EmbeddingResponse
+		if err := json.Unmarshal(body, &embResp); err != nil {
+			return nil, fmt.Errorf("error parsing response: %v", err)
+		}
+		if embResp.Error != nil {
+			return nil, fmt.Errorf("embedding API Error: %s", embResp.Error.Message)
+		}
+		if len(embResp.Data) != len(inputs) {
+			return nil, fmt.Errorf("embedding API returned %d vectors for %d inputs", len(embResp.Data), len(inputs))
+		}
+		vectors := make([][]float32, len(inputs))
+		for _, d := range embResp.Data {
+			if d.Index < 0 || d.Index >= len(vectors) {
+				return nil, fmt.Errorf("embedding API returned invalid index %d", d.Index)
+			}
+			vectors[d.Index] = d.Embedding
+		}
+		return vectors, nil
+	}
+}
+
+// --- Project Memory ---
+
+// Memory is the structured knowledge base for a project: decisions,
+// conventions, and gotchas that should survive across sessions. It is stored
+// in ~/.simple_agent/memory/<project>.json, outside the repository.
+
+var memoryKinds = []string{"decision", "convention", "gotcha", "note"}
+
+// maxPromptMemories caps how many entries are listed in the system prompt.
+// Older entries are surfaced per turn when they match the user's message.
+const maxPromptMemories = 30
+
+var rememberTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "remember",
+		Description: "Save a fact to long-term project memory so it is available in future sessions. Store one self-contained fact per call: a decision and its reason, a project convention, or a gotcha (a tricky bug or pitfall and how to avoid it).",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"kind": {
+					"type": "string",
+					"enum": ["decision", "convention", "gotcha", "note"],
+					"description": "The kind of fact"
+				},
+				"text": {
+					"type": "string",
+					"description": "The fact, written so it makes sense without the current conversation"
+				},
+				"tags": {
+					"type": "array",
+					"items": {"type": "string"},
+					"description": "Optional keywords (e.g. file names, subsystems) to help recall"
+				}
+			},
+			"required": ["kind", "text"]
+		}`),
+	},
+}
+
+var recallTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "recall",
+		Description: "Search long-term project memory by keywords. Returns matching entries with their IDs, most relevant first. An empty query returns the most recent entries.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"query": {
+					"type": "string",
+					"description": "Keywords to search for"
+				},
+				"limit": {
+					"type": "integer",
+					"description": "Maximum number of entries to return (default 10)"
+				}
+			},
+			"required": ["query"]
+		}`),
+	},
+}
+
+type MemoryEntry struct {
+	ID      int       `json:"id"`
+	Kind    string    `json:"kind"`
+	Text    string    `json:"text"`
+	Tags    []string  `json:"tags,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type Memory struct {
+	mu      sync.Mutex
+	path    string
+	Project string        `json:"project"`
+	NextID  int           `json:"next_id"`
+	Entries []MemoryEntry `json:"entries"`
+}
+
+func getMemoryPath() (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	// Directory names repeat across machines and checkouts, so the hash of
+	// the full path keeps projects apart
+	sum := sha1.Sum([]byte(cwd))
+	name := fmt.Sprintf("%s-%x.json", filepath.Base(cwd), sum[:4])
+	return filepath.Join(home, ".simple_agent", "memory", name), nil
+}
+
+// loadMemory always returns a usable Memory; if it cannot be persisted, a
+// warning is printed and entries only last for the session.
+func loadMemory() *Memory {
+	m := &Memory{NextID: 1}
+	path, err := getMemoryPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Project memory disabled: %v\n", err)
+		return m
+	}
+	m.path = path
+	m.Project, _ = os.Getwd()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to parse memory %s: %v\n", path, err)
+	}
+	return m
+}
+
+// save writes the memory file. Callers must hold m.mu.
+func (m *Memory) save() error {
+	if m.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, data, 0644)
+}
+
+// Add stores a new entry. Re-adding an existing fact returns the original.
+func (m *Memory) Add(kind, text string, tags []string) (MemoryEntry, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return MemoryEntry{}, fmt.Errorf("memory text is empty")
+	}
+	validKind := false
+	for _, k := range memoryKinds {
+		validKind = validKind || k == kind
+	}
+	if !validKind {
+		return MemoryEntry{}, fmt.Errorf("unknown memory kind '%s' (use one of: %s)", kind, strings.Join(memoryKinds, ", "))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.Entries {
+		if strings.EqualFold(e.Text, text) {
+			return e, nil
+		}
+	}
+	entry := MemoryEntry{ID: m.NextID, Kind: kind, Text: text, Tags: tags, Created: time.Now()}
+	m.NextID++
+	m.Entries = append(m.Entries, entry)
+	if err := m.save(); err != nil {
+		return entry, fmt.Errorf("memory saved for this session only: %v", err)
+	}
+	return entry, nil
+}
+
+// Forget removes entries by ID and returns how many were removed.
+func (m *Memory) Forget(ids ...int) (int, error) {
+	drop := make(map[int]bool)
+	for _, id := range ids {
+		drop[id] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.Entries[:0]
+	removed := 0
+	for _, e := range m.Entries {
+		if drop[e.ID] {
+			removed++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	m.Entries = kept
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, m.save()
+}
+
+func (m *Memory) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Entries = nil
+	return m.save()
+}
+
+// Search ranks entries by how many query words they contain. An empty query
+// returns the most recent entries.
+func (m *Memory) Search(query string, limit int) []MemoryEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return searchMemories(m.Entries, query, limit)
+}
+
+func searchMemories(entries []MemoryEntry, query string, limit int) []MemoryEntry {
+	if limit <= 0 {
+		limit = 10
+	}
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.'
+	}) {
+		if len(w) >= 3 {
+			words = append(words, w)
+		}
+	}
+
+	type scored struct {
+		entry MemoryEntry
+		score int
+	}
+	var matches []scored
+	for _, e := range entries {
+		score := 1
+		if len(words) > 0 {
+			score = 0
+			haystack := strings.ToLower(e.Kind + " " + e.Text + " " + strings.Join(e.Tags, " "))
+			for _, w := range words {
+				if strings.Contains(haystack, w) {
+					score++
+				}
+			}
+		} else if query != "" {
+			continue
+		}
+		if score > 0 {
+			matches = append(matches, scored{e, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].entry.ID > matches[j].entry.ID
+	})
+
+	var result []MemoryEntry
+	for i := 0; i < len(matches) && i < limit; i++ {
+		result = append(result, matches[i].entry)
+	}
+	return result
+}
+
+func formatMemoryEntry(e MemoryEntry) string {
+	line := fmt.Sprintf("#%d [%s] %s", e.ID, e.Kind, e.Text)
+	if len(e.Tags) > 0 {
+		line += fmt.Sprintf(" (tags: %s)", strings.Join(e.Tags, ", "))
+	}
+	return line
+}
+
+// PromptSection lists the most recent entries for the system prompt.
+func (m *Memory) PromptSection() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.Entries) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n# Project Memory\nFacts saved in previous sessions. Treat them as project knowledge; update them with 'remember' when they change.\n")
+	start := 0
+	if len(m.Entries) > maxPromptMemories {
+		start = len(m.Entries) - maxPromptMemories
+	}
+	for _, e := range m.Entries[start:] {
+		sb.WriteString("- " + formatMemoryEntry(e) + "\n")
+	}
+	if start > 0 {
+		sb.WriteString(fmt.Sprintf("(%d older entries not shown; use 'recall' to search them.)\n", start))
+	}
+	return sb.String()
+}
+
+// RelevantContext returns older entries (those not listed in the system
+// prompt) that match the user's message.
+func (m *Memory) RelevantContext(input string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.Entries) <= maxPromptMemories || strings.TrimSpace(input) == "" {
+		return ""
+	}
+	older := m.Entries[:len(m.Entries)-maxPromptMemories]
+	var sb strings.Builder
+	for _, e := range searchMemories(older, input, 5) {
+		sb.WriteString("- " + formatMemoryEntry(e) + "\n")
+	}
+	return sb.String()
+}
+
+// ImportFile migrates a remember.txt style Markdown file. Each top-level
+// bullet becomes a note; indented lines are folded into the preceding bullet.
+func (m *Memory) ImportFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var facts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+		case strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* "):
+			facts = append(facts, strings.TrimSpace(line[2:]))
+		case len(facts) > 0:
+			facts[len(facts)-1] += " " + strings.TrimPrefix(strings.TrimPrefix(trimmed, "- "), "* ")
+		default:
+			facts = append(facts, trimmed)
+		}
+	}
+	imported := 0
+	for _, fact := range facts {
+		if _, err := m.Add("note", fact, []string{"imported"}); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+func (m *Memory) printEntries(entries []MemoryEntry) {
+	if len(entries) == 0 {
+		fmt.Println("No memories found.")
+		return
+	}
+	for _, e := range entries {
+		fmt.Printf("  \033[36m#%-4d\033[0m \033[33m%-10s\033[0m %s", e.ID, e.Kind, e.Text)
+		if len(e.Tags) > 0 {
+			fmt.Printf(" \033[90m[%s]\033[0m", strings.Join(e.Tags, ", "))
+		}
+		fmt.Println()
+	}
+}
+
+// handleMemoryCommand implements /memory [list|search <query>|forget <id>...|import [file]|clear].
+func handleMemoryCommand(memory *Memory, arg string) {
+	sub, rest := arg, ""
+	if i := strings.IndexFunc(arg, unicode.IsSpace); i != -1 {
+		sub, rest = arg[:i], strings.TrimSpace(arg[i:])
+	}
+
+	switch sub {
+	case "", "list":
+		memory.mu.Lock()
+		entries := append([]MemoryEntry(nil), memory.Entries...)
+		memory.mu.Unlock()
+		if memory.path != "" {
+			fmt.Printf("Project memory (%s):\n", memory.path)
+		}
+		memory.printEntries(entries)
+	case "search":
+		memory.printEntries(memory.Search(rest, 20))
+	case "forget":
+		var ids []int
+		for _, field := range strings.Fields(rest) {
+			id, err := strconv.Atoi(strings.TrimPrefix(field, "#"))
+			if err != nil {
+				fmt.Printf("Invalid memory ID: %s\n", field)
+				return
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			fmt.Println("Usage: /memory forget <id> [id...]")
+			return
+		}
+		removed, err := memory.Forget(ids...)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Removed %d memories.\n", removed)
+	case "import":
+		path := rest
+		if path == "" {
+			path = "remember.txt"
+		}
+		n, err := memory.ImportFile(path)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		fmt.Printf("Imported %d memories from %s.\n", n, path)
+	case "clear":
+		fmt.Print("Delete all memories for this project? [y/N]: ")
+		confirm, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(confirm)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+		if err := memory.Clear(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Project memory cleared.")
+	default:
+		fmt.Println("Usage: /memory [list | search <query> | forget <id>... | import [file] | clear]")
+	}
+}
+
+// --- Attachments ---
+
+const maxAttachmentSize = 20 * 1024 * 1024
+
+// maxTextAttachment bounds text files inlined into a message.
+const maxTextAttachment = 100 * 1024
+
+// pendingAttachments are sent with the next user message.
+var pendingAttachments []ContentPart
+
+var attachmentImageExts = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// loadAttachment encodes a file as a content part: images as data URLs,
+// PDFs as files and anything else that is valid text inline.
+func loadAttachment(path, provider string) (ContentPart, error) {
+	path = expandPath(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return ContentPart{}, err
+	}
+	if info.IsDir() {
+		return ContentPart{}, fmt.Errorf("%s is a directory", path)
+	}
+	if info.Size() > maxAttachmentSize {
+		return ContentPart{}, fmt.Errorf("%s is too large (%d bytes, max %d)", path, info.Size(), maxAttachmentSize)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ContentPart{}, err
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	mimeType, isImage := attachmentImageExts[ext]
+	if !isImage && ext != ".pdf" {
+		if sniffed := http.DetectContentType(data); strings.HasPrefix(sniffed, "image/") {
+			mimeType, isImage = sniffed, true
+		}
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	switch {
+	case isImage:
+		return ContentPart{Type: "image_url", ImageURL: &ContentImage{URL: "data:" + mimeType + ";base64," + encoded}}, nil
+	case ext == ".pdf" && provider == "gemini":
+		// Gemini's OpenAI-compatible endpoint takes documents as inline data URLs
+		return ContentPart{Type: "image_url", ImageURL: &ContentImage{URL: "data:application/pdf;base64," + encoded}}, nil
+	case ext == ".pdf":
+		return ContentPart{Type: "file", File: &ContentFile{Filename: filepath.Base(path), FileData: "data:application/pdf;base64," + encoded}}, nil
+	case utf8.Valid(data) && !bytes.ContainsRune(data, 0):
+		if len(data) > maxTextAttachment {
+			return ContentPart{}, fmt.Errorf("%s is too large to attach as text (%d bytes, max %d); ask the agent to read it instead", path, len(data), maxTextAttachment)
+		}
+		text := fmt.Sprintf("[Attached file: %s]\n```\n%s\n```", filepath.Base(path), strings.TrimRight(string(data), "\n"))
+		return ContentPart{Type: "text", Text: text}, nil
+	}
+	return ContentPart{}, fmt.Errorf("unsupported attachment type for %s (images, PDFs and text files are supported)", path)
+}
+
+// describeAttachment returns a short label for an attachment.
+func describeAttachment(part ContentPart) string {
+	switch {
+	case part.ImageURL != nil:
+		mimeType := strings.TrimPrefix(strings.SplitN(part.ImageURL.URL, ";", 2)[0], "data:")
+		return fmt.Sprintf("%s, %d KB", mimeType, len(part.ImageURL.URL)*3/4/1024)
+	case part.File != nil:
+		return part.File.Filename
+	default:
+		label := strings.SplitN(part.Text, "\n", 2)[0]
+		return strings.TrimSuffix(strings.TrimPrefix(label, "[Attached file: "), "]")
+	}
+}
+
+// splitDroppedPaths splits input the way a shell would for paths dropped
+// into the terminal: quoted strings and backslash-escaped spaces stay
+// together. It returns each word and its byte range in the input.
+func splitDroppedPaths(input string) (words []string, spans [][2]int) {
+	var word strings.Builder
+	start, quote, inWord := 0, rune(0), false
+	escaped := false
+	for i, r := range input {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+			continue
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				spans = append(spans, [2]int{start, i})
+				word.Reset()
+				inWord = false
+			}
+			continue
+		default:
+			word.WriteRune(r)
+		}
+		if !inWord {
+			start, inWord = i, true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+		spans = append(spans, [2]int{start, len(input)})
+	}
+	return words, spans
+}
+
+// attachDroppedFiles attaches images and PDFs whose paths appear in the
+// input, as happens when files are dragged into the terminal. The paths are
+// replaced by a short marker so the model knows what was attached.
+func attachDroppedFiles(input, provider string) (string, []ContentPart) {
+	words, spans := splitDroppedPaths(input)
+	var parts []ContentPart
+	for i := len(words) - 1; i >= 0; i-- {
+		word := words[i]
+		ext := strings.ToLower(filepath.Ext(word))
+		if _, ok := attachmentImageExts[ext]; !ok && ext != ".pdf" {
+			continue
+		}
+		if !strings.ContainsRune(word, os.PathSeparator) && !strings.HasPrefix(word, "~") {
+			continue
+		}
+		part, err := loadAttachment(word, provider)
+		if err != nil {
+			continue
+		}
+		parts = append([]ContentPart{part}, parts...)
+		input = input[:spans[i][0]] + fmt.Sprintf("[attached: %s]", filepath.Base(word)) + input[spans[i][1]:]
+		fmt.Printf("\033[36m📎 Attached %s (%s)\033[0m\n", word, describeAttachment(part))
+	}
+	return input, parts
+}
+
+// handleAttachCommand handles "/attach [path... | clear]".
+func handleAttachCommand(arg, provider string) {
+	switch arg {
+	case "":
+		if len(pendingAttachments) == 0 {
+			fmt.Println("No pending attachments. Usage: /attach <path> [path...] | /attach clear")
+			return
+		}
+		fmt.Println("Attachments for the next message:")
+		for _, part := range pendingAttachments {
+			fmt.Printf("  - %s\n", describeAttachment(part))
+		}
+		return
+	case "clear":
+		pendingAttachments = nil
+		fmt.Println("Pending attachments cleared.")
+		return
+	}
+	paths, _ := splitDroppedPaths(arg)
+	for _, path := range paths {
+		part, err := loadAttachment(path, provider)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		pendingAttachments = append(pendingAttachments, part)
+		fmt.Printf("\033[36m📎 Attached %s (%s)\033[0m\n", path, describeAttachment(part))
+	}
+	if len(pendingAttachments) > 0 {
+		fmt.Printf("%d attachment(s) will be sent with your next message.\n", len(pendingAttachments))
+	}
+}
+
+// --- Transcript ---
+
+// TranscriptEntry is one message of the append-only session transcript.
+// Unlike the history file, the transcript is never rewritten by /clear or
+// shorten_context, so past turns can always be inspected with /show.
+type TranscriptEntry struct {
+	Turn    int       `json:"turn"`
+	Time    time.Time `json:"time"`
+	Message Message   `json:"message"`
+}
+
+type Transcript struct {
+	path     string
+	lastTurn int
+}
+
+func getTranscriptPath() string {
+	return filepath.Join(".simple_agent", "transcript.jsonl")
+}
+
+// openTranscript opens the project transcript, continuing its turn numbering.
+func openTranscript() *Transcript {
+	t := &Transcript{path: getTranscriptPath()}
+	for _, e := range readTranscript() {
+		if e.Turn > t.lastTurn {
+			t.lastTurn = e.Turn
+		}
+	}
+	return t
+}
+
+func (t *Transcript) NextTurn() int {
+	t.lastTurn++
+	return t.lastTurn
+}
+
+func (t *Transcript) Record(turn int, msg Message) {
+	data, err := json.Marshal(TranscriptEntry{Turn: turn, Time: time.Now(), Message: msg})
+	if err == nil {
+		data, err = sealData(data)
+	}
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf("Warning: Failed to write transcript: %v\n", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+func readTranscript() []TranscriptEntry {
+	f, err := os.Open(getTranscriptPath())
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024) // Tool results can be large
+	for scanner.Scan() {
+		var e TranscriptEntry
+		data, err := openData(scanner.Bytes())
+		if err == nil && json.Unmarshal(data, &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// printTurnList prints the most recent turns with the first line of the user message.
+func printTurnList(entries []TranscriptEntry, limit int) {
+	var turns []TranscriptEntry
+	for _, e := range entries {
+		if e.Message.Role == "user" && (len(turns) == 0 || turns[len(turns)-1].Turn != e.Turn) {
+			turns = append(turns, e)
+		}
+	}
+	if len(turns) == 0 {
+		fmt.Println("Transcript is empty.")
+		return
+	}
+	if len(turns) > limit {
+		turns = turns[len(turns)-limit:]
+	}
+	fmt.Println("Recent turns (use /show <turn> for details):")
+	for _, e := range turns {
+		line := truncateLine(strings.SplitN(strings.TrimSpace(e.Message.Content), "\n", 2)[0], 80)
+		fmt.Printf("  %4d  %s  %s\n", e.Turn, e.Time.Format("2006-01-02 15:04"), line)
+	}
+}
+
+// renderTurn re-renders every message of a turn: user input, thoughts, tool
+// calls with their arguments (diffs in color), tool results and notices.
+func renderTurn(entries []TranscriptEntry, turn int) error {
+	found := false
+	for _, e := range entries {
+		if e.Turn != turn {
+			continue
+		}
+		if !found {
+			fmt.Printf("\033[90m═══ Turn %d (%s) ═══\033[0m\n", turn, e.Time.Format("2006-01-02 15:04:05"))
+			found = true
+		}
+		msg := e.Message
+		switch msg.Role {
+		case "user":
+			fmt.Printf("\n\033[1;32mUser 👤\033[0m\n%s\n", msg.Content)
+		case "assistant":
+			printThought(msg.ExtraContent)
+			cleanContent := extractAndPrintThoughts(msg.Content)
+			if strings.TrimSpace(cleanContent) != "" {
+				fmt.Printf("\n\033[1;34m🤖 Gemini:\033[0m\n")
+				printMarkdown(cleanContent)
+			}
+			for _, tc := range msg.ToolCalls {
+				printThought(tc.ExtraContent)
+				fmt.Printf("\n\033[1;35m🛠  Tool Call: %s\033[0m\n", tc.Function.Name)
+				var args struct {
+					Path string `json:"path"`
+					Diff string `json:"diff"`
+				}
+				if tc.Function.Name == "apply_udiff" && json.Unmarshal([]byte(tc.Function.Arguments), &args) == nil {
+					fmt.Printf("Path: %s\n", args.Path)
+					printColoredDiff(args.Diff)
+				} else {
+					fmt.Println(tc.Function.Arguments)
+				}
+			}
+		case "tool":
+			fmt.Printf("\033[90m─── [Result] ───\033[0m\n%s\n", msg.Content)
+		default:
+			fmt.Printf("\033[90m─── [%s] ───\033[0m\n%s\n", msg.Role, msg.Content)
+		}
+	}
+	if !found {
+		return fmt.Errorf("turn %d not found in transcript", turn)
+	}
+	return nil
+}
+
+// --- Plans ---
+
+// Plan is a multi-step task the agent works through one step per turn. After
+// each step the verify command runs and, if it passes, the step is committed
+// (optionally) and checkpointed so the run can be rolled back to any step
+// boundary. The plan and its step log are kept in .simple_agent/plan.json.
+type Plan struct {
+	ID     string     `json:"id"`
+	Goal   string     `json:"goal"`
+	Commit bool       `json:"commit"` // Commit tracked changes after each verified step
+	Active bool       `json:"active"` // Steps are fed to the agent automatically
+	Steps  []PlanStep `json:"steps"`
+}
+
+type PlanStep struct {
+	Title        string    `json:"title"`
+	Instructions string    `json:"instructions"`
+	Verify       string    `json:"verify,omitempty"` // Shell command that must succeed after the step
+	Status       string    `json:"status"`           // pending, running, done, failed or skipped
+	VerifyOutput string    `json:"verify_output,omitempty"`
+	Checkpoint   string    `json:"checkpoint,omitempty"`
+	Commit       string    `json:"commit,omitempty"`
+	Started      time.Time `json:"started,omitempty"`
+	Finished     time.Time `json:"finished,omitempty"`
+}
+
+const planVerifyTimeout = 10 * time.Minute
+
+// maxVerifyOutput bounds the verify output kept in the plan and sent to the model.
+const maxVerifyOutput = 4000
+
+// currentPlan is the plan of this project, if any.
+var currentPlan *Plan
+
+const planPrompt = `Break the following goal into a short sequence of concrete, independently verifiable steps (usually 2-8). Each step should leave the project in a working state.
+
+Goal: %s
+
+Reply with ONLY a JSON object, no prose:
+{"steps": [{"title": "short title", "instructions": "what to do in this step", "verify": "shell command that exits 0 when the step is done, e.g. go build ./... (may be empty)"}]}`
+
+func getPlanPath() string {
+	return filepath.Join(".simple_agent", "plan.json")
+}
+
+// loadPlan loads the project's plan, always paused: the file may be left over
+// or come with the repository, so only /plan resume starts running steps. A
+// step left running by a crashed session is reset to pending.
+func loadPlan() *Plan {
+	data, err := os.ReadFile(getPlanPath())
+	if err != nil {
+		return nil
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to parse %s: %v\n", getPlanPath(), err)
+		return nil
+	}
+	plan.Active = false
+	if i := plan.runningStep(); i != -1 {
+		plan.Steps[i].Status = "pending"
+		plan.save()
+	}
+	return &plan
+}
+
+func (p *Plan) save() {
+	if err := os.MkdirAll(filepath.Dir(getPlanPath()), 0755); err != nil {
+		fmt.Printf("Warning: Failed to save plan: %v\n", err)
+		return
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err == nil {
+		err = os.WriteFile(getPlanPath(), data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: Failed to save plan: %v\n", err)
+	}
+}
+
+func (p *Plan) runningStep() int {
+	for i, step := range p.Steps {
+		if step.Status == "running" {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Plan) nextPendingStep() int {
+	for i, step := range p.Steps {
+		if step.Status == "pending" || step.Status == "failed" {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Plan) checkpointName(i int) string {
+	return fmt.Sprintf("plan-%s-step-%d", p.ID, i+1)
+}
+
+func (p *Plan) Print() {
+	state := "paused"
+	if p.Active {
+		state = "running"
+	} else if p.nextPendingStep() == -1 {
+		state = "complete"
+	}
+	fmt.Printf("Plan %s (%s): %s\n", p.ID, state, p.Goal)
+	icons := map[string]string{"pending": " ", "running": "\033[33m>\033[0m", "done": "\033[32m✓\033[0m", "failed": "\033[31m✗\033[0m", "skipped": "-"}
+	for i, step := range p.Steps {
+		fmt.Printf(" [%s] %d. %s\n", icons[step.Status], i+1, step.Title)
+		if step.Verify != "" {
+			fmt.Printf("        \033[90mverify: %s\033[0m\n", step.Verify)
+		}
+		if step.Commit != "" {
+			fmt.Printf("        \033[90mcommit: %.8s\033[0m\n", step.Commit)
+		}
+	}
+}
+
+// StartNextStep marks the next pending step as running and returns the user
+// message that asks the agent to carry it out.
+func (p *Plan) StartNextStep() (string, bool) {
+	i := p.nextPendingStep()
+	if i == -1 {
+		return "", false
+	}
+	step := &p.Steps[i]
+	retry := step.Status == "failed"
+	step.Status, step.Started = "running", time.Now()
+	p.save()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("[Plan step %d/%d] %s\n\n%s\n", i+1, len(p.Steps), step.Title, step.Instructions))
+	if retry && step.VerifyOutput != "" {
+		sb.WriteString(fmt.Sprintf("\nThe previous attempt failed verification (`%s`):\n```\n%s\n```\nFix the problem.\n", step.Verify, step.VerifyOutput))
+	}
+	sb.WriteString("\nOnly do this step; the following steps come later. ")
+	if step.Verify != "" {
+		sb.WriteString(fmt.Sprintf("When you finish, `%s` will be run to verify it. ", step.Verify))
+	}
+	sb.WriteString("End with a short summary of what you changed.")
+	return sb.String(), true
+}
+
+// FinishStep verifies the running step after its turn and records a commit and
+// checkpoint on success. The verify command goes through the command policy
+// and approval like run_command. A failed or refused verification pauses the
+// plan.
+func (p *Plan) FinishStep(ctx context.Context, env *ToolEnv, messages []Message) {
+	i := p.runningStep()
+	if i == -1 {
+		return
+	}
+	step := &p.Steps[i]
+	step.Finished = time.Now()
+
+	if step.Verify != "" {
+		fmt.Printf("\033[36m[Plan] Verifying step %d: %s\033[0m\n", i+1, step.Verify)
+		dir, _ := os.Getwd()
+		var out string
+		err := authorizeCommand(ctx, env, step.Verify, dir)
+		if err == nil {
+			out, err = runShellCommand(ctx, step.Verify, dir, planVerifyTimeout)
+		}
+		step.VerifyOutput = strings.TrimSpace(out)
+		if step.VerifyOutput == "" && err != nil {
+			step.VerifyOutput = err.Error()
+		}
+		if len(step.VerifyOutput) > maxVerifyOutput {
+			step.VerifyOutput = "...\n" + step.VerifyOutput[len(step.VerifyOutput)-maxVerifyOutput:]
+		}
+		if err != nil {
+			step.Status, p.Active = "failed", false
+			p.save()
+			fmt.Printf("\033[31m[Plan] Step %d failed verification: %s\033[0m\n%s\n", i+1, strings.SplitN(err.Error(), "\n", 2)[0], step.VerifyOutput)
+			fmt.Println("Use /plan resume to let the agent fix it, /plan skip to move on, or /plan rollback <step> to go back.")
+			return
+		}
+	}
+
+	// Like auto-commit, only the files the agent changed are committed
+	if p.Commit && isGitRepo() {
+		if paths := agentChanges.Pending(); len(paths) > 0 {
+			message := fmt.Sprintf("Plan step %d: %s", i+1, step.Title)
+			if err := gitCommit(message, paths, commitOptions{}); err != nil {
+				fmt.Printf("Warning: Failed to commit step %d: %v\n", i+1, err)
+			} else if hash, err := runGit(nil, "rev-parse", "HEAD"); err == nil {
+				step.Commit = hash
+			}
+		}
+	}
+	// The checkpoint comes after the commit so rolling back keeps it
+	if err := createCheckpoint(p.checkpointName(i), messages); err != nil {
+		fmt.Printf("Warning: Failed to checkpoint step %d: %v\n", i+1, err)
+	} else {
+		step.Checkpoint = p.checkpointName(i)
+	}
+	step.Status = "done"
+	fmt.Printf("\033[32m[Plan] Step %d/%d done: %s\033[0m\n", i+1, len(p.Steps), step.Title)
+	if p.nextPendingStep() == -1 {
+		p.Active = false
+		fmt.Println("\033[32m[Plan] All steps complete.\033[0m")
+	}
+	p.save()
+}
+
+// PauseStep returns an interrupted step to pending and stops the plan.
+func (p *Plan) PauseStep() {
+	if i := p.runningStep(); i != -1 {
+		p.Steps[i].Status = "pending"
+	}
+	p.Active = false
+	p.save()
+	fmt.Println("[Plan] Paused. Use /plan resume to continue.")
+}
+
+// generatePlan asks the model to break goal into steps, using the
+// conversation so far as context.
+func generatePlan(apiKey, goal string, messages []Message) (*Plan, error) {
+	request := append(messages[:len(messages):len(messages)], Message{Role: "user", Content: fmt.Sprintf(planPrompt, goal)})
+	resp, err := requestCompletion(internalRequest(context.Background()), &http.Client{}, apiKey, ChatCompletionRequest{
+		Model:    ModelName,
+		Messages: request,
+	})
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(resp.Choices[0].Message.Content)
+	if start, end := strings.Index(content, "{"), strings.LastIndex(content, "}"); start != -1 && end > start {
+		content = content[start : end+1]
+	}
+	var parsed struct {
+		Steps []PlanStep `json:"steps"`
+	}
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return nil, fmt.Errorf("model returned an invalid plan: %v", err)
+	}
+	if len(parsed.Steps) == 0 {
+		return nil, fmt.Errorf("model returned an empty plan")
+	}
+	return newPlan(goal, parsed.Steps), nil
+}
+
+func newPlan(goal string, steps []PlanStep) *Plan {
+	for i := range steps {
+		steps[i].Status = "pending"
+	}
+	return &Plan{ID: time.Now().Format("20060102-150405"), Goal: goal, Steps: steps}
+}
+
+// handlePlanCommand handles "/plan [goal | load <file> | resume | skip |
+// rollback <step> | abort]".
+func handlePlanCommand(arg string, messages *[]Message, apiKey string) {
+	ctx := context.Background()
+	sub, rest := arg, ""
+	if i := strings.IndexFunc(arg, unicode.IsSpace); i != -1 {
+		sub, rest = arg[:i], strings.TrimSpace(arg[i:])
+	}
+
+	switch sub {
+	case "":
+		if currentPlan == nil {
+			fmt.Println("No plan. Usage: /plan <goal> | /plan load <file.json>")
+			return
+		}
+		currentPlan.Print()
+		return
+	case "resume":
+		if currentPlan == nil || currentPlan.nextPendingStep() == -1 {
+			fmt.Println("No unfinished plan to resume.")
+			return
+		}
+		currentPlan.Active = true
+		currentPlan.save()
+		return
+	case "skip":
+		if currentPlan == nil || currentPlan.nextPendingStep() == -1 {
+			fmt.Println("No unfinished plan.")
+			return
+		}
+		i := currentPlan.nextPendingStep()
+		currentPlan.Steps[i].Status = "skipped"
+		currentPlan.save()
+		fmt.Printf("Skipped step %d. Use /plan resume to continue.\n", i+1)
+		return
+	case "rollback":
+		if currentPlan == nil {
+			fmt.Println("No plan.")
+			return
+		}
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 || n > len(currentPlan.Steps) {
+			fmt.Printf("Usage: /plan rollback <step 1-%d, or 0 for the start of the plan>\n", len(currentPlan.Steps))
+			return
+		}
+		name := currentPlan.ID + "-start"
+		if n > 0 {
+			name = currentPlan.Steps[n-1].Checkpoint
+		}
+		if name == "" {
+			fmt.Printf("Step %d has no checkpoint.\n", n)
+			return
+		}
+		if err := rewindToCheckpoint(name, messages); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		for i := n; i < len(currentPlan.Steps); i++ {
+			step := &currentPlan.Steps[i]
+			step.Status, step.VerifyOutput, step.Checkpoint, step.Commit = "pending", "", "", ""
+		}
+		currentPlan.Active = false
+		currentPlan.save()
+		fmt.Printf("Rolled back to the end of step %d. Use /plan resume to continue.\n", n)
+		return
+	case "abort":
+		if currentPlan != nil {
+			currentPlan.Active = false
+			currentPlan.save()
+		}
+		fmt.Println("Plan stopped.")
+		return
+	}
+
+	var plan *Plan
+	if sub == "load" {
+		data, err := os.ReadFile(rest)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		var loaded struct {
+			Goal  string     `json:"goal"`
+			Steps []PlanStep `json:"steps"`
+		}
+		if err := json.Unmarshal(data, &loaded); err != nil || len(loaded.Steps) == 0 {
+			fmt.Printf("Error: %s is not a plan (expected {\"goal\", \"steps\": [...]}): %v\n", rest, err)
+			return
+		}
+		plan = newPlan(loaded.Goal, loaded.Steps)
+	} else {
+		fmt.Println("Planning...")
+		var err error
+		if plan, err = generatePlan(apiKey, arg, *messages); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
+	plan.Print()
+	if answer := askUser(ctx, "Approve and run this plan? [y/N]: "); strings.ToLower(answer) != "y" {
+		fmt.Println("Plan discarded.")
+		return
+	}
+	if isGitRepo() {
+		plan.Commit = strings.ToLower(askUser(ctx, "Commit after each verified step? [y/N]: ")) == "y"
+	}
+	if err := createCheckpoint(plan.ID+"-start", *messages); err != nil {
+		fmt.Printf("Warning: Failed to checkpoint the start of the plan: %v\n", err)
+	}
+	plan.Active = true
+	plan.save()
+	currentPlan = plan
+}
+
+// --- Todos ---
+
+// The model keeps a task list for the session with manage_todos, sending the
+// whole list each time. The list lives in the conversation: every call's
+// result holds the full list, and compaction appends it to the summary, so
+// --continue, /rewind and shorten_context all find it again in the history.
+
+var manageTodosTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "manage_todos",
+		Description: "Replace the session's todo list. Send the complete list every time, in order, with each item's status: pending, in_progress or done. Use it for tasks with three or more steps: write the list before starting, mark one item in_progress while you work on it, and mark it done as soon as it is finished. The user sees the list between turns.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"todos": {
+					"type": "array",
+					"items": {
+						"type": "object",
+						"properties": {
+							"content": {
+								"type": "string",
+								"description": "What to do, as a short imperative sentence"
+							},
+							"status": {
+								"type": "string",
+								"enum": ["pending", "in_progress", "done"]
+							}
+						},
+						"required": ["content", "status"]
+					},
+					"description": "The complete todo list. An empty list clears it."
+				}
+			},
+			"required": ["todos"]
+		}`),
+	},
+}
+
+const (
+	maxTodos = 50
+	// todoSnapshotHeader introduces the list in a compaction summary
+	todoSnapshotHeader = "Todo list (kept with manage_todos):"
+)
+
+// Todo is one item of the session's todo list.
+type Todo struct {
+	Content string `json:"content"`
+	Status  string `json:"status"` // pending, in_progress or done
+}
+
+// todoList is the session's todo list. changed is set when the model
+// updates it, so it is shown at the end of that turn only.
+type todoList struct {
+	mu      sync.Mutex
+	items   []Todo
+	changed bool
+}
+
+var sessionTodos = &todoList{}
+
+// Set validates and replaces the list.
+func (l *todoList) Set(todos []Todo) error {
+	if len(todos) > maxTodos {
+		return fmt.Errorf("too many todos (%d); keep the list under %d items", len(todos), maxTodos)
+	}
+	for i, t := range todos {
+		if strings.TrimSpace(t.Content) == "" {
+			return fmt.Errorf("todo %d has no content", i+1)
+		}
+		switch t.Status {
+		case "pending", "in_progress", "done":
+		default:
+			return fmt.Errorf("todo %d has unknown status '%s'; use pending, in_progress or done", i+1, t.Status)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.items = append([]Todo(nil), todos...)
+	l.changed = true
+	return nil
+}
+
+// Items returns a copy of the list.
+func (l *todoList) Items() []Todo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Todo(nil), l.items...)
+}
+
+// Restore sets the list from the latest manage_todos result or compaction
+// summary in messages, or clears it if there is none. It does not count as a
+// change.
+func (l *todoList) Restore(messages []Message) {
+	calls := make(map[string]bool) // IDs of manage_todos calls
+	for _, m := range messages {
+		for _, tc := range m.ToolCalls {
+			if tc.Function.Name == "manage_todos" {
+				calls[tc.ID] = true
+			}
+		}
+	}
+	var items []Todo
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		var result struct {
+			Todos *[]Todo `json:"todos"`
+		}
+		if m.Role == "tool" && calls[m.ToolCallID] && json.Unmarshal([]byte(m.Content), &result) == nil && result.Todos != nil {
+			items = *result.Todos
+			break
+		}
+		if _, snapshot, ok := strings.Cut(m.Content, todoSnapshotHeader); ok && m.Role == "user" && json.Unmarshal([]byte(snapshot), &items) == nil {
+			break
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.items, l.changed = items, false
+}
+
+// Snapshot renders the list for a compaction summary, or "" if it is empty.
+func (l *todoList) Snapshot() string {
+	items := l.Items()
+	if len(items) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(items)
+	return "\n\n" + todoSnapshotHeader + "\n" + string(data)
+}
+
+// result is what manage_todos returns: the full list and the progress.
+func (l *todoList) result() string {
+	items := l.Items()
+	done := 0
+	for _, t := range items {
+		if t.Status == "done" {
+			done++
+		}
+	}
+	return toJSON(map[string]any{"todos": items, "done": done, "total": len(items)})
+}
+
+// Print shows the list in the terminal.
+func (l *todoList) Print() {
+	items := l.Items()
+	if len(items) == 0 {
+		fmt.Println("No todos.")
+		return
+	}
+	done := 0
+	for _, t := range items {
+		if t.Status == "done" {
+			done++
+		}
+	}
+	fmt.Printf("\033[1m📋 Todos (%d/%d done)\033[0m\n", done, len(items))
+	for _, t := range items {
+		switch t.Status {
+		case "done":
+			fmt.Printf("  \033[32m✔\033[0m \033[90m%s\033[0m\n", t.Content)
+		case "in_progress":
+			fmt.Printf("  \033[33m▶\033[0m \033[1m%s\033[0m\n", t.Content)
+		default:
+			fmt.Printf("  ○ %s\n", t.Content)
+		}
+	}
+}
+
+// PrintIfChanged shows the list at the end of a turn that updated it.
+func (l *todoList) PrintIfChanged() {
+	l.mu.Lock()
+	changed := l.changed
+	l.changed = false
+	l.mu.Unlock()
+	if changed {
+		l.Print()
+	}
+}
+
+// --- Turn Budget ---
+
+// A turn stops to ask the user once the model has made maxTurnRequests
+// requests or maxTurnToolCalls tool calls for one message, so a confused
+// model can't loop indefinitely. The user can grant another budget of the
+// same size, abort, or have the model summarize where it stands without
+// further tool calls. 0 disables a limit.
+var (
+	maxTurnRequests  = 40
+	maxTurnToolCalls = 200
+)
+
+type turnBudget struct {
+	requests, toolCalls         int
+	requestLimit, toolCallLimit int
+}
+
+func newTurnBudget() *turnBudget {
+	return &turnBudget{requestLimit: maxTurnRequests, toolCallLimit: maxTurnToolCalls}
+}
+
+// exceeded describes the limit the turn has reached, if any.
+func (b *turnBudget) exceeded() string {
+	switch {
+	case b.requestLimit > 0 && b.requests >= b.requestLimit:
+		return fmt.Sprintf("%d model requests", b.requests)
+	case b.toolCallLimit > 0 && b.toolCalls >= b.toolCallLimit:
+		return fmt.Sprintf("%d tool calls", b.toolCalls)
+	}
+	return ""
+}
+
+// extend grants another budget of the configured size.
+func (b *turnBudget) extend() {
+	if b.requestLimit > 0 {
+		b.requestLimit = b.requests + maxTurnRequests
+	}
+	if b.toolCallLimit > 0 {
+		b.toolCallLimit = b.toolCalls + maxTurnToolCalls
+	}
+}
+
+// askTurnBudget asks what to do about an exhausted budget: "continue",
+// "abort" or "summarize" (the default).
+func askTurnBudget(ctx context.Context, spent string) string {
+	fmt.Printf("\n\033[33m⚠️  This turn has used %s (max_turn_requests/max_turn_tool_calls in the config).\033[0m\n", spent)
+	switch strings.ToLower(askUser(ctx, "[c]ontinue, [a]bort, or [s]ummarize progress and stop (default)? ")) {
+	case "c", "continue":
+		return "continue"
+	case "a", "abort":
+		return "abort"
+	}
+	return "summarize"
+}
+
+// turnBudgetSummaryPrompt asks the model to wrap up instead of calling more tools.
+func turnBudgetSummaryPrompt(spent string) string {
+	return fmt.Sprintf("[System] This turn has used %s and the user asked you to stop here. Do not call any more tools. Summarize what you have done, what remains to be done, and how to continue.", spent)
+}
+
+// --- Large Message Guard ---
+
+// A single user message or tool result over largeMessageTokens is not sent
+// as is: the user chooses to send it anyway, truncate it, or save it to a
+// file in .simple_agent/outputs/ and send a reference the model can read in
+// chunks. Without anyone to ask (sub-agents, headless runs) it is saved to a
+// file. 0 disables the check.
+var largeMessageTokens = 20000
+
+const largeMessagePreviewLines = 20
+
+// guardLargeMessage returns content, or what to send instead when it is over
+// the limit. what names the content in messages, e.g. "Your message".
+func guardLargeMessage(ctx context.Context, what, content string, interactive bool) string {
+	tokens := len(content) / 4
+	if largeMessageTokens <= 0 || tokens <= largeMessageTokens {
+		return content
+	}
+
+	choice := "f"
+	if interactive {
+		fmt.Printf("\033[33m⚠️  %s is ~%d tokens (limit %d, large_message_tokens in the config).\033[0m\n", what, tokens, largeMessageTokens)
+		choice = strings.ToLower(askUser(ctx, "[s]end anyway, [t]runcate, or save to a [f]ile and send a reference (default)? "))
+	}
+	switch {
+	case strings.HasPrefix(choice, "s"):
+		return content
+	case strings.HasPrefix(choice, "t"):
+		fmt.Printf("Truncated %s to ~%d tokens.\n", strings.ToLower(what), largeMessageTokens)
+		return truncateMiddle(content, largeMessageTokens*4)
+	}
+
+	root, _ := getWorkDir(ctx)
+	path, err := saveLargeMessage(root, content)
+	if err != nil {
+		fmt.Printf("\033[31mCould not save %s to a file (%v); truncating it instead.\033[0m\n", strings.ToLower(what), err)
+		return truncateMiddle(content, largeMessageTokens*4)
+	}
+	rel := displayPath(root, path)
+	fmt.Printf("Saved %s (~%d tokens) to %s; sending a reference instead.\n", strings.ToLower(what), tokens, rel)
+
+	lines := strings.Split(content, "\n")
+	preview := lines[:min(len(lines), largeMessagePreviewLines)]
+	for i, line := range preview {
+		preview[i] = truncateLine(line, 200)
+	}
+	return fmt.Sprintf("[%s was too large to send (%d lines, ~%d tokens). It was saved to %s; read the parts you need with read_file or search it.]\n\nFirst lines:\n%s",
+		what, len(lines), tokens, rel, strings.Join(preview, "\n"))
+}
+
+// truncateMiddle keeps the start and end of s within limit characters, as
+// both usually matter for logs.
+func truncateMiddle(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	head, start := limit/2, len(s)-limit/2
+	// Cut at line boundaries when there are any nearby
+	if i := strings.LastIndex(s[:head], "\n"); i > head/2 {
+		head = i
+	}
+	if i := strings.Index(s[start:], "\n"); i >= 0 && i < limit/4 {
+		start += i + 1
+	}
+	for head > 0 && !utf8.RuneStart(s[head]) {
+		head--
+	}
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return fmt.Sprintf("%s\n\n[... %d characters truncated ...]\n\n%s", s[:head], start-head, s[start:])
+}
+
+// saveLargeMessage writes content to .simple_agent/outputs/ under root.
+func saveLargeMessage(root, content string) (string, error) {
+	dir := filepath.Join(root, ".simple_agent", "outputs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("message_%d.txt", time.Now().UnixNano()))
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// --- Context Dump ---
+
+// /dump-context writes the request the next turn would send: the message
+// array after middleware and tool-protocol encoding, with an approximate
+// token count per message, so prompt problems can be inspected outside the
+// session. Per-request context (pre_prompt hook output, relevant memories)
+// depends on the next message and is not included.
+
+type contextDump struct {
+	Model           string               `json:"model"`
+	Created         string               `json:"created"`
+	ApproxTokens    int                  `json:"approx_tokens"`
+	Messages        []contextDumpMessage `json:"messages"`
+	Tools           []Tool               `json:"tools,omitempty"`
+	ToolTokens      int                  `json:"tools_approx_tokens,omitempty"`
+	ExtraBody       json.RawMessage      `json:"extra_body,omitempty"`
+	ReasoningEffort string               `json:"reasoning_effort,omitempty"`
+}
+
+type contextDumpMessage struct {
+	Index        int     `json:"index"`
+	ApproxTokens int     `json:"approx_tokens"`
+	Attachments  int     `json:"attachments,omitempty"` // Not included in approx_tokens
+	Message      Message `json:"message"`
+}
+
+// approxMessageTokens estimates a message at four characters per token,
+// counting its text and tool calls but not attachments.
+func approxMessageTokens(msg Message) int {
+	msg.Parts = nil
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return messageChars([]Message{msg}) / 4
+	}
+	return len(data) / 4
+}
+
+// buildContextDump prepares the request exactly as sendCompletion would.
+func buildContextDump(messages []Message, provider string) (*contextDump, error) {
+	req := ChatCompletionRequest{
+		Model:           ModelName,
+		Messages:        append([]Message(nil), messages...),
+		Tools:           enabledTools(allTools()),
+		ExtraBody:       getExtraBody(provider),
+		ReasoningEffort: getReasoningEffort(provider),
+	}
+	if len(req.Tools) > 0 && usesTextTools(req.Model) {
+		encodeTextTools(&req)
+	}
+	if err := middleware.ApplyRequest(context.Background(), &req); err != nil {
+		return nil, err
+	}
+
+	dump := &contextDump{
+		Model:           req.Model,
+		Created:         time.Now().Format(time.RFC3339),
+		Tools:           req.Tools,
+		ExtraBody:       req.ExtraBody,
+		ReasoningEffort: req.ReasoningEffort,
+	}
+	for i, msg := range req.Messages {
+		tokens := approxMessageTokens(msg)
+		dump.Messages = append(dump.Messages, contextDumpMessage{Index: i, ApproxTokens: tokens, Attachments: len(msg.Parts), Message: msg})
+		dump.ApproxTokens += tokens
+	}
+	if len(req.Tools) > 0 {
+		if data, err := json.Marshal(req.Tools); err == nil {
+			dump.ToolTokens = len(data) / 4
+			dump.ApproxTokens += dump.ToolTokens
+		}
+	}
+	return dump, nil
+}
+
+func handleDumpContextCommand(arg string, messages []Message, provider string) {
+	dump, err := buildContextDump(messages, provider)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	path := arg
+	if path == "" {
+		path = filepath.Join(".simple_agent", "context-"+time.Now().Format("20060102-150405")+".json")
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	byRole := map[string]int{}
+	var roles []string
+	for _, m := range dump.Messages {
+		if _, ok := byRole[m.Message.Role]; !ok {
+			roles = append(roles, m.Message.Role)
+		}
+		byRole[m.Message.Role] += m.ApproxTokens
+	}
+	var parts []string
+	for _, role := range roles {
+		parts = append(parts, fmt.Sprintf("%s ~%d", role, byRole[role]))
+	}
+	if dump.ToolTokens > 0 {
+		parts = append(parts, fmt.Sprintf("tools ~%d", dump.ToolTokens))
+	}
+	fmt.Printf("Wrote %d messages (~%d tokens: %s) for %s to %s\n", len(dump.Messages), dump.ApproxTokens, strings.Join(parts, ", "), dump.Model, path)
+}
+
+// --- Session Sharing ---
+
+// /share writes the session as a Markdown report for bug reports or for
+// asking someone for help. Secrets are always redacted, whatever
+// redact_secrets says; "anon" also replaces the project path and home
+// directory. "gist" uploads the report as a secret gist with gh.
+
+// maxSharedResultChars bounds each tool result in the report.
+const maxSharedResultChars = 4000
+
+// pathAnonymizer replaces the project path and home directory, which
+// usually contains the user name.
+func pathAnonymizer() *strings.Replacer {
+	var pairs []string
+	if cwd, err := os.Getwd(); err == nil {
+		pairs = append(pairs, cwd, "<project>")
+	}
+	if home, err := os.UserHomeDir(); err == nil && home != "/" {
+		pairs = append(pairs, home, "~")
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// markdownFence wraps s in a code fence longer than any backtick run in it.
+func markdownFence(s, lang string) string {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fence + lang + "\n" + strings.TrimRight(s, "\n") + "\n" + fence + "\n"
+}
+
+// buildShareReport renders the conversation (without the system prompt) and
+// returns it with the number of secrets redacted.
+func buildShareReport(messages []Message, anonymize bool) (string, int) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Simple Agent session\n\n")
+	fmt.Fprintf(&sb, "- Version: %s\n- Model: %s\n- Date: %s\n- Session: %s\n", Version, ModelName, time.Now().Format("2006-01-02 15:04"), sessionID)
+	if len(messages) > 0 && messages[0].Role == "system" {
+		fmt.Fprintf(&sb, "- System prompt: %d characters (not included)\n", len(messages[0].Content))
+		messages = messages[1:]
+	}
+	sb.WriteString("\n")
+
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user":
+			fmt.Fprintf(&sb, "## User\n\n%s\n\n", strings.TrimSpace(msg.Content))
+			for _, p := range msg.Parts {
+				name := p.Type
+				if p.File != nil {
+					name = p.File.Filename
+				}
+				fmt.Fprintf(&sb, "_Attachment: %s (not included)_\n\n", name)
+			}
+		case "assistant":
+			if content := strings.TrimSpace(thoughtTagRe.ReplaceAllString(msg.Content, "")); content != "" {
+				fmt.Fprintf(&sb, "## Assistant\n\n%s\n\n", content)
+			}
+			for _, tc := range msg.ToolCalls {
+				args := tc.Function.Arguments
+				var pretty bytes.Buffer
+				if json.Indent(&pretty, []byte(args), "", "  ") == nil {
+					args = pretty.String()
+				}
+				fmt.Fprintf(&sb, "**Tool call: `%s`**\n\n%s\n", tc.Function.Name, markdownFence(args, "json"))
+			}
+		case "tool":
+			content := msg.Content
+			if len(content) > maxSharedResultChars {
+				content = truncateMiddle(content, maxSharedResultChars)
+			}
+			fmt.Fprintf(&sb, "<details><summary>Result</summary>\n\n%s\n</details>\n\n", markdownFence(content, ""))
+		default:
+			fmt.Fprintf(&sb, "_[%s]_\n\n%s\n", msg.Role, markdownFence(msg.Content, ""))
+		}
+	}
+
+	report := sb.String()
+	if anonymize {
+		report = pathAnonymizer().Replace(report)
+	}
+	return redact(report)
+}
+
+func handleShareCommand(arg string, messages []Message) {
+	var anonymize, gist bool
+	path := ""
+	for _, f := range strings.Fields(arg) {
+		switch f {
+		case "anon":
+			anonymize = true
+		case "gist":
+			gist = true
+		default:
+			if path != "" {
+				fmt.Println("Usage: /share [anon] [gist] [file]")
+				return
+			}
+			path = f
+		}
+	}
+	if path == "" {
+		path = filepath.Join(".simple_agent", "share-"+time.Now().Format("20060102-150405")+".md")
+	}
+
+	report, redacted := buildShareReport(messages, anonymize)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(path, []byte(report), 0600); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Wrote the session report to %s (%d bytes, %d secret(s) redacted", path, len(report), redacted)
+	if anonymize {
+		fmt.Print(", paths anonymized")
+	}
+	fmt.Println("). Review it before sharing.")
+	if !gist {
+		return
+	}
+
+	if _, err := exec.LookPath("gh"); err != nil {
+		fmt.Println("Uploading needs the GitHub CLI (gh), which was not found.")
+		return
+	}
+	if answer := strings.ToLower(promptUser("Upload it as a secret gist with gh? [y/N] ")); answer != "y" && answer != "yes" {
+		fmt.Println("Not uploaded.")
+		return
+	}
+	out, err := exec.Command("gh", "gist", "create", "--desc", "Simple Agent session "+sessionID, path).CombinedOutput()
+	if err != nil {
+		fmt.Printf("Error: gh gist create failed: %v\n%s", err, out)
+		return
+	}
+	// gh prints progress first and the gist URL last
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fmt.Printf("Uploaded: %s\n", lines[len(lines)-1])
+}
+
+// --- Session Export ---
+
+// /export renders the session as a document for code review or
+// documentation: Markdown, a self-contained HTML page, or JSON. Each tool
+// call is shown with its output (collapsed), and apply_udiff calls with the
+// diff they applied. Secrets are redacted as for /share.
+
+// exportMessage is one user or assistant message of an export.
+type exportMessage struct {
+	Role        string           `json:"role"`
+	Content     string           `json:"content,omitempty"`
+	Attachments []string         `json:"attachments,omitempty"`
+	ToolCalls   []exportToolCall `json:"tool_calls,omitempty"`
+}
+
+type exportToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments,omitempty"` // Pretty-printed JSON
+	Path      string `json:"path,omitempty"`      // apply_udiff only
+	Diff      string `json:"diff,omitempty"`      // apply_udiff only
+	Output    string `json:"output"`
+}
+
+// sessionExport is the JSON form of an export.
+type sessionExport struct {
+	Version  string          `json:"version"`
+	Model    string          `json:"model"`
+	Session  string          `json:"session"`
+	Exported string          `json:"exported"`
+	Messages []exportMessage `json:"messages"`
+}
+
+// buildSessionExport pairs tool calls with their results and drops the
+// system prompt and thoughts.
+func buildSessionExport(messages []Message) sessionExport {
+	export := sessionExport{Version: Version, Model: ModelName, Session: sessionID, Exported: time.Now().Format(time.RFC3339)}
+	calls := map[string]*exportToolCall{}
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user", "assistant":
+			em := exportMessage{Role: msg.Role, Content: strings.TrimSpace(thoughtTagRe.ReplaceAllString(msg.Content, ""))}
+			for _, p := range msg.Parts {
+				name := p.Type
+				if p.File != nil {
+					name = p.File.Filename
+				}
+				em.Attachments = append(em.Attachments, name)
+			}
+			for _, tc := range msg.ToolCalls {
+				call := exportToolCall{Name: tc.Function.Name, Arguments: tc.Function.Arguments}
+				var pretty bytes.Buffer
+				if json.Indent(&pretty, []byte(tc.Function.Arguments), "", "  ") == nil {
+					call.Arguments = pretty.String()
+				}
+				if tc.Function.Name == "apply_udiff" {
+					var args struct{ Path, Diff string }
+					if json.Unmarshal([]byte(tc.Function.Arguments), &args) == nil && args.Diff != "" {
+						call.Path, call.Diff, call.Arguments = args.Path, args.Diff, ""
+					}
+				}
+				em.ToolCalls = append(em.ToolCalls, call)
+			}
+			if em.Content == "" && len(em.Attachments) == 0 && len(em.ToolCalls) == 0 {
+				continue
+			}
+			export.Messages = append(export.Messages, em)
+			last := &export.Messages[len(export.Messages)-1]
+			for i, tc := range msg.ToolCalls {
+				calls[tc.ID] = &last.ToolCalls[i]
+			}
+		case "tool":
+			if call, ok := calls[msg.ToolCallID]; ok {
+				call.Output = msg.Content
+			}
+		}
+	}
+	return export
+}
+
+func exportMarkdown(export sessionExport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Simple Agent session\n\n")
+	fmt.Fprintf(&sb, "- Version: %s\n- Model: %s\n- Session: %s\n- Exported: %s\n\n", export.Version, export.Model, export.Session, export.Exported)
+	for _, msg := range export.Messages {
+		title := "User"
+		if msg.Role == "assistant" {
+			title = "Assistant"
+		}
+		fmt.Fprintf(&sb, "## %s\n\n", title)
+		if msg.Content != "" {
+			fmt.Fprintf(&sb, "%s\n\n", msg.Content)
+		}
+		for _, name := range msg.Attachments {
+			fmt.Fprintf(&sb, "_Attachment: %s (not included)_\n\n", name)
+		}
+		for _, call := range msg.ToolCalls {
+			if call.Diff != "" {
+				fmt.Fprintf(&sb, "**Edit: `%s`**\n\n%s\n", call.Path, markdownFence(call.Diff, "diff"))
+			} else {
+				fmt.Fprintf(&sb, "**Tool call: `%s`**\n\n%s\n", call.Name, markdownFence(call.Arguments, "json"))
+			}
+			fmt.Fprintf(&sb, "<details><summary>Output</summary>\n\n%s\n</details>\n\n", markdownFence(call.Output, ""))
+		}
+	}
+	return sb.String()
+}
+
+const exportHTMLStyle = `body { max-width: 980px; margin: 2em auto; padding: 0 1em; font: 14px/1.5 system-ui, sans-serif; color: #222; }
+.msg { margin: 1em 0; padding: .6em 1em; border-radius: 6px; white-space: pre-wrap; }
+.user { background: #e8f0fe; } .assistant { background: #f4f4f4; }
+.role { font-size: 11px; text-transform: uppercase; color: #777; }
+details, .edit { margin: .5em 0; white-space: normal; } summary { cursor: pointer; color: #7b3fa0; }
+pre { background: #fff; border: 1px solid #ddd; padding: .5em; overflow-x: auto; font: 12px/1.4 ui-monospace, monospace; }
+.add { color: #22863a; } .del { color: #cb2431; } .hunk { color: #005cc5; }`
+
+// exportDiffHTML colors the lines of a unified diff.
+func exportDiffHTML(diff string) string {
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			sb.WriteString(`<span class="hunk">`)
+		case strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++"):
+			sb.WriteString(`<span class="add">`)
+		case strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "---"):
+			sb.WriteString(`<span class="del">`)
+		default:
+			sb.WriteString("<span>")
+		}
+		sb.WriteString(html.EscapeString(line) + "</span>\n")
+	}
+	return sb.String()
+}
+
+func exportHTML(export sessionExport) string {
+	esc := html.EscapeString
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n<title>Simple Agent session %s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", esc(export.Session), exportHTMLStyle)
+	fmt.Fprintf(&sb, "<h1>Simple Agent session</h1>\n<p>Version %s · Model %s · Session %s · Exported %s</p>\n", esc(export.Version), esc(export.Model), esc(export.Session), esc(export.Exported))
+	for _, msg := range export.Messages {
+		title := "You"
+		if msg.Role == "assistant" {
+			title = "Agent"
+		}
+		fmt.Fprintf(&sb, "<div class=\"msg %s\"><div class=\"role\">%s</div>", msg.Role, title)
+		if msg.Content != "" {
+			sb.WriteString(esc(msg.Content))
+		}
+		for _, name := range msg.Attachments {
+			fmt.Fprintf(&sb, "\n<em>Attachment: %s (not included)</em>", esc(name))
+		}
+		for _, call := range msg.ToolCalls {
+			if call.Diff != "" {
+				fmt.Fprintf(&sb, "<div class=\"edit\">✏️ <code>%s</code><pre>%s</pre></div>", esc(call.Path), exportDiffHTML(call.Diff))
+			} else {
+				fmt.Fprintf(&sb, "<details><summary>🛠 %s</summary><pre>%s</pre></details>", esc(call.Name), esc(call.Arguments))
+			}
+			fmt.Fprintf(&sb, "<details><summary>Output</summary><pre>%s</pre></details>", esc(call.Output))
+		}
+		sb.WriteString("</div>\n")
+	}
+	sb.WriteString("</body>\n</html>\n")
+	return sb.String()
+}
+
+func handleExportCommand(arg string, messages []Message) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		fmt.Println("Usage: /export [md|html|json] <file>")
+		return
+	}
+	// Without a format, the file extension decides, defaulting to Markdown
+	path := fields[len(fields)-1]
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if len(fields) == 2 {
+		format = fields[0]
+	} else if format != "html" && format != "htm" && format != "json" {
+		format = "md"
+	}
+	if format == "markdown" {
+		format = "md"
+	}
+
+	export := buildSessionExport(messages)
+	var doc string
+	switch format {
+	case "md":
+		doc = exportMarkdown(export)
+	case "html", "htm":
+		doc = exportHTML(export)
+	case "json":
+		data, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		doc = string(data) + "\n"
+	default:
+		fmt.Printf("Unknown export format '%s' (use md, html or json)\n", format)
+		return
+	}
+	doc, redacted := redact(doc)
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Exported %d messages to %s (%d bytes, %d secret(s) redacted).\n", len(export.Messages), path, len(doc), redacted)
+}
+
+// --- Pruning ---
+
+// /prune removes parts of the live context. The transcript is not touched, so
+// pruned turns can still be inspected with /show.
+
+const prunedToolOutput = "[Tool output pruned by the user]"
+
+// liveTurns splits the conversation into turns: each turn starts at a user
+// message and runs until the next one. The system prompt is never part of a
+// turn, and tool results stay with the assistant message that requested them.
+func liveTurns(messages []Message) [][2]int {
+	var turns [][2]int
+	for i, msg := range messages {
+		if msg.Role == "user" {
+			if len(turns) > 0 {
+				turns[len(turns)-1][1] = i
+			}
+			turns = append(turns, [2]int{i, len(messages)})
+		}
+	}
+	return turns
+}
+
+func messageChars(msgs []Message) int {
+	n := 0
+	for _, msg := range msgs {
+		n += len(msg.Content)
+		for _, tc := range msg.ToolCalls {
+			n += len(tc.Function.Arguments)
+		}
+	}
+	return n
+}
+
+func printLiveTurns(messages []Message) {
+	turns := liveTurns(messages)
+	if len(turns) == 0 {
+		fmt.Println("The live context has no turns.")
+		return
+	}
+	fmt.Println("Turns in the live context:")
+	for i, t := range turns {
+		line := truncateLine(strings.SplitN(strings.TrimSpace(messages[t[0]].Content), "\n", 2)[0], 70)
+		fmt.Printf("  %3d  %3d msgs  ~%6d tokens  %s\n", i+1, t[1]-t[0], messageChars(messages[t[0]:t[1]])/4, line)
+	}
+}
+
+// parseTurnSelection parses "3", "2-5" or "1,4,6-7" into a set of 1-based turns.
+func parseTurnSelection(arg string, count int) (map[int]bool, error) {
+	selected := make(map[int]bool)
+	for _, part := range strings.Split(arg, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid turn '%s'", part)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("invalid turn range '%s'", part)
+			}
+		}
+		if from < 1 || to > count || from > to {
+			return nil, fmt.Errorf("turn '%s' out of range (1-%d)", part, count)
+		}
+		for n := from; n <= to; n++ {
+			selected[n] = true
+		}
+	}
+	return selected, nil
+}
+
+// pruneTurns drops the selected turns from messages.
+func pruneTurns(messages []Message, selected map[int]bool) []Message {
+	turns := liveTurns(messages)
+	drop := make([]bool, len(messages))
+	for i, t := range turns {
+		if selected[i+1] {
+			for j := t[0]; j < t[1]; j++ {
+				drop[j] = true
+			}
+		}
+	}
+	var kept []Message
+	for i, msg := range messages {
+		if !drop[i] {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// pruneToolOutputs replaces every tool result with a placeholder. The tool
+// messages themselves stay because the API requires a result per tool call.
+func pruneToolOutputs(messages []Message) (int, int) {
+	count, saved := 0, 0
+	for i := range messages {
+		if messages[i].Role == "tool" && messages[i].Content != prunedToolOutput {
+			saved += max(0, len(messages[i].Content)-len(prunedToolOutput))
+			messages[i].Content = prunedToolOutput
+			count++
+		}
+	}
+	return count, saved
+}
+
+// pruneBeforeCheckpoint removes every message the checkpoint had already
+// seen, keeping the system prompt and what came after the checkpoint.
+func pruneBeforeCheckpoint(messages []Message, name string) ([]Message, error) {
+	cp, err := loadCheckpoint(name)
+	if err != nil {
+		return nil, err
+	}
+	n := len(cp.Messages)
+	if n > 0 && cp.Messages[0].Role != "system" {
+		n++ // Align with the live context, which starts with the system prompt
+	}
+	if n <= 1 {
+		return messages, nil
+	}
+	last := cp.Messages[len(cp.Messages)-1]
+	if n > len(messages) || messages[n-1].Role != last.Role || messages[n-1].Content != last.Content {
+		return nil, fmt.Errorf("checkpoint '%s' is not part of the live context (was it cleared or rewound?)", name)
+	}
+	// Never start the remaining context with orphaned tool results
+	for n < len(messages) && messages[n].Role == "tool" {
+		n++
+	}
+	return append([]Message{messages[0]}, messages[n:]...), nil
+}
+
+func handlePruneCommand(arg string, messages *[]Message) {
+	sub, rest, _ := strings.Cut(arg, " ")
+	rest = strings.TrimSpace(rest)
+	before := len(*messages)
+
+	switch sub {
+	case "":
+		printLiveTurns(*messages)
+		fmt.Println("Usage: /prune turn <n|n-m|n,m> | /prune tools | /prune before <checkpoint>")
+		return
+	case "turn", "turns":
+		selected, err := parseTurnSelection(rest, len(liveTurns(*messages)))
+		if rest == "" || err != nil {
+			if err == nil {
+				err = fmt.Errorf("usage: /prune turn <n|n-m|n,m>")
+			}
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		*messages = pruneTurns(*messages, selected)
+		fmt.Printf("Pruned %d turn(s) (%d messages).\n", len(selected), before-len(*messages))
+	case "tools":
+		count, saved := pruneToolOutputs(*messages)
+		if count == 0 {
+			fmt.Println("No tool outputs to prune.")
+			return
+		}
+		fmt.Printf("Pruned %d tool output(s) (~%d tokens).\n", count, saved/4)
+	case "before":
+		if rest == "" {
+			printCheckpoints()
+			return
+		}
+		pruned, err := pruneBeforeCheckpoint(*messages, rest)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		*messages = pruned
+		fmt.Printf("Pruned %d message(s) before checkpoint '%s'.\n", before-len(*messages), rest)
+	default:
+		fmt.Println("Usage: /prune turn <n|n-m|n,m> | /prune tools | /prune before <checkpoint>")
+		return
+	}
+	saveHistory(*messages)
+	fmt.Println("The full conversation remains in the transcript (/show).")
+}
+
+// --- Checkpoints ---
+
+// Checkpoint captures the conversation together with a snapshot of the working
+// tree. The snapshot is a commit (including untracked files) kept alive by the
+// ref refs/simple-agent/checkpoints/<name>, so the user's stash and branches are
+// left untouched.
+type Checkpoint struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	Head     string    `json:"head,omitempty"`     // HEAD when the checkpoint was taken
+	Snapshot string    `json:"snapshot,omitempty"` // Commit holding the worktree state
+	Messages []Message `json:"messages"`
+}
+
+var checkpointNameRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// agentStatePaths are excluded from worktree snapshots so rewinding never
+// clobbers the agent's own history and checkpoints.
+var agentStatePaths = []string{".simple_agent", legacyHistoryPath}
+
+func getCheckpointDir() string {
+	return filepath.Join(".simple_agent", "checkpoints")
+}
+
+func runGit(env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func isGitRepo() bool {
+	_, err := runGit(nil, "rev-parse", "--is-inside-work-tree")
+	return err == nil
+}
+
+// snapshotWorktree records the current working tree (tracked and untracked,
+// respecting .gitignore) as a commit without touching the real index. The
+// commit is kept alive by ref.
+func snapshotWorktree(message, ref string) (head string, snapshot string, err error) {
+	head, _ = runGit(nil, "rev-parse", "--verify", "-q", "HEAD")
+
+	tmpIndex, err := os.CreateTemp("", "simple-agent-index-*")
+	if err != nil {
+		return "", "", err
+	}
+	tmpIndex.Close()
+	os.Remove(tmpIndex.Name()) // git must create the index itself
+	defer os.Remove(tmpIndex.Name())
+	env := []string{"GIT_INDEX_FILE=" + tmpIndex.Name()}
+
+	if head != "" {
+		if _, err := runGit(env, "read-tree", head); err != nil {
+			return "", "", err
+		}
+	}
+	addArgs := []string{"add", "-A", "--", "."}
+	for _, p := range agentStatePaths {
+		addArgs = append(addArgs, ":(exclude)"+p)
+	}
+	if _, err := runGit(env, addArgs...); err != nil {
+		return "", "", err
+	}
+	tree, err := runGit(env, "write-tree")
+	if err != nil {
+		return "", "", err
+	}
+
+	commitArgs := []string{"commit-tree", tree, "-m", message}
+	if head != "" {
+		commitArgs = append(commitArgs, "-p", head)
+	}
+	snapshot, err = runGit(nil, commitArgs...)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := runGit(nil, "update-ref", ref, snapshot); err != nil {
+		return "", "", err
+	}
+	return head, snapshot, nil
+}
+
+// restoreWorktree resets HEAD and the working tree to a snapshot taken by
+// snapshotWorktree, deleting files created after the checkpoint.
+func restoreWorktree(head, snapshot string) error {
+	if head != "" {
+		if _, err := runGit(nil, "reset", "-q", "--hard", head); err != nil {
+			return err
+		}
+	}
+	if _, err := runGit(nil, "checkout", snapshot, "--", "."); err != nil {
+		return err
+	}
+	// checkout updates the index too; keep it in sync with HEAD so that
+	// restored untracked files stay untracked.
+	if head != "" {
+		if _, err := runGit(nil, "reset", "-q"); err != nil {
+			return err
+		}
+	}
+
+	listing, err := runGit(nil, "ls-tree", "-r", "--name-only", snapshot)
+	if err != nil {
+		return err
+	}
+	inSnapshot := make(map[string]bool)
+	for _, f := range strings.Split(listing, "\n") {
+		inSnapshot[f] = true
+	}
+	current, err := runGit(nil, "ls-files", "-co", "--exclude-standard")
+	if err != nil {
+		return err
+	}
+	for _, f := range strings.Split(current, "\n") {
+		if f == "" || inSnapshot[f] || isAgentStatePath(f) {
+			continue
+		}
+		os.Remove(f)
+	}
+	return nil
+}
+
+func isAgentStatePath(path string) bool {
+	for _, p := range agentStatePaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func createCheckpoint(name string, messages []Message) error {
+	if !checkpointNameRe.MatchString(name) {
+		return fmt.Errorf("invalid checkpoint name '%s' (use letters, digits, '.', '_' or '-')", name)
+	}
+	cp := Checkpoint{Name: name, Created: time.Now(), Messages: messages}
+	if isGitRepo() {
+		head, snapshot, err := snapshotWorktree("simple-agent checkpoint: "+name, "refs/simple-agent/checkpoints/"+name)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot working tree: %v", err)
+		}
+		cp.Head, cp.Snapshot = head, snapshot
+	}
+
+	if err := os.MkdirAll(getCheckpointDir(), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err == nil {
+		data, err = sealData(data)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(getCheckpointDir(), name+".json"), data, 0644)
+}
+
+func loadCheckpoint(name string) (Checkpoint, error) {
+	var cp Checkpoint
+	if !checkpointNameRe.MatchString(name) {
+		return cp, fmt.Errorf("invalid checkpoint name '%s'", name)
+	}
+	data, err := os.ReadFile(filepath.Join(getCheckpointDir(), name+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, fmt.Errorf("checkpoint '%s' not found", name)
+		}
+		return cp, err
+	}
+	if data, err = openData(data); err != nil {
+		return cp, err
+	}
+	err = json.Unmarshal(data, &cp)
+	return cp, err
+}
+
+func listCheckpoints() []Checkpoint {
+	entries, err := os.ReadDir(getCheckpointDir())
+	if err != nil {
+		return nil
+	}
+	var checkpoints []Checkpoint
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		if cp, err := loadCheckpoint(strings.TrimSuffix(e.Name(), ".json")); err == nil {
+			checkpoints = append(checkpoints, cp)
+		}
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].Created.Before(checkpoints[j].Created) })
+	return checkpoints
+}
+
+func printCheckpoints() {
+	checkpoints := listCheckpoints()
+	if len(checkpoints) == 0 {
+		fmt.Println("No checkpoints. Create one with /checkpoint <name>.")
+		return
+	}
+	fmt.Println("Checkpoints:")
+	for _, cp := range checkpoints {
+		code := "no git snapshot"
+		if cp.Snapshot != "" {
+			code = "code " + cp.Snapshot[:8]
+		}
+		fmt.Printf("- %s (%s, %d messages, %s)\n", cp.Name, cp.Created.Format("2006-01-02 15:04"), len(cp.Messages), code)
+	}
+}
+
+// rewindToCheckpoint restores the conversation (keeping the current system
+// prompt) and, after confirmation, the working tree.
+func rewindToCheckpoint(name string, messages *[]Message) error {
+	cp, err := loadCheckpoint(name)
+	if err != nil {
+		return err
+	}
+
+	if cp.Snapshot != "" {
+		fmt.Printf("Rewinding to '%s' will discard all uncommitted changes", cp.Name)
+		if head, _ := runGit(nil, "rev-parse", "--verify", "-q", "HEAD"); cp.Head != "" && head != cp.Head {
+			fmt.Printf(" and reset the current branch from %.8s to %.8s (later commits stay reachable via git reflog)", head, cp.Head)
+		}
+		fmt.Print(".\nContinue? [y/N]: ")
+		confirm, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(confirm)) != "y" {
+			return fmt.Errorf("rewind aborted")
+		}
+		if err := restoreWorktree(cp.Head, cp.Snapshot); err != nil {
+			return fmt.Errorf("failed to restore working tree: %v", err)
+		}
+	}
+
+	restored := []Message{(*messages)[0]}
+	if len(cp.Messages) > 0 && cp.Messages[0].Role == "system" {
+		cp.Messages = cp.Messages[1:]
+	}
+	*messages = append(restored, cp.Messages...)
+	saveHistory(*messages)
+	return nil
+}
+
+func handleSlashCommand(input string, messages *[]Message, skills []Skill, memory *Memory, systemPrompt, apiKey, provider string) bool {
+	cmd := strings.TrimSpace(input)
+	if !strings.HasPrefix(cmd, "/") {
+		return false
+	}
+
+	// Split "/command argument"
+	arg := ""
+	if i := strings.IndexFunc(cmd, unicode.IsSpace); i != -1 {
+		cmd, arg = cmd[:i], strings.TrimSpace(cmd[i:])
+	}
+
+	switch cmd {
+	case "/checkpoint":
+		if arg == "" {
+			printCheckpoints()
+			return true
+		}
+		if err := createCheckpoint(arg, *messages); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Checkpoint '%s' saved.\n", arg)
+		}
+		return true
+	case "/show":
+		entries := readTranscript()
+		if arg == "" {
+			printTurnList(entries, 20)
+			return true
+		}
+		turn, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Println("Usage: /show <turn-number>")
+			return true
+		}
+		if err := renderTurn(entries, turn); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return true
+	case "/rewind":
+		if arg == "" {
+			printCheckpoints()
+			return true
+		}
+		if err := rewindToCheckpoint(arg, messages); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			seenFiles.Forget()
+			sessionTodos.Restore(*messages)
+			fmt.Printf("Rewound to checkpoint '%s' (%d messages).\n", arg, len(*messages))
+		}
+		return true
+	case "/edit":
+		handleEditCommand(arg, messages)
+		return true
+	case "/instructions":
+		handleInstructionsCommand(arg)
+		return true
+	case "/share":
+		handleShareCommand(arg, *messages)
+		return true
+	case "/export":
+		handleExportCommand(arg, *messages)
+		return true
+	case "/dump-context":
+		handleDumpContextCommand(arg, *messages, provider)
+		return true
+	case "/retry":
+		if arg != "" && arg != "diff" {
+			fmt.Println("Usage: /retry [diff]")
+			return true
+		}
+		retry, err := prepareRetry(messages, arg == "diff")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return true
+		}
+		pendingRetry = retry
+		sessionTodos.Restore(*messages)
+		fmt.Println("Retrying the last message. Changes the previous answer made to files are kept.")
+		return true
+	case "/audit":
+		handleAuditCommand(arg)
+		return true
+	case "/commit":
+		var history []Message
+		for _, m := range *messages {
+			if m.Role != "system" {
+				history = append(history, m)
+			}
+		}
+		paths := agentChanges.Pending()
+		if len(paths) == 0 && isGitDirty() {
+			fmt.Println("No uncommitted changes by the agent are recorded; proposing a commit of all modified tracked files.")
+		}
+		if err := performGitCommit(context.Background(), apiKey, history, skills, paths, false); err != nil {
+			if err.Error() == "git clean" {
+				fmt.Println("Nothing to commit (working directory clean).")
+			} else {
+				fmt.Printf("Error: %v\n", err)
+			}
+		}
+		return true
+	case "/clear":
+		*messages = []Message{
+			{
+				Role:    "system",
+				Content: systemPrompt,
+			},
+		}
+		saveHistory(*messages)
+		seenFiles.Forget()
+		sessionTodos.Restore(*messages)
+		fmt.Println("Conversation history cleared.")
+		return true
+	case "/merge":
+		handleMergeCommand(arg)
+		return true
+	case "/pr":
+		handlePRCommand(arg, *messages, apiKey)
+		return true
+	case "/prune":
+		handlePruneCommand(arg, messages)
+		sessionTodos.Restore(*messages)
+		return true
+	case "/todos":
+		sessionTodos.Print()
+		return true
+	case "/skills":
+		fmt.Println("Available Skills:")
+		for _, s := range skills {
+			fmt.Printf("- %s (v%s): %s\n", s.Name, s.Version, s.Description)
+			if len(s.Commands) > 0 {
+				var names []string
+				for name := range s.Commands {
+					names = append(names, "/"+name)
+				}
+				sort.Strings(names)
+				fmt.Printf("  Commands: %s\n", strings.Join(names, ", "))
+			}
+		}
+		return true
+	case "/history":
+		fmt.Printf("History contains %d messages.\n", len(*messages))
+		return true
+	case "/memory":
+		handleMemoryCommand(memory, arg)
+		return true
+	case "/plan":
+		handlePlanCommand(arg, messages, apiKey)
+		return true
+	case "/attach":
+		handleAttachCommand(arg, provider)
+		return true
+	case "/model":
+		handleModelCommand(arg, provider)
+		return true
+	case "/thinking":
+		switch {
+		case arg == "":
+			level := thinkingLevel
+			if level == "" {
+				level = "default"
+			}
+			fmt.Printf("Thinking: %s (set with /thinking off|low|medium|high|default)\n", level)
+		case arg == "default":
+			thinkingLevel = ""
+			fmt.Println("Thinking reset to the provider default.")
+		case validThinkingLevel(arg):
+			thinkingLevel = arg
+			fmt.Printf("Thinking set to %s from the next request.\n", arg)
+		default:
+			fmt.Println("Usage: /thinking [off|low|medium|high|default]")
+		}
+		return true
+	case "/cost":
+		fmt.Println("Session usage:")
+		sessionUsage.Print()
+		return true
+	case "/hooks":
+		handleHooksCommand(skills, arg)
+		return true
+	case "/debug":
+		switch arg {
+		case "on":
+			debugLLM = true
+		case "off":
+			debugLLM = false
+		case "":
+		default:
+			fmt.Println("Usage: /debug [on|off]")
+			return true
+		}
+		if debugLLM {
+			fmt.Printf("Logging model requests and responses to %s\n", debugLLMDir())
+		} else {
+			fmt.Println("Request logging is off.")
+		}
+		return true
+	case "/help":
+		fmt.Println("Available Commands:")
+		fmt.Println("  /clear             - Clear conversation history")
+		fmt.Println("  /prune [cmd]       - Drop turns, tool outputs or everything before a checkpoint from context")
+		fmt.Println("  /edit [path]       - Edit a file (default: the last one the agent edited) in $EDITOR and tell the model")
+		fmt.Println("  /retry [diff]      - Regenerate the last answer (diff: then show what changed)")
+		fmt.Println("  /dump-context [f]  - Write the messages the next request would send, with token estimates")
+		fmt.Println("  /share [anon] [gist] - Write a redacted session report (anon: hide paths; gist: upload via gh)")
+		fmt.Println("  /export [md|html|json] <file> - Export the session with tool calls, outputs and diffs")
+		fmt.Println("  /commit            - Generate and propose a git commit")
+		fmt.Println("  /pr [base]         - Push the branch and open a pull request with a generated description")
+		fmt.Println("  /merge [abort]     - Squash the task branch back into its base branch (-auto-branch)")
+		fmt.Println("  /skills            - List available skills")
+		fmt.Println("  /hooks [cmd]       - Show the order skill hooks run in; enable, disable or reprioritize one")
+		fmt.Println("  /model [name]      - Show or switch the active model (e.g. /model flash)")
+		fmt.Println("  /cost              - Show token usage and estimated cost for this session")
+		fmt.Println("  /audit [tool]      - List this session's tool calls with approvals, exit codes and durations")
+		fmt.Println("  /debug [on|off]    - Log every model request and response to ~/.simple_agent/debug")
+		fmt.Println("  /thinking [level]  - Show or set the thinking budget (off, low, medium, high, default)")
+		fmt.Println("  /history           - Show history stats")
+		fmt.Println("  /memory [cmd]      - List, search, forget, import or clear project memory")
+		fmt.Println("  /instructions [f]  - List the loaded AGENTS.md/CLAUDE.md/.cursorrules files, or show one")
+		fmt.Println("  /attach [path...]  - Attach images, PDFs or text files to the next message")
+		fmt.Println("  /paste [END]       - Paste a block verbatim until a line reading END (default EOF)")
+		fmt.Println("  /show [turn]       - Re-render a past turn in full (no turn: list recent turns)")
+		fmt.Println("  /plan [goal|cmd]   - Plan a task and run it step by step (resume, skip, rollback <n>, abort)")
+		fmt.Println("  /todos             - Show the model's todo list for this session")
+		fmt.Println("  /checkpoint [name] - Save conversation and code state (no name: list)")
+		fmt.Println("  /rewind <name>     - Restore conversation and code to a checkpoint")
+		fmt.Println("  /help              - Show this help message")
+		fmt.Println("  /exit              - Exit the agent")
+		printSkillCommands(skills)
+		return true
+	case "/exit", "/quit":
+		tui.Close()
+		fmt.Println("Exiting...")
+		runSessionEndHooks(skills)
+		os.Exit(0)
+		return true
+	}
+
+	if skill, command, ok := findSkillCommand(skills, strings.TrimPrefix(cmd, "/")); ok {
+		runSkillCommand(skill, strings.TrimPrefix(cmd, "/"), command, arg, messages)
+		return true
+	}
+
+	fmt.Printf("Unknown command: %s\n", cmd)
+	return true
+}
+
+// --- Skill Commands ---
+
+// Skills can declare slash commands (see SkillCommand). Built-in commands
+// take precedence; project skills override core skills, as for skills.
+
+// skillCommandInput is the prompt of a skill command, sent as the next message.
+var skillCommandInput string
+
+// findSkillCommand returns the skill that declares the command name.
+func findSkillCommand(skills []Skill, name string) (*Skill, SkillCommand, bool) {
+	var found *Skill
+	for i := range skills {
+		if _, ok := skills[i].Commands[name]; !ok {
+			continue
+		}
+		if found == nil || (isCoreSkill(found) && !isCoreSkill(&skills[i])) || (isCoreSkill(found) == isCoreSkill(&skills[i]) && skills[i].Name < found.Name) {
+			found = &skills[i]
+		}
+	}
+	if found == nil {
+		return nil, SkillCommand{}, false
+	}
+	return found, found.Commands[name], true
+}
+
+// runSkillCommand runs a skill command with the text typed after it. Script
+// output is shown and noted for the model; a prompt is queued as the next
+// message.
+func runSkillCommand(skill *Skill, name string, command SkillCommand, arg string, messages *[]Message) {
+	if command.Prompt != "" {
+		prompt := strings.ReplaceAll(command.Prompt, "{skill_path}", skill.Path)
+		prompt = expandPromptVariables(context.Background(), ModelName, prompt)
+		if strings.Contains(prompt, "{args}") {
+			prompt = strings.ReplaceAll(prompt, "{args}", arg)
+		} else if arg != "" {
+			prompt += "\n\n" + arg
+		}
+		skillCommandInput = prompt
+		return
+	}
+	if command.Script == "" {
+		fmt.Printf("Command /%s of skill '%s' has neither a script nor a prompt.\n", name, skill.Name)
+		return
+	}
+	if ok, reason := trustSkill(context.Background(), skill); !ok {
+		fmt.Println(reason)
+		return
+	}
+	if isCoreSkill(skill) {
+		ensureCoreSkills()
+	}
+
+	template := strings.ReplaceAll(command.Script, "{skill_path}", skill.Path)
+	userArgs, err := parseArgs(arg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	parts, err := parseArgs(strings.ReplaceAll(template, "{args}", ""))
+	if err != nil || len(parts) == 0 {
+		fmt.Printf("Error: invalid script '%s' for /%s in skill '%s'\n", command.Script, name, skill.Name)
+		return
+	}
+	// Typed arguments are passed as is, wherever {args} stood (default: last)
+	var args []string
+	if strings.Contains(template, "{args}") {
+		before, after, _ := strings.Cut(template, "{args}")
+		beforeParts, _ := parseArgs(before)
+		afterParts, _ := parseArgs(after)
+		args = append(append(append(args, beforeParts[1:]...), userArgs...), afterParts...)
+	} else {
+		args = append(parts[1:], userArgs...)
+	}
+	script := parts[0]
+	if !filepath.IsAbs(script) {
+		script = filepath.Join(skill.Path, script)
+	}
+
+	fmt.Printf("\033[36m▶ /%s (skill '%s'): %s %s\033[0m\n", name, skill.Name, script, strings.Join(args, " "))
+	out, err := runSafeScript(context.Background(), script, args, "")
+	fmt.Println(strings.TrimRight(out, "\n"))
+	status := "succeeded"
+	if err != nil {
+		fmt.Printf("\033[31m/%s failed: %v\033[0m\n", name, err)
+		status = fmt.Sprintf("failed (%v)", err)
+	}
+
+	// The model may be asked about the result next
+	if len(out) > maxTestOutputChars {
+		out = "... (earlier output truncated)\n" + out[len(out)-maxTestOutputChars:]
+	}
+	cwd, _ := os.Getwd()
+	*messages = append(*messages, Message{
+		Role:    "system",
+		Content: fmt.Sprintf("[System] The user ran /%s %s (skill '%s', %s), which %s. Output:\n%s", name, arg, skill.Name, displayPath(cwd, script), status, out),
+	})
+	saveHistory(*messages)
+}
+
+// printSkillCommands lists the slash commands declared by skills for /help.
+func printSkillCommands(skills []Skill) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range skills {
+		for name := range s.Commands {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	fmt.Println("Skill Commands:")
+	for _, name := range names {
+		skill, command, _ := findSkillCommand(skills, name)
+		description := command.Description
+		if description == "" {
+			description = "Runs " + command.Script
+			if command.Prompt != "" {
+				description = "Asks the model: " + truncateLine(command.Prompt, 50)
+			}
+		}
+		fmt.Printf("  %-18s - %s (%s)\n", "/"+name, description, skill.Name)
+	}
+}
+
+// --- Project Instructions ---
+
+// Instruction files (AGENTS.md, CLAUDE.md, .cursorrules) are added to the
+// system prompt from three levels, most general first: global
+// (~/.simple_agent), the repository root, and each directory from there down
+// to the working directory. Files further down the tree are only listed; the
+// model reads them before working in their directory.
+
+var defaultInstructionFiles = []string{"AGENTS.md", "CLAUDE.md", ".cursorrules"}
+
+const (
+	maxInstructionFileChars = 32000
+	maxNestedInstructions   = 50
+)
+
+type InstructionFile struct {
+	Path      string // As shown to the model
+	Scope     string // org, global, repo, directory or nested
+	Content   string // Empty for nested files
+	Truncated bool
+}
+
+// loadedInstructions is what the session's system prompt was built from.
+var loadedInstructions []InstructionFile
+
+// loadInstructionFiles finds the instruction files called one of names.
+func loadInstructionFiles(names []string) []InstructionFile {
+	if len(names) == 0 {
+		names = defaultInstructionFiles
+	}
+	cwd, _ := os.Getwd()
+	var files []InstructionFile
+	seen := make(map[string]bool) // Contents, since CLAUDE.md is often a copy of AGENTS.md
+	load := func(dir, scope string) {
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			data, err := os.ReadFile(path)
+			if err != nil || len(bytes.TrimSpace(data)) == 0 {
+				continue
+			}
+			content := strings.TrimSpace(string(data))
+			if seen[content] {
+				continue
+			}
+			seen[content] = true
+			f := InstructionFile{Path: displayPath(cwd, path), Scope: scope, Content: content}
+			if rel, err := filepath.Rel(cwd, path); err == nil && scope != "global" && scope != "org" {
+				f.Path = filepath.ToSlash(rel)
+			}
+			if len(f.Content) > maxInstructionFileChars {
+				f.Content, f.Truncated = f.Content[:maxInstructionFileChars], true
+			}
+			files = append(files, f)
+		}
+	}
+
+	if dir := orgSkillsDir(); dir != "" {
+		load(dir, "org")
+	}
+	if home := getAgentHomeDir(); home != "" {
+		load(home, "global")
+	}
+	root := cwd
+	if top, err := runGit(nil, "rev-parse", "--show-toplevel"); err == nil {
+		root = top
+	}
+	// The directories from the repository root down to the working directory
+	dirs := []string{cwd}
+	for dir := cwd; dir != root; {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			dirs = []string{cwd} // cwd isn't inside root (e.g. through a symlink)
+			break
+		}
+		dir = parent
+		dirs = append([]string{dir}, dirs...)
+	}
+	for i, dir := range dirs {
+		scope := "directory"
+		if i == 0 {
+			scope = "repo"
+		}
+		load(dir, scope)
+	}
+
+	for _, path := range findNestedInstructionFiles(names) {
+		files = append(files, InstructionFile{Path: path, Scope: "nested"})
+	}
+	return files
+}
+
+// findNestedInstructionFiles lists the instruction files below the working
+// directory (not in it).
+func findNestedInstructionFiles(names []string) []string {
+	isInstructionFile := func(path string) bool {
+		for _, name := range names {
+			if filepath.Base(path) == name {
+				return true
+			}
+		}
+		return false
+	}
+	var paths []string
+	if out, err := runGit(nil, "ls-files", "--cached", "--others", "--exclude-standard"); err == nil {
+		for _, path := range strings.Split(out, "\n") {
+			if strings.Contains(path, "/") && isInstructionFile(path) {
+				paths = append(paths, path)
+			}
+		}
+	} else {
+		filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+			if err != nil || len(paths) >= maxNestedInstructions {
+				return filepath.SkipDir
+			}
+			if d.IsDir() {
+				if path != "." && (strings.HasPrefix(d.Name(), ".") || d.Name() == "node_modules" || d.Name() == "vendor") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.Contains(path, string(os.PathSeparator)) && isInstructionFile(path) {
+				paths = append(paths, filepath.ToSlash(path))
+			}
+			return nil
+		})
+	}
+	sort.Strings(paths)
+	if len(paths) > maxNestedInstructions {
+		paths = paths[:maxNestedInstructions]
+	}
+	return paths
+}
+
+func instructionsPrompt(files []InstructionFile) string {
+	var sb strings.Builder
+	var nested []string
+	for _, f := range files {
+		if f.Scope == "nested" {
+			nested = append(nested, f.Path)
+			continue
+		}
+		if sb.Len() == 0 {
+			sb.WriteString("\n# Project Instructions\nInstructions from the user's and the project's instruction files, most general first. Follow them; where they conflict, the more specific (later) file wins.\n")
+		}
+		sb.WriteString(fmt.Sprintf("\n## %s (%s)\n%s\n", f.Path, f.Scope, f.Content))
+		if f.Truncated {
+			sb.WriteString(fmt.Sprintf("(truncated after %d characters)\n", maxInstructionFileChars))
+		}
+	}
+	if len(nested) > 0 {
+		sb.WriteString("\nThese instruction files apply to their own directories. Read the one for a directory before working in it:\n")
+		for _, path := range nested {
+			sb.WriteString("- " + path + "\n")
+		}
+	}
+	return sb.String()
+}
+
+func handleInstructionsCommand(arg string) {
+	if len(loadedInstructions) == 0 {
+		fmt.Println("No instruction files found.")
+		return
+	}
+	if arg != "" {
+		for _, f := range loadedInstructions {
+			if f.Path == arg || (f.Content != "" && filepath.Base(f.Path) == arg) {
+				if f.Content == "" {
+					fmt.Printf("%s is not loaded into the prompt; the model reads it when working in %s.\n", f.Path, filepath.Dir(f.Path))
+					return
+				}
+				printMarkdown(f.Content)
+				return
+			}
+		}
+		fmt.Printf("Unknown instruction file: %s\n", arg)
+		return
+	}
+	fmt.Println("Instruction files in the system prompt:")
+	for _, f := range loadedInstructions {
+		switch {
+		case f.Scope == "nested":
+			continue
+		case f.Truncated:
+			fmt.Printf("  %-10s %s (%d chars, truncated)\n", f.Scope, f.Path, len(f.Content))
+		default:
+			fmt.Printf("  %-10s %s (%d chars)\n", f.Scope, f.Path, len(f.Content))
+		}
+	}
+	var nested int
+	for _, f := range loadedInstructions {
+		if f.Scope == "nested" {
+			if nested == 0 {
+				fmt.Println("Listed for subdirectories (read on demand):")
+			}
+			nested++
+			fmt.Printf("  %s\n", f.Path)
+		}
+	}
+	fmt.Println("Show one with /instructions <path>. Changes apply to new sessions.")
+}
+
+// --- Test Fixing ---
+
+// -fix-tests runs the project's tests, hands the failures to the model as the
+// task, and re-runs the tests after every turn until they pass or the round
+// budget is spent.
+
+// TestFailure is one failing test parsed from the test output.
+type TestFailure struct {
+	Test   string `json:"test"`
+	File   string `json:"file,omitempty"`   // file:line, if the output names one
+	Output string `json:"output,omitempty"` // Assertion output
+}
+
+type testRun struct {
+	Command  string
+	Passed   bool
+	Output   string
+	Failures []TestFailure
+}
+
+type testFixer struct {
+	Command   string
+	MaxRounds int
+	Round     int
+}
+
+const (
+	maxTestOutputChars  = 6000
+	maxFailureLineChars = 400
+	testRunTimeout      = 10 * time.Minute
+)
+
+// runTests runs command and parses its failures.
+func runTests(ctx context.Context, command string) testRun {
+	ctx, cancel := context.WithTimeout(ctx, testRunTimeout)
+	defer cancel()
+	fmt.Printf("\033[36m🧪 Running %s\033[0m\n", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir, _ = getWorkDir(ctx)
+	out, err := cmd.CombinedOutput()
+	run := testRun{Command: command, Passed: err == nil, Output: string(out)}
+	if ctx.Err() == context.DeadlineExceeded {
+		run.Output += fmt.Sprintf("\n(test run timed out after %s)", testRunTimeout)
+	}
+	if !run.Passed {
+		run.Failures = parseTestFailures(run.Output)
+	}
+	return run
+}
+
+var (
+	goFailRe      = regexp.MustCompile(`^\s*--- FAIL: (\S+)`)
+	goLocationRe  = regexp.MustCompile(`^\s+(\S+\.go:\d+): (.*)`)
+	pytestFailRe  = regexp.MustCompile(`^FAILED (\S+?)::(\S+)(?: - (.*))?$`)
+	cargoFailRe   = regexp.MustCompile(`^---- (\S+) stdout ----$`)
+	cargoPanicRe  = regexp.MustCompile(`panicked at (\S+:\d+):\d+`)
+	jestFailRe    = regexp.MustCompile(`^\s*● (.+›.+)$`)
+	jestLocatorRe = regexp.MustCompile(`\(([^()\s]+:\d+):\d+\)`)
+)
+
+// parseTestFailures extracts the failing tests from go test, pytest, cargo
+// test and jest output. Other formats yield none; the raw output is still
+// passed on.
+func parseTestFailures(output string) []TestFailure {
+	var failures []TestFailure
+	var current *TestFailure
+	addLine := func(line string) {
+		if current != nil && strings.TrimSpace(line) != "" && strings.Count(current.Output, "\n") < 10 {
+			current.Output += truncateLine(strings.TrimSpace(line), maxFailureLineChars) + "\n"
+		}
+	}
+	start := func(f TestFailure) {
+		failures = append(failures, f)
+		current = &failures[len(failures)-1]
+	}
+	// go test -v prints a test's log above its FAIL line, otherwise below
+	goVerbose := strings.Contains(output, "=== RUN")
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if m := goFailRe.FindStringSubmatch(line); m != nil {
+			start(TestFailure{Test: m[1]})
+			if goVerbose {
+				for j := i - 1; j >= 0 && !strings.Contains(lines[j], "--- ") && !strings.HasPrefix(strings.TrimSpace(lines[j]), "=== "); j-- {
+					if loc := goLocationRe.FindStringSubmatch(lines[j]); loc != nil {
+						current.File = loc[1]
+						current.Output = truncateLine(loc[2], maxFailureLineChars) + "\n" + current.Output
+					}
+				}
+				current = nil
+			}
+			continue
+		}
+		if loc := goLocationRe.FindStringSubmatch(line); loc != nil && current != nil && !goVerbose {
+			if current.File == "" {
+				current.File = loc[1]
+			}
+			addLine(loc[2])
+			continue
+		}
+		if line == "failures:" || line == "FAIL" || strings.HasPrefix(line, "FAIL\t") {
+			current = nil
+			continue
+		}
+		if m := pytestFailRe.FindStringSubmatch(line); m != nil {
+			start(TestFailure{Test: m[2], File: m[1], Output: m[3]})
+			current = nil
+			continue
+		}
+		if m := cargoFailRe.FindStringSubmatch(line); m != nil {
+			start(TestFailure{Test: m[1]})
+			continue
+		}
+		if m := jestFailRe.FindStringSubmatch(line); m != nil {
+			start(TestFailure{Test: strings.TrimSpace(m[1])})
+			continue
+		}
+		if current != nil {
+			if current.File == "" {
+				if m := cargoPanicRe.FindStringSubmatch(line); m != nil {
+					current.File = m[1]
+				} else if m := jestLocatorRe.FindStringSubmatch(line); m != nil && !strings.Contains(line, "node_modules") {
+					current.File = m[1]
+				}
+			}
+			addLine(line)
+		}
+	}
+	return failures
+}
 
-			// No tool calls, just print response
-			cleanContent := extractAndPrintThoughts(msg.Content)
-			if strings.TrimSpace(cleanContent) != "" {
-				fmt.Printf("\n\033[1;34m🤖 Gemini:\033[0m\n")
-				printMarkdown(cleanContent)
+// prompt describes the failing run to the model.
+func (f *testFixer) prompt(run testRun) string {
+	var sb strings.Builder
+	if f.Round == 1 {
+		sb.WriteString(fmt.Sprintf("The test command `%s` fails. Fix the code so that the tests pass. Investigate each failure, find the root cause, and change the code under test; only change a test if it is clearly wrong, and say so. Don't delete or skip tests. I'll re-run the tests after your turn.\n", run.Command))
+	} else {
+		sb.WriteString(fmt.Sprintf("I re-ran `%s` and it still fails (round %d of %d). Continue fixing.\n", run.Command, f.Round, f.MaxRounds))
+	}
+	if len(run.Failures) > 0 {
+		sb.WriteString(fmt.Sprintf("\nFailing tests (%d):\n", len(run.Failures)))
+		for _, failure := range run.Failures {
+			sb.WriteString("- " + failure.Test)
+			if failure.File != "" {
+				sb.WriteString(" (" + failure.File + ")")
+			}
+			sb.WriteString("\n")
+			for _, line := range strings.Split(strings.TrimSpace(failure.Output), "\n") {
+				if line != "" {
+					sb.WriteString("    " + line + "\n")
+				}
 			}
-			break
 		}
+	}
+	output := run.Output
+	if len(output) > maxTestOutputChars {
+		output = "... (earlier output truncated)\n" + output[len(output)-maxTestOutputChars:]
+	}
+	sb.WriteString("\nTest output:\n```\n" + strings.TrimRight(output, "\n") + "\n```")
+	return sb.String()
+}
 
-		// End of turn cleanup
-		mu.Lock()
-		if currentCancel != nil {
-			cancel()
-			currentCancel = nil
+// next runs the tests and returns the next task for the model, or "" when
+// fixing is over: the tests pass or the rounds are used up.
+func (f *testFixer) next(ctx context.Context) string {
+	run := runTests(ctx, f.Command)
+	if run.Passed {
+		if f.Round == 0 {
+			fmt.Println("\033[32m✅ All tests pass; nothing to fix.\033[0m")
+		} else {
+			fmt.Printf("\033[32m✅ All tests pass after %d round(s).\033[0m\n", f.Round)
 		}
-		mu.Unlock()
+		return ""
+	}
+	if f.Round >= f.MaxRounds {
+		fmt.Printf("\033[31m❌ Tests still fail after %d round(s); giving up. %d failing test(s) remain.\033[0m\n", f.Round, len(run.Failures))
+		return ""
+	}
+	f.Round++
+	fmt.Printf("\033[33m%d failing test(s); starting round %d of %d.\033[0m\n", len(run.Failures), f.Round, f.MaxRounds)
+	return f.prompt(run)
+}
 
-		// End of turn: Check for git changes and propose commit
-		if (*gitAutoCommit || *gitForceCommit) && isGitDirty() {
-			// Get conversation history for this turn
-			var turnHistory []Message
-			if startHistoryIndex < len(messages) {
-				turnHistory = messages[startHistoryIndex:]
-			}
+// --- Test Runner ---
 
-			// If history is empty (e.g. after context reset), use the full recent context
-			if len(turnHistory) == 0 && len(messages) > 0 {
-				if len(messages) > 1 && messages[0].Role == "system" {
-					turnHistory = messages[1:]
-				} else {
-					turnHistory = messages
+// run_tests runs the project's test command, optionally narrowed to a
+// package, directory or file and a test name, and returns a summary instead
+// of the raw log: counts, the failing tests and, on failure, the output tail.
+
+var runTestsTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "run_tests",
+		Description: "Run the project's tests with its test command (see the project profile) and get a JSON summary: whether they passed, pass/fail/skip counts, each failing test with its file and assertion output, and the end of the output on failure. Narrow the run with 'path' (a package, directory or test file) and 'test' (a test name or pattern). With 'coverage', the summary also lists the coverage of the changed files and their changed lines that no test runs.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"path": {
+					"type": "string",
+					"description": "Package, directory or test file to test, relative to the project root (default: everything)"
+				},
+				"test": {
+					"type": "string",
+					"description": "Only run tests matching this name or pattern, e.g. 'TestParse' for go test -run or pytest -k"
+				},
+				"coverage": {
+					"type": "boolean",
+					"description": "Also measure coverage and report it for the changed files, with the changed lines no test runs (go test, pytest with pytest-cov, Jest)"
 				}
 			}
+		}`),
+	},
+}
 
-			if err := performGitCommit(apiKey, turnHistory, skills, *gitForceCommit); err != nil {
-				fmt.Printf("Git commit workflow failed: %v\n", err)
+const maxTestSummaryTail = 2000
+
+// testCounts is how many tests passed, failed and were skipped.
+type testCounts struct {
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+}
+
+// testSummary is the result of run_tests.
+type testSummary struct {
+	Command  string         `json:"command"`
+	Passed   bool           `json:"passed"`
+	Counts   *testCounts    `json:"counts,omitempty"`
+	Failures []TestFailure  `json:"failures,omitempty"`
+	Coverage []FileCoverage `json:"coverage,omitempty"` // Changed files, with coverage requested
+	Note     string         `json:"note,omitempty"`
+	Output   string         `json:"output_tail,omitempty"`
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// testCommandFor narrows the profile's test command to path and test, in
+// the syntax of the test runner it calls. Go tests run with -v so they can
+// be counted.
+func testCommandFor(p ProjectProfile, path, test string) (string, error) {
+	command := p.TestCommand
+	if command == "" {
+		return "", codedToolError(errNotFound, "no_test_command", "Set test_command in the config, or run the tests with run_command.", fmt.Errorf("no test command found for this project"))
+	}
+	unsupported := func(what string) error {
+		return codedToolError(errValidation, "filter_unsupported", "Leave out '"+what+"', or run a narrower command with run_command.", fmt.Errorf("can't narrow '%s' by %s", command, what))
+	}
+	path = filepath.ToSlash(path)
+	switch {
+	case strings.HasPrefix(command, "go test"):
+		if !strings.Contains(command, " -v") {
+			command = "go test -v" + strings.TrimPrefix(command, "go test")
+		}
+		if path != "" && path != "." {
+			pkg := "./" + path
+			if strings.HasSuffix(path, ".go") {
+				pkg = "./" + filepath.ToSlash(filepath.Dir(path))
 			}
+			if strings.Contains(command, "./...") {
+				command = strings.Replace(command, "./...", shellQuote(pkg), 1)
+			} else {
+				command += " " + shellQuote(pkg)
+			}
+		}
+		if test != "" {
+			command += " -run " + shellQuote(test)
+		}
+	case strings.HasPrefix(command, "cargo test"):
+		if path != "" {
+			if filepath.Dir(path) != "tests" || filepath.Ext(path) != ".rs" {
+				return "", unsupported("path")
+			}
+			command += " --test " + shellQuote(strings.TrimSuffix(filepath.Base(path), ".rs"))
+		}
+		if test != "" {
+			command += " " + shellQuote(test)
+		}
+	case strings.Contains(command, "pytest"):
+		if path != "" {
+			command += " " + shellQuote(path)
+		}
+		if test != "" {
+			command += " -k " + shellQuote(test)
 		}
+	case strings.HasPrefix(command, "npm test"), strings.HasPrefix(command, "pnpm test"), strings.HasPrefix(command, "yarn test"), strings.HasPrefix(command, "bun run test"):
+		// Jest and Vitest both take a path and -t
+		if (path != "" || test != "") && !strings.Contains(command, " -- ") {
+			command += " --"
+		}
+		if path != "" {
+			command += " " + shellQuote(path)
+		}
+		if test != "" {
+			command += " -t " + shellQuote(test)
+		}
+	case strings.HasPrefix(command, "mvn"):
+		if path != "" {
+			return "", unsupported("path")
+		}
+		if test != "" {
+			command += " -Dtest=" + shellQuote(test)
+		}
+	case strings.Contains(command, "gradle"):
+		if path != "" {
+			return "", unsupported("path")
+		}
+		if test != "" {
+			command += " --tests " + shellQuote(test)
+		}
+	default:
+		if path != "" {
+			return "", unsupported("path")
+		}
+		if test != "" {
+			return "", unsupported("test")
+		}
+	}
+	return command, nil
+}
 
-		// Check token usage
-		if lastUsage > 400000 && len(messages) > 2 {
-			fmt.Printf("\n[System] Context size is %d tokens (>400,000).\n", lastUsage)
-			fmt.Print("Would you like to ask the model to shorten the context? [y/N]: ")
-			confirm, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-			if strings.ToLower(strings.TrimSpace(confirm)) == "y" {
-				pendingInput = "The context size has exceeded 400,000 tokens. Please use the 'shorten_context' tool to summarize the conversation and reset the context."
+var (
+	goResultRe     = regexp.MustCompile(`(?m)^\s*--- (PASS|FAIL|SKIP): `)
+	pytestCountsRe = regexp.MustCompile(`(?m)^=*\s*((?:\d+ \w+(?:, )?)+) in [\d.]+s`)
+	cargoResultRe  = regexp.MustCompile(`test result: \w+\. (\d+) passed; (\d+) failed; (\d+) ignored`)
+	jestCountsRe   = regexp.MustCompile(`(?m)^\s*Tests:?\s+(.*\d+ (?:passed|failed).*)$`)
+	mavenCountsRe  = regexp.MustCompile(`Tests run: (\d+), Failures: (\d+), Errors: (\d+), Skipped: (\d+)`)
+	countItemRe    = regexp.MustCompile(`(\d+) (passed|failed|errors?|skipped|todo)`)
+)
+
+// parseTestCounts reads the pass/fail/skip counts from go test -v, pytest,
+// cargo test, Jest, Vitest or Maven output, or returns nil if it finds none.
+func parseTestCounts(output string) *testCounts {
+	var c testCounts
+	addItems := func(s string) {
+		for _, m := range countItemRe.FindAllStringSubmatch(s, -1) {
+			n, _ := strconv.Atoi(m[1])
+			switch m[2] {
+			case "passed":
+				c.Passed += n
+			case "failed", "error", "errors":
+				c.Failed += n
+			default:
+				c.Skipped += n
 			}
 		}
-		saveHistory(messages)
 	}
+	switch {
+	case strings.Contains(output, "=== RUN") || strings.Contains(output, "no tests to run"):
+		for _, m := range goResultRe.FindAllStringSubmatch(output, -1) {
+			switch m[1] {
+			case "PASS":
+				c.Passed++
+			case "FAIL":
+				c.Failed++
+			default:
+				c.Skipped++
+			}
+		}
+	case cargoResultRe.MatchString(output):
+		for _, m := range cargoResultRe.FindAllStringSubmatch(output, -1) {
+			passed, _ := strconv.Atoi(m[1])
+			failed, _ := strconv.Atoi(m[2])
+			ignored, _ := strconv.Atoi(m[3])
+			c.Passed, c.Failed, c.Skipped = c.Passed+passed, c.Failed+failed, c.Skipped+ignored
+		}
+	case mavenCountsRe.MatchString(output):
+		// The last match is the total for the build
+		all := mavenCountsRe.FindAllStringSubmatch(output, -1)
+		m := all[len(all)-1]
+		run, _ := strconv.Atoi(m[1])
+		failures, _ := strconv.Atoi(m[2])
+		errs, _ := strconv.Atoi(m[3])
+		skipped, _ := strconv.Atoi(m[4])
+		c = testCounts{Passed: run - failures - errs - skipped, Failed: failures + errs, Skipped: skipped}
+	case jestCountsRe.MatchString(output):
+		all := jestCountsRe.FindAllStringSubmatch(output, -1)
+		addItems(all[len(all)-1][1])
+	case pytestCountsRe.MatchString(output):
+		all := pytestCountsRe.FindAllStringSubmatch(output, -1)
+		addItems(all[len(all)-1][1])
+	default:
+		return nil
+	}
+	return &c
 }
 
-func startSpinner(stopChan chan struct{}, doneChan chan struct{}) {
-	defer close(doneChan)
-	chars := []rune{'|', '/', '-', '\\'}
-	i := 0
-	start := time.Now()
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+// summarizeTestRun turns a test run into the run_tests result.
+func summarizeTestRun(run testRun) testSummary {
+	s := testSummary{Command: run.Command, Passed: run.Passed, Counts: parseTestCounts(run.Output), Failures: run.Failures}
+	if s.Counts != nil && s.Counts.Passed+s.Counts.Failed+s.Counts.Skipped == 0 {
+		s.Note = "No tests ran; check 'path' and 'test'."
+	}
+	if !run.Passed {
+		tail := maxTestOutputChars
+		if len(run.Failures) > 0 {
+			tail = maxTestSummaryTail
+		}
+		s.Output = strings.TrimRight(run.Output, "\n")
+		if len(s.Output) > tail {
+			s.Output = "... (earlier output truncated)\n" + s.Output[len(s.Output)-tail:]
+		}
+	}
+	return s
+}
 
-	// Initial print
-	fmt.Printf("\r%c Waiting... (0s)", chars[0])
+// --- Build Tool ---
 
-	for {
-		select {
-		case <-stopChan:
-			fmt.Print("\r\033[K") // Clear line
+// build_project runs the project's build or type-check command and returns
+// the compiler errors as structured data, so the model can fix them one by
+// one without re-deriving the build invocation or reading the whole log.
+
+var buildProjectTool = Tool{
+	Type: "function",
+	Function: FunctionDefinition{
+		Name:        "build_project",
+		Description: "Build or type-check the project with its build command (see the project profile) and get a JSON summary: whether it succeeded and each compiler error or warning with its file, line, column and message. The end of the output is included when no error could be parsed.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {}
+		}`),
+	},
+}
+
+const (
+	buildTimeout        = 10 * time.Minute
+	maxBuildDiagnostics = 50
+)
+
+// BuildDiagnostic is one compiler error or warning.
+type BuildDiagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"` // error or warning
+	Message  string `json:"message"`
+}
+
+// buildSummary is the result of build_project.
+type buildSummary struct {
+	Command     string            `json:"command"`
+	Success     bool              `json:"success"`
+	Diagnostics []BuildDiagnostic `json:"diagnostics,omitempty"`
+	Omitted     int               `json:"omitted,omitempty"` // Diagnostics beyond the first 50
+	Output      string            `json:"output_tail,omitempty"`
+}
+
+// configuredBuildCommand is build_command from the config.
+var configuredBuildCommand string
+
+var (
+	// file:line:col: message (Go, gcc, clang); gcc prefixes error: or warning:
+	colonDiagRe = regexp.MustCompile(`^([^\s:()][^:()]*?\.\w+):(\d+)(?::(\d+))?: (?:(error|warning|fatal error|note): )?(.+)$`)
+	// file(line,col): error TS1234: message (tsc)
+	tscDiagRe = regexp.MustCompile(`^(\S+?\.\w+)\((\d+),(\d+)\): (error|warning) (TS\d+: .+)$`)
+	// file:line:col - error TS1234: message (tsc --pretty)
+	tscPrettyDiagRe = regexp.MustCompile(`^(\S+?\.\w+):(\d+):(\d+) - (error|warning) (TS\d+: .+)$`)
+	// error[E0308]: message, followed by "  --> file:line:col" (rustc)
+	rustHeadRe     = regexp.MustCompile(`^(error|warning)(?:\[\w+\])?: (.+)$`)
+	rustLocationRe = regexp.MustCompile(`^\s*--> (\S+?):(\d+):(\d+)$`)
+	// [ERROR] /path/File.java:[12,5] message (maven)
+	javacDiagRe = regexp.MustCompile(`^\[(ERROR|WARNING)\] (\S+?\.\w+):\[(\d+),(\d+)\] (.+)$`)
+)
+
+// parseBuildDiagnostics extracts compiler errors and warnings from build
+// output. Paths under root are made relative to it, and notes and
+// duplicates (e.g. from a build that prints its errors twice) are dropped.
+func parseBuildDiagnostics(output, root string) []BuildDiagnostic {
+	var diags []BuildDiagnostic
+	seen := make(map[BuildDiagnostic]bool)
+	add := func(file, line, col, severity, message string) {
+		if severity == "note" {
 			return
-		case <-ticker.C:
-			elapsed := time.Since(start).Round(time.Second)
-			fmt.Printf("\r%c Waiting... (%s)", chars[i%len(chars)], elapsed)
-			i++
+		}
+		if severity == "" || severity == "fatal error" {
+			severity = "error"
+		}
+		if rel, err := filepath.Rel(root, file); err == nil && filepath.IsAbs(file) && !strings.HasPrefix(rel, "..") {
+			file = rel
+		}
+		d := BuildDiagnostic{File: file, Severity: strings.ToLower(severity), Message: strings.TrimSpace(message)}
+		d.Line, _ = strconv.Atoi(line)
+		d.Column, _ = strconv.Atoi(col)
+		if !seen[d] {
+			seen[d] = true
+			diags = append(diags, d)
+		}
+	}
+	var rustSeverity, rustMessage string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := rustHeadRe.FindStringSubmatch(line); m != nil {
+			rustSeverity, rustMessage = m[1], m[2]
+			continue
+		}
+		if m := rustLocationRe.FindStringSubmatch(line); m != nil {
+			if rustMessage != "" {
+				add(m[1], m[2], m[3], rustSeverity, rustMessage)
+				rustMessage = ""
+			}
+			continue
+		}
+		if m := tscDiagRe.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4], m[5])
+		} else if m := tscPrettyDiagRe.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4], m[5])
+		} else if m := javacDiagRe.FindStringSubmatch(line); m != nil {
+			add(m[2], m[3], m[4], m[1], m[5])
+		} else if m := colonDiagRe.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4], m[5])
 		}
 	}
+	return diags
 }
 
-func getLatestVersion() (string, error) {
-	resp, err := http.Get("https://api.github.com/repos/robert-at-pretension-io/simple-agent/releases/latest")
-	if err != nil {
-		return "", err
+// runBuild runs command in the working directory of ctx and summarizes it.
+func runBuild(ctx context.Context, command string) buildSummary {
+	ctx, cancel := context.WithTimeout(ctx, buildTimeout)
+	defer cancel()
+	fmt.Printf("\033[36m🔨 Running %s\033[0m\n", command)
+	root, _ := getWorkDir(ctx)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = root
+	out, err := cmd.CombinedOutput()
+	output := string(out)
+	if ctx.Err() == context.DeadlineExceeded {
+		output += fmt.Sprintf("\n(build timed out after %s)", buildTimeout)
 	}
-	defer resp.Body.Close()
+	s := buildSummary{Command: command, Success: err == nil, Diagnostics: parseBuildDiagnostics(output, root)}
+	if len(s.Diagnostics) > maxBuildDiagnostics {
+		s.Omitted = len(s.Diagnostics) - maxBuildDiagnostics
+		s.Diagnostics = s.Diagnostics[:maxBuildDiagnostics]
+	}
+	if !s.Success && len(s.Diagnostics) == 0 {
+		s.Output = strings.TrimRight(output, "\n")
+		if len(s.Output) > maxTestOutputChars {
+			s.Output = "... (earlier output truncated)\n" + s.Output[len(s.Output)-maxTestOutputChars:]
+		}
+	}
+	return s
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API status: %s", resp.Status)
+// --- Coverage ---
+
+// Coverage comes from the project's own test runner: go test -coverprofile,
+// pytest-cov's JSON report or Jest's coverage-final.json. run_tests reports
+// it for the changed files on request, and with coverage_check (or
+// -coverage-check) it is measured after every turn that changed files: the
+// per-file delta is printed, and lines the agent added or changed that no
+// test runs are pointed out to the model before its next request.
+
+// lineCoverage maps the instrumented lines of a file to whether a test ran
+// them.
+type lineCoverage map[int]bool
+
+func (c lineCoverage) percent() float64 {
+	if len(c) == 0 {
+		return 0
+	}
+	covered := 0
+	for _, hit := range c {
+		if hit {
+			covered++
+		}
 	}
+	return math.Round(float64(covered)*1000/float64(len(c))) / 10
+}
 
-	var release struct {
-		TagName string `json:"tag_name"`
+// FileCoverage is the line coverage of one file in a run_tests result.
+type FileCoverage struct {
+	File      string   `json:"file"`
+	Percent   float64  `json:"percent"`
+	Uncovered []string `json:"uncovered_changed_lines,omitempty"` // e.g. "12-15", in lines changed since HEAD
+}
+
+// coverageCommandFor adds coverage output to the profile's test command,
+// written to out, and names the report format.
+func coverageCommandFor(p ProjectProfile, out string) (command, format string, err error) {
+	command = p.TestCommand
+	switch {
+	case strings.HasPrefix(command, "go test"):
+		return "go test -coverprofile=" + shellQuote(out) + strings.TrimPrefix(command, "go test"), "go", nil
+	case strings.Contains(command, "pytest"):
+		return command + " --cov=. --cov-report=json:" + shellQuote(out), "pytest-cov", nil
+	case command == "npm test", command == "pnpm test", command == "yarn test", command == "bun run test":
+		return command + " -- --coverage --coverageReporters=json --coverageDirectory=" + shellQuote(filepath.Dir(out)), "istanbul", nil
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		return "", err
+	if command == "" {
+		return "", "", codedToolError(errNotFound, "no_test_command", "Set test_command in the config.", fmt.Errorf("no test command found for this project"))
 	}
-	return release.TagName, nil
+	return "", "", codedToolError(errValidation, "coverage_unsupported", "Run without 'coverage'; coverage is supported for go test, pytest (with pytest-cov) and Jest.", fmt.Errorf("can't measure coverage with '%s'", command))
 }
 
-func parseVersion(v string) []int {
-	v = strings.TrimPrefix(v, "v")
-	parts := strings.Split(v, ".")
-	var res []int
-	for _, p := range parts {
-		i, _ := strconv.Atoi(p)
-		res = append(res, i)
+// readCoverage parses a coverage report into line coverage per file, keyed
+// by path relative to root.
+func readCoverage(format, out, root string) (map[string]lineCoverage, error) {
+	if format == "istanbul" {
+		out = filepath.Join(filepath.Dir(out), "coverage-final.json")
 	}
-	return res
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return nil, fmt.Errorf("no coverage report was written: %v", err)
+	}
+	files := make(map[string]lineCoverage)
+	file := func(name string) lineCoverage {
+		if filepath.IsAbs(name) {
+			if rel, err := filepath.Rel(root, name); err == nil {
+				name = rel
+			}
+		}
+		name = filepath.ToSlash(name)
+		if files[name] == nil {
+			files[name] = make(lineCoverage)
+		}
+		return files[name]
+	}
+	switch format {
+	case "go":
+		// Blocks are "import/path/file.go:12.5,14.2 3 1"; paths start with
+		// the module path
+		module := ""
+		if mod, err := os.ReadFile(filepath.Join(root, "go.mod")); err == nil {
+			if m := regexp.MustCompile(`(?m)^module\s+(\S+)`).FindSubmatch(mod); m != nil {
+				module = string(m[1]) + "/"
+			}
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			var name string
+			var startLine, startCol, endLine, endCol, stmts, count int
+			colon := strings.LastIndex(line, ":")
+			if colon < 0 {
+				continue
+			}
+			name = line[:colon]
+			if _, err := fmt.Sscanf(line[colon+1:], "%d.%d,%d.%d %d %d", &startLine, &startCol, &endLine, &endCol, &stmts, &count); err != nil {
+				continue
+			}
+			lines := file(strings.TrimPrefix(name, module))
+			for l := startLine; l <= endLine; l++ {
+				lines[l] = lines[l] || count > 0
+			}
+		}
+	case "pytest-cov":
+		var report struct {
+			Files map[string]struct {
+				Executed []int `json:"executed_lines"`
+				Missing  []int `json:"missing_lines"`
+			} `json:"files"`
+		}
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, fmt.Errorf("failed to parse coverage report: %v", err)
+		}
+		for name, f := range report.Files {
+			lines := file(name)
+			for _, l := range f.Missing {
+				lines[l] = false
+			}
+			for _, l := range f.Executed {
+				lines[l] = true
+			}
+		}
+	case "istanbul":
+		var report map[string]struct {
+			StatementMap map[string]struct {
+				Start struct{ Line int } `json:"start"`
+				End   struct{ Line int } `json:"end"`
+			} `json:"statementMap"`
+			S map[string]int `json:"s"`
+		}
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, fmt.Errorf("failed to parse coverage report: %v", err)
+		}
+		for name, f := range report {
+			lines := file(name)
+			for id, stmt := range f.StatementMap {
+				for l := stmt.Start.Line; l <= stmt.End.Line; l++ {
+					lines[l] = lines[l] || f.S[id] > 0
+				}
+			}
+		}
+	}
+	return files, nil
 }
 
-func isNewer(current, latest string) bool {
-	c := parseVersion(current)
-	l := parseVersion(latest)
+// measureCoverage runs command (from coverageCommandFor) in the working
+// directory of ctx and reads its report.
+func measureCoverage(ctx context.Context, command, format, out string) (testRun, map[string]lineCoverage, error) {
+	root, _ := getWorkDir(ctx)
+	run := runTests(ctx, command)
+	files, err := readCoverage(format, out, root)
+	return run, files, err
+}
 
-	lenC := len(c)
-	lenL := len(l)
-	maxLen := lenC
-	if lenL > maxLen {
-		maxLen = lenL
-	}
+var hunkAddedRe = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
 
-	for i := 0; i < maxLen; i++ {
-		vC, vL := 0, 0
-		if i < lenC {
-			vC = c[i]
+// changedLines returns the lines of path (relative to root) added or
+// changed since HEAD; every line for an untracked file, nil outside git.
+func changedLines(root, path string) map[int]bool {
+	out, err := exec.Command("git", "-C", root, "diff", "-U0", "--no-color", "HEAD", "--", path).Output()
+	if err != nil {
+		return nil
+	}
+	lines := make(map[int]bool)
+	if len(out) == 0 {
+		if err := exec.Command("git", "-C", root, "ls-files", "--error-unmatch", "--", path).Run(); err == nil {
+			return lines // Tracked and unchanged
 		}
-		if i < lenL {
-			vL = l[i]
+		data, err := os.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			return nil
 		}
-		if vL > vC {
-			return true
+		for i := 1; i <= strings.Count(string(data), "\n")+1; i++ {
+			lines[i] = true
 		}
-		if vL < vC {
-			return false
+		return lines
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := hunkAddedRe.FindStringSubmatch(line); m != nil {
+			start, _ := strconv.Atoi(m[1])
+			count := 1
+			if m[2] != "" {
+				count, _ = strconv.Atoi(m[2])
+			}
+			for l := start; l < start+count; l++ {
+				lines[l] = true
+			}
+		}
+	}
+	return lines
+}
+
+// lineRanges renders sorted line numbers as "3", "5-9".
+func lineRanges(lines []int) []string {
+	sort.Ints(lines)
+	var ranges []string
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(lines[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	return ranges
+}
+
+// changedFileCoverage reports the coverage of the files in paths that the
+// report covers, with the changed lines that no test ran.
+func changedFileCoverage(files map[string]lineCoverage, root string, paths []string) []FileCoverage {
+	var report []FileCoverage
+	for _, path := range paths {
+		lines, ok := files[filepath.ToSlash(path)]
+		if !ok {
+			continue
 		}
+		fc := FileCoverage{File: path, Percent: lines.percent()}
+		var uncovered []int
+		for l := range changedLines(root, path) {
+			if hit, instrumented := lines[l]; instrumented && !hit {
+				uncovered = append(uncovered, l)
+			}
+		}
+		fc.Uncovered = lineRanges(uncovered)
+		report = append(report, fc)
 	}
-	return false
+	sort.Slice(report, func(i, j int) bool { return report[i].File < report[j].File })
+	return report
+}
+
+// coverageChecker measures coverage after turns that changed files and
+// keeps the last percentage of each file for the deltas.
+type coverageChecker struct {
+	mu       sync.Mutex
+	last     map[string]float64 // File -> percent at the last measurement
+	measured map[string]string  // Changed file -> fingerprint when last measured
+	notice   string             // For the model's next request
 }
 
-func autoUpdate() {
-	fmt.Println("Checking for updates...")
+var coverageWatch *coverageChecker
 
-	latest, err := getLatestVersion()
+// startCoverageChecker measures the baseline the first deltas are taken
+// against.
+func startCoverageChecker(ctx context.Context) (*coverageChecker, error) {
+	c := &coverageChecker{last: make(map[string]float64), measured: make(map[string]string)}
+	fmt.Println("\033[36m📊 Measuring baseline coverage...\033[0m")
+	files, err := c.measure(ctx)
 	if err != nil {
-		fmt.Printf("⚠️  Could not check for updates: %v\n", err)
-		return
+		return nil, err
 	}
-
-	if !isNewer(Version, latest) {
-		fmt.Println("✅ You are using the latest version.")
-		return
+	for name, lines := range files {
+		c.last[name] = lines.percent()
 	}
+	return c, nil
+}
 
-	fmt.Printf("⬇️  New version available: %s (Current: %s)\n", latest, Version)
-
-	// Get current executable info to check for changes
-	exe, err := os.Executable()
+func (c *coverageChecker) measure(ctx context.Context) (map[string]lineCoverage, error) {
+	root, _ := getWorkDir(ctx)
+	dir, err := os.MkdirTemp("", "simple-agent-coverage-")
 	if err != nil {
-		return
+		return nil, err
 	}
-	infoBefore, err := os.Stat(exe)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "coverage.out")
+	command, format, err := coverageCommandFor(projectProfile(root), out)
 	if err != nil {
-		return
+		return nil, err
 	}
+	_, files, err := measureCoverage(ctx, command, format, out)
+	return files, err
+}
 
-	var cmd *exec.Cmd
-
-	// Create temp script to update using the install script (release channel)
-	// This avoids "text file busy" errors when updating the running binary
-	tmpFile, err := os.CreateTemp("", "install-agent-*.sh")
+// AfterTurn measures coverage if files changed since the last measurement,
+// prints the deltas and prepares a notice about uncovered changed lines.
+func (c *coverageChecker) AfterTurn(ctx context.Context, changed []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dirty := dirtyFiles()
+	var fresh []string
+	for _, path := range changed {
+		if state := dirty[path]; state != "" && state != c.measured[path] {
+			fresh = append(fresh, path)
+			c.measured[path] = state
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+	files, err := c.measure(ctx)
 	if err != nil {
-		fmt.Printf("⚠️  Update failed: %v\n", err)
+		fmt.Printf("\033[33mCoverage check failed: %v\033[0m\n", err)
 		return
 	}
-	defer os.Remove(tmpFile.Name())
-
-	if _, err := tmpFile.Write(installScript); err != nil {
-		fmt.Printf("⚠️  Update failed: %v\n", err)
+	root, _ := getWorkDir(ctx)
+	report := changedFileCoverage(files, root, fresh)
+	if len(report) == 0 {
 		return
 	}
-	tmpFile.Close()
-	os.Chmod(tmpFile.Name(), 0755)
-
-	// Execute install script (arg1=version(empty=latest), arg2=target)
-	cmd = exec.Command("/bin/sh", tmpFile.Name(), "", exe)
-
-	// Execute and capture output
-	if out, err := cmd.CombinedOutput(); err != nil {
-		fmt.Printf("⚠️  Binary update failed: %v\n", err)
-		if len(out) > 0 {
-			fmt.Printf("Output:\n%s\n", out)
+	var deltas []string
+	var notice strings.Builder
+	for _, fc := range report {
+		if before, ok := c.last[fc.File]; ok {
+			deltas = append(deltas, fmt.Sprintf("%s %.1f%% (%+.1f)", fc.File, fc.Percent, fc.Percent-before))
+		} else {
+			deltas = append(deltas, fmt.Sprintf("%s %.1f%% (new)", fc.File, fc.Percent))
 		}
-
-		// Fallback: Try 'go install' for backward compatibility
-		fmt.Println("🔄 Attempting fallback to 'go install'...")
-		cmd = exec.Command("go", "install", "github.com/robert-at-pretension-io/simple-agent@latest")
-		cmd.Env = append(os.Environ(), "GOPROXY=direct")
-		if out, err := cmd.CombinedOutput(); err != nil {
-			fmt.Printf("⚠️  Fallback update failed: %v\n", err)
-			if len(out) > 0 {
-				fmt.Printf("Output:\n%s\n", out)
-			}
-			return
+		c.last[fc.File] = fc.Percent
+		if len(fc.Uncovered) > 0 {
+			fmt.Fprintf(&notice, "- %s: lines %s\n", fc.File, strings.Join(fc.Uncovered, ", "))
 		}
-		fmt.Println("✅ Fallback update complete via 'go install'. Please restart.")
-		os.Exit(0)
 	}
-
-	// Check if binary was updated
-	if infoAfter, err := os.Stat(exe); err == nil {
-		if infoAfter.ModTime().After(infoBefore.ModTime()) {
-			// Verify if the version actually changed to prevent restart loops
-			if out, err := exec.Command(exe, "--version").CombinedOutput(); err == nil {
-				newVer := strings.TrimSpace(string(out))
-				if newVer == fmt.Sprintf("Simple Agent %s", Version) {
-					return // Same version, continue running
-				}
-			}
-
-			fmt.Println("✅ Update installed. Please restart the agent.")
-			os.Exit(0)
-		}
+	fmt.Printf("\033[36m📊 Coverage: %s\033[0m\n", strings.Join(deltas, ", "))
+	if notice.Len() > 0 {
+		c.notice = "Coverage check: no test runs these lines you added or changed:\n" + notice.String() + "Add tests that cover them, or tell the user why they don't need any."
 	}
 }
 
-func setupCoreSkills() error {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return err
+// TakeNotice returns the pending notice for the model, once.
+func (c *coverageChecker) TakeNotice() string {
+	if c == nil {
+		return ""
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	notice := c.notice
+	c.notice = ""
+	return notice
+}
 
-	// Create a hidden directory in user home for core skills
-	CoreSkillsDir = filepath.Join(home, ".simple_agent", "core_skills")
+// --- Answer Retry ---
 
-	// Remove old version to ensure updates apply
-	os.RemoveAll(CoreSkillsDir)
+// /retry drops the last turn and sends its message again. With "/retry diff"
+// the new answer is then compared with the one it replaced: prose sentence
+// by sentence and code blocks line by line, so only what changed has to be
+// read again.
 
-	err = fs.WalkDir(embeddedSkillsFS, "skills", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+type retryRequest struct {
+	Input    string
+	Parts    []ContentPart
+	Previous string // The final answer being replaced
+	Diff     bool
+}
 
-		// Rel path from "skills" root in embed
-		relPath, _ := filepath.Rel("skills", path)
-		targetPath := filepath.Join(CoreSkillsDir, relPath)
+// pendingRetry is set by /retry and consumed by the next turn.
+var pendingRetry *retryRequest
 
-		if d.IsDir() {
-			return os.MkdirAll(targetPath, 0755)
-		}
+var (
+	thoughtTagRe  = regexp.MustCompile(`(?s)<thought>.*?</thought>`)
+	sentenceEndRe = regexp.MustCompile(`[.!?]["')\]]*\s+`)
+)
 
-		data, err := embeddedSkillsFS.ReadFile(path)
-		if err != nil {
-			return err
+// prepareRetry removes the last turn from messages and returns its request.
+func prepareRetry(messages *[]Message, diff bool) (*retryRequest, error) {
+	for i := len(*messages) - 1; i > 0; i-- {
+		m := (*messages)[i]
+		if m.Role != "user" || strings.HasPrefix(m.Content, "[Guidance added while the turn was paused]") {
+			continue
 		}
-
-		// Write file (executable for scripts)
-		return os.WriteFile(targetPath, data, 0755)
-	})
-
-	if err != nil {
-		return err
+		if strings.HasPrefix(m.Content, "Context has been shortened.") {
+			break
+		}
+		retry := &retryRequest{Input: m.Content, Parts: m.Parts, Previous: finalAnswer((*messages)[i+1:]), Diff: diff}
+		*messages = (*messages)[:i]
+		saveHistory(*messages)
+		return retry, nil
 	}
-
-	return nil
+	return nil, fmt.Errorf("there is no message to retry")
 }
 
-// --- Tool Implementations ---
-
-// validatePath ensures the path is within the current working directory
-func validatePath(path string) (string, error) {
-	if path == "" {
-		path = "."
+// finalAnswer returns the last reply in messages that isn't a tool call.
+func finalAnswer(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if m := messages[i]; m.Role == "assistant" && len(m.ToolCalls) == 0 {
+			return strings.TrimSpace(thoughtTagRe.ReplaceAllString(m.Content, ""))
+		}
 	}
+	return ""
+}
 
-	// Resolve virtual "skills/" path to CoreSkillsDir if needed
-	if CoreSkillsDir != "" {
-		cleanPath := filepath.Clean(path)
-		magicPrefix := "skills" + string(os.PathSeparator)
-		if strings.HasPrefix(cleanPath, magicPrefix) {
-			if _, err := os.Stat(path); os.IsNotExist(err) {
-				suffix := strings.TrimPrefix(cleanPath, magicPrefix)
-				candidatePath := filepath.Join(CoreSkillsDir, suffix)
-				if _, err := os.Stat(candidatePath); err == nil {
-					path = candidatePath
-				}
+// answerUnits splits an answer into the units it is compared by.
+func answerUnits(answer string) []string {
+	var units []string
+	inCode := false
+	for _, line := range strings.Split(answer, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			units = append(units, line)
+			continue
+		}
+		if inCode || strings.TrimSpace(line) == "" {
+			units = append(units, line)
+			continue
+		}
+		for {
+			loc := sentenceEndRe.FindStringIndex(line)
+			if loc == nil || loc[1] == len(line) {
+				break
 			}
+			units = append(units, strings.TrimRight(line[:loc[1]], " \t"))
+			line = line[loc[1]:]
 		}
+		units = append(units, strings.TrimRight(line, " \t"))
 	}
+	return units
+}
 
-	cwd, err := os.Getwd()
-	if err != nil {
-		return "", fmt.Errorf("failed to get CWD: %w", err)
+// diffUnits returns the edit script from a to b as lines prefixed with
+// ' ', '-' or '+', using the longest common subsequence.
+func diffUnits(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
 	}
-	absPath, err := filepath.Abs(path)
-	if err != nil {
-		return "", fmt.Errorf("failed to resolve absolute path: %w", err)
-	}
-
-	// Check if path is within CoreSkillsDir (Read-Only/Exec allowed)
-	isCore := false
-	if CoreSkillsDir != "" {
-		relCore, err := filepath.Rel(CoreSkillsDir, absPath)
-		if err == nil && !strings.HasPrefix(relCore, "..") {
-			isCore = true
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
 		}
 	}
-
-	// Check if path is within CWD using filepath.Rel
-	rel, err := filepath.Rel(cwd, absPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to check path relation: %w", err)
-	}
-
-	if strings.HasPrefix(rel, "..") && !isCore {
-		return "", fmt.Errorf("access denied: path '%s' is outside the current working directory", path)
+	var ops []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, "-"+a[i])
+			i++
+		default:
+			ops = append(ops, "+"+b[j])
+			j++
+		}
 	}
-
-	return absPath, nil
+	return ops
 }
 
-func parseArgs(command string) ([]string, error) {
-	var args []string
-	var current strings.Builder
-	var inQuote rune
-	escaped := false
+// maxAnswerDiffUnits bounds the quadratic diff; longer answers aren't compared.
+const maxAnswerDiffUnits = 2000
 
-	for _, r := range command {
-		if escaped {
-			current.WriteRune(r)
-			escaped = false
-			continue
-		}
+func printAnswerDiff(previous, current string) {
+	fmt.Printf("\n\033[1;36m─── Changes from the previous answer ───\033[0m\n")
+	a, b := answerUnits(previous), answerUnits(current)
+	switch {
+	case previous == "":
+		fmt.Println("The previous turn ended without an answer to compare with.")
+		return
+	case current == "":
+		fmt.Println("The new turn ended without an answer.")
+		return
+	case previous == current:
+		fmt.Println("The new answer is identical to the previous one.")
+		return
+	case len(a) > maxAnswerDiffUnits || len(b) > maxAnswerDiffUnits:
+		fmt.Println("The answers are too long to compare.")
+		return
+	}
 
-		if r == '\\' {
-			escaped = true
-			continue
+	ops := diffUnits(a, b)
+	const contextUnits = 1
+	removed, added := 0, 0
+	near := func(i int) bool {
+		for k := max(0, i-contextUnits); k <= min(len(ops)-1, i+contextUnits); k++ {
+			if ops[k][0] != ' ' {
+				return true
+			}
 		}
-
-		if inQuote != 0 {
-			if r == inQuote {
-				inQuote = 0
-			} else {
-				current.WriteRune(r)
+		return false
+	}
+	skipped := false
+	for i, op := range ops {
+		switch op[0] {
+		case '-':
+			removed++
+			fmt.Printf("\033[31m- %s\033[0m\n", op[1:])
+		case '+':
+			added++
+			fmt.Printf("\033[32m+ %s\033[0m\n", op[1:])
+		default:
+			if !near(i) {
+				if !skipped {
+					fmt.Println("\033[90m  ...\033[0m")
+				}
+				skipped = true
+				continue
 			}
-			continue
+			fmt.Printf("  %s\n", op[1:])
 		}
+		skipped = false
+	}
+	fmt.Printf("\033[90m%d removed, %d added, %d unchanged (sentences of prose, lines of code)\033[0m\n", removed, added, len(ops)-removed-added)
+}
 
-		if r == '"' || r == '\'' {
-			inQuote = r
-			continue
-		}
+// --- Secret Redaction ---
+
+// Tool outputs are scanned for credentials before they are saved or sent to
+// the provider. Matches are replaced with a [REDACTED:<kind>] marker.
+
+// redactSecrets is set from the redact_secrets config (default on).
+var redactSecrets = true
+
+var secretPatterns = []struct {
+	Kind string
+	Re   *regexp.Regexp
+}{
+	{"private_key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{"api_key", regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}`)},
+	{"google_api_key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+	{"github_token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+	{"gitlab_token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+	{"aws_access_key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"slack_token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"stripe_key", regexp.MustCompile(`\b[rs]k_(?:live|test)_[A-Za-z0-9]{16,}`)},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+}
 
-		if unicode.IsSpace(r) {
-			if current.Len() > 0 {
-				args = append(args, current.String())
-				current.Reset()
-			}
-			continue
-		}
+// Credential-like names assigned a value, either quoted (code, JSON, YAML) or
+// alone on a line (.env files). Only the value is redacted.
+const secretNamePattern = `[A-Za-z0-9_.-]*(?i:secret|token|password|passwd|api_?key|access_?key|private_?key)[A-Za-z0-9_]*`
 
-		current.WriteRune(r)
-	}
+var (
+	quotedSecretRe = regexp.MustCompile(`\b(` + secretNamePattern + `["']?\s*[:=]\s*["'])([^"'\s]{8,})(["'])`)
+	lineSecretRe   = regexp.MustCompile(`(?m)^(\s*(?:export\s+)?` + secretNamePattern + `\s*[:=]\s*)([^\s"'#]{8,})[ \t]*$`)
+	bearerRe       = regexp.MustCompile(`(?i)\b(bearer\s+)([A-Za-z0-9._~+/-]{20,}=*)`)
+	// A value like config.apiKey is code referring to a secret, not the secret
+	identifierChainRe = regexp.MustCompile(`^[A-Za-z_]\w*(\.[A-Za-z_]\w*)+$`)
+)
 
-	if inQuote != 0 {
-		return nil, fmt.Errorf("unclosed quote")
+// redact replaces the secrets in s and returns how many it found.
+func redact(s string) (string, int) {
+	count := 0
+	for _, p := range secretPatterns {
+		s = p.Re.ReplaceAllStringFunc(s, func(string) string {
+			count++
+			return "[REDACTED:" + p.Kind + "]"
+		})
 	}
-	if current.Len() > 0 {
-		args = append(args, current.String())
+	for _, re := range []*regexp.Regexp{quotedSecretRe, lineSecretRe, bearerRe} {
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			m := re.FindStringSubmatch(match)
+			// Variable references and placeholders aren't secrets
+			if strings.HasPrefix(m[2], "[REDACTED") || strings.ContainsAny(m[2][:1], "$<{%") || identifierChainRe.MatchString(m[2]) {
+				return match
+			}
+			count++
+			return m[1] + "[REDACTED:secret]" + strings.Join(m[3:], "")
+		})
 	}
-	return args, nil
+	// Values of the agent's own secret environment variables
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if len(value) < 8 || !isSecretEnv(commandPolicy, name) || !strings.Contains(s, value) {
+			continue
+		}
+		count += strings.Count(s, value)
+		s = strings.ReplaceAll(s, value, "[REDACTED:$"+name+"]")
+	}
+	return s, count
 }
 
-func runSafeScript(ctx context.Context, scriptPath string, args []string, skillsPrompt string) (string, error) {
-	// Validate path
-	absPath, err := validatePath(scriptPath)
-	if err != nil {
-		return "", fmt.Errorf("%w\n\nREMINDER: run_script can only execute scripts defined within a 'skills' directory (Local or Core).\n%s", err, skillsPrompt)
-	}
+// --- History Encryption ---
 
-	// Check if file exists
-	info, err := os.Stat(absPath)
-	if err != nil {
-		return "", fmt.Errorf("script not found: %w\n\nREMINDER: run_script can only execute scripts defined within the 'skills' directory.\n%s", err, skillsPrompt)
-	}
-	if info.IsDir() {
-		return "", fmt.Errorf("path is a directory, not a file\n\nREMINDER: run_script can only execute scripts defined within the 'skills' directory.\n%s", skillsPrompt)
-	}
+// With encrypt_history enabled, session history, the transcript and
+// checkpoints are sealed with AES-256-GCM. The key is derived from a
+// passphrase or kept in the OS keychain. Plaintext files from before
+// encryption was enabled are still read.
 
-	// Check if it is inside a "scripts" folder within "skills"
-	cwd, _ := os.Getwd()
-	localSkillsDir := filepath.Join(cwd, "skills")
+type HistoryEncryption struct {
+	Enabled bool   `json:"enabled"`
+	Key     string `json:"key,omitempty"` // passphrase (default) or keychain
+}
 
-	// Validate it's in either Local or Core skills dir
-	isLocal := strings.HasPrefix(absPath, localSkillsDir)
-	isCore := CoreSkillsDir != "" && strings.HasPrefix(absPath, CoreSkillsDir)
+const (
+	sealPrefix       = "SAENC1:"
+	pbkdf2Iterations = 600000
+	keychainService  = "simple-agent"
+	keychainAccount  = "history-key"
+	passphraseEnv    = "SIMPLE_AGENT_HISTORY_PASSPHRASE"
+	keyCheckText     = "simple-agent history key"
+)
 
-	if !isLocal && !isCore {
-		return "", fmt.Errorf("script must be inside a 'skills' directory (Local or Core).\n%s", skillsPrompt)
-	}
+// historyKey is the AES key, or nil when history is stored in plaintext.
+var historyKey []byte
 
-	// Check for 'scripts' in the path components
-	// We use string(os.PathSeparator) to be cross-platform
-	sep := string(os.PathSeparator)
-	if !strings.Contains(absPath, sep+"scripts"+sep) {
-		return "", fmt.Errorf("script must be inside a 'scripts' folder.\n%s", skillsPrompt)
-	}
+// historyKeyFile holds what is needed to check and re-derive a
+// passphrase key; the passphrase itself is never stored.
+type historyKeyFile struct {
+	Salt       string `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Check      string `json:"check"` // keyCheckText sealed with the key
+}
 
-	// Determine execution method
-	var cmd *exec.Cmd
-	ext := filepath.Ext(absPath)
+func getHistoryKeyPath() string {
+	return filepath.Join(getAgentHomeDir(), "history_key.json")
+}
 
-	switch ext {
-	case ".py":
-		cmdArgs := append([]string{absPath}, args...)
-		cmd = exec.CommandContext(ctx, "python3", cmdArgs...)
-	case ".sh":
-		cmdArgs := append([]string{absPath}, args...)
-		cmd = exec.CommandContext(ctx, "bash", cmdArgs...)
-	case ".js":
-		cmdArgs := append([]string{absPath}, args...)
-		cmd = exec.CommandContext(ctx, "node", cmdArgs...)
+// initHistoryEncryption loads or creates the history key.
+func initHistoryEncryption(cfg HistoryEncryption) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	var key []byte
+	var err error
+	switch cfg.Key {
+	case "", "passphrase":
+		key, err = passphraseKey()
+	case "keychain":
+		key, err = keychainKey()
 	default:
-		// Try to execute directly
-		cmd = exec.CommandContext(ctx, absPath, args...)
+		return fmt.Errorf("unknown encrypt_history key '%s' (use passphrase or keychain)", cfg.Key)
 	}
+	if err != nil {
+		return err
+	}
+	historyKey = key
+	return nil
+}
 
-	out, err := cmd.CombinedOutput()
-	output := string(out)
-
-	// Output size check to prevent context overflow
-	const MaxOutputChars = 50000 // ~12.5k tokens
-	if len(output) > MaxOutputChars {
-		home, homeErr := os.UserHomeDir()
-		if homeErr == nil {
-			outputDir := filepath.Join(home, ".simple_agent", "outputs")
-			_ = os.MkdirAll(outputDir, 0755)
-
-			filename := fmt.Sprintf("output_%d.txt", time.Now().UnixNano())
-			filePath := filepath.Join(outputDir, filename)
-
-			if writeErr := os.WriteFile(filePath, out, 0644); writeErr == nil {
-				output = fmt.Sprintf("Output too large (%d chars). Saved to %s\nRead this file to see the results.", len(output), filePath)
-			}
+func passphraseKey() ([]byte, error) {
+	data, err := os.ReadFile(getHistoryKeyPath())
+	if os.IsNotExist(err) {
+		// First use: pick a salt and confirm the passphrase
+		pass, err := readPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		salt := make([]byte, 16)
+		if _, err := crand.Read(salt); err != nil {
+			return nil, err
 		}
+		key := pbkdf2SHA256([]byte(pass), salt, pbkdf2Iterations, 32)
+		check, err := sealWith(key, []byte(keyCheckText))
+		if err != nil {
+			return nil, err
+		}
+		kf := historyKeyFile{Salt: base64.StdEncoding.EncodeToString(salt), Iterations: pbkdf2Iterations, Check: string(check)}
+		data, _ := json.MarshalIndent(kf, "", "  ")
+		if err := os.MkdirAll(filepath.Dir(getHistoryKeyPath()), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(getHistoryKeyPath(), data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save %s: %v", getHistoryKeyPath(), err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
+	var kf historyKeyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", getHistoryKeyPath(), err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(kf.Salt)
 	if err != nil {
-		return output, fmt.Errorf("script execution failed: %w\nOutput:\n%s", err, output)
+		return nil, fmt.Errorf("failed to parse %s: %v", getHistoryKeyPath(), err)
 	}
-	return output, nil
+	pass, err := readPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	key := pbkdf2SHA256([]byte(pass), salt, kf.Iterations, 32)
+	if check, err := openWith(key, []byte(kf.Check)); err != nil || string(check) != keyCheckText {
+		return nil, fmt.Errorf("wrong history passphrase")
+	}
+	return key, nil
 }
 
-// applyUDiff applies a unified diff to a file
-func applyUDiff(ctx context.Context, path string, diff string, dryRun bool) (string, error) {
-	absPath, err := validatePath(path)
-	if err != nil {
-		return "", err
+// readPassphrase takes the passphrase from the environment or asks for it
+// without echoing.
+func readPassphrase(confirm bool) (string, error) {
+	if pass := os.Getenv(passphraseEnv); pass != "" {
+		return pass, nil
 	}
+	pass := readSecret("History passphrase: ")
+	if pass == "" {
+		return "", fmt.Errorf("history encryption needs a passphrase (or set %s)", passphraseEnv)
+	}
+	if confirm && readSecret("Repeat passphrase: ") != pass {
+		return "", fmt.Errorf("passphrases don't match")
+	}
+	return pass, nil
+}
 
-	// Protect CoreSkillsDir from modification
-	if CoreSkillsDir != "" && strings.HasPrefix(absPath, CoreSkillsDir) {
-		return "", fmt.Errorf("access denied: cannot modify core skills in '%s'", CoreSkillsDir)
+func readSecret(prompt string) string {
+	fmt.Print(prompt)
+	cmd := exec.Command("stty", "-echo")
+	cmd.Stdin = os.Stdin
+	if cmd.Run() == nil {
+		defer fmt.Println()
+		defer restoreTerminal()
 	}
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(answer, "\r\n")
+}
 
-	// Read original file
-	var content string
-	data, err := os.ReadFile(absPath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return "", fmt.Errorf("failed to read file: %w", err)
-		}
-		content = "" // New file
+// keychainKey returns the history key from the OS keychain, creating it on
+// first use: 'security' on macOS, 'secret-tool' (libsecret) on Linux.
+func keychainKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	var get, put *exec.Cmd
+	if _, err := exec.LookPath("security"); err == nil {
+		get = exec.Command("security", "find-generic-password", "-s", keychainService, "-a", keychainAccount, "-w")
+		put = exec.Command("security", "add-generic-password", "-s", keychainService, "-a", keychainAccount, "-w", encoded)
+	} else if _, err := exec.LookPath("secret-tool"); err == nil {
+		get = exec.Command("secret-tool", "lookup", "service", keychainService, "account", keychainAccount)
+		put = exec.Command("secret-tool", "store", "--label=simple-agent history key", "service", keychainService, "account", keychainAccount)
+		put.Stdin = strings.NewReader(encoded)
 	} else {
-		content = string(data)
+		return nil, fmt.Errorf("no OS keychain found (needs 'security' on macOS or 'secret-tool' on Linux); use \"key\": \"passphrase\" instead")
 	}
 
-	// Normalize line endings to \n
-	content = strings.ReplaceAll(content, "\r\n", "\n")
-
-	hunks := parseHunks(diff)
-	if len(hunks) == 0 {
-		return "", fmt.Errorf("no valid hunks found in diff")
+	if out, err := get.Output(); err == nil && len(bytes.TrimSpace(out)) > 0 {
+		stored, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(out)))
+		if err != nil || len(stored) != 32 {
+			return nil, fmt.Errorf("the keychain entry %s/%s is not a history key", keychainService, keychainAccount)
+		}
+		return stored, nil
 	}
+	if out, err := put.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to store the history key in the keychain: %v\n%s", err, out)
+	}
+	return key, nil
+}
 
-	// Apply hunks
-	newContent := content
-	for i, hunk := range hunks {
-		// Check context cancellation
-		if ctx.Err() != nil {
-			return "", ctx.Err()
+// pbkdf2SHA256 derives a key from a password (RFC 8018, PBKDF2 with HMAC-SHA256).
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	size := prf.Size()
+	var dk []byte
+	for block := 1; len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
 		}
+		dk = append(dk, t[:size]...)
+	}
+	return dk[:keyLen]
+}
 
-		// Create search block
-		searchBlock := strings.Join(hunk.SearchLines, "\n")
-		replaceBlock := strings.Join(hunk.ReplaceLines, "\n")
+// sealData encrypts data with the history key, if encryption is enabled.
+// The result is a single line, so sealed records can be stored as JSONL.
+func sealData(data []byte) ([]byte, error) {
+	if historyKey == nil {
+		return data, nil
+	}
+	return sealWith(historyKey, data)
+}
 
-		// If search block is empty (creating a new file), we just append/replace
-		if len(hunk.SearchLines) == 0 && content == "" {
-			newContent = replaceBlock
-			continue
-		}
+// openData decrypts data written by sealData. Plaintext is returned as is.
+func openData(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealPrefix)) {
+		return data, nil
+	}
+	if historyKey == nil {
+		return nil, fmt.Errorf("history is encrypted; enable encrypt_history to read it")
+	}
+	return openWith(historyKey, data)
+}
 
-		// Check for pure insertion without context in existing file
-		if len(hunk.SearchLines) == 0 && content != "" {
-			return "", fmt.Errorf("hunk %d failed to apply: pure insertion (no context lines) is not allowed in existing file.\nPlease provide at least 2 lines of context (' ') around the new code to uniquely locate the insertion point.", i+1)
-		}
+func sealWith(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, data, nil)
+	return []byte(sealPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
 
-		// Verify uniqueness of the search block
-		matches := strings.Count(newContent, searchBlock)
-		if matches > 1 {
-			return "", fmt.Errorf("hunk %d failed to apply: ambiguous context. The search block matches %d times in the file.\nPlease provide more context lines to uniquely identify the code to replace.", i+1, matches)
-		}
+func openWith(key, data []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(string(data), sealPrefix)))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt encrypted data: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return nil, fmt.Errorf("corrupt encrypted data")
+	}
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt history (wrong key?)")
+	}
+	return plain, nil
+}
 
-		// Check if search block exists
-		if matches == 0 {
-			// Fuzzy search for error reporting
-			fileLines := strings.Split(newContent, "\n")
-			bestIdx, score := findBestMatch(fileLines, hunk.SearchLines)
+// --- Session History ---
 
-			// Threshold for suggestion (e.g. 50% match)
-			if bestIdx != -1 && score > 0.5 {
-				start := bestIdx - 5
-				if start < 0 {
-					start = 0
-				}
-				end := bestIdx + len(hunk.SearchLines) + 5
-				if end > len(fileLines) {
-					end = len(fileLines)
-				}
+// Each session saves its history to its own file under
+// ~/.simple_agent/projects/<hash>/sessions/, keyed by the working directory,
+// so concurrent sessions in one project never overwrite each other.
+// --continue picks up the latest session, and can merge sessions that ran
+// side by side.
 
-				snippet := strings.Join(fileLines[start:end], "\n")
-				return "", fmt.Errorf("hunk %d failed to apply: context not found.\nProbable match found at lines %d-%d (score %.2f):\n```\n%s\n```\nPlease verify the context lines and try again.", i+1, start+1, end, score, snippet)
-			}
+const (
+	maxSavedSessions  = 20
+	historyLockWait   = 5 * time.Second
+	historyLockStale  = 30 * time.Second
+	legacyHistoryPath = ".simple_agent_history.json" // Used before per-project storage
+)
 
-			return "", fmt.Errorf("hunk %d failed to apply: context not found.\nSearch Block:\n%s", i+1, searchBlock)
-		}
+// savedSession is a session history on disk.
+type savedSession struct {
+	ID       string
+	Path     string
+	Started  time.Time
+	Updated  time.Time
+	Live     bool // Still held by a running process
+	Messages []Message
+}
 
-		// Perform replacement (replace 1 occurrence)
-		newContent = strings.Replace(newContent, searchBlock, replaceBlock, 1)
-	}
+var (
+	sessionClaimed bool
+	sessionMu      sync.Mutex
+)
 
-	if dryRun {
-		return newContent, nil
+// getProjectStateDir returns the per-project state directory in the agent
+// home, named by a hash of the working directory.
+func getProjectStateDir() string {
+	home := getAgentHomeDir()
+	cwd, err := os.Getwd()
+	if home == "" || err != nil {
+		return ""
 	}
+	sum := sha256.Sum256([]byte(cwd))
+	return filepath.Join(home, "projects", hex.EncodeToString(sum[:8]))
+}
 
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
-		return "", fmt.Errorf("failed to create directory: %w", err)
+// getHistoryPath returns this session's history file.
+func getHistoryPath() string {
+	dir := getProjectStateDir()
+	if dir == "" {
+		return legacyHistoryPath
 	}
+	return filepath.Join(dir, "sessions", sessionID+".json")
+}
 
-	// Write back to file
-	err = os.WriteFile(absPath, []byte(newContent), 0644)
-	if err != nil {
-		return "", fmt.Errorf("failed to write file: %w", err)
+// acquireLock takes an advisory lock by creating path exclusively, like
+// git's index.lock. Locks older than stale are assumed to be left behind by a
+// crashed process and are broken.
+func acquireLock(path string, wait, stale time.Duration) (func(), error) {
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > stale {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is held by another process", path)
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
-
-	return "Success", nil
 }
 
-func findBestMatch(fileLines []string, searchLines []string) (int, float64) {
-	if len(searchLines) == 0 || len(fileLines) < len(searchLines) {
-		return -1, 0.0
+// lockHistory locks the project's sessions directory for a read or write.
+func lockHistory() (func(), error) {
+	dir := filepath.Dir(getHistoryPath())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
 	}
+	return acquireLock(filepath.Join(dir, "history.lock"), historyLockWait, historyLockStale)
+}
 
-	bestScore := 0.0
-	bestIdx := -1
+// claimSession marks this session as live and records which directory the
+// project state belongs to. Old sessions beyond maxSavedSessions are removed.
+// Called with the history lock held.
+func claimSession() {
+	if sessionClaimed {
+		return
+	}
+	sessionClaimed = true
+	dir := filepath.Dir(getHistoryPath())
+	os.WriteFile(filepath.Join(dir, sessionID+".pid"), []byte(strconv.Itoa(os.Getpid())), 0600)
+	if cwd, err := os.Getwd(); err == nil {
+		data, _ := json.Marshal(map[string]string{"path": cwd})
+		os.WriteFile(filepath.Join(filepath.Dir(dir), "project.json"), data, 0600)
+	}
 
-	for i := 0; i <= len(fileLines)-len(searchLines); i++ {
-		matches := 0
-		for j := 0; j < len(searchLines); j++ {
-			// Compare trimmed lines to be lenient on whitespace
-			if strings.TrimSpace(fileLines[i+j]) == strings.TrimSpace(searchLines[j]) {
-				matches++
-			}
-		}
-		score := float64(matches) / float64(len(searchLines))
-		if score > bestScore {
-			bestScore = score
-			bestIdx = i
+	sessions := listSessions(false)
+	for _, s := range sessions[min(len(sessions), maxSavedSessions):] {
+		if !s.Live {
+			os.Remove(s.Path)
 		}
 	}
-	return bestIdx, bestScore
 }
 
-type Hunk struct {
-	SearchLines  []string
-	ReplaceLines []string
+// releaseSession marks this session as finished.
+func releaseSession() {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if sessionClaimed {
+		os.Remove(filepath.Join(filepath.Dir(getHistoryPath()), sessionID+".pid"))
+	}
 }
 
-func parseHunks(diff string) []Hunk {
-	lines := strings.Split(diff, "\n")
-	var hunks []Hunk
-	var currentHunk *Hunk
-
-	for _, line := range lines {
-		line = strings.TrimRight(line, "\r") // Handle Windows line endings in diff string
+// sessionAlive reports whether the process that owns a session is running.
+func sessionAlive(dir, id string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, id+".pid"))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+	proc, err := os.FindProcess(pid)
+	return err == nil && proc.Signal(syscall.Signal(0)) == nil
+}
 
-		// Check for hunk header
-		if strings.HasPrefix(line, "@@") {
-			if currentHunk != nil {
-				hunks = append(hunks, *currentHunk)
-			}
-			currentHunk = &Hunk{
-				SearchLines:  []string{},
-				ReplaceLines: []string{},
-			}
+// listSessions returns the project's other sessions, most recently saved
+// first. Messages are only read when withMessages is set.
+func listSessions(withMessages bool) []savedSession {
+	dir := filepath.Dir(getHistoryPath())
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var sessions []savedSession
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		info, err := os.Stat(path)
+		if err != nil || id == sessionID {
 			continue
 		}
-
-		// If we haven't found a hunk header yet, skip (e.g. ---/+++ headers)
-		if currentHunk == nil {
-			continue
+		s := savedSession{ID: id, Path: path, Updated: info.ModTime(), Started: info.ModTime()}
+		if nanos, err := strconv.ParseInt(id, 36, 64); err == nil {
+			s.Started = time.Unix(0, nanos)
 		}
-
-		if strings.HasPrefix(line, " ") {
-			// Context line: present in both
-			content := line[1:]
-			currentHunk.SearchLines = append(currentHunk.SearchLines, content)
-			currentHunk.ReplaceLines = append(currentHunk.ReplaceLines, content)
-		} else if strings.HasPrefix(line, "-") {
-			// Removal: present in search only
-			content := line[1:]
-			currentHunk.SearchLines = append(currentHunk.SearchLines, content)
-		} else if strings.HasPrefix(line, "+") {
-			// Addition: present in replace only
-			content := line[1:]
-			currentHunk.ReplaceLines = append(currentHunk.ReplaceLines, content)
+		s.Live = sessionAlive(dir, id)
+		if withMessages {
+			messages, err := readHistoryFile(path)
+			if err != nil {
+				fmt.Printf("Warning: Skipping session %s: %v\n", id, err)
+				continue
+			}
+			s.Messages = messages
 		}
-		// Ignore other lines
-	}
-
-	// Append last hunk
-	if currentHunk != nil {
-		hunks = append(hunks, *currentHunk)
+		sessions = append(sessions, s)
 	}
-
-	return hunks
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Updated.After(sessions[j].Updated) })
+	return sessions
 }
 
-func printThought(extraContent json.RawMessage) {
-	if len(extraContent) == 0 {
+// importLegacyHistory moves a history file from before per-project storage
+// into the sessions directory.
+func importLegacyHistory() {
+	info, err := os.Stat(legacyHistoryPath)
+	if err != nil || getProjectStateDir() == "" {
 		return
 	}
-	var content struct {
-		Google struct {
-			Thought string `json:"thought"`
-		} `json:"google"`
+	dest := filepath.Join(filepath.Dir(getHistoryPath()), strconv.FormatInt(info.ModTime().UnixNano(), 36)+".json")
+	data, err := os.ReadFile(legacyHistoryPath)
+	if err == nil {
+		data, err = sealData(data)
 	}
-	if err := json.Unmarshal(extraContent, &content); err == nil && content.Google.Thought != "" {
-		fmt.Printf("\n\033[90m─── [Thought] ───\033[0m\n")
-		printMarkdown(content.Google.Thought)
-		fmt.Printf("\033[90m───────────────────\033[0m\n")
+	if err == nil {
+		err = writeFileAtomic(dest, data, 0600)
 	}
-}
-
-func extractAndPrintThoughts(content string) string {
-	re := regexp.MustCompile(`(?s)<thought>(.*?)</thought>`)
-	matches := re.FindAllStringSubmatch(content, -1)
-	for _, match := range matches {
-		if len(match) > 1 {
-			fmt.Printf("\n\033[90m─── [Thought] ───\033[0m\n")
-			printMarkdown(strings.TrimSpace(match[1]))
-			fmt.Printf("\033[90m───────────────────\033[0m\n")
-		}
+	if err != nil {
+		fmt.Printf("Warning: Failed to import %s: %v\n", legacyHistoryPath, err)
+		return
 	}
-	return re.ReplaceAllString(content, "")
+	os.Chtimes(dest, info.ModTime(), info.ModTime())
+	os.Remove(legacyHistoryPath)
+	fmt.Printf("Moved %s to %s\n", legacyHistoryPath, dest)
 }
 
-func printMarkdown(content string) {
-	lines := strings.Split(content, "\n")
-	inCodeBlock := false
-
-	// ANSI codes
-	reset := "\033[0m"
-	bold := "\033[1m"
-	cyan := "\033[36m"
-	blue := "\033[34m"
+// loadHistory returns the history to continue from: the latest session, or
+// a merge with the sessions that ran alongside it if the user chooses. live
+// reports that the history belongs to a session that is still running, so
+// its last turn may not be over yet.
+func loadHistory() (messages []Message, live bool) {
+	unlock, err := lockHistory()
+	if err != nil {
+		fmt.Printf("Warning: Failed to load history: %v\n", err)
+		return []Message{}, false
+	}
+	importLegacyHistory()
+	sessions := listSessions(true)
+	unlock()
+	if len(sessions) == 0 {
+		return []Message{}, false
+	}
 
-	for _, line := range lines {
-		if strings.HasPrefix(strings.TrimSpace(line), "```") {
-			inCodeBlock = !inCodeBlock
-			fmt.Println(cyan + line + reset)
-			continue
+	latest := sessions[0]
+	// Sessions whose lifetimes overlap the latest one ran concurrently
+	concurrent := []savedSession{latest}
+	for _, s := range sessions[1:] {
+		if s.Updated.After(latest.Started) {
+			concurrent = append(concurrent, s)
 		}
+	}
+	if len(concurrent) == 1 {
+		return latest.Messages, latest.Live
+	}
 
-		if inCodeBlock {
-			fmt.Println(cyan + line + reset)
-			continue
+	fmt.Printf("%d sessions ran concurrently in this directory:\n", len(concurrent))
+	for i, s := range concurrent {
+		status := ""
+		if s.Live {
+			status = " (running)"
 		}
+		fmt.Printf("  [%d] saved %s, %d messages%s: %s\n", i+1, s.Updated.Format("2006-01-02 15:04"), len(s.Messages), status, truncateLine(lastUserMessage(s.Messages), 60))
+	}
+	answer := strings.ToLower(promptUser(fmt.Sprintf("Continue [1-%d] or [m]erge them? [1]: ", len(concurrent))))
+	if answer == "m" || answer == "merge" {
+		merged := mergeSessions(concurrent)
+		fmt.Printf("Merged %d sessions.\n", len(concurrent))
+		return merged, false
+	}
+	chosen := latest
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(concurrent) {
+		chosen = concurrent[n-1]
+	}
+	return chosen.Messages, chosen.Live
+}
 
-		// Headers
-		if strings.HasPrefix(line, "#") {
-			fmt.Println(bold + blue + line + reset)
+// mergeSessions appends what each later session added after the history it
+// shares with the first one, marking where each begins.
+func mergeSessions(sessions []savedSession) []Message {
+	merged := append([]Message(nil), sessions[0].Messages...)
+	for _, s := range sessions[1:] {
+		shared := commonHistoryPrefix(merged, s.Messages)
+		if shared == len(s.Messages) {
 			continue
 		}
-
-		// Inline formatting (simple)
-		// Bold **text**
-		line = regexp.MustCompile(`\*\*(.*?)\*\*`).ReplaceAllString(line, bold+"$1"+reset)
-		// Code `text`
-		line = regexp.MustCompile("`([^`]+)`").ReplaceAllString(line, cyan+"$1"+reset)
-
-		fmt.Println(line)
+		merged = append(merged, Message{
+			Role:    "user",
+			Content: fmt.Sprintf("[System] The messages below are from another session that ran at the same time in this directory (last saved %s). Both sessions' changes may be present in the workspace.", s.Updated.Format("2006-01-02 15:04")),
+		})
+		merged = append(merged, s.Messages[shared:]...)
 	}
+	merged, _ = repairHistory(merged, notExecutedResult("The session ended before this tool call completed"))
+	return merged
 }
 
-func printColoredDiff(diff string) {
-	lines := strings.Split(diff, "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++") {
-			fmt.Printf("\033[32m%s\033[0m\n", line)
-		} else if strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "---") {
-			fmt.Printf("\033[31m%s\033[0m\n", line)
-		} else {
-			fmt.Println(line)
+func commonHistoryPrefix(a, b []Message) int {
+	n := 0
+	for n < len(a) && n < len(b) {
+		x, _ := json.Marshal(a[n])
+		y, _ := json.Marshal(b[n])
+		if !bytes.Equal(x, y) {
+			break
 		}
+		n++
 	}
+	return n
 }
 
-func summarizeContext(apiKey string, history []Message, task, future, vital string) (string, error) {
-	var historyBuf bytes.Buffer
-	for i, msg := range history {
-		if i == 0 {
-			continue
-		} // Skip system prompt
-		historyBuf.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, msg.Content))
-		if msg.Content == "" && len(msg.ToolCalls) > 0 {
-			historyBuf.WriteString(fmt.Sprintf("%s: [Tool Call: %s]\n", msg.Role, msg.ToolCalls[0].Function.Name))
+func lastUserMessage(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
 		}
 	}
+	return ""
+}
 
-	instructions := fmt.Sprintf(`1. **Current Task**: %s
-2. **Future Plans**: %s
-3. **Vital Information**: %s
+func saveHistory(messages []Message) {
+	data, err := encodeHistory(messages)
+	if err != nil {
+		fmt.Printf("Warning: Failed to save history: %v\n", err)
+		return
+	}
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	unlock, err := lockHistory()
+	if err != nil {
+		fmt.Printf("Warning: Failed to save history: %v\n", err)
+		return
+	}
+	defer unlock()
+	claimSession()
+	// Written atomically since it is saved mid-turn, where a crash is most likely
+	if err := writeFileAtomic(getHistoryPath(), data, 0600); err != nil {
+		fmt.Printf("Warning: Failed to save history: %v\n", err)
+	}
+}
 
-Ensure the summary is concise but retains all information necessary to continue working on the task and future plans.
-Preserve code snippets or specific data mentioned in "Vital Information".`, task, future, vital)
+// --- History Format ---
 
-	prompt := fmt.Sprintf(`Please summarize the provided conversation history, adhering to the following constraints:
+// Session histories are saved as {"version": N, "messages": [...]}. Files
+// in an older format are migrated when they are loaded, so --continue keeps
+// working across upgrades; `simple-agent migrate-history` migrates them all
+// up front. Format 1 was a bare array of messages.
 
-%s
+const historyVersion = 2
 
-Conversation History:
-%s
+// historyFile is a session history on disk.
+type historyFile struct {
+	Version      int       `json:"version"`
+	AgentVersion string    `json:"agent_version,omitempty"` // Version that saved it
+	Messages     []Message `json:"messages"`
+}
 
----
-friendly reminder: Please summarize the conversation history above based on the following constraints:
-%s
-`, instructions, historyBuf.String(), instructions)
+// historyMigrations[i] rewrites a format i+1 history as format i+2. A schema
+// change adds a migration here and bumps historyVersion.
+var historyMigrations = []func(data []byte) ([]byte, error){
+	// 1 -> 2: wrap the array of messages in a versioned object
+	func(data []byte) ([]byte, error) {
+		var messages []json.RawMessage
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]any{"version": 2, "messages": messages})
+	},
+}
 
-	reqBody := ChatCompletionRequest{
-		Model: ModelName,
-		Messages: []Message{
-			{Role: "user", Content: prompt},
-		},
+// historyFormat returns the format version of a (decrypted) history file.
+func historyFormat(data []byte) (int, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return 1, nil
+	}
+	var header struct {
+		Version      int    `json:"version"`
+		AgentVersion string `json:"agent_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, err
+	}
+	if header.Version < 2 {
+		return 0, fmt.Errorf("unknown history format")
+	}
+	if header.Version > historyVersion {
+		return 0, fmt.Errorf("history format %d was saved by a newer simple-agent (%s); upgrade to read it", header.Version, header.AgentVersion)
+	}
+	return header.Version, nil
+}
+
+// decodeHistory migrates a (decrypted) history file to the current format
+// and returns its messages and the format it was in.
+func decodeHistory(data []byte) ([]Message, int, error) {
+	from, err := historyFormat(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	for v := from; v < historyVersion; v++ {
+		if data, err = historyMigrations[v-1](data); err != nil {
+			return nil, from, fmt.Errorf("failed to migrate history from format %d: %v", v, err)
+		}
+	}
+	var h historyFile
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, from, err
 	}
+	if h.Messages == nil {
+		h.Messages = []Message{}
+	}
+	return h.Messages, from, nil
+}
 
-	jsonData, err := json.Marshal(reqBody)
+// encodeHistory returns messages as a sealed history file.
+func encodeHistory(messages []Message) ([]byte, error) {
+	data, err := json.MarshalIndent(historyFile{Version: historyVersion, AgentVersion: Version, Messages: messages}, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("error marshaling request: %v", err)
+		return nil, err
 	}
+	return sealData(data)
+}
 
-	req, err := http.NewRequest("POST", GeminiURL, bytes.NewBuffer(jsonData))
+// readHistoryFile loads the history at path, rewriting it in the current
+// format if it was older. The file keeps its modification time, which
+// orders sessions.
+func readHistoryFile(path string) ([]Message, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		data, err = openData(data)
+	}
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %v", err)
+		return nil, err
 	}
+	messages, from, err := decodeHistory(data)
+	if err != nil || from == historyVersion {
+		return messages, err
+	}
+	if err := rewriteHistoryFile(path, messages); err != nil {
+		fmt.Printf("Warning: Failed to migrate %s: %v\n", path, err)
+	}
+	return messages, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-
-	client := &http.Client{}
-
-	spinnerStop := make(chan struct{})
-	spinnerDone := make(chan struct{})
-	go startSpinner(spinnerStop, spinnerDone)
-
-	resp, err := client.Do(req)
-
-	close(spinnerStop)
-	<-spinnerDone
-
+func rewriteHistoryFile(path string, messages []Message) error {
+	info, err := os.Stat(path)
 	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	data, err := encodeHistory(messages)
 	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
 	}
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API Error (Status %d): %s", resp.StatusCode, string(body))
+// runMigrateHistoryCommand implements "simple-agent migrate-history", which
+// migrates the saved sessions of every project and returns the exit code.
+func runMigrateHistoryCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate-history", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "List the files that need migrating without changing them")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: simple-agent migrate-history [--dry-run] [file...]")
+		flags.PrintDefaults()
 	}
+	flags.Parse(args)
 
-	var chatResp ChatCompletionResponse
-	if err := json.Unmarshal(body, &chatResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+	cfg := loadConfig()
+	if err := initHistoryEncryption(cfg.EncryptHistory); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths, _ = filepath.Glob(filepath.Join(getAgentHomeDir(), "projects", "*", "sessions", "*.json"))
 	}
 
-	if len(chatResp.Choices) == 0 {
-		return "", fmt.Errorf("no choices returned from API")
+	migrated, failed := 0, 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			data, err = openData(data)
+		}
+		var messages []Message
+		var from int
+		if err == nil {
+			messages, from, err = decodeHistory(data)
+		}
+		switch {
+		case err != nil:
+			fmt.Printf("\033[31m✗ %s: %v\033[0m\n", path, err)
+			failed++
+		case from == historyVersion:
+			continue
+		case *dryRun:
+			fmt.Printf("%s: format %d -> %d\n", path, from, historyVersion)
+			migrated++
+		default:
+			if err := rewriteHistoryFile(path, messages); err != nil {
+				fmt.Printf("\033[31m✗ %s: %v\033[0m\n", path, err)
+				failed++
+				continue
+			}
+			fmt.Printf("\033[32m✓ %s: format %d -> %d\033[0m\n", path, from, historyVersion)
+			migrated++
+		}
 	}
+	verb := "Migrated"
+	if *dryRun {
+		verb = "Would migrate"
+	}
+	fmt.Printf("%s %d of %d session files (format %d).\n", verb, migrated, len(paths), historyVersion)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
 
-	return chatResp.Choices[0].Message.Content, nil
+// --- Session Replay ---
+
+// `simple-agent replay <history.json>` steps through a saved session turn by
+// turn, for debugging agent behavior or attaching to a bug report. With
+// --rerun, read-only tool calls are executed again in the current directory
+// and their output compared with the recorded one, which shows whether the
+// model saw what the workspace holds now.
+
+// replayableTools are the tools --rerun may execute: they only read.
+var replayableTools = map[string]bool{
+	"read_file":    true,
+	"code_outline": true,
+	"git_status":   true,
+	"git_diff":     true,
+	"git_log":      true,
 }
 
-// --- Git Integration ---
+// maxReplayResultLines bounds each recorded result unless --full is given.
+const maxReplayResultLines = 20
 
-func isGitDirty() bool {
-	cmd := exec.Command("git", "status", "--porcelain")
-	out, err := cmd.Output()
+// loadReplayHistory reads a history file, or a session of this project by
+// ID. Older formats are migrated in memory; the file is left as it is.
+func loadReplayHistory(arg string) ([]Message, error) {
+	path := arg
+	if _, err := os.Stat(path); os.IsNotExist(err) && !strings.ContainsAny(arg, `/\`) {
+		if dir := getProjectStateDir(); dir != "" {
+			path = filepath.Join(dir, "sessions", strings.TrimSuffix(arg, ".json")+".json")
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		data, err = openData(data)
+	}
 	if err != nil {
-		// If git fails (e.g. not a repo), assume not dirty
-		return false
+		return nil, err
 	}
-	return len(bytes.TrimSpace(out)) > 0
+	messages, _, err := decodeHistory(data)
+	return messages, err
 }
 
-func generateCommitMessage(apiKey string, history []Message) (string, error) {
-	// Convert history to a transcript string to avoid tool call complexity with Flash
-	var historyBuf bytes.Buffer
-	for _, msg := range history {
-		historyBuf.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, msg.Content))
-		if len(msg.ToolCalls) > 0 {
-			for _, tc := range msg.ToolCalls {
-				historyBuf.WriteString(fmt.Sprintf("Tool Call: %s (%s)\n", tc.Function.Name, tc.Function.Arguments))
-			}
-		}
+// printReplayResult prints a recorded tool result, shortened to
+// maxReplayResultLines unless full.
+func printReplayResult(result string, full bool) {
+	lines := strings.Split(strings.TrimRight(result, "\n"), "\n")
+	if !full && len(lines) > maxReplayResultLines {
+		omitted := len(lines) - maxReplayResultLines
+		lines = append(lines[:maxReplayResultLines], fmt.Sprintf("\033[90m... %d more lines (--full shows them)\033[0m", omitted))
 	}
+	fmt.Printf("\033[90m─── [Result] ───\033[0m\n%s\n", strings.Join(lines, "\n"))
+}
 
-	if historyBuf.Len() == 0 {
-		return "", fmt.Errorf("no conversation history available to generate commit message")
+// rerunReplayTool executes a read-only tool call again and reports how its
+// output differs from the recorded one.
+func rerunReplayTool(env *ToolEnv, call ToolCall, recorded string) {
+	ctx := context.Background()
+	result, err := dispatchTool(ctx, env, call)
+	root, _ := getWorkDir(ctx)
+	result = normalizeOutputPaths(root, result)
+	if err != nil {
+		result = formatToolError(err)
 	}
-
-	systemPrompt := "You are an expert developer. Generate a tight git commit message (less than 15 words) describing the changes made in the provided conversation history. Output ONLY the commit message. Do not use markdown or quotes."
-
-	reqBody := ChatCompletionRequest{
-		Model: FlashModelName,
-		Messages: []Message{
-			{Role: "system", Content: systemPrompt},
-			{Role: "user", Content: historyBuf.String()},
-		},
+	result, _ = redact(result)
+	if strings.TrimSpace(result) == strings.TrimSpace(recorded) {
+		fmt.Println("\033[32m↻ Re-run: same output as recorded\033[0m")
+		return
+	}
+	a := strings.Split(strings.TrimRight(recorded, "\n"), "\n")
+	b := strings.Split(strings.TrimRight(result, "\n"), "\n")
+	if len(a)+len(b) > maxAnswerDiffUnits {
+		fmt.Printf("\033[33m↻ Re-run: output differs (%d lines recorded, %d now)\033[0m\n", len(a), len(b))
+		return
+	}
+	fmt.Println("\033[33m↻ Re-run: output differs (- recorded, + now)\033[0m")
+	shown := 0
+	for _, op := range diffUnits(a, b) {
+		if op[0] == ' ' {
+			continue
+		}
+		if shown == maxReplayResultLines {
+			fmt.Println("\033[90m...\033[0m")
+			break
+		}
+		if op[0] == '-' {
+			fmt.Printf("\033[31m%s\033[0m\n", op)
+		} else {
+			fmt.Printf("\033[32m%s\033[0m\n", op)
+		}
+		shown++
 	}
+}
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("error marshaling request: %v", err)
+// runReplayCommand implements "simple-agent replay" and returns the exit code.
+func runReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	rerun := flags.Bool("rerun", false, "Execute read-only tool calls again and compare their output")
+	all := flags.Bool("all", false, "Print every turn without pausing")
+	full := flags.Bool("full", false, "Print tool results in full")
+	from := flags.Int("turn", 1, "Start at this turn")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: simple-agent replay [--rerun] [--all] [--full] [--turn N] <history.json|session-id>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
 	}
 
-	req, err := http.NewRequest("POST", GeminiURL, bytes.NewBuffer(jsonData))
+	cfg := loadConfig()
+	if err := initHistoryEncryption(cfg.EncryptHistory); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	messages, err := loadReplayHistory(flags.Arg(0))
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	turns := liveTurns(messages)
+	if len(turns) == 0 {
+		fmt.Println("The session has no turns.")
+		return 0
+	}
+	if len(messages) > 0 && messages[0].Role == "system" {
+		fmt.Printf("\033[90mSystem prompt: %d characters\033[0m\n", len(messages[0].Content))
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	env := &ToolEnv{Patches: newPatchStore()}
+	results := map[string]string{}
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			results[msg.ToolCallID] = msg.Content
+		}
+	}
+	for n := max(*from, 1); n <= len(turns); n++ {
+		fmt.Printf("\n\033[90m═══ Turn %d of %d ═══\033[0m\n", n, len(turns))
+		for _, msg := range messages[turns[n-1][0]:turns[n-1][1]] {
+			switch msg.Role {
+			case "user":
+				fmt.Printf("\n\033[1;32mUser 👤\033[0m\n%s\n", msg.Content)
+			case "assistant":
+				printThought(msg.ExtraContent)
+				if content := extractAndPrintThoughts(msg.Content); strings.TrimSpace(content) != "" {
+					fmt.Printf("\n\033[1;34m🤖 Agent:\033[0m\n")
+					printMarkdown(content)
+				}
+				for _, tc := range msg.ToolCalls {
+					printThought(tc.ExtraContent)
+					fmt.Printf("\n\033[1;35m🛠  Tool Call: %s\033[0m\n", tc.Function.Name)
+					var args struct {
+						Path string `json:"path"`
+						Diff string `json:"diff"`
+					}
+					if tc.Function.Name == "apply_udiff" && json.Unmarshal([]byte(tc.Function.Arguments), &args) == nil {
+						fmt.Printf("Path: %s\n", args.Path)
+						printColoredDiff(args.Diff)
+					} else {
+						fmt.Println(tc.Function.Arguments)
+					}
+					recorded, ok := results[tc.ID]
+					if !ok {
+						fmt.Println("\033[90m(no result recorded)\033[0m")
+						continue
+					}
+					printReplayResult(recorded, *full)
+					if *rerun && replayableTools[tc.Function.Name] {
+						rerunReplayTool(env, tc, recorded)
+					}
+				}
+			}
+		}
+		if *all || n == len(turns) {
+			continue
+		}
+		switch strings.ToLower(promptUser("\n\033[90m[Enter] next turn, [a]ll remaining, [q]uit: \033[0m")) {
+		case "q", "quit":
+			return 0
+		case "a", "all":
+			*all = true
+		}
+	}
+	return 0
+}
 
-	client := &http.Client{}
+// --- Idle Recap ---
 
-	spinnerStop := make(chan struct{})
-	spinnerDone := make(chan struct{})
-	go startSpinner(spinnerStop, spinnerDone)
+// While the REPL waits at the prompt, the session state is flushed every
+// idleSaveInterval, so a laptop that never wakes up loses nothing. Coming
+// back after idleRecapAfter (measured on the wall clock, which unlike Go's
+// monotonic clock includes sleep) prints a one-line recap of where the task
+// stood before the message is sent.
 
-	resp, err := client.Do(req)
+const idleSaveInterval = 5 * time.Minute
 
-	close(spinnerStop)
-	<-spinnerDone
+// idleRecapAfter is how long at the prompt counts as being away; 0 disables
+// the recap.
+var idleRecapAfter = 2 * time.Hour
 
-	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+// flushSessionState saves everything a resumed session needs. A session
+// nobody has typed in yet isn't saved.
+func flushSessionState(messages []Message) {
+	if lastUserMessage(messages) != "" {
+		saveHistory(messages)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+	if currentPlan != nil {
+		currentPlan.save()
 	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API Error (Status %d): %s", resp.StatusCode, string(body))
+// watchIdle flushes the session state periodically until the returned stop
+// function is called, which reports how long the prompt waited.
+func watchIdle(messages []Message) (stop func() time.Duration) {
+	started := time.Now().Round(0) // Wall clock
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(idleSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flushSessionState(messages)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() time.Duration {
+		close(done)
+		<-finished // The caller may change messages next
+		return time.Now().Round(0).Sub(started)
 	}
+}
 
-	var chatResp ChatCompletionResponse
-	if err := json.Unmarshal(body, &chatResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+// sessionRecap is a one-line summary of where the task stood: the last
+// request, how it ended, uncommitted changes and the plan's progress.
+func sessionRecap(messages []Message) string {
+	task := ""
+	for i := len(messages) - 1; i >= 0 && task == ""; i-- {
+		if m := messages[i]; m.Role == "user" && !strings.HasPrefix(m.Content, "[") {
+			task = m.Content
+		}
 	}
-
-	if len(chatResp.Choices) == 0 {
-		return "", fmt.Errorf("no choices returned from API")
+	if task == "" {
+		return "Nothing has been asked in this session yet."
 	}
 
-	return strings.TrimSpace(chatResp.Choices[0].Message.Content), nil
-}
-
-func gitCommit(message string) error {
-	// Commit tracked files only (modified/deleted)
-	// We avoid 'git add .' to prevent accidentally committing untracked files (e.g. debug logs, temp files).
-	// Users should explicitly add new files if they intend to commit them.
-	commitCmd := exec.Command("git", "commit", "-am", message)
-	if out, err := commitCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git commit failed: %v\n%s", err, out)
+	parts := []string{fmt.Sprintf("Last task: %q", truncateLine(task, 60))}
+	if turnUnfinished(messages) {
+		parts = append(parts, "it was interrupted before the agent finished")
+	} else if answer := finalAnswer(messages); answer != "" {
+		parts = append(parts, "agent replied: "+truncateLine(strings.SplitN(answer, "\n", 2)[0], 80))
 	}
-	return nil
-}
-
-func performGitCommit(apiKey string, history []Message, skills []Skill, force bool) error {
-	if !isGitDirty() {
-		return fmt.Errorf("git clean")
+	if n := len(agentChanges.Pending()); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d uncommitted file(s) changed", n))
 	}
-
-	commitMsg, err := generateCommitMessage(apiKey, history)
-	if err != nil {
-		return fmt.Errorf("failed to generate commit message: %v", err)
+	if currentPlan != nil {
+		if next := currentPlan.nextPendingStep(); next != -1 {
+			parts = append(parts, fmt.Sprintf("plan at step %d/%d (%s)", next+1, len(currentPlan.Steps), currentPlan.Steps[next].Title))
+		}
 	}
+	return strings.TrimRight(strings.Join(parts, "; "), ".") + "."
+}
 
-	// Pre-commit hook
-	hookOut := runSkillHooks(context.Background(), skills, "pre_commit", map[string]string{"message": commitMsg})
-	if hookOut != "" {
-		fmt.Printf("\n[Pre-Commit Hook Output]\n%s\n", hookOut)
+// formatAway formats an idle duration as e.g. "9h12m".
+func formatAway(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
 	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
 
-	fmt.Printf("\n[Git] Proposed commit message: %s\n", commitMsg)
+// --- Session Recovery ---
 
-	confirm := "y"
-	if !force {
-		fmt.Print("Commit these changes? [y/N]: ")
-		userIn, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-		confirm = strings.TrimSpace(userIn)
-	}
+// A turn that dies mid-way (crash, power loss, aborted turn) can leave an
+// assistant message whose tool calls have no results. Providers reject such a
+// history, so it is repaired before it is sent again.
 
-	if strings.ToLower(confirm) == "y" {
-		if err := gitCommit(commitMsg); err != nil {
-			return fmt.Errorf("git commit failed: %v", err)
+const resumeTurnPrompt = "[System] The previous session ended in the middle of a turn. Review the conversation above, check the current state of anything the interrupted tool calls may have touched, and continue the task where it left off."
+
+// findIncompleteToolCalls returns the tool calls that have no result.
+func findIncompleteToolCalls(messages []Message) []ToolCall {
+	var missing []ToolCall
+	for i, m := range messages {
+		if m.Role != "assistant" || len(m.ToolCalls) == 0 {
+			continue
+		}
+		answered := make(map[string]bool)
+		for j := i + 1; j < len(messages) && messages[j].Role == "tool"; j++ {
+			answered[messages[j].ToolCallID] = true
+		}
+		for _, call := range m.ToolCalls {
+			if !answered[call.ID] {
+				missing = append(missing, call)
+			}
 		}
-		fmt.Println("Changes committed successfully.")
-	} else {
-		fmt.Println("Commit aborted.")
 	}
-	return nil
+	return missing
 }
 
-func handleSlashCommand(input string, messages *[]Message, skills []Skill, systemPrompt string, apiKey string) bool {
-	cmd := strings.TrimSpace(input)
-	if !strings.HasPrefix(cmd, "/") {
-		return false
-	}
-
-	switch cmd {
-	case "/commit":
-		var history []Message
-		for _, m := range *messages {
-			if m.Role != "system" {
-				history = append(history, m)
-			}
+// repairHistory gives every tool call without a result the result returned
+// by resultFor, and drops tool results that don't follow their call. It
+// returns the repaired history and the number of changes.
+func repairHistory(messages []Message, resultFor func(ToolCall) string) ([]Message, int) {
+	repaired := make([]Message, 0, len(messages))
+	changes := 0
+	for i := 0; i < len(messages); i++ {
+		m := messages[i]
+		if m.Role == "tool" {
+			// Results are consumed together with their call below
+			changes++
+			continue
 		}
-		if err := performGitCommit(apiKey, history, skills, false); err != nil {
-			if err.Error() == "git clean" {
-				fmt.Println("Nothing to commit (working directory clean).")
+		repaired = append(repaired, m)
+		if m.Role != "assistant" || len(m.ToolCalls) == 0 {
+			continue
+		}
+		pending := make(map[string]bool)
+		for _, call := range m.ToolCalls {
+			pending[call.ID] = true
+		}
+		for ; i+1 < len(messages) && messages[i+1].Role == "tool"; i++ {
+			if result := messages[i+1]; pending[result.ToolCallID] {
+				repaired = append(repaired, result)
+				delete(pending, result.ToolCallID)
 			} else {
-				fmt.Printf("Error: %v\n", err)
+				changes++
 			}
 		}
-		return true
-	case "/clear":
-		*messages = []Message{
-			{
-				Role:    "system",
-				Content: systemPrompt,
-			},
-		}
-		saveHistory(*messages)
-		fmt.Println("Conversation history cleared.")
-		return true
-	case "/skills":
-		fmt.Println("Available Skills:")
-		for _, s := range skills {
-			fmt.Printf("- %s (v%s): %s\n", s.Name, s.Version, s.Description)
+		for _, call := range m.ToolCalls {
+			if pending[call.ID] {
+				repaired = append(repaired, Message{Role: "tool", Content: resultFor(call), ToolCallID: call.ID})
+				changes++
+			}
 		}
-		return true
-	case "/history":
-		fmt.Printf("History contains %d messages.\n", len(*messages))
-		return true
-	case "/help":
-		fmt.Println("Available Commands:")
-		fmt.Println("  /clear   - Clear conversation history")
-		fmt.Println("  /commit  - Generate and propose a git commit")
-		fmt.Println("  /skills  - List available skills")
-		fmt.Println("  /history - Show history stats")
-		fmt.Println("  /help    - Show this help message")
-		fmt.Println("  /exit    - Exit the agent")
-		return true
-	case "/exit", "/quit":
-		fmt.Println("Exiting...")
-		os.Exit(0)
-		return true
 	}
-
-	fmt.Printf("Unknown command: %s\n", cmd)
-	return true
+	return repaired, changes
 }
 
-func getHistoryPath() string {
-	return ".simple_agent_history.json"
+func notExecutedResult(reason string) func(ToolCall) string {
+	return func(ToolCall) string {
+		return fmt.Sprintf("Error: Not executed. %s, so whether it had any effect is unknown. Check the current state before retrying it.", reason)
+	}
 }
 
-func loadHistory() []Message {
-	path := getHistoryPath()
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return []Message{}
-	}
-	var messages []Message
-	if err := json.Unmarshal(data, &messages); err != nil {
-		return []Message{}
+// turnUnfinished reports whether the model never gave its final reply to the
+// last user message.
+func turnUnfinished(messages []Message) bool {
+	for i := len(messages) - 1; i >= 0; i-- {
+		switch messages[i].Role {
+		case "system":
+			continue
+		case "assistant":
+			return len(messages[i].ToolCalls) > 0
+		default:
+			return true
+		}
 	}
-	return messages
+	return false
 }
 
-func saveHistory(messages []Message) {
-	path := getHistoryPath()
-	data, err := json.MarshalIndent(messages, "", "  ")
-	if err != nil {
-		fmt.Printf("Warning: Failed to save history: %v\n", err)
-		return
+// recoverInterruptedTurn repairs a history loaded with --continue. Tool calls
+// that never completed are re-run or marked as not executed, as the user
+// chooses. It reports whether the interrupted turn should be resumed.
+func recoverInterruptedTurn(env *ToolEnv, messages []Message) ([]Message, bool) {
+	if !turnUnfinished(messages) {
+		messages, _ = repairHistory(messages, notExecutedResult("The session ended before this tool call completed"))
+		return messages, false
 	}
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		fmt.Printf("Warning: Failed to save history: %v\n", err)
+
+	fmt.Printf("\033[33m⚠️  The previous session ended in the middle of a turn.\033[0m\n")
+	results := make(map[string]string)
+	if missing := findIncompleteToolCalls(messages); len(missing) > 0 {
+		fmt.Printf("These tool calls never completed:\n")
+		for _, call := range missing {
+			fmt.Printf("  - %s %s\n", call.Function.Name, truncateLine(call.Function.Arguments, 100))
+		}
+		if answer := strings.ToLower(promptUser("Re-run them now? [y/N]: ")); answer == "y" || answer == "yes" {
+			for _, call := range missing {
+				result, err := executeTool(context.Background(), env, call)
+				if err != nil {
+					result = formatToolError(err)
+				}
+				results[call.ID] = "[Re-run after the session was interrupted]\n" + result
+			}
+		}
+	}
+	messages, changes := repairHistory(messages, func(call ToolCall) string {
+		if result, ok := results[call.ID]; ok {
+			return result
+		}
+		return notExecutedResult("The session ended before this tool call completed")(call)
+	})
+	if changes > 0 {
+		fmt.Printf("Repaired %d tool result(s) in the history.\n", changes)
+		saveHistory(messages)
 	}
+
+	answer := strings.ToLower(promptUser("Resume the interrupted turn? [Y/n]: "))
+	return messages, answer != "n" && answer != "no"
 }
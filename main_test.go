@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden transcripts in testdata/transcripts")
+
+// transcriptCase is a golden-transcript test: case.json holds the task and
+// the mock script (see the llm package), workspace/ the starting files, and
+// skills/ optional skills whose hooks take part. golden.json is the
+// conversation the model saw plus the workspace files afterwards.
+type transcriptCase struct {
+	Task  string   `json:"task"`
+	Tools []string `json:"tools"`
+}
+
+type goldenTranscript struct {
+	Messages []Message         `json:"messages"`
+	Files    map[string]string `json:"files"`
+}
+
+func TestGoldenTranscripts(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "transcripts", "*"))
+	if err != nil || len(dirs) == 0 {
+		t.Fatalf("no transcript cases found: %v", err)
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) { runTranscriptCase(t, dir) })
+	}
+}
+
+func runTranscriptCase(t *testing.T, dir string) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "case.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tc transcriptCase
+	if err := json.Unmarshal(data, &tc); err != nil {
+		t.Fatalf("invalid case.json: %v", err)
+	}
+
+	workspace := t.TempDir()
+	if err := copyDir(filepath.Join(dir, "workspace"), workspace); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(mockEnv, filepath.Join(dir, "case.json"))
+	chdir(t, workspace)
+
+	transport := http.DefaultTransport
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	mock, err := installMockLLM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The case's skills are installed as core skills, which are trusted
+	coreDir := CoreSkillsDir
+	t.Cleanup(func() { CoreSkillsDir = coreDir })
+	CoreSkillsDir = filepath.Join(dir, "skills")
+	skills := discoverSkills(CoreSkillsDir)
+
+	env := &ToolEnv{
+		APIKey:       "mock",
+		Client:       &http.Client{},
+		Provider:     "gemini",
+		SystemPrompt: "You are a test agent.",
+		Skills:       skills,
+		SkillsPrompt: generateSkillsPrompt(skills),
+		AutoApprove:  true,
+		Patches:      newPatchStore(),
+	}
+	report, err := runAgentLoop(context.Background(), env, "Agent", "", tc.Task, tc.Tools, 0)
+	if err != nil {
+		t.Fatalf("agent loop failed: %v", err)
+	}
+	if n := mock.Remaining(); n > 0 {
+		t.Errorf("%d canned responses were not used", n)
+	}
+
+	// The last request holds the whole conversation except the final answer
+	requests := mock.Requests()
+	var last ChatCompletionRequest
+	if err := json.Unmarshal(requests[len(requests)-1].Body, &last); err != nil {
+		t.Fatal(err)
+	}
+	got := goldenTranscript{
+		Messages: append(last.Messages, Message{Role: "assistant", Content: report}),
+		Files:    map[string]string{},
+	}
+	err = filepath.WalkDir(workspace, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(workspace, path)
+		for _, p := range agentStatePaths {
+			if rel == p {
+				return fs.SkipDir
+			}
+		}
+		if d.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		got.Files[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotJSON = append(gotJSON, '\n')
+
+	goldenPath := filepath.Join(dir, "golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(goldenPath, gotJSON, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("%v (run go test -run TestGoldenTranscripts -update to create it)", err)
+	}
+	if !bytes.Equal(gotJSON, want) {
+		t.Errorf("transcript differs from %s (run with -update if the change is intended):\n%s", goldenPath, lineDiff(string(want), string(gotJSON)))
+	}
+}
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// lineDiff shows the lines that differ between want and got.
+func lineDiff(want, got string) string {
+	var out bytes.Buffer
+	for _, op := range diffUnits(strings.Split(want, "\n"), strings.Split(got, "\n")) {
+		if op[0] != ' ' {
+			out.WriteString(op + "\n")
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,114 @@
+// Package middleware transforms the agent's model requests before they are
+// sent and its replies before it acts on them. The agent registers the
+// built-ins its config asks for (StripPhrases, AppendNotice); a build of the
+// agent can register its own from init, e.g.
+//
+//	func init() {
+//		middleware.Use(middleware.EnforceFormat("End every reply with a one-line summary."))
+//	}
+//
+// Request middleware runs in registration order, response middleware in
+// reverse order so the first registered middleware has the final say. A
+// returned error fails the request.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/robert-at-pretension-io/simple-agent/chat"
+)
+
+// Middleware is a named pair of request and response hooks; either may be nil.
+type Middleware struct {
+	Name     string
+	Request  func(ctx context.Context, req *chat.ChatCompletionRequest) error
+	Response func(ctx context.Context, resp *chat.ChatCompletionResponse) error
+}
+
+var chain []Middleware
+
+// Use appends middleware to the chain. It is not safe to call once requests
+// are in flight.
+func Use(m ...Middleware) {
+	chain = append(chain, m...)
+}
+
+// ApplyRequest runs the request middleware on req.
+func ApplyRequest(ctx context.Context, req *chat.ChatCompletionRequest) error {
+	for _, m := range chain {
+		if m.Request == nil {
+			continue
+		}
+		if err := m.Request(ctx, req); err != nil {
+			return fmt.Errorf("middleware %s: %v", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// ApplyResponse runs the response middleware on resp.
+func ApplyResponse(ctx context.Context, resp *chat.ChatCompletionResponse) error {
+	for i := len(chain) - 1; i >= 0; i-- {
+		m := chain[i]
+		if m.Response == nil {
+			continue
+		}
+		if err := m.Response(ctx, resp); err != nil {
+			return fmt.Errorf("middleware %s: %v", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// StripPhrases removes boilerplate phrases (e.g. "As an AI language model,")
+// from assistant replies.
+func StripPhrases(phrases ...string) Middleware {
+	return Middleware{
+		Name: "strip-phrases",
+		Response: func(ctx context.Context, resp *chat.ChatCompletionResponse) error {
+			for i := range resp.Choices {
+				content := resp.Choices[i].Message.Content
+				for _, phrase := range phrases {
+					if phrase != "" {
+						content = strings.ReplaceAll(content, phrase, "")
+					}
+				}
+				resp.Choices[i].Message.Content = strings.TrimSpace(content)
+			}
+			return nil
+		},
+	}
+}
+
+// AppendNotice appends a fixed notice to final replies, i.e. those that do
+// not request tool calls.
+func AppendNotice(notice string) Middleware {
+	return Middleware{
+		Name: "append-notice",
+		Response: func(ctx context.Context, resp *chat.ChatCompletionResponse) error {
+			for i := range resp.Choices {
+				msg := &resp.Choices[i].Message
+				if len(msg.ToolCalls) == 0 && msg.Content != "" {
+					msg.Content += "\n\n" + notice
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// EnforceFormat adds output format instructions to the system prompt of every
+// request without changing the stored conversation.
+func EnforceFormat(instructions string) Middleware {
+	return Middleware{
+		Name: "enforce-format",
+		Request: func(ctx context.Context, req *chat.ChatCompletionRequest) error {
+			if len(req.Messages) > 0 && req.Messages[0].Role == "system" {
+				req.Messages[0].Content += "\n\n# Output Format\n" + instructions
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/robert-at-pretension-io/simple-agent/chat"
+)
+
+func reply(content string, toolCalls ...chat.ToolCall) *chat.ChatCompletionResponse {
+	return &chat.ChatCompletionResponse{Choices: []chat.Choice{{Message: chat.Message{Role: "assistant", Content: content, ToolCalls: toolCalls}}}}
+}
+
+func TestBuiltins(t *testing.T) {
+	ctx := context.Background()
+
+	resp := reply("As an AI language model, I think so.")
+	if err := StripPhrases("As an AI language model,").Response(ctx, resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Choices[0].Message.Content; got != "I think so." {
+		t.Errorf("StripPhrases = %q", got)
+	}
+
+	notice := AppendNotice("-- generated")
+	final, call := reply("Done."), reply("", chat.ToolCall{ID: "1"})
+	notice.Response(ctx, final)
+	notice.Response(ctx, call)
+	if got := final.Choices[0].Message.Content; got != "Done.\n\n-- generated" {
+		t.Errorf("AppendNotice on a final reply = %q", got)
+	}
+	if got := call.Choices[0].Message.Content; got != "" {
+		t.Errorf("AppendNotice on a tool call = %q", got)
+	}
+
+	req := &chat.ChatCompletionRequest{Messages: []chat.Message{{Role: "system", Content: "Be helpful."}, {Role: "user", Content: "hi"}}}
+	EnforceFormat("Use bullet points.").Request(ctx, req)
+	if got := req.Messages[0].Content; !strings.HasSuffix(got, "# Output Format\nUse bullet points.") {
+		t.Errorf("EnforceFormat system prompt = %q", got)
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	defer func() { chain = nil }()
+	var order []string
+	named := func(name string) Middleware {
+		return Middleware{
+			Name: name,
+			Request: func(ctx context.Context, req *chat.ChatCompletionRequest) error {
+				order = append(order, "request "+name)
+				return nil
+			},
+			Response: func(ctx context.Context, resp *chat.ChatCompletionResponse) error {
+				order = append(order, "response "+name)
+				return nil
+			},
+		}
+	}
+	Use(named("a"), named("b"))
+	ApplyRequest(context.Background(), &chat.ChatCompletionRequest{})
+	ApplyResponse(context.Background(), reply(""))
+	if got, want := strings.Join(order, ", "), "request a, request b, response b, response a"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+
+	Use(Middleware{Name: "veto", Request: func(ctx context.Context, req *chat.ChatCompletionRequest) error {
+		return errors.New("no")
+	}})
+	if err := ApplyRequest(context.Background(), &chat.ChatCompletionRequest{}); err == nil || err.Error() != "middleware veto: no" {
+		t.Errorf("ApplyRequest error = %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build noselfupdate
+
+// Package-manager builds (go build -tags noselfupdate) leave upgrades to the
+// package manager: autoUpdate only reports a newer release, with
+// upgradeInstructions, and never downloads or replaces anything.
+
+package main
+
+import "fmt"
+
+// upgradeInstructions tells the user how to upgrade. Packagers set it with
+// -ldflags "-X 'main.upgradeInstructions=Run: brew upgrade simple-agent'".
+var upgradeInstructions = "Upgrade with the package manager you installed it with, e.g. 'brew upgrade simple-agent' or 'sudo apt install --only-upgrade simple-agent'."
+
+func autoUpdate(allowUnsigned bool) {
+	latest, err := getLatestVersion()
+	if err != nil || !isNewer(Version, latest) {
+		return
+	}
+	fmt.Printf("⬇️  New version available: %s (Current: %s)\n", latest, Version)
+	fmt.Println("   " + upgradeInstructions)
+}
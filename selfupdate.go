@@ -0,0 +1,233 @@
+//go:build !noselfupdate
+
+// Self-update, compiled out of package-manager builds by the noselfupdate
+// build tag (see noselfupdate.go).
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Releases publish checksums.txt (sha256sum output for every binary) and,
+// when the release key is configured, checksums.txt.minisig. The updater
+// verifies the binary against them before replacing itself.
+const releaseDownloadURL = "https://github.com/robert-at-pretension-io/simple-agent/releases/download"
+
+// updatePublicKey is the minisign public key releases are signed with (the
+// base64 line of minisign.pub). Release builds set it with
+// -ldflags "-X main.updatePublicKey=..."; when set, updates must be signed.
+var updatePublicKey string
+
+// errUnverified marks updates refused because they couldn't be verified, as
+// opposed to failed downloads.
+var errUnverified = errors.New("unverified update")
+
+func releaseAssetName() (string, error) {
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "linux/amd64", "linux/arm64", "darwin/amd64", "darwin/arm64":
+		return fmt.Sprintf("simple-agent-%s-%s", runtime.GOOS, runtime.GOARCH), nil
+	}
+	return "", fmt.Errorf("no release binary for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// downloadReleaseAsset fetches one file of a release; a missing file returns
+// os.ErrNotExist.
+func downloadReleaseAsset(version, name string) ([]byte, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(fmt.Sprintf("%s/%s/%s", releaseDownloadURL, version, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", name, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// verifyChecksum checks data against its line in a sha256sum-style file.
+func verifyChecksum(checksums []byte, name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	for _, line := range strings.Split(string(checksums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != name {
+			continue
+		}
+		if !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("%w: checksum mismatch for %s", errUnverified, name)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not listed in checksums.txt", errUnverified, name)
+}
+
+// verifyMinisign checks a minisign signature of message made with the
+// legacy (non-prehashed, "minisign -S -l") algorithm, including the
+// signature of its trusted comment.
+func verifyMinisign(publicKey string, message, signature []byte) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != 42 || string(key[:2]) != "Ed" {
+		return fmt.Errorf("invalid minisign public key")
+	}
+	lines := strings.Split(strings.ReplaceAll(string(signature), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("%w: malformed signature file", errUnverified)
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 74 {
+		return fmt.Errorf("%w: malformed signature", errUnverified)
+	}
+	switch {
+	case string(sig[:2]) == "ED":
+		return fmt.Errorf("%w: prehashed signatures are not supported; sign with minisign -S -l", errUnverified)
+	case string(sig[:2]) != "Ed":
+		return fmt.Errorf("%w: unknown signature algorithm", errUnverified)
+	case !bytes.Equal(sig[2:10], key[2:10]):
+		return fmt.Errorf("%w: signed with a different key", errUnverified)
+	}
+	pub := ed25519.PublicKey(key[10:])
+	if !ed25519.Verify(pub, message, sig[10:]) {
+		return fmt.Errorf("%w: invalid signature", errUnverified)
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if err != nil || !ed25519.Verify(pub, append(append([]byte(nil), sig[10:]...), trusted...), globalSig) {
+		return fmt.Errorf("%w: invalid signature of the trusted comment", errUnverified)
+	}
+	return nil
+}
+
+// downloadVerifiedRelease downloads this platform's binary of version and
+// verifies it. Without checksums (or without a signature, when a key is
+// built in) it is refused unless allowUnsigned.
+func downloadVerifiedRelease(version string, allowUnsigned bool) ([]byte, error) {
+	name, err := releaseAssetName()
+	if err != nil {
+		return nil, err
+	}
+	binary, err := downloadReleaseAsset(version, name)
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := downloadReleaseAsset(version, "checksums.txt")
+	if errors.Is(err, os.ErrNotExist) {
+		if !allowUnsigned {
+			return nil, fmt.Errorf("%w: release %s has no checksums.txt (use --allow-unsigned to install it anyway)", errUnverified, version)
+		}
+		fmt.Println("⚠️  Release has no checksums; installing unverified (--allow-unsigned).")
+		return binary, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(checksums, name, binary); err != nil {
+		return nil, err
+	}
+
+	if updatePublicKey == "" {
+		return binary, nil
+	}
+	signature, err := downloadReleaseAsset(version, "checksums.txt.minisig")
+	if errors.Is(err, os.ErrNotExist) {
+		if !allowUnsigned {
+			return nil, fmt.Errorf("%w: release %s is not signed (use --allow-unsigned to install it anyway)", errUnverified, version)
+		}
+		fmt.Println("⚠️  Release is not signed; installing with checksum verification only (--allow-unsigned).")
+		return binary, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyMinisign(updatePublicKey, checksums, signature); err != nil {
+		return nil, err
+	}
+	return binary, nil
+}
+
+// replaceExecutable writes data next to exe and renames it into place, which
+// works while exe is running.
+func replaceExecutable(exe string, data []byte) error {
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".simple-agent-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+func autoUpdate(allowUnsigned bool) {
+	fmt.Println("Checking for updates...")
+
+	latest, err := getLatestVersion()
+	if err != nil {
+		fmt.Printf("⚠️  Could not check for updates: %v\n", err)
+		return
+	}
+
+	if !isNewer(Version, latest) {
+		fmt.Println("✅ You are using the latest version.")
+		return
+	}
+
+	fmt.Printf("⬇️  New version available: %s (Current: %s)\n", latest, Version)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	binary, err := downloadVerifiedRelease(latest, allowUnsigned)
+	if err == nil {
+		err = replaceExecutable(exe, binary)
+	}
+	if errors.Is(err, errUnverified) {
+		// Never fall back to another channel for an artifact that failed verification
+		fmt.Printf("⛔ Update refused: %v\n", err)
+		return
+	}
+	if err != nil {
+		// No fallback to another channel: it would skip the signature check
+		fmt.Printf("⚠️  Update failed: %v\n", err)
+		return
+	}
+
+	// Verify the version actually changed to prevent restart loops
+	if out, err := exec.Command(exe, "--version").CombinedOutput(); err == nil {
+		if strings.TrimSpace(string(out)) == fmt.Sprintf("Simple Agent %s", Version) {
+			return // Same version, continue running
+		}
+	}
+	fmt.Printf("✅ Update to %s installed and verified. Please restart the agent.\n", latest)
+	os.Exit(0)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "example/pkg"
+
+func main() {
+	println(pkg.OldName(), pkg.OldNameCount)
+}
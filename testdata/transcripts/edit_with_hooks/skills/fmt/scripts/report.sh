@@ -0,0 +1,2 @@
+#!/bin/sh
+echo "checked $1 ($(wc -l < "$1") lines)"
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeWatchChanges(t *testing.T) {
+	got := mergeWatchChanges(
+		[]string{"b.go (created)", "a.go (modified)"},
+		[]string{"b.go (deleted)", "c (1).txt (created)"},
+	)
+	want := []string{"a.go (modified)", "b.go (deleted)", "c (1).txt (created)"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeWatchChanges = %q, want %q", got, want)
+	}
+}
+
+func TestFormatWatchEntry(t *testing.T) {
+	at := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	if got, want := formatWatchEntry(at, "scheduled", "Found 2 TODOs.", nil), "## 2026-10-16 09:30 (scheduled)\n\nFound 2 TODOs.\n\n"; got != want {
+		t.Errorf("report entry = %q, want %q", got, want)
+	}
+	got := formatWatchEntry(at, "files changed", "", errors.New("rate limited"))
+	if !strings.Contains(got, "(files changed)") || !strings.Contains(got, "Run failed: rate limited") {
+		t.Errorf("failed entry = %q", got)
+	}
+}
+
+func TestWatchTrigger(t *testing.T) {
+	root := t.TempDir()
+	start := time.Now()
+	tr := newWatchTrigger(root, filepath.Join(root, "reports", "watch.md"))
+
+	// Appending to the report must not start another run
+	tr.Add([]string{"reports/watch.md (modified)"}, start)
+	if got := tr.Ready(start.Add(time.Hour)); got != nil {
+		t.Fatalf("report change triggered a run: %q", got)
+	}
+
+	tr.Add([]string{"a.go (modified)", "reports/watch.md (modified)"}, start)
+	if got := tr.Ready(start.Add(watchSettle / 2)); got != nil {
+		t.Fatalf("ran before the files settled: %q", got)
+	}
+	tr.Add([]string{"b.go (created)"}, start.Add(watchSettle/2))
+	if got := tr.Ready(start.Add(watchSettle)); got != nil {
+		t.Fatalf("a later change didn't restart the settle time: %q", got)
+	}
+	got := tr.Ready(start.Add(watchSettle/2 + watchSettle))
+	if want := []string{"a.go (modified)", "b.go (created)"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Ready = %q, want %q", got, want)
+	}
+	if got := tr.Ready(start.Add(time.Hour)); got != nil {
+		t.Errorf("changes were reported twice: %q", got)
+	}
+
+	// A report outside the project is never among the watcher's changes
+	if outside := newWatchTrigger(root, filepath.Join(filepath.Dir(root), "watch.md")); outside.report != "" {
+		t.Errorf("report outside the root = %q, want none", outside.report)
+	}
+}